@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// ErrorCode — стабильный машиночитаемый код ошибки API. Клиенты должны
+// опираться на код, а не на текст сообщения: текст зависит от языка и может
+// меняться.
+type ErrorCode string
+
+const (
+	CodeInvalidParameter     ErrorCode = "invalid_parameter"
+	CodeInvalidBody          ErrorCode = "invalid_body"
+	CodeValidationFailed     ErrorCode = "validation_failed"
+	CodeNoUpdateData         ErrorCode = "no_update_data"
+	CodePatchFailed          ErrorCode = "patch_failed"
+	CodePreconditionFailed   ErrorCode = "precondition_failed"
+	CodePreconditionRequired ErrorCode = "precondition_required"
+	CodeVersionConflict      ErrorCode = "version_conflict"
+	CodeRouteNotFound        ErrorCode = "route_not_found"
+	CodeInternal             ErrorCode = "internal_error"
+	CodeUserNotFound         ErrorCode = "user_not_found"
+	CodeProductNotFound      ErrorCode = "product_not_found"
+	CodeOrderNotFound        ErrorCode = "order_not_found"
+	CodeReturnNotFound       ErrorCode = "return_not_found"
+	CodeWarehouseNotFound    ErrorCode = "warehouse_not_found"
+
+	CodePaymentMethodNotFound    ErrorCode = "payment_method_not_found"
+	CodeShippingZoneNotFound     ErrorCode = "shipping_zone_not_found"
+	CodeShippingRateNotFound     ErrorCode = "shipping_rate_not_found"
+	CodeCartEmpty                ErrorCode = "cart_empty"
+	CodeCartProductNotFound      ErrorCode = "cart_product_not_found"
+	CodeCartChanged              ErrorCode = "cart_changed"
+	CodePaymentMethodNotSelected ErrorCode = "payment_method_not_selected"
+	CodeShippingUnavailable      ErrorCode = "shipping_unavailable"
+	CodeShippingAddressRequired  ErrorCode = "shipping_address_required"
+	CodeInvalidOrderStatus       ErrorCode = "invalid_order_status"
+	CodeInvalidOrderTransition   ErrorCode = "invalid_order_transition"
+	CodePaymentOnDelivery        ErrorCode = "payment_on_delivery"
+	CodeOrderNotAwaitingPayment  ErrorCode = "order_not_awaiting_payment"
+	CodeOrderNotDelivered        ErrorCode = "order_not_delivered"
+	CodeOrderNotShippable        ErrorCode = "order_not_shippable"
+	CodeOrderFullyShipped        ErrorCode = "order_fully_shipped"
+	CodeShipmentQuantity         ErrorCode = "shipment_quantity_unavailable"
+	CodePaymentProviderFailed    ErrorCode = "payment_provider_unavailable"
+	CodePaymentCaptureFailed     ErrorCode = "payment_capture_failed"
+	CodePaymentsDisabled         ErrorCode = "payments_disabled"
+	CodePaymentInProgress        ErrorCode = "payment_in_progress"
+	CodeRefundFailed             ErrorCode = "refund_failed"
+	CodeRefundNoPayment          ErrorCode = "refund_no_payment"
+	CodeInvalidSignature         ErrorCode = "invalid_signature"
+	CodeInvalidEvent             ErrorCode = "invalid_event"
+	CodeImageTooLarge            ErrorCode = "image_too_large"
+	CodeReturnQuantity           ErrorCode = "return_quantity_unavailable"
+	CodeInvalidReturnTransition  ErrorCode = "invalid_return_transition"
+	CodeReturnNotAwaitingShip    ErrorCode = "return_not_awaiting_shipment"
+	CodeReturnNotApproved        ErrorCode = "return_not_approved"
+	CodeInvalidRefundAmount      ErrorCode = "invalid_refund_amount"
+	CodeInvalidZoneShape         ErrorCode = "invalid_zone_shape"
+	CodeInvalidZonePolygon       ErrorCode = "invalid_zone_polygon"
+	CodeExchangeRateUnavailable  ErrorCode = "exchange_rate_unavailable"
+	CodeCouponNotFound           ErrorCode = "coupon_not_found"
+	CodePromotionNotFound        ErrorCode = "promotion_not_found"
+	CodeCouponInactive           ErrorCode = "coupon_inactive"
+	CodeCouponExhausted          ErrorCode = "coupon_exhausted"
+	CodeCouponUserLimit          ErrorCode = "coupon_user_limit"
+	CodeCouponMinTotal           ErrorCode = "coupon_min_total"
+	CodeCouponNotApplicable      ErrorCode = "coupon_not_applicable"
+	CodeTaxZoneNotFound          ErrorCode = "tax_zone_not_found"
+	CodeTaxRateNotFound          ErrorCode = "tax_rate_not_found"
+)
+
+// localizedText — текст сообщения на поддерживаемых языках. В тексте могут
+// быть подстановки {ключ}, значения берутся из details ошибки.
+type localizedText struct {
+	ru, en string
+}
+
+func (t localizedText) in(lang string) string {
+	if lang == "en" {
+		return t.en
+	}
+	return t.ru
+}
+
+type errorDefinition struct {
+	status  int
+	message localizedText
+}
+
+var errorDefinitions = map[ErrorCode]errorDefinition{
+	CodeInvalidParameter:     {http.StatusBadRequest, localizedText{"Некорректный параметр пути", "Invalid path parameter"}},
+	CodeInvalidBody:          {http.StatusBadRequest, localizedText{"Некорректное тело запроса", "Malformed request body"}},
+	CodeValidationFailed:     {http.StatusBadRequest, localizedText{"Данные запроса не прошли проверку", "Request validation failed"}},
+	CodeNoUpdateData:         {http.StatusBadRequest, localizedText{"Нет данных для обновления", "Nothing to update"}},
+	CodePatchFailed:          {http.StatusConflict, localizedText{"Патч нельзя применить к текущему состоянию объекта", "The patch cannot be applied to the current state of the resource"}},
+	CodePreconditionFailed:   {http.StatusPreconditionFailed, localizedText{"Объект изменился: If-Match не совпадает с текущим ETag", "The resource has changed: If-Match does not match the current ETag"}},
+	CodePreconditionRequired: {http.StatusPreconditionRequired, localizedText{"Требуется заголовок If-Match с ETag объекта", "The If-Match header with the resource ETag is required"}},
+	CodeVersionConflict:      {http.StatusConflict, localizedText{"Объект одновременно изменен другим запросом, повторите попытку", "The resource was changed by another request at the same time, try again"}},
+	CodeRouteNotFound:        {http.StatusNotFound, localizedText{"Маршрут не найден", "Route not found"}},
+	CodeInternal:             {http.StatusInternalServerError, localizedText{"Внутренняя ошибка сервера", "Internal server error"}},
+	CodeUserNotFound:         {http.StatusNotFound, localizedText{"Пользователь не найден", "User not found"}},
+	CodeProductNotFound:      {http.StatusNotFound, localizedText{"Продукт не найден", "Product not found"}},
+	CodeOrderNotFound:        {http.StatusNotFound, localizedText{"Заказ не найден", "Order not found"}},
+	CodeReturnNotFound:       {http.StatusNotFound, localizedText{"Возврат не найден", "Return not found"}},
+	CodeWarehouseNotFound:    {http.StatusNotFound, localizedText{"Склад не найден", "Warehouse not found"}},
+
+	CodePaymentMethodNotFound:    {http.StatusNotFound, localizedText{"Способ оплаты не найден", "Payment method not found"}},
+	CodeShippingZoneNotFound:     {http.StatusNotFound, localizedText{"Зона доставки не найдена", "Shipping zone not found"}},
+	CodeShippingRateNotFound:     {http.StatusNotFound, localizedText{"Тариф доставки не найден", "Shipping rate not found"}},
+	CodeCartEmpty:                {http.StatusBadRequest, localizedText{"Корзина пуста", "Cart is empty"}},
+	CodeCartProductNotFound:      {http.StatusBadRequest, localizedText{"В корзине есть несуществующий продукт", "Cart contains a product that does not exist"}},
+	CodeCartChanged:              {http.StatusConflict, localizedText{"Корзина изменилась во время оформления заказа", "The cart changed while the order was being placed"}},
+	CodePaymentMethodNotSelected: {http.StatusBadRequest, localizedText{"Способ оплаты не выбран", "No payment method selected"}},
+	CodeShippingUnavailable:      {http.StatusBadRequest, localizedText{"Доставка по адресу пользователя недоступна", "Delivery to the user's address is not available"}},
+	CodeShippingAddressRequired:  {http.StatusBadRequest, localizedText{"Не указан адрес доставки или пользователь", "Either a delivery address or a user is required"}},
+	CodeInvalidOrderStatus:       {http.StatusBadRequest, localizedText{"Неизвестный статус заказа", "Unknown order status"}},
+	CodeInvalidOrderTransition:   {http.StatusConflict, localizedText{"Недопустимый переход статуса заказа: {from} -> {to}", "Invalid order status transition: {from} -> {to}"}},
+	CodePaymentOnDelivery:        {http.StatusBadRequest, localizedText{"Заказ оплачивается при получении", "The order is paid on delivery"}},
+	CodeOrderNotAwaitingPayment:  {http.StatusConflict, localizedText{"Заказ не ожидает оплаты", "The order is not awaiting payment"}},
+	CodeOrderNotDelivered:        {http.StatusConflict, localizedText{"Возврат возможен только для доставленного заказа", "Only delivered orders can be returned"}},
+	CodeOrderNotShippable:        {http.StatusConflict, localizedText{"Заказ нельзя отправить в текущем статусе", "The order cannot be shipped in its current status"}},
+	CodeOrderFullyShipped:        {http.StatusConflict, localizedText{"Все позиции заказа уже отправлены", "All order items have already been shipped"}},
+	CodeShipmentQuantity:         {http.StatusBadRequest, localizedText{"Позиция {order_item_id} недоступна для отправки в таком количестве", "Order item {order_item_id} is not available for shipment in this quantity"}},
+	CodePaymentProviderFailed:    {http.StatusBadGateway, localizedText{"Платежный провайдер недоступен", "Payment provider is unavailable"}},
+	CodePaymentCaptureFailed:     {http.StatusBadGateway, localizedText{"Ошибка списания платежа", "Failed to capture the payment"}},
+	CodePaymentsDisabled:         {http.StatusServiceUnavailable, localizedText{"Онлайн-оплата отключена", "Online payments are disabled"}},
+	CodePaymentInProgress:        {http.StatusConflict, localizedText{"Оплата заказа уже проводится: платеж {payment_id}", "The order payment is already in progress: payment {payment_id}"}},
+	CodeRefundFailed:             {http.StatusBadGateway, localizedText{"Платежный провайдер не смог вернуть средства", "Payment provider failed to refund"}},
+	CodeRefundNoPayment:          {http.StatusConflict, localizedText{"У заказа нет успешной оплаты, по которой можно вернуть средства", "The order has no succeeded payment to refund"}},
+	CodeInvalidSignature:         {http.StatusBadRequest, localizedText{"Неверная подпись", "Invalid signature"}},
+	CodeInvalidEvent:             {http.StatusBadRequest, localizedText{"Некорректное событие", "Malformed event"}},
+	CodeImageTooLarge:            {http.StatusBadRequest, localizedText{"Размер изображения превышает {max_size} байт", "Image exceeds {max_size} bytes"}},
+	CodeReturnQuantity:           {http.StatusBadRequest, localizedText{"Позиция {order_item_id} недоступна для возврата в таком количестве", "Order item {order_item_id} is not available for return in this quantity"}},
+	CodeInvalidReturnTransition:  {http.StatusConflict, localizedText{"Недопустимый переход статуса возврата: {from} -> {to}", "Invalid return status transition: {from} -> {to}"}},
+	CodeReturnNotAwaitingShip:    {http.StatusConflict, localizedText{"Возврат не ожидает отправки", "The return is not awaiting shipment"}},
+	CodeReturnNotApproved:        {http.StatusConflict, localizedText{"Возврат еще не одобрен", "The return has not been approved yet"}},
+	CodeInvalidRefundAmount:      {http.StatusBadRequest, localizedText{"Сумма возврата должна быть больше нуля и не больше {max}", "Refund amount must be greater than zero and at most {max}"}},
+	CodeInvalidZoneShape:         {http.StatusBadRequest, localizedText{"Зона должна иметь радиус или многоугольник минимум из трех точек", "A zone needs a radius or a polygon of at least three points"}},
+	CodeInvalidZonePolygon:       {http.StatusBadRequest, localizedText{"Некорректный многоугольник зоны", "Invalid zone polygon"}},
+	CodeExchangeRateUnavailable:  {http.StatusServiceUnavailable, localizedText{"Нет курса для пересчета в нужную валюту", "No exchange rate to convert to the requested currency"}},
+	CodeCouponNotFound:           {http.StatusNotFound, localizedText{"Купон не найден", "Coupon not found"}},
+	CodePromotionNotFound:        {http.StatusNotFound, localizedText{"Акция не найдена", "Promotion not found"}},
+	CodeCouponInactive:           {http.StatusBadRequest, localizedText{"Купон не действует", "The coupon is not active"}},
+	CodeCouponExhausted:          {http.StatusConflict, localizedText{"Купон больше нельзя использовать", "The coupon has been used up"}},
+	CodeCouponUserLimit:          {http.StatusConflict, localizedText{"Пользователь уже использовал купон максимальное число раз", "The user has already used the coupon the maximum number of times"}},
+	CodeCouponMinTotal:           {http.StatusBadRequest, localizedText{"Сумма товаров меньше минимальной для купона", "The cart total is below the coupon minimum"}},
+	CodeCouponNotApplicable:      {http.StatusBadRequest, localizedText{"Купон не действует на товары корзины", "The coupon does not apply to any product in the cart"}},
+	CodeTaxZoneNotFound:          {http.StatusNotFound, localizedText{"Налоговая зона не найдена", "Tax zone not found"}},
+	CodeTaxRateNotFound:          {http.StatusNotFound, localizedText{"Ставка налога не найдена", "Tax rate not found"}},
+}
+
+// fieldMessages — тексты ошибок полей по коду. Коды совпадают с тегами
+// валидатора (required, min, ...), {param} — параметр правила.
+var fieldMessages = map[string]localizedText{
+	"required":   {"Обязательное поле", "This field is required"},
+	"invalid":    {"Некорректное значение", "Invalid value"},
+	"type":       {"Некорректный тип значения", "Invalid value type"},
+	"min":        {"Значение должно быть не меньше {param}", "Must be at least {param}"},
+	"max":        {"Значение должно быть не больше {param}", "Must be at most {param}"},
+	"gt":         {"Значение должно быть больше {param}", "Must be greater than {param}"},
+	"min_length": {"Длина должна быть не меньше {param}", "Must be at least {param} characters long"},
+	"len":        {"Длина должна быть ровно {param}", "Must be exactly {param} characters long"},
+	"gtefield":   {"Значение должно быть не меньше поля {param}", "Must not be less than {param}"},
+	"oneof":      {"Значение должно быть одним из: {param}", "Must be one of: {param}"},
+	"not_found":  {"Объект не найден", "Referenced object not found"},
+	"unique":     {"Значение уже используется", "Value is already taken"},
+
+	"required_without": {"Обязательное поле, если не указано {param}", "Required when {param} is not set"},
+	"excluded_with":    {"Нельзя указывать вместе с {param}", "Must not be set together with {param}"},
+	"http_url":         {"Должно быть ссылкой http(s)", "Must be an http(s) URL"},
+	"image":            {"Ожидается изображение PNG, JPEG, GIF или WebP в base64", "Must be a base64-encoded PNG, JPEG, GIF or WebP image"},
+}
+
+// FieldError описывает ошибку в конкретном поле запроса.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+// ErrorBody — тело ошибки в обычном формате: {"error": {...}}.
+type ErrorBody struct {
+	Code      ErrorCode      `json:"code"`
+	Message   string         `json:"message"`
+	Details   map[string]any `json:"details,omitempty"`
+	Fields    []FieldError   `json:"fields,omitempty"`
+	RequestId string         `json:"request_id,omitempty"`
+}
+
+// Problem — тело ошибки в формате RFC 7807 (application/problem+json).
+// code, request_id, details и fields — расширения.
+type Problem struct {
+	Type      string         `json:"type"`
+	Title     string         `json:"title"`
+	Status    int            `json:"status"`
+	Detail    string         `json:"detail"`
+	Instance  string         `json:"instance"`
+	Code      ErrorCode      `json:"code"`
+	RequestId string         `json:"request_id,omitempty"`
+	Details   map[string]any `json:"details,omitempty"`
+	Fields    []FieldError   `json:"fields,omitempty"`
+}
+
+const (
+	problemContentType = "application/problem+json"
+	problemTypePrefix  = "urn:shop:error:"
+)
+
+var supportedLanguages = []string{"ru", "en"}
+
+const defaultLanguage = "ru"
+
+func init() {
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(jsonFieldName)
+	}
+}
+
+// jsonFieldName возвращает имя поля из тега json (или form), чтобы в
+// ошибках валидации были те же имена, что и в запросе.
+func jsonFieldName(f reflect.StructField) string {
+	for _, tag := range []string{"json", "form"} {
+		name, _, _ := strings.Cut(f.Tag.Get(tag), ",")
+		if name == "-" {
+			return ""
+		}
+		if name != "" {
+			return name
+		}
+	}
+	return f.Name
+}
+
+// respondError отвечает ошибкой с кодом code. Статус и текст берутся из
+// errorDefinitions.
+func respondError(c *gin.Context, code ErrorCode) {
+	writeError(c, code, nil, nil)
+}
+
+// respondErrorDetails отвечает ошибкой с дополнительными данными details,
+// которые также подставляются в текст сообщения.
+func respondErrorDetails(c *gin.Context, code ErrorCode, details map[string]any) {
+	writeError(c, code, details, nil)
+}
+
+// respondFieldErrors отвечает ошибкой validation_failed со списком полей.
+func respondFieldErrors(c *gin.Context, fields ...FieldError) {
+	writeError(c, CodeValidationFailed, nil, fields)
+}
+
+// respondBindingError превращает ошибку ShouldBindJSON в ответ: ошибки
+// валидатора и типов — в ошибки полей, остальное — в invalid_body. Текст
+// ошибки разбора клиенту не отдается.
+func respondBindingError(c *gin.Context, err error) {
+	var validationErrors validator.ValidationErrors
+	var typeError *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &validationErrors):
+		fields := make([]FieldError, 0, len(validationErrors))
+		for _, fe := range validationErrors {
+			fields = append(fields, FieldError{Field: fieldPath(fe), Code: fe.Tag(), Param: fe.Param()})
+		}
+		respondFieldErrors(c, fields...)
+	case errors.As(err, &typeError):
+		respondFieldErrors(c, FieldError{Field: typeError.Field, Code: "type"})
+	default:
+		if !errors.Is(err, io.EOF) {
+			requestLog(c).Warn("Некорректное тело запроса", "error", err)
+		}
+		respondError(c, CodeInvalidBody)
+	}
+}
+
+// fieldPath возвращает путь к полю без имени корневой структуры.
+func fieldPath(fe validator.FieldError) string {
+	namespace := fe.Namespace()
+	if _, rest, ok := strings.Cut(namespace, "."); ok {
+		return rest
+	}
+	return fe.Field()
+}
+
+func writeError(c *gin.Context, code ErrorCode, details map[string]any, fields []FieldError) {
+	definition, ok := errorDefinitions[code]
+	if !ok {
+		definition = errorDefinitions[CodeInternal]
+	}
+	lang := negotiateLanguage(c.GetHeader("Accept-Language"))
+	message := expandPlaceholders(definition.message.in(lang), details)
+	for i := range fields {
+		text, ok := fieldMessages[fields[i].Code]
+		if !ok {
+			text = fieldMessages["invalid"]
+		}
+		fields[i].Message = expandPlaceholders(text.in(lang), map[string]any{"param": fields[i].Param})
+	}
+	requestId := c.Writer.Header().Get(requestIdHeader)
+
+	c.Header("Content-Language", lang)
+	if wantsProblem(c.GetHeader("Accept")) {
+		c.Header("Content-Type", problemContentType)
+		c.AbortWithStatusJSON(definition.status, Problem{
+			Type:      problemTypePrefix + string(code),
+			Title:     http.StatusText(definition.status),
+			Status:    definition.status,
+			Detail:    message,
+			Instance:  c.Request.URL.Path,
+			Code:      code,
+			RequestId: requestId,
+			Details:   details,
+			Fields:    fields,
+		})
+		return
+	}
+	c.AbortWithStatusJSON(definition.status, gin.H{"error": ErrorBody{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		Fields:    fields,
+		RequestId: requestId,
+	}})
+}
+
+// expandPlaceholders заменяет {ключ} в тексте значениями из values.
+func expandPlaceholders(text string, values map[string]any) string {
+	if len(values) == 0 || !strings.Contains(text, "{") {
+		return text
+	}
+	pairs := make([]string, 0, len(values)*2)
+	for key, value := range values {
+		pairs = append(pairs, "{"+key+"}", fmt.Sprint(value))
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// wantsProblem сообщает, просит ли клиент ответ в формате RFC 7807.
+func wantsProblem(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, _ := strings.Cut(part, ";")
+		if strings.EqualFold(strings.TrimSpace(mediaType), problemContentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateLanguage выбирает язык ответа по Accept-Language с учетом
+// q-значений. Если подходящего языка нет, используется русский.
+func negotiateLanguage(header string) string {
+	type candidate struct {
+		lang string
+		q    float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		primary, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		for _, lang := range supportedLanguages {
+			if primary == lang && q > 0 {
+				candidates = append(candidates, candidate{lang, q})
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return defaultLanguage
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	return candidates[0].lang
+}
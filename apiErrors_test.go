@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestNegotiateLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", "ru"},
+		{"en", "en"},
+		{"en-US,en;q=0.9", "en"},
+		{"de-DE, en;q=0.5, ru;q=0.8", "ru"},
+		{"ru;q=0.1, en;q=0.9", "en"},
+		{"en;q=0, ru", "ru"},
+		{"fr, de", "ru"},
+		{"*", "ru"},
+	}
+	for _, tt := range tests {
+		if got := negotiateLanguage(tt.header); got != tt.want {
+			t.Errorf("negotiateLanguage(%q) = %s, ожидалось %s", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newRouter(NewHandlers(NewMemoryProductRepository(), NewMemoryUserRepository(), NewMemoryAuditRepository(), NewMemoryPriceHistoryRepository()))
+	do := func(method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("envelope", func(t *testing.T) {
+		w := do(http.MethodGet, "/product/42", "", map[string]string{requestIdHeader: "req-1"})
+		var body struct {
+			Error ErrorBody `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("тело ответа: %v %s", err, w.Body)
+		}
+		if w.Code != http.StatusNotFound || body.Error.Code != CodeProductNotFound || body.Error.Message != "Продукт не найден" || body.Error.RequestId != "req-1" {
+			t.Fatalf("неожиданный ответ: %d %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("problem+json in english", func(t *testing.T) {
+		w := do(http.MethodGet, "/product/abc", "", map[string]string{"Accept": "application/problem+json", "Accept-Language": "en-GB"})
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, problemContentType) {
+			t.Fatalf("Content-Type %s", ct)
+		}
+		if lang := w.Header().Get("Content-Language"); lang != "en" {
+			t.Fatalf("Content-Language %s", lang)
+		}
+		var problem Problem
+		if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+			t.Fatalf("тело ответа: %v %s", err, w.Body)
+		}
+		if problem.Status != http.StatusBadRequest || problem.Code != CodeInvalidParameter || problem.Type != problemTypePrefix+"invalid_parameter" ||
+			problem.Detail != "Invalid path parameter" || problem.Instance != "/product/abc" {
+			t.Fatalf("неожиданный problem: %+v", problem)
+		}
+	})
+
+	t.Run("field errors", func(t *testing.T) {
+		w := do(http.MethodPost, "/user", `{"name":"Мария"}`, map[string]string{"Accept-Language": "en"})
+		var body struct {
+			Error ErrorBody `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("тело ответа: %v %s", err, w.Body)
+		}
+		if w.Code != http.StatusBadRequest || body.Error.Code != CodeValidationFailed || len(body.Error.Fields) != 2 {
+			t.Fatalf("неожиданный ответ: %d %s", w.Code, w.Body)
+		}
+		if f := body.Error.Fields[0]; f.Field != "latitude" || f.Code != "required" || f.Message != "This field is required" {
+			t.Fatalf("неожиданная ошибка поля: %+v", f)
+		}
+	})
+
+	t.Run("malformed body does not leak parser errors", func(t *testing.T) {
+		w := do(http.MethodPost, "/user", `{"name":`, nil)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"code":"invalid_body"`) || strings.Contains(w.Body.String(), "unexpected") {
+			t.Fatalf("неожиданный ответ: %d %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("unknown route", func(t *testing.T) {
+		w := do(http.MethodGet, "/nope", "", nil)
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), `"code":"route_not_found"`) {
+			t.Fatalf("неожиданный ответ: %d %s", w.Code, w.Body)
+		}
+	})
+}
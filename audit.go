@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// actorHeader — кто выполняет запрос. Аутентификации в сервисе нет, поэтому
+// заголовок выставляет админка или шлюз перед сервисом.
+const actorHeader = "X-Actor"
+
+const (
+	anonymousActor = "anonymous"
+	// systemActor — фоновые задачи, например очистка корзины удаленных.
+	systemActor    = "system"
+	maxActorLength = 128
+)
+
+const (
+	AuditEntityProduct      = "product"
+	AuditEntityUser         = "user"
+	AuditEntityExchangeRate = "exchange_rate"
+	AuditEntityWarehouse    = "warehouse"
+	AuditEntityShippingZone = "shipping_zone"
+	AuditEntityShippingRate = "shipping_rate"
+	AuditEntityTaxZone      = "tax_zone"
+	AuditEntityTaxRate      = "tax_rate"
+	AuditEntityCoupon       = "coupon"
+	AuditEntityPromotion    = "promotion"
+	AuditEntityOrder        = "order"
+	AuditEntityShipment     = "shipment"
+	AuditEntityReturn       = "return"
+	AuditEntityRefund       = "refund"
+)
+
+var auditEntities = []string{
+	AuditEntityProduct,
+	AuditEntityUser,
+	AuditEntityExchangeRate,
+	AuditEntityWarehouse,
+	AuditEntityShippingZone,
+	AuditEntityShippingRate,
+	AuditEntityTaxZone,
+	AuditEntityTaxRate,
+	AuditEntityCoupon,
+	AuditEntityPromotion,
+	AuditEntityOrder,
+	AuditEntityShipment,
+	AuditEntityReturn,
+	AuditEntityRefund,
+}
+
+const (
+	AuditActionCreate  = "create"
+	AuditActionUpdate  = "update"
+	AuditActionDelete  = "delete"
+	AuditActionRestore = "restore"
+	AuditActionPurge   = "purge"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// AuditEntry — запись журнала изменений. Changes содержит только
+// изменившиеся поля сущности.
+type AuditEntry struct {
+	Id         int64                  `json:"id"`
+	Actor      string                 `json:"actor"`
+	Action     string                 `json:"action"`
+	EntityType string                 `json:"entity_type"`
+	EntityId   int64                  `json:"entity_id"`
+	Changes    map[string]AuditChange `json:"changes"`
+	IP         string                 `json:"ip"`
+	RequestId  string                 `json:"request_id"`
+	CreatedAt  time.Time              `json:"created_at"`
+}
+
+// AuditChange — значение поля до и после изменения; null, если поля не было.
+type AuditChange struct {
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
+
+// AuditFilter выбирает записи журнала. Пустой EntityType и нулевой EntityId
+// не ограничивают выборку. Записи возвращаются от новых к старым.
+type AuditFilter struct {
+	EntityType string
+	EntityId   int64
+	Limit      int
+}
+
+// auditDiff сравнивает JSON-представления before и after по полям верхнего
+// уровня. nil означает, что сущности не было (создание или окончательное
+// удаление).
+func auditDiff(before, after any) (map[string]AuditChange, error) {
+	beforeFields, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+	changes := make(map[string]AuditChange)
+	for name, value := range beforeFields {
+		if !bytes.Equal(value, afterFields[name]) {
+			changes[name] = AuditChange{Before: value, After: afterFields[name]}
+		}
+	}
+	for name, value := range afterFields {
+		if _, ok := beforeFields[name]; !ok {
+			changes[name] = AuditChange{After: value}
+		}
+	}
+	return changes, nil
+}
+
+func auditFields(entity any) (map[string]json.RawMessage, error) {
+	if entity == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(entity)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	return fields, err
+}
+
+func isAuditEntity(entityType string) bool {
+	for _, e := range auditEntities {
+		if e == entityType {
+			return true
+		}
+	}
+	return false
+}
+
+// auditRow читает строку table с указанным id как набор полей для журнала.
+// Нужна сущностям без своего типа загрузки, например при удалении через
+// deleteById. Если строки нет, возвращает sql.ErrNoRows.
+func auditRow(ctx context.Context, table string, id int64) (map[string]any, error) {
+	rows, err := db.QueryContext(ctx, "SELECT * FROM "+table+" WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	if err := rows.Scan(pointers...); err != nil {
+		return nil, err
+	}
+	row := make(map[string]any, len(columns))
+	for i, column := range columns {
+		// Драйверы отдают текст как []byte, а в JSON он стал бы base64.
+		if b, ok := values[i].([]byte); ok {
+			values[i] = string(b)
+		}
+		row[column] = values[i]
+	}
+	return row, rows.Err()
+}
+
+// requestActor возвращает автора изменения из заголовка X-Actor.
+func requestActor(c *gin.Context) string {
+	actor := strings.TrimSpace(c.GetHeader(actorHeader))
+	if actor == "" {
+		return anonymousActor
+	}
+	if len(actor) > maxActorLength {
+		actor = actor[:maxActorLength]
+	}
+	return actor
+}
+
+// audit записывает в журнал изменение, сделанное текущим запросом. Запись
+// делается после сохранения изменения, поэтому ошибка журнала только
+// логируется и не меняет ответ.
+func (h *Handlers) audit(c *gin.Context, action, entityType string, entityId int64, before, after any) {
+	entry := AuditEntry{
+		Actor:      requestActor(c),
+		Action:     action,
+		EntityType: entityType,
+		EntityId:   entityId,
+		IP:         c.ClientIP(),
+		RequestId:  c.Writer.Header().Get(requestIdHeader),
+	}
+	h.recordAudit(c.Request.Context(), entry, before, after)
+}
+
+func (h *Handlers) recordAudit(ctx context.Context, entry AuditEntry, before, after any) {
+	changes, err := auditDiff(before, after)
+	if err == nil {
+		entry.Changes = changes
+		entry.CreatedAt = time.Now().UTC()
+		err = h.audits.Record(ctx, &entry)
+	}
+	if err != nil {
+		loggerFromContext(ctx).Error("Ошибка записи в журнал изменений", "action", entry.Action,
+			"entity_type", entry.EntityType, "entity_id", entry.EntityId, "error", err)
+	}
+}
+
+// getAudit возвращает журнал изменений, при необходимости по одной
+// сущности: GET /audit?entity=product&id=5.
+func (h *Handlers) getAudit(c *gin.Context) {
+	filter := AuditFilter{EntityType: c.Query("entity"), Limit: defaultAuditLimit}
+	if filter.EntityType != "" && !isAuditEntity(filter.EntityType) {
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+	if idStr := c.Query("id"); idStr != "" {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil || filter.EntityType == "" {
+			respondError(c, CodeInvalidParameter)
+			return
+		}
+		filter.EntityId = id
+	}
+	if limitStr := c.Query("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxAuditLimit {
+			respondError(c, CodeInvalidParameter)
+			return
+		}
+		filter.Limit = limit
+	}
+
+	entries, err := h.audits.List(c.Request.Context(), filter)
+	if err != nil {
+		requestLog(c).Error("Ошибка получения журнала изменений", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	c.JSON(http.StatusOK, entries)
+}
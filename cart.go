@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CartTotals — расчет корзины в валюте Currency: позиции со скидками и
+// налогом, строки скидок и налогов и доставка. Total = Subtotal -
+// Discount + ShippingCost, плюс Tax, если цены не включают налог.
+// ShippingRateId пустой, если доставка по адресу недоступна.
+type CartTotals struct {
+	Currency       string      `json:"currency"`
+	Items          []OrderItem `json:"items"`
+	Subtotal       int         `json:"subtotal"`
+	Discounts      []Discount  `json:"discounts"`
+	Discount       int         `json:"discount"`
+	ShippingRateId *int64      `json:"shipping_rate_id"`
+	ShippingCost   int         `json:"shipping_cost"`
+	Taxes          []TaxLine   `json:"taxes"`
+	Tax            int         `json:"tax"`
+	// PricesIncludeTax — цены и доставка уже включают налог.
+	PricesIncludeTax bool         `json:"prices_include_tax"`
+	Total            int          `json:"total"`
+	ExchangeRates    RateSnapshot `json:"exchange_rates"`
+	// UnavailableProducts — товары корзины, перенесенные в корзину
+	// удаленных: в расчет они не входят.
+	UnavailableProducts []int64 `json:"unavailable_products"`
+}
+
+// cartRequest — что нужно для расчета корзины пользователя. Нулевой
+// shippingRateId — самый дешевый доступный тариф, пустой coupon — без
+// купона.
+type cartRequest struct {
+	userId         int64
+	lat, lon       float64
+	cart           []int64
+	currency       string
+	shippingRateId int64
+	coupon         string
+}
+
+// loadUserCart возвращает координаты пользователя и его корзину как она
+// хранится в базе.
+func loadUserCart(ctx context.Context, userId int64) (float64, float64, string, error) {
+	var (
+		lat, lon float64
+		cartStr  string
+	)
+	err := db.QueryRowContext(ctx, "SELECT latitude,longitude,cart FROM users WHERE id = ? AND deleted_at IS NULL", userId).Scan(&lat, &lon, &cartStr)
+	return lat, lon, cartStr, err
+}
+
+// dropTrashedProducts убирает из корзины товары, перенесенные в корзину
+// удаленных, чтобы из-за них корзину можно было посмотреть и оформить.
+// Возвращает оставшиеся позиции и ID убранных товаров.
+func dropTrashedProducts(ctx context.Context, cart []int64) ([]int64, []int64, error) {
+	unavailable := []int64{}
+	if len(cart) == 0 {
+		return cart, unavailable, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(cart)), ",")
+	args := make([]interface{}, len(cart))
+	for i, id := range cart {
+		args[i] = id
+	}
+	rows, err := db.QueryContext(ctx, "SELECT id FROM products WHERE deleted_at IS NOT NULL AND id IN ("+placeholders+") ORDER BY id", args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	trashed := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, nil, err
+		}
+		trashed[id] = true
+		unavailable = append(unavailable, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(trashed) == 0 {
+		return cart, unavailable, nil
+	}
+	kept := make([]int64, 0, len(cart))
+	for _, id := range cart {
+		if !trashed[id] {
+			kept = append(kept, id)
+		}
+	}
+	return kept, unavailable, nil
+}
+
+// priceCart считает корзину так же, как ее оформит checkout: цены по
+// cartPricePolicy в валюте корзины, доставку, акции, купон и налоги
+// налоговой зоны адреса доставки. Вместе с расчетом возвращает
+// примененный купон.
+func priceCart(ctx context.Context, r cartRequest) (CartTotals, *Coupon, error) {
+	totals := CartTotals{Currency: r.currency, Items: []OrderItem{}, Discounts: []Discount{}, Taxes: []TaxLine{}, PricesIncludeTax: taxConfig.PricesIncludeTax}
+	cart, unavailable, err := dropTrashedProducts(ctx, r.cart)
+	if err != nil {
+		return totals, nil, err
+	}
+	r.cart, totals.UnavailableProducts = cart, unavailable
+	products, err := getProductsByIds(ctx, r.cart)
+	if err != nil {
+		return totals, nil, err
+	}
+	prices, err := cartItemPrices(ctx, r.userId, products)
+	if err != nil {
+		return totals, nil, err
+	}
+	rates := exchangeRates.snapshot()
+	basePrices, err := rates.convertPrices(prices, products, baseCurrency)
+	if err != nil {
+		return totals, nil, err
+	}
+	if prices, err = rates.convertPrices(prices, products, r.currency); err != nil {
+		return totals, nil, err
+	}
+
+	quote, err := quoteCart(ctx, r.lat, r.lon, r.cart, products, basePrices)
+	if err != nil {
+		return totals, nil, err
+	}
+	for i := range quote.Options {
+		if r.shippingRateId == 0 || quote.Options[i].RateId == r.shippingRateId {
+			rateId := quote.Options[i].RateId
+			totals.ShippingRateId = &rateId
+			if totals.ShippingCost, err = rates.convert(quote.Options[i].Price, baseCurrency, r.currency); err != nil {
+				return totals, nil, err
+			}
+			break
+		}
+	}
+
+	now := time.Now().UTC()
+	promotions, err := loadPromotions(ctx)
+	if err != nil {
+		return totals, nil, err
+	}
+	var coupon *Coupon
+	usedCurrencies := []string{baseCurrency, r.currency}
+	if r.coupon != "" {
+		found, err := loadCoupon(ctx, r.coupon)
+		if err == sql.ErrNoRows {
+			return totals, nil, &couponError{code: CodeCouponNotFound}
+		} else if err != nil {
+			return totals, nil, err
+		}
+		if err := checkCoupon(ctx, found, r.userId, now); err != nil {
+			return totals, nil, err
+		}
+		coupon = &found
+		usedCurrencies = append(usedCurrencies, coupon.Currency)
+	}
+	discounts, byProduct, err := cartDiscounts(r.cart, products, prices, promotions, coupon, r.currency, rates, totals.ShippingCost, now)
+	if err != nil {
+		return totals, nil, err
+	}
+	totals.Discounts = discounts
+	for _, line := range discounts {
+		totals.Discount += line.Amount
+	}
+
+	positions := make(map[int64]int)
+	for _, productId := range r.cart {
+		totals.Subtotal += prices[productId]
+		if i, ok := positions[productId]; ok {
+			totals.Items[i].Quantity++
+			continue
+		}
+		p := products[productId]
+		positions[productId] = len(totals.Items)
+		totals.Items = append(totals.Items, OrderItem{ProductId: p.Id, Name: p.Name, Price: prices[productId], Quantity: 1, Discount: byProduct[productId]})
+		usedCurrencies = append(usedCurrencies, p.Currency)
+	}
+	if err := applyTaxes(ctx, &totals, r.lat, r.lon, products); err != nil {
+		return totals, nil, err
+	}
+	totals.Total = totals.Subtotal - totals.Discount + totals.ShippingCost
+	if !totals.PricesIncludeTax {
+		totals.Total += totals.Tax
+	}
+	totals.ExchangeRates = rates.subset(usedCurrencies...)
+	return totals, coupon, nil
+}
+
+// applyTaxes считает налоги корзины в налоговой зоне точки lat, lon и
+// распределяет их по позициям.
+func applyTaxes(ctx context.Context, totals *CartTotals, lat, lon float64, products map[int64]Product) error {
+	zones, err := loadTaxZones(ctx)
+	if err != nil {
+		return err
+	}
+	rates, err := loadTaxRates(ctx)
+	if err != nil {
+		return err
+	}
+	shipping := totals.ShippingCost
+	for _, line := range totals.Discounts {
+		if line.Target == DiscountTargetShipping {
+			shipping -= line.Amount
+		}
+	}
+	lines, byProduct, err := cartTaxes(findTaxZone(zones, lat, lon), rates, totals.Items, products, shipping, totals.PricesIncludeTax)
+	if err != nil {
+		return err
+	}
+	totals.Taxes = lines
+	for _, line := range lines {
+		totals.Tax += line.Amount
+	}
+	for i := range totals.Items {
+		totals.Items[i].Tax = byProduct[totals.Items[i].ProductId]
+	}
+	return nil
+}
+
+// respondCartError отвечает на ошибку расчета корзины.
+func respondCartError(c *gin.Context, err error) {
+	var ce *couponError
+	switch {
+	case errors.As(err, &ce):
+		respondErrorDetails(c, ce.code, ce.details)
+	case errors.Is(err, errProductNotFound):
+		respondError(c, CodeCartProductNotFound)
+	case errors.Is(err, errExchangeRateUnavailable):
+		respondConversionError(c, err)
+	default:
+		requestLog(c).Error("Ошибка расчета корзины", "error", err)
+		respondError(c, CodeInternal)
+	}
+}
+
+// getCart возвращает расчет корзины пользователя с доставкой, скидками и
+// налогами: ту же разбивку, что получит заказ при оформлении.
+func getCart(c *gin.Context) {
+	userId, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+	currency, ok := requestCurrency(c)
+	if !ok {
+		return
+	}
+	if currency == "" {
+		currency = baseCurrency
+	}
+	var shippingRateId int64
+	if rateIdStr := c.Query("shipping_rate_id"); rateIdStr != "" {
+		if shippingRateId, err = strconv.ParseInt(rateIdStr, 10, 64); err != nil {
+			respondError(c, CodeInvalidParameter)
+			return
+		}
+	}
+
+	lat, lon, cartStr, err := loadUserCart(c.Request.Context(), userId)
+	if err == sql.ErrNoRows {
+		respondError(c, CodeUserNotFound)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при получении пользователя с ID", "user_id", userId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	totals, _, err := priceCart(c.Request.Context(), cartRequest{
+		userId:         userId,
+		lat:            lat,
+		lon:            lon,
+		cart:           parseCart(cartStr),
+		currency:       currency,
+		shippingRateId: shippingRateId,
+		coupon:         c.Query("coupon"),
+	})
+	if err != nil {
+		respondCartError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, totals)
+}
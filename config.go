@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config — настройки сервиса. Значения берутся по возрастанию приоритета:
+// значения по умолчанию, YAML-файл (-config или SHOP_CONFIG), переменные
+// окружения и флаги командной строки.
+type Config struct {
+	Server    ServerConfig        `yaml:"server"`
+	Database  DatabaseConfig      `yaml:"database"`
+	Uploads   UploadsConfig       `yaml:"uploads"`
+	Payments  PaymentsConfig      `yaml:"payments"`
+	Shipments ShipmentsConfig     `yaml:"shipments"`
+	Trash     TrashConfig         `yaml:"trash"`
+	Cart      CartConfig          `yaml:"cart"`
+	Tax       TaxConfig           `yaml:"tax"`
+	Rates     ExchangeRatesConfig `yaml:"exchange_rates"`
+	Logging   LoggingConfig       `yaml:"logging"`
+	Tracing   TracingConfig       `yaml:"tracing"`
+}
+
+// ServerConfig — параметры HTTP-сервера. Нулевой таймаут чтения, записи
+// или простоя означает отсутствие ограничения. RequireIfMatch запрещает
+// менять и удалять товары и пользователей без заголовка If-Match.
+type ServerConfig struct {
+	Addr              string        `yaml:"addr"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`
+	RequireIfMatch    bool          `yaml:"require_if_match"`
+}
+
+type DatabaseConfig struct {
+	DSN string `yaml:"dsn"`
+}
+
+type UploadsConfig struct {
+	Dir         string `yaml:"dir"`
+	MaxFileSize int64  `yaml:"max_file_size"`
+}
+
+// PaymentsConfig — платежный провайдер: none (онлайн-оплата отключена,
+// по умолчанию), fake или stripe. Фейковый провайдер проводит платежи без
+// списания денег, поэтому включается только явно через AllowFake — для
+// разработки и тестов. WebhookSecret — секрет подписи вебхуков фейкового
+// провайдера, значения по умолчанию нет.
+type PaymentsConfig struct {
+	Provider            string `yaml:"provider"`
+	AllowFake           bool   `yaml:"allow_fake"`
+	WebhookSecret       string `yaml:"webhook_secret"`
+	StripeSecretKey     string `yaml:"stripe_secret_key"`
+	StripeWebhookSecret string `yaml:"stripe_webhook_secret"`
+}
+
+// LoggingConfig — уровень логирования: debug, info, warn или error.
+type LoggingConfig struct {
+	Level string `yaml:"level"`
+}
+
+// TracingConfig — экспорт трасс OpenTelemetry. Exporter: none, stdout
+// (в консоль, для локальной отладки) или otlp (OTLP/HTTP на Endpoint, например
+// http://localhost:4318). SampleRatio — доля запросов, для которых пишутся
+// трассы, если вызывающая сторона не передала решение в traceparent.
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter"`
+	Endpoint    string  `yaml:"endpoint"`
+	ServiceName string  `yaml:"service_name"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+type ShipmentsConfig struct {
+	PollInterval time.Duration `yaml:"poll_interval"`
+}
+
+// TrashConfig — корзина удаленных товаров и пользователей: через
+// RetentionDays дней записи удаляются окончательно, проверка идет раз в
+// PurgeInterval.
+type TrashConfig struct {
+	RetentionDays int           `yaml:"retention_days"`
+	PurgeInterval time.Duration `yaml:"purge_interval"`
+}
+
+// CartConfig — какую цену товаров корзины берут доставка и оформление
+// заказа: current — текущую, added — на момент добавления в корзину,
+// lowest — меньшую из двух.
+type CartConfig struct {
+	PricePolicy string `yaml:"price_policy"`
+}
+
+// TaxConfig — как считается налог. PricesIncludeTax — цены товаров и
+// доставки уже включают налог (он выделяется из них), иначе налог
+// начисляется сверху. Categories задает налоговый класс товаров категории,
+// остальные товары — класса standard. ShippingClass — класс доставки;
+// пустой — доставка налогом не облагается.
+type TaxConfig struct {
+	PricesIncludeTax bool              `yaml:"prices_include_tax"`
+	ShippingClass    string            `yaml:"shipping_class"`
+	Categories       map[string]string `yaml:"categories"`
+}
+
+// ExchangeRatesConfig — источник курсов валют: manual (курсы задаются
+// только через PUT /exchange-rate/:currency, по умолчанию), fixture
+// (постоянные курсы, включается явно через AllowFixture — для разработки и
+// тестов) или http (JSON по адресу URL, см. HTTPRateProvider). Курсы из
+// источника обновляются раз в RefreshInterval.
+type ExchangeRatesConfig struct {
+	Provider        string        `yaml:"provider"`
+	AllowFixture    bool          `yaml:"allow_fixture"`
+	URL             string        `yaml:"url"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+}
+
+const redactedValue = "xxxxx"
+
+func defaultConfig() Config {
+	return Config{
+		Server: ServerConfig{
+			Addr:              ":8080",
+			ReadTimeout:       30 * time.Second,
+			ReadHeaderTimeout: 10 * time.Second,
+			WriteTimeout:      60 * time.Second,
+			IdleTimeout:       120 * time.Second,
+			ShutdownTimeout:   30 * time.Second,
+		},
+		Database:  DatabaseConfig{DSN: defaultDatabaseDSN},
+		Uploads:   UploadsConfig{Dir: "uploads/images", MaxFileSize: 10 << 20},
+		Payments:  PaymentsConfig{Provider: PaymentProviderNone},
+		Shipments: ShipmentsConfig{PollInterval: defaultShipmentPollInterval},
+		Trash:     TrashConfig{RetentionDays: defaultTrashRetentionDays, PurgeInterval: defaultTrashPurgeInterval},
+		Cart:      CartConfig{PricePolicy: CartPriceCurrent},
+		Tax:       TaxConfig{PricesIncludeTax: true, ShippingClass: defaultTaxClass},
+		Rates:     ExchangeRatesConfig{Provider: RateProviderManual, RefreshInterval: defaultRateRefreshInterval},
+		Logging:   LoggingConfig{Level: "info"},
+		Tracing:   TracingConfig{Exporter: TracingExporterNone, ServiceName: "shop", SampleRatio: 1},
+	}
+}
+
+// configEnv связывает переменные окружения с полями конфигурации.
+var configEnv = []struct {
+	name  string
+	apply func(cfg *Config, value string) error
+}{
+	{"HTTP_ADDR", func(cfg *Config, v string) error { cfg.Server.Addr = v; return nil }},
+	{"HTTP_READ_TIMEOUT", func(cfg *Config, v string) (err error) {
+		cfg.Server.ReadTimeout, err = time.ParseDuration(v)
+		return err
+	}},
+	{"HTTP_READ_HEADER_TIMEOUT", func(cfg *Config, v string) (err error) {
+		cfg.Server.ReadHeaderTimeout, err = time.ParseDuration(v)
+		return err
+	}},
+	{"HTTP_WRITE_TIMEOUT", func(cfg *Config, v string) (err error) {
+		cfg.Server.WriteTimeout, err = time.ParseDuration(v)
+		return err
+	}},
+	{"HTTP_IDLE_TIMEOUT", func(cfg *Config, v string) (err error) {
+		cfg.Server.IdleTimeout, err = time.ParseDuration(v)
+		return err
+	}},
+	{"HTTP_SHUTDOWN_TIMEOUT", func(cfg *Config, v string) (err error) {
+		cfg.Server.ShutdownTimeout, err = time.ParseDuration(v)
+		return err
+	}},
+	{"HTTP_REQUIRE_IF_MATCH", func(cfg *Config, v string) (err error) {
+		cfg.Server.RequireIfMatch, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"DATABASE_URL", func(cfg *Config, v string) error { cfg.Database.DSN = v; return nil }},
+	{"UPLOADS_DIR", func(cfg *Config, v string) error { cfg.Uploads.Dir = v; return nil }},
+	{"UPLOAD_MAX_FILE_SIZE", func(cfg *Config, v string) (err error) {
+		cfg.Uploads.MaxFileSize, err = strconv.ParseInt(v, 10, 64)
+		return err
+	}},
+	{"PAYMENT_PROVIDER", func(cfg *Config, v string) error { cfg.Payments.Provider = v; return nil }},
+	{"PAYMENT_ALLOW_FAKE", func(cfg *Config, v string) (err error) {
+		cfg.Payments.AllowFake, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"PAYMENT_WEBHOOK_SECRET", func(cfg *Config, v string) error { cfg.Payments.WebhookSecret = v; return nil }},
+	{"STRIPE_SECRET_KEY", func(cfg *Config, v string) error { cfg.Payments.StripeSecretKey = v; return nil }},
+	{"STRIPE_WEBHOOK_SECRET", func(cfg *Config, v string) error { cfg.Payments.StripeWebhookSecret = v; return nil }},
+	{"SHIPMENT_POLL_INTERVAL", func(cfg *Config, v string) (err error) {
+		cfg.Shipments.PollInterval, err = time.ParseDuration(v)
+		return err
+	}},
+	{"TRASH_RETENTION_DAYS", func(cfg *Config, v string) (err error) {
+		cfg.Trash.RetentionDays, err = strconv.Atoi(v)
+		return err
+	}},
+	{"TRASH_PURGE_INTERVAL", func(cfg *Config, v string) (err error) {
+		cfg.Trash.PurgeInterval, err = time.ParseDuration(v)
+		return err
+	}},
+	{"CART_PRICE_POLICY", func(cfg *Config, v string) error { cfg.Cart.PricePolicy = v; return nil }},
+	{"TAX_PRICES_INCLUDE_TAX", func(cfg *Config, v string) (err error) {
+		cfg.Tax.PricesIncludeTax, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"TAX_SHIPPING_CLASS", func(cfg *Config, v string) error { cfg.Tax.ShippingClass = v; return nil }},
+	{"EXCHANGE_RATES_PROVIDER", func(cfg *Config, v string) error { cfg.Rates.Provider = v; return nil }},
+	{"EXCHANGE_RATES_ALLOW_FIXTURE", func(cfg *Config, v string) (err error) {
+		cfg.Rates.AllowFixture, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"EXCHANGE_RATES_URL", func(cfg *Config, v string) error { cfg.Rates.URL = v; return nil }},
+	{"EXCHANGE_RATES_REFRESH_INTERVAL", func(cfg *Config, v string) (err error) {
+		cfg.Rates.RefreshInterval, err = time.ParseDuration(v)
+		return err
+	}},
+	{"LOG_LEVEL", func(cfg *Config, v string) error { cfg.Logging.Level = v; return nil }},
+	{"TRACING_EXPORTER", func(cfg *Config, v string) error { cfg.Tracing.Exporter = v; return nil }},
+	{"OTEL_EXPORTER_OTLP_ENDPOINT", func(cfg *Config, v string) error { cfg.Tracing.Endpoint = v; return nil }},
+	{"OTEL_SERVICE_NAME", func(cfg *Config, v string) error { cfg.Tracing.ServiceName = v; return nil }},
+	{"TRACING_SAMPLE_RATIO", func(cfg *Config, v string) (err error) {
+		cfg.Tracing.SampleRatio, err = strconv.ParseFloat(v, 64)
+		return err
+	}},
+}
+
+// loadConfig собирает конфигурацию из файла, окружения и флагов args.
+// Флаги указываются до подкоманды; оставшиеся аргументы возвращаются.
+func loadConfig(args []string, getenv func(string) string) (Config, []string, error) {
+	cfg := defaultConfig()
+
+	flags := flag.NewFlagSet("shop", flag.ContinueOnError)
+	configPath := flags.String("config", getenv("SHOP_CONFIG"), "путь к YAML-файлу конфигурации")
+	addr := flags.String("addr", "", "адрес HTTP-сервера")
+	dsn := flags.String("db", "", "DSN базы данных: путь к файлу SQLite или postgres://...")
+	uploadsDir := flags.String("uploads-dir", "", "директория для загруженных изображений")
+	maxFileSize := flags.Int64("upload-max-file-size", 0, "максимальный размер загружаемого файла в байтах")
+	provider := flags.String("payment-provider", "", "платежный провайдер: none, fake или stripe")
+	pollInterval := flags.Duration("shipment-poll-interval", 0, "период опроса служб доставки")
+	logLevel := flags.String("log-level", "", "уровень логирования: debug, info, warn или error")
+	tracingExporter := flags.String("tracing-exporter", "", "экспорт трасс: none, stdout или otlp")
+	if err := flags.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+
+	if *configPath != "" {
+		if err := readConfigFile(*configPath, &cfg); err != nil {
+			return cfg, nil, err
+		}
+	}
+
+	for _, env := range configEnv {
+		if value := getenv(env.name); value != "" {
+			if err := env.apply(&cfg, value); err != nil {
+				return cfg, nil, fmt.Errorf("некорректное значение %s: %w", env.name, err)
+			}
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Server.Addr = *addr
+		case "db":
+			cfg.Database.DSN = *dsn
+		case "uploads-dir":
+			cfg.Uploads.Dir = *uploadsDir
+		case "upload-max-file-size":
+			cfg.Uploads.MaxFileSize = *maxFileSize
+		case "payment-provider":
+			cfg.Payments.Provider = *provider
+		case "shipment-poll-interval":
+			cfg.Shipments.PollInterval = *pollInterval
+		case "log-level":
+			cfg.Logging.Level = *logLevel
+		case "tracing-exporter":
+			cfg.Tracing.Exporter = *tracingExporter
+		}
+	})
+	return cfg, flags.Args(), nil
+}
+
+func readConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("ошибка чтения файла конфигурации: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+		return fmt.Errorf("ошибка разбора файла конфигурации %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate проверяет конфигурацию и возвращает все найденные ошибки сразу.
+func (cfg Config) Validate() error {
+	return errors.Join(cfg.validateBase(), cfg.Payments.Validate())
+}
+
+// validateBase проверяет все, кроме платежей: этого достаточно подкоманде
+// migrate.
+func (cfg Config) validateBase() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(cfg.Server.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("server.addr: некорректный адрес '%s'", cfg.Server.Addr))
+	}
+	if cfg.Server.ReadTimeout < 0 || cfg.Server.ReadHeaderTimeout < 0 || cfg.Server.WriteTimeout < 0 || cfg.Server.IdleTimeout < 0 {
+		errs = append(errs, errors.New("server: таймауты не могут быть отрицательными"))
+	}
+	if cfg.Server.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("server.shutdown_timeout: таймаут должен быть положительным"))
+	}
+	if _, _, err := parseDatabaseDSN(cfg.Database.DSN); err != nil {
+		errs = append(errs, fmt.Errorf("database.dsn: %w", err))
+	}
+	if cfg.Uploads.Dir == "" {
+		errs = append(errs, errors.New("uploads.dir: не задана директория загрузок"))
+	}
+	if cfg.Uploads.MaxFileSize <= 0 {
+		errs = append(errs, errors.New("uploads.max_file_size: размер должен быть положительным"))
+	}
+	if cfg.Shipments.PollInterval <= 0 {
+		errs = append(errs, errors.New("shipments.poll_interval: период должен быть положительным"))
+	}
+	if cfg.Trash.RetentionDays <= 0 {
+		errs = append(errs, errors.New("trash.retention_days: срок хранения должен быть положительным"))
+	}
+	if cfg.Trash.PurgeInterval <= 0 {
+		errs = append(errs, errors.New("trash.purge_interval: период должен быть положительным"))
+	}
+	if !isValidCartPricePolicy(cfg.Cart.PricePolicy) {
+		errs = append(errs, fmt.Errorf("cart.price_policy: неизвестная политика '%s', ожидается current, added или lowest", cfg.Cart.PricePolicy))
+	}
+	for category, class := range cfg.Tax.Categories {
+		if class == "" {
+			errs = append(errs, fmt.Errorf("tax.categories: не задан налоговый класс категории '%s'", category))
+		}
+	}
+	switch cfg.Rates.Provider {
+	case RateProviderManual:
+	case RateProviderFixture:
+		if !cfg.Rates.AllowFixture {
+			errs = append(errs, errors.New("exchange_rates.provider: постоянные курсы только для разработки и тестов, включите exchange_rates.allow_fixture (EXCHANGE_RATES_ALLOW_FIXTURE)"))
+		}
+	case RateProviderHTTP:
+		if u, err := url.Parse(cfg.Rates.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("exchange_rates.url: ожидается URL http(s), получено '%s'", cfg.Rates.URL))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("exchange_rates.provider: неизвестный источник '%s', ожидается manual, fixture или http", cfg.Rates.Provider))
+	}
+	if cfg.Rates.RefreshInterval <= 0 {
+		errs = append(errs, errors.New("exchange_rates.refresh_interval: период должен быть положительным"))
+	}
+	if _, err := parseLogLevel(cfg.Logging.Level); err != nil {
+		errs = append(errs, fmt.Errorf("logging.level: %w", err))
+	}
+	switch cfg.Tracing.Exporter {
+	case TracingExporterNone, TracingExporterStdout:
+	case TracingExporterOTLP:
+		if u, err := url.Parse(cfg.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("tracing.endpoint: ожидается URL вида http://host:4318, получено '%s'", cfg.Tracing.Endpoint))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("tracing.exporter: неизвестный экспортер '%s', ожидается none, stdout или otlp", cfg.Tracing.Exporter))
+	}
+	if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		errs = append(errs, errors.New("tracing.sample_ratio: доля должна быть от 0 до 1"))
+	}
+	if cfg.Tracing.ServiceName == "" {
+		errs = append(errs, errors.New("tracing.service_name: не задано имя сервиса"))
+	}
+	return errors.Join(errs...)
+}
+
+// Validate проверяет настройки выбранного платежного провайдера.
+func (cfg PaymentsConfig) Validate() error {
+	var errs []error
+	switch cfg.Provider {
+	case PaymentProviderNone:
+	case PaymentProviderFake:
+		if !cfg.AllowFake {
+			errs = append(errs, errors.New("payments.provider: фейковый провайдер только для разработки и тестов, включите payments.allow_fake (PAYMENT_ALLOW_FAKE)"))
+		}
+		if cfg.WebhookSecret == "" {
+			errs = append(errs, errors.New("payments.webhook_secret: не задан секрет вебхуков (PAYMENT_WEBHOOK_SECRET)"))
+		}
+	case PaymentProviderStripe:
+		if cfg.StripeSecretKey == "" {
+			errs = append(errs, errors.New("payments.stripe_secret_key: не задан ключ Stripe"))
+		}
+		if cfg.StripeWebhookSecret == "" {
+			errs = append(errs, errors.New("payments.stripe_webhook_secret: не задан секрет вебхуков Stripe"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("payments.provider: неизвестный провайдер '%s', ожидается none, fake или stripe", cfg.Provider))
+	}
+	return errors.Join(errs...)
+}
+
+// Redacted возвращает копию конфигурации со скрытыми секретами и паролем
+// в DSN базы данных.
+func (cfg Config) Redacted() Config {
+	hide := func(secret *string) {
+		if *secret != "" {
+			*secret = redactedValue
+		}
+	}
+	hide(&cfg.Payments.WebhookSecret)
+	hide(&cfg.Payments.StripeSecretKey)
+	hide(&cfg.Payments.StripeWebhookSecret)
+	if u, err := url.Parse(cfg.Database.DSN); err == nil && u.User != nil {
+		if _, hasPassword := u.User.Password(); hasPassword {
+			cfg.Database.DSN = u.Redacted()
+		}
+	}
+	return cfg
+}
+
+// runConfigCommand обрабатывает подкоманду "config print".
+func runConfigCommand(cfg Config, args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return errors.New("ожидается команда config print")
+	}
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(cfg.Redacted()); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	return cfg.Validate()
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// baseCurrency — валюта, к которой хранятся курсы и в которой заданы
+// тарифы доставки.
+const baseCurrency = "RUB"
+
+const defaultRateRefreshInterval = time.Hour
+
+// currencyExponents — поддерживаемые валюты ISO 4217 и число знаков после
+// запятой: суммы хранятся целыми числами в минимальных единицах валюты
+// (копейках, центах, тиынах, фэнях).
+var currencyExponents = map[string]int{
+	"RUB": 2,
+	"KZT": 2,
+	"USD": 2,
+	"EUR": 2,
+	"CNY": 2,
+}
+
+var errExchangeRateUnavailable = errors.New("нет курса валюты")
+
+// ExchangeRate — курс валюты: сколько единиц базовой валюты стоит единица
+// Currency. Rate — десятичная строка, чтобы пересчет по записанному курсу
+// давал ровно те же суммы.
+type ExchangeRate struct {
+	Currency  string    `json:"currency"`
+	Rate      string    `json:"rate"`
+	Source    string    `json:"source"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// RateProvider — источник курсов валют. Rates возвращает курсы к
+// baseCurrency; валюты, которых нет у источника, пропускаются.
+type RateProvider interface {
+	Name() string
+	Rates(ctx context.Context) (map[string]*big.Rat, error)
+}
+
+const (
+	RateProviderManual  = "manual"
+	RateProviderFixture = "fixture"
+	RateProviderHTTP    = "http"
+)
+
+// rateProvider — nil, если курсы задаются только вручную (источник manual):
+// тогда runRateUpdater не запускается и ручные курсы не перезаписываются.
+var rateProvider RateProvider
+
+func newRateProvider(cfg ExchangeRatesConfig) RateProvider {
+	switch cfg.Provider {
+	case RateProviderHTTP:
+		return NewHTTPRateProvider(cfg.URL)
+	case RateProviderFixture:
+		slog.Info("Используются постоянные курсы валют")
+		return NewFixtureRateProvider()
+	default:
+		slog.Info("Курсы валют задаются вручную")
+		return nil
+	}
+}
+
+// exchangeRates — последние курсы из таблицы exchange_rates. Обработчики
+// читают курсы отсюда, а не из базы.
+var exchangeRates = &rateCache{}
+
+type rateCache struct {
+	mu    sync.RWMutex
+	rates map[string]ExchangeRate
+}
+
+func (c *rateCache) set(rates []ExchangeRate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rates == nil {
+		c.rates = make(map[string]ExchangeRate)
+	}
+	for _, rate := range rates {
+		c.rates[rate.Currency] = rate
+	}
+}
+
+// list возвращает курсы, отсортированные по коду валюты.
+func (c *rateCache) list() []ExchangeRate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	rates := make([]ExchangeRate, 0, len(c.rates))
+	for _, rate := range c.rates {
+		rates = append(rates, rate)
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i].Currency < rates[j].Currency })
+	return rates
+}
+
+// snapshot возвращает курсы для пересчета. Курс базовой валюты всегда 1.
+func (c *rateCache) snapshot() RateSnapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	snapshot := RateSnapshot{baseCurrency: "1"}
+	for currency, rate := range c.rates {
+		snapshot[currency] = rate.Rate
+	}
+	return snapshot
+}
+
+// RateSnapshot — курсы валют к базовой на момент расчета. Заказ хранит
+// курсы, по которым посчитаны его суммы.
+type RateSnapshot map[string]string
+
+func (s RateSnapshot) rate(currency string) (*big.Rat, error) {
+	value, ok := s[currency]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", errExchangeRateUnavailable, currency)
+	}
+	rate, ok := new(big.Rat).SetString(value)
+	if !ok || rate.Sign() <= 0 {
+		return nil, fmt.Errorf("некорректный курс %s: %q", currency, value)
+	}
+	return rate, nil
+}
+
+// convert пересчитывает сумму amount в минимальных единицах валюты from в
+// минимальные единицы валюты to через базовую валюту. Результат
+// округляется до ближайшего целого, половина — от нуля.
+func (s RateSnapshot) convert(amount int, from, to string) (int, error) {
+	if from == to {
+		return amount, nil
+	}
+	fromRate, err := s.rate(from)
+	if err != nil {
+		return 0, err
+	}
+	toRate, err := s.rate(to)
+	if err != nil {
+		return 0, err
+	}
+	value := new(big.Rat).SetInt64(int64(amount))
+	value.Mul(value, fromRate)
+	value.Quo(value, toRate)
+	value.Mul(value, pow10Rat(currencyExponents[to]-currencyExponents[from]))
+	return roundRat(value), nil
+}
+
+// convertPrices пересчитывает цены prices товаров products из валют
+// товаров в валюту to.
+func (s RateSnapshot) convertPrices(prices map[int64]int, products map[int64]Product, to string) (map[int64]int, error) {
+	result := make(map[int64]int, len(prices))
+	for id, price := range prices {
+		converted, err := s.convert(price, products[id].Currency, to)
+		if err != nil {
+			return nil, err
+		}
+		result[id] = converted
+	}
+	return result, nil
+}
+
+// subset возвращает курсы только указанных валют, чтобы записать их в заказ.
+func (s RateSnapshot) subset(currencies ...string) RateSnapshot {
+	result := make(RateSnapshot, len(currencies))
+	for _, currency := range currencies {
+		if rate, ok := s[currency]; ok {
+			result[currency] = rate
+		}
+	}
+	return result
+}
+
+func pow10Rat(exp int) *big.Rat {
+	if exp < 0 {
+		return new(big.Rat).SetFrac(big.NewInt(1), new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(-exp)), nil))
+	}
+	return new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil))
+}
+
+// roundRat округляет до целого, половину — от нуля.
+func roundRat(r *big.Rat) int {
+	num := new(big.Int).Abs(r.Num())
+	quo, rem := new(big.Int).QuoRem(num, r.Denom(), new(big.Int))
+	if rem.Mul(rem, big.NewInt(2)).Cmp(r.Denom()) >= 0 {
+		quo.Add(quo, big.NewInt(1))
+	}
+	if r.Sign() < 0 {
+		quo.Neg(quo)
+	}
+	return int(quo.Int64())
+}
+
+// formatRate записывает курс десятичной строкой: не больше 10 знаков после
+// запятой, без лишних нулей.
+func formatRate(rate *big.Rat) string {
+	s := rate.FloatString(10)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+func isSupportedCurrency(currency string) bool {
+	_, ok := currencyExponents[currency]
+	return ok
+}
+
+// supportedCurrencies возвращает коды поддерживаемых валют через пробел,
+// как параметр правила oneof.
+func supportedCurrencies() string {
+	currencies := make([]string, 0, len(currencyExponents))
+	for currency := range currencyExponents {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	return strings.Join(currencies, " ")
+}
+
+// requestCurrency возвращает валюту из query-параметра currency; пустая
+// строка — параметр не передан. При неизвестной валюте ответ уже
+// отправлен.
+func requestCurrency(c *gin.Context) (string, bool) {
+	currency := strings.ToUpper(c.Query("currency"))
+	if currency != "" && !isSupportedCurrency(currency) {
+		respondError(c, CodeInvalidParameter)
+		return "", false
+	}
+	return currency, true
+}
+
+// respondConversionError отвечает на ошибку пересчета валют.
+func respondConversionError(c *gin.Context, err error) {
+	if errors.Is(err, errExchangeRateUnavailable) {
+		requestLog(c).Warn("Нет курса для пересчета валюты", "error", err)
+		respondError(c, CodeExchangeRateUnavailable)
+		return
+	}
+	requestLog(c).Error("Ошибка пересчета валюты", "error", err)
+	respondError(c, CodeInternal)
+}
+
+// loadExchangeRates читает в exchangeRates последние курсы каждой валюты
+// из базы.
+func loadExchangeRates(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, "SELECT currency,rate,source,fetched_at FROM exchange_rates e WHERE id = (SELECT MAX(id) FROM exchange_rates WHERE currency = e.currency)")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var rates []ExchangeRate
+	for rows.Next() {
+		var rate ExchangeRate
+		if err := rows.Scan(&rate.Currency, &rate.Rate, &rate.Source, &rate.FetchedAt); err != nil {
+			return err
+		}
+		rate.FetchedAt = rate.FetchedAt.UTC()
+		rates = append(rates, rate)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	exchangeRates.set(rates)
+	return nil
+}
+
+// saveExchangeRates записывает новые курсы в историю и в exchangeRates и
+// возвращает ID записей истории в порядке rates.
+func saveExchangeRates(ctx context.Context, rates []ExchangeRate) ([]int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	ids := make([]int64, 0, len(rates))
+	for _, rate := range rates {
+		id, err := tx.Insert("INSERT INTO exchange_rates (currency,rate,source,fetched_at) VALUES (?,?,?,?)",
+			rate.Currency, rate.Rate, rate.Source, rate.FetchedAt)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	exchangeRates.set(rates)
+	return ids, nil
+}
+
+// refreshExchangeRates запрашивает курсы у rateProvider и сохраняет курсы
+// поддерживаемых валют. Неизменившийся курс новой записи в истории не
+// получает.
+func refreshExchangeRates(ctx context.Context) error {
+	fetched, err := rateProvider.Rates(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	current := exchangeRates.snapshot()
+	var rates []ExchangeRate
+	for currency, rate := range fetched {
+		if currency == baseCurrency || !isSupportedCurrency(currency) || rate.Sign() <= 0 {
+			continue
+		}
+		value := formatRate(rate)
+		if current[currency] == value {
+			continue
+		}
+		rates = append(rates, ExchangeRate{Currency: currency, Rate: value, Source: rateProvider.Name(), FetchedAt: now})
+	}
+	if len(rates) == 0 {
+		return nil
+	}
+	_, err = saveExchangeRates(ctx, rates)
+	return err
+}
+
+// runRateUpdater сразу и затем раз в interval обновляет курсы валют, пока
+// не будет отменен ctx. Если источник недоступен, остаются прежние курсы.
+func runRateUpdater(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := refreshExchangeRates(ctx); err != nil {
+			slog.Error("Ошибка обновления курсов валют", "provider", rateProvider.Name(), "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type ExchangeRateRequest struct {
+	Rate string `json:"rate" binding:"required"`
+}
+
+// getExchangeRates возвращает последние курсы валют к базовой.
+func getExchangeRates(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"base": baseCurrency, "rates": exchangeRates.list()})
+}
+
+// setExchangeRate задает курс валюты вручную, например когда источник
+// курсов недоступен. Курс действует до следующего изменения курса в
+// источнике; без источника (manual) — пока не задан новый.
+func (h *Handlers) setExchangeRate(c *gin.Context) {
+	currency := strings.ToUpper(c.Param("currency"))
+	if !isSupportedCurrency(currency) || currency == baseCurrency {
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+	var request ExchangeRateRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+	rate, ok := new(big.Rat).SetString(request.Rate)
+	if !ok || rate.Sign() <= 0 {
+		respondFieldErrors(c, FieldError{Field: "rate", Code: "gt", Param: "0"})
+		return
+	}
+
+	exchangeRate := ExchangeRate{Currency: currency, Rate: formatRate(rate), Source: "manual", FetchedAt: time.Now().UTC()}
+	ids, err := saveExchangeRates(c.Request.Context(), []ExchangeRate{exchangeRate})
+	if err != nil {
+		requestLog(c).Error("Ошибка сохранения курса валюты", "currency", currency, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	// Каждый курс — новая запись истории, поэтому в журнале это создание.
+	h.audit(c, AuditActionCreate, AuditEntityExchangeRate, ids[0], nil, exchangeRate)
+	c.JSON(http.StatusOK, gin.H{"message": "Курс валюты обновлен", "rate": exchangeRate})
+}
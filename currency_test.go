@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateSnapshotConvert(t *testing.T) {
+	rates := RateSnapshot{"RUB": "1", "USD": "90", "EUR": "100", "KZT": "0.2", "CNY": "12.5"}
+	tests := []struct {
+		amount   int
+		from, to string
+		want     int
+	}{
+		{1000, "USD", "RUB", 90000},
+		{90000, "RUB", "USD", 1000},
+		{1000, "USD", "KZT", 450000},
+		{1000, "USD", "EUR", 900},
+		{1990, "RUB", "EUR", 20},
+		// 1 копейка — 0,01 евроцента: округляется к нулю.
+		{1, "RUB", "EUR", 0},
+		// 0,5 цента и больше округляются от нуля, в том числе у отрицательных сумм.
+		{50, "RUB", "EUR", 1},
+		{-50, "RUB", "EUR", -1},
+		{49, "RUB", "EUR", 0},
+		{125, "CNY", "RUB", 1563},
+		{777, "KZT", "KZT", 777},
+	}
+	for _, tt := range tests {
+		got, err := rates.convert(tt.amount, tt.from, tt.to)
+		if err != nil || got != tt.want {
+			t.Errorf("convert(%d, %s, %s) = %d, %v; ожидалось %d", tt.amount, tt.from, tt.to, got, err, tt.want)
+		}
+	}
+
+	if _, err := rates.convert(100, "RUB", "GBP"); !errors.Is(err, errExchangeRateUnavailable) {
+		t.Errorf("пересчет без курса: %v", err)
+	}
+	if got := rates.subset("USD", "RUB", "GBP"); len(got) != 2 || got["USD"] != "90" {
+		t.Errorf("subset = %v", got)
+	}
+}
+
+func TestHTTPRateProvider(t *testing.T) {
+	body := `{"base":"USD","rates":{"RUB":92.5,"EUR":0.925,"kzt":462.5}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	rates, err := NewHTTPRateProvider(server.URL).Rates(context.Background())
+	if err != nil {
+		t.Fatalf("Rates: %v", err)
+	}
+	want := map[string]string{"USD": "92.5", "EUR": "100", "KZT": "0.2", "RUB": "1"}
+	if len(rates) != len(want) {
+		t.Fatalf("курсы %v", rates)
+	}
+	for currency, rate := range want {
+		if got, ok := rates[currency]; !ok || formatRate(got) != rate {
+			t.Errorf("курс %s = %v, ожидался %s", currency, got, rate)
+		}
+	}
+
+	body = `{"base":"USD","rates":{"EUR":0.925}}`
+	if _, err := NewHTTPRateProvider(server.URL).Rates(context.Background()); err == nil {
+		t.Error("ожидалась ошибка без курса рубля")
+	}
+	body = `{"base":"USD","rates":{"RUB":-1}}`
+	if _, err := NewHTTPRateProvider(server.URL).Rates(context.Background()); err == nil {
+		t.Error("ожидалась ошибка при отрицательном курсе")
+	}
+}
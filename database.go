@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Dialect определяет, под какую СУБД переписываются запросы и какой набор
+// миграций применяется.
+type Dialect string
+
+const (
+	DialectSQLite   Dialect = "sqlite"
+	DialectPostgres Dialect = "postgres"
+)
+
+const defaultDatabaseDSN = "shop.db?_foreign_keys=on"
+
+// DB оборачивает *sql.DB. Запросы в коде пишутся с плейсхолдерами "?",
+// а для PostgreSQL они переписываются в $1, $2, ...
+type DB struct {
+	*sql.DB
+	Dialect Dialect
+}
+
+// Tx — транзакция DB с той же перезаписью плейсхолдеров.
+type Tx struct {
+	*sql.Tx
+	dialect Dialect
+	ctx     context.Context
+}
+
+// parseDatabaseDSN определяет диалект по DSN: postgres:// и postgresql://
+// открываются драйвером PostgreSQL, sqlite://путь и просто путь к файлу —
+// драйвером SQLite.
+func parseDatabaseDSN(dsn string) (Dialect, string, error) {
+	switch {
+	case dsn == "":
+		return "", "", fmt.Errorf("не задан DSN базы данных")
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return DialectPostgres, dsn, nil
+	case strings.HasPrefix(dsn, "sqlite://"):
+		return DialectSQLite, strings.TrimPrefix(dsn, "sqlite://"), nil
+	case strings.Contains(dsn, "://"):
+		return "", "", fmt.Errorf("неподдерживаемая схема DSN базы данных %s", dsn)
+	default:
+		return DialectSQLite, dsn, nil
+	}
+}
+
+func openDB(dsn string) (*DB, error) {
+	dialect, driverDSN, err := parseDatabaseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	driver := "sqlite3"
+	if dialect == DialectPostgres {
+		driver = "postgres"
+	}
+	sqlDB, err := sql.Open(driver, driverDSN)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{DB: sqlDB, Dialect: dialect}, nil
+}
+
+// rebind заменяет плейсхолдеры "?" на нумерованные $N для PostgreSQL.
+// Вопросительные знаки внутри строковых литералов не трогаются.
+func rebind(dialect Dialect, query string) string {
+	if dialect != DialectPostgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	n := 0
+	inString := false
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case ch == '\'':
+			inString = !inString
+			b.WriteByte(ch)
+		case ch == '?' && !inString:
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
+
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, end := startQuery(ctx, db.Dialect, "exec", query)
+	result, err := db.DB.ExecContext(ctx, rebind(db.Dialect, query), args...)
+	end(err)
+	return result, err
+}
+
+func (db *DB) Query(query string, args ...interface{}) (*Rows, error) {
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+func (db *DB) QueryContext(ctx context.Context, query string, args ...interface{}) (*Rows, error) {
+	ctx, end := startQuery(ctx, db.Dialect, "query", query)
+	rows, err := db.DB.QueryContext(ctx, rebind(db.Dialect, query), args...)
+	if err != nil {
+		end(err)
+		return nil, err
+	}
+	return &Rows{Rows: rows, end: end}, nil
+}
+
+func (db *DB) QueryRow(query string, args ...interface{}) *Row {
+	return db.QueryRowContext(context.Background(), query, args...)
+}
+
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *Row {
+	ctx, end := startQuery(ctx, db.Dialect, "query_row", query)
+	return &Row{Row: db.DB.QueryRowContext(ctx, rebind(db.Dialect, query), args...), end: end}
+}
+
+func (db *DB) Begin() (*Tx, error) {
+	return db.BeginTx(context.Background(), nil)
+}
+
+// BeginTx начинает транзакцию. Запросы транзакции без явного контекста
+// выполняются в ctx, чтобы попадать в трассировку запроса.
+func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	tx, err := db.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, dialect: db.Dialect, ctx: ctx}, nil
+}
+
+// Insert выполняет INSERT и возвращает ID новой строки: в PostgreSQL через
+// RETURNING id, в SQLite через LastInsertId.
+func (db *DB) Insert(query string, args ...interface{}) (int64, error) {
+	return db.InsertContext(context.Background(), query, args...)
+}
+
+func (db *DB) InsertContext(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	return insertReturningId(ctx, db.DB, db.Dialect, query, args)
+}
+
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.ExecContext(tx.ctx, query, args...)
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, end := startQuery(ctx, tx.dialect, "exec", query)
+	result, err := tx.Tx.ExecContext(ctx, rebind(tx.dialect, query), args...)
+	end(err)
+	return result, err
+}
+
+func (tx *Tx) Query(query string, args ...interface{}) (*Rows, error) {
+	return tx.QueryContext(tx.ctx, query, args...)
+}
+
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...interface{}) (*Rows, error) {
+	ctx, end := startQuery(ctx, tx.dialect, "query", query)
+	rows, err := tx.Tx.QueryContext(ctx, rebind(tx.dialect, query), args...)
+	if err != nil {
+		end(err)
+		return nil, err
+	}
+	return &Rows{Rows: rows, end: end}, nil
+}
+
+func (tx *Tx) QueryRow(query string, args ...interface{}) *Row {
+	return tx.QueryRowContext(tx.ctx, query, args...)
+}
+
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *Row {
+	ctx, end := startQuery(ctx, tx.dialect, "query_row", query)
+	return &Row{Row: tx.Tx.QueryRowContext(ctx, rebind(tx.dialect, query), args...), end: end}
+}
+
+func (tx *Tx) Insert(query string, args ...interface{}) (int64, error) {
+	return tx.InsertContext(tx.ctx, query, args...)
+}
+
+func (tx *Tx) InsertContext(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	return insertReturningId(ctx, tx.Tx, tx.dialect, query, args)
+}
+
+// Rows оборачивает *sql.Rows: спан и метрика запроса завершаются в Close,
+// поэтому в длительность входит и чтение строк, а не только отправка запроса.
+type Rows struct {
+	*sql.Rows
+	end func(error)
+}
+
+func (r *Rows) Close() error {
+	iterErr := r.Rows.Err()
+	err := r.Rows.Close()
+	if r.end != nil {
+		if iterErr == nil {
+			iterErr = err
+		}
+		r.end(iterErr)
+		r.end = nil
+	}
+	return err
+}
+
+// Row оборачивает *sql.Row: спан и метрика запроса завершаются в Scan,
+// где на самом деле читается строка и становится известна ошибка.
+type Row struct {
+	*sql.Row
+	end func(error)
+}
+
+func (r *Row) Scan(dest ...interface{}) error {
+	err := r.Row.Scan(dest...)
+	if r.end != nil {
+		r.end(err)
+		r.end = nil
+	}
+	return err
+}
+
+type sqlExecQueryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func insertReturningId(ctx context.Context, q sqlExecQueryer, dialect Dialect, query string, args []interface{}) (id int64, err error) {
+	ctx, end := startQuery(ctx, dialect, "insert", query)
+	defer func() { end(err) }()
+	if dialect == DialectPostgres {
+		err = q.QueryRowContext(ctx, rebind(dialect, query)+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+	result, err := q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
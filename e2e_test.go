@@ -0,0 +1,2111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testWebhookSecret = "whsec_test"
+
+var testImage = []byte("\x89PNG\r\n\x1a\n")
+
+// testServer — роутер с настоящими обработчиками поверх тестовой базы из
+// forEachDialect, временной директории загрузок и фейковых провайдера
+// платежей и службы доставки.
+type testServer struct {
+	t        *testing.T
+	router   *gin.Engine
+	handlers *Handlers
+	provider *FakePaymentProvider
+	tracker  *FakeCarrierTracker
+}
+
+type formFile struct {
+	field   string
+	name    string
+	content []byte
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	s := &testServer{
+		t:        t,
+		handlers: NewHandlers(NewSQLProductRepository(db), NewSQLUserRepository(db), NewSQLAuditRepository(db), NewSQLPriceHistoryRepository(db)),
+		provider: NewFakePaymentProvider(testWebhookSecret),
+		tracker:  NewFakeCarrierTracker(),
+	}
+	s.router = newRouter(s.handlers)
+	previousUploads, previousProvider, previousTracker := uploadsConfig, paymentProvider, carrierTracker
+	uploadsConfig.Dir = t.TempDir()
+	paymentProvider, carrierTracker = s.provider, s.tracker
+	t.Cleanup(func() {
+		uploadsConfig, paymentProvider, carrierTracker = previousUploads, previousProvider, previousTracker
+	})
+	return s
+}
+
+func (s *testServer) do(method, path, contentType string, body []byte, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+func (s *testServer) sendJSON(method, path, body string) *httptest.ResponseRecorder {
+	contentType := ""
+	if body != "" {
+		contentType = "application/json"
+	}
+	return s.do(method, path, contentType, []byte(body), nil)
+}
+
+func (s *testServer) form(method, path string, fields map[string]string, files ...formFile) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for name, value := range fields {
+		mw.WriteField(name, value)
+	}
+	for _, f := range files {
+		part, _ := mw.CreateFormFile(f.field, f.name)
+		part.Write(f.content)
+	}
+	mw.Close()
+	return s.do(method, path, mw.FormDataContentType(), buf.Bytes(), nil)
+}
+
+func (s *testServer) webhook(eventId, eventType, intentId string, amount int) *httptest.ResponseRecorder {
+	payload, header := s.provider.Webhook(eventId, eventType, intentId, amount)
+	return s.do(http.MethodPost, "/webhooks/payments", "application/json", payload, header)
+}
+
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("статус %d, ожидался %d: %s", w.Code, status, w.Body)
+	}
+}
+
+// expectError проверяет, что ответ — ошибка с кодом code и статусом из
+// errorDefinitions.
+func expectError(t *testing.T, w *httptest.ResponseRecorder, code ErrorCode) {
+	t.Helper()
+	var body struct {
+		Error ErrorBody `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != errorDefinitions[code].status || body.Error.Code != code {
+		t.Fatalf("ответ %d %s, ожидалась ошибка %d %s", w.Code, w.Body, errorDefinitions[code].status, code)
+	}
+}
+
+func decodeResponse[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatalf("тело ответа: %v %s", err, w.Body)
+	}
+	return v
+}
+
+func uploadedFiles(t *testing.T) []string {
+	t.Helper()
+	entries, err := os.ReadDir(uploadsConfig.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func imageExists(imageUrl string) bool {
+	_, err := os.Stat(filepath.Join(uploadsConfig.Dir, strings.TrimPrefix(imageUrl, uploadsURLPrefix)))
+	return err == nil
+}
+
+func (s *testServer) createProduct(name string, price, weight int) Product {
+	s.t.Helper()
+	w := s.form(http.MethodPost, "/product", map[string]string{"name": name, "price": strconv.Itoa(price), "weight": strconv.Itoa(weight)},
+		formFile{"image", "photo.png", testImage})
+	expectStatus(s.t, w, http.StatusCreated)
+	return decodeResponse[struct {
+		Product Product `json:"product"`
+	}](s.t, w).Product
+}
+
+func (s *testServer) createUser(user User) User {
+	s.t.Helper()
+	body, _ := json.Marshal(user)
+	w := s.sendJSON(http.MethodPost, "/user", string(body))
+	expectStatus(s.t, w, http.StatusCreated)
+	return decodeResponse[struct {
+		User User `json:"user"`
+	}](s.t, w).User
+}
+
+func (s *testServer) addPaymentMethod(userId int64, body string) PaymentMethod {
+	s.t.Helper()
+	w := s.sendJSON(http.MethodPost, fmt.Sprintf("/user/%d/payment-method", userId), body)
+	expectStatus(s.t, w, http.StatusCreated)
+	return decodeResponse[struct {
+		PaymentMethod PaymentMethod `json:"payment_method"`
+	}](s.t, w).PaymentMethod
+}
+
+// addDeliveryZone заводит склад в центре Москвы с зоной доставки радиусом
+// 50 км и курьерским тарифом.
+func (s *testServer) addDeliveryZone() ShippingRate {
+	s.t.Helper()
+	w := s.sendJSON(http.MethodPost, "/warehouse", `{"name":"Москва","latitude":55.75,"longitude":37.62}`)
+	expectStatus(s.t, w, http.StatusCreated)
+	warehouse := decodeResponse[struct {
+		Warehouse Warehouse `json:"warehouse"`
+	}](s.t, w).Warehouse
+
+	w = s.sendJSON(http.MethodPost, "/shipping/zone", fmt.Sprintf(`{"name":"Москва","warehouse_id":%d,"radius_km":50}`, warehouse.Id))
+	expectStatus(s.t, w, http.StatusCreated)
+	zone := decodeResponse[struct {
+		Zone ShippingZone `json:"zone"`
+	}](s.t, w).Zone
+
+	w = s.sendJSON(http.MethodPost, "/shipping/rate", fmt.Sprintf(`{"zone_id":%d,"name":"Курьер","base_price":300,"price_per_km":10,"delivery_days":2}`, zone.Id))
+	expectStatus(s.t, w, http.StatusCreated)
+	return decodeResponse[struct {
+		Rate ShippingRate `json:"rate"`
+	}](s.t, w).Rate
+}
+
+func (s *testServer) checkout(userId int64) Order {
+	s.t.Helper()
+	w := s.sendJSON(http.MethodPost, fmt.Sprintf("/user/%d/checkout", userId), "")
+	expectStatus(s.t, w, http.StatusCreated)
+	return decodeResponse[struct {
+		Order Order `json:"order"`
+	}](s.t, w).Order
+}
+
+// placeOrder оформляет заказ двух единиц product пользователем из Москвы
+// со способом оплаты paymentMethod.
+func (s *testServer) placeOrder(product Product, paymentMethod string) Order {
+	s.t.Helper()
+	user := s.createUser(User{Name: "Покупатель", Latitude: 55.76, Longitude: 37.64, Cart: []int64{product.Id, product.Id}})
+	s.addPaymentMethod(user.Id, paymentMethod)
+	return s.checkout(user.Id)
+}
+
+func (s *testServer) getOrder(id int64) Order {
+	s.t.Helper()
+	w := s.sendJSON(http.MethodGet, fmt.Sprintf("/order/%d", id), "")
+	expectStatus(s.t, w, http.StatusOK)
+	return decodeResponse[Order](s.t, w)
+}
+
+// pollUntilDelivered опрашивает фейковую службу доставки, пока все
+// отправления не будут вручены.
+func (s *testServer) pollUntilDelivered() {
+	s.t.Helper()
+	for range fakeTrackingSteps {
+		if err := pollShipments(context.Background(), s.tracker); err != nil {
+			s.t.Fatalf("pollShipments: %v", err)
+		}
+	}
+}
+
+func (s *testServer) createReturn(orderId int64, items string, photos ...formFile) Return {
+	s.t.Helper()
+	w := s.form(http.MethodPost, fmt.Sprintf("/order/%d/return", orderId), map[string]string{"reason": "Не подошел", "items": items}, photos...)
+	expectStatus(s.t, w, http.StatusCreated)
+	return decodeResponse[struct {
+		Return Return `json:"return"`
+	}](s.t, w).Return
+}
+
+func returnAction(t *testing.T, w *httptest.ResponseRecorder, status string) Return {
+	t.Helper()
+	expectStatus(t, w, http.StatusOK)
+	ret := decodeResponse[struct {
+		Return Return `json:"return"`
+	}](t, w).Return
+	if ret.Status != status {
+		t.Fatalf("статус возврата %s, ожидался %s", ret.Status, status)
+	}
+	return ret
+}
+
+func TestServiceRoutes(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		s := newTestServer(t)
+		tests := []struct {
+			path        string
+			contentType string
+			contains    string
+		}{
+			{"/healthz", "application/json", `"status":"ok"`},
+			{"/readyz", "application/json", `"uploads":"ok"`},
+			{"/openapi.json", "application/json", `"openapi"`},
+			{"/docs", "text/html", "swagger-ui"},
+			{"/metrics", "text/plain", "shop_http_requests_total"},
+		}
+		for _, tt := range tests {
+			w := s.sendJSON(http.MethodGet, tt.path, "")
+			expectStatus(t, w, http.StatusOK)
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.contentType) {
+				t.Errorf("%s: Content-Type %s, ожидался %s", tt.path, ct, tt.contentType)
+			}
+			if !strings.Contains(w.Body.String(), tt.contains) {
+				t.Errorf("%s: в ответе нет %s", tt.path, tt.contains)
+			}
+		}
+		expectError(t, s.sendJSON(http.MethodGet, "/nope", ""), CodeRouteNotFound)
+	})
+}
+
+func TestProductRoutes(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		s := newTestServer(t)
+		product := s.createProduct("Чайник", 1990, 800)
+		if product.Name != "Чайник" || product.Price != 1990 || product.Weight != 800 || !imageExists(product.Image) || !strings.HasSuffix(product.Image, ".png") {
+			t.Fatalf("созданный товар %+v", product)
+		}
+		productPath := fmt.Sprintf("/product/%d", product.Id)
+
+		t.Run("invalid create", func(t *testing.T) {
+			image := formFile{"image", "photo.png", testImage}
+			tests := []struct {
+				name   string
+				fields map[string]string
+				files  []formFile
+				code   ErrorCode
+			}{
+				{"без имени", map[string]string{"price": "100"}, []formFile{image}, CodeValidationFailed},
+				{"цена не число", map[string]string{"name": "Чашка", "price": "дорого"}, []formFile{image}, CodeValidationFailed},
+				{"нулевая цена", map[string]string{"name": "Чашка", "price": "0"}, []formFile{image}, CodeValidationFailed},
+				{"отрицательный вес", map[string]string{"name": "Чашка", "price": "100", "weight": "-1"}, []formFile{image}, CodeValidationFailed},
+				{"без изображения", map[string]string{"name": "Чашка", "price": "100"}, nil, CodeValidationFailed},
+				{"не изображение", map[string]string{"name": "Чашка", "price": "100"}, []formFile{{"image", "photo.png", []byte("<html>не картинка</html>")}}, CodeValidationFailed},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					expectError(t, s.form(http.MethodPost, "/product", tt.fields, tt.files...), tt.code)
+				})
+			}
+
+			uploadsConfig.MaxFileSize = 4
+			w := s.form(http.MethodPost, "/product", map[string]string{"name": "Чашка", "price": "100"}, image)
+			uploadsConfig.MaxFileSize = defaultConfig().Uploads.MaxFileSize
+			expectError(t, w, CodeImageTooLarge)
+
+			if files := uploadedFiles(t); len(files) != 1 {
+				t.Fatalf("после ошибок в директории загрузок %v", files)
+			}
+		})
+
+		t.Run("read", func(t *testing.T) {
+			if products := decodeResponse[[]Product](t, s.sendJSON(http.MethodGet, "/products", "")); len(products) != 1 || products[0] != product {
+				t.Fatalf("список товаров %+v", products)
+			}
+			if got := decodeResponse[Product](t, s.sendJSON(http.MethodGet, productPath, "")); got != product {
+				t.Fatalf("товар %+v, ожидался %+v", got, product)
+			}
+			expectError(t, s.sendJSON(http.MethodGet, "/product/abc", ""), CodeInvalidParameter)
+			expectError(t, s.sendJSON(http.MethodGet, "/product/999", ""), CodeProductNotFound)
+		})
+
+		t.Run("update fields", func(t *testing.T) {
+			expectStatus(t, s.form(http.MethodPatch, productPath, map[string]string{"name": "Электрочайник", "price": "2490"}), http.StatusOK)
+			got := decodeResponse[Product](t, s.sendJSON(http.MethodGet, productPath, ""))
+			if got.Name != "Электрочайник" || got.Price != 2490 || got.Weight != 800 || got.Image != product.Image {
+				t.Fatalf("после обновления %+v", got)
+			}
+			product = got
+		})
+
+		t.Run("update image", func(t *testing.T) {
+			expectStatus(t, s.form(http.MethodPatch, productPath, nil, formFile{"image", "new.png", testImage}), http.StatusOK)
+			got := decodeResponse[Product](t, s.sendJSON(http.MethodGet, productPath, ""))
+			if got.Image == product.Image || !strings.HasSuffix(got.Image, "-new.png") {
+				t.Fatalf("изображение не обновлено: %s", got.Image)
+			}
+			if imageExists(product.Image) || !imageExists(got.Image) {
+				t.Fatalf("на диске %v", uploadedFiles(t))
+			}
+			product = got
+		})
+
+		t.Run("invalid update", func(t *testing.T) {
+			tests := []struct {
+				name   string
+				path   string
+				fields map[string]string
+				code   ErrorCode
+			}{
+				{"без изменений", productPath, map[string]string{"name": product.Name}, CodeNoUpdateData},
+				{"нулевая цена", productPath, map[string]string{"price": "0"}, CodeValidationFailed},
+				{"вес не число", productPath, map[string]string{"weight": "много"}, CodeValidationFailed},
+				{"некорректный ID", "/product/abc", map[string]string{"name": "Чайник"}, CodeInvalidParameter},
+				{"несуществующий товар", "/product/999", map[string]string{"name": "Чайник"}, CodeProductNotFound},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					expectError(t, s.form(http.MethodPatch, tt.path, tt.fields), tt.code)
+				})
+			}
+			if files := uploadedFiles(t); len(files) != 1 {
+				t.Fatalf("после ошибок в директории загрузок %v", files)
+			}
+		})
+
+		t.Run("json", func(t *testing.T) {
+			productResult := func(w *httptest.ResponseRecorder, status int) Product {
+				t.Helper()
+				expectStatus(t, w, status)
+				return decodeResponse[struct {
+					Product Product `json:"product"`
+				}](t, w).Product
+			}
+			encoded := base64.StdEncoding.EncodeToString(testImage)
+
+			linked := productResult(s.sendJSON(http.MethodPost, "/product", `{"name":"Кружка","price":300,"image_url":"https://cdn.example.com/mug.png"}`), http.StatusCreated)
+			if linked.Id == 0 || linked.Image != "https://cdn.example.com/mug.png" || linked.Weight != 0 {
+				t.Fatalf("товар со ссылкой %+v", linked)
+			}
+			uploaded := productResult(s.sendJSON(http.MethodPost, "/product", `{"name":"Блюдце","price":150,"weight":120,"image_data":"`+encoded+`"}`), http.StatusCreated)
+			if !strings.HasSuffix(uploaded.Image, ".png") || !imageExists(uploaded.Image) {
+				t.Fatalf("товар с изображением в base64 %+v", uploaded)
+			}
+			if got := decodeResponse[Product](t, s.sendJSON(http.MethodGet, fmt.Sprintf("/product/%d", uploaded.Id), "")); got != uploaded {
+				t.Fatalf("товар %+v, ожидался %+v", got, uploaded)
+			}
+
+			linkedPath := fmt.Sprintf("/product/%d", linked.Id)
+			got := productResult(s.sendJSON(http.MethodPatch, linkedPath, `{"price":350,"image_data":"data:image/png;base64,`+encoded+`"}`), http.StatusOK)
+			if got.Price != 350 || got.Name != "Кружка" || !imageExists(got.Image) {
+				t.Fatalf("после обновления JSON %+v", got)
+			}
+			got = productResult(s.sendJSON(http.MethodPatch, linkedPath, `{"image_url":"https://cdn.example.com/mug-2.png"}`), http.StatusOK)
+			if got.Image != "https://cdn.example.com/mug-2.png" {
+				t.Fatalf("ссылка на изображение не обновлена: %+v", got)
+			}
+			if files := uploadedFiles(t); len(files) != 2 {
+				t.Fatalf("замененное изображение осталось на диске: %v", files)
+			}
+			got = productResult(s.do(http.MethodPatch, linkedPath, mimeMergePatch, []byte(`{"weight":null,"image":"https://cdn.example.com/mug-3.png"}`), nil), http.StatusOK)
+			if got.Image != "https://cdn.example.com/mug-3.png" || got.Weight != 0 || got.Price != 350 {
+				t.Fatalf("после JSON Merge Patch %+v", got)
+			}
+			got = productResult(s.do(http.MethodPatch, linkedPath, mimeJSONPatch, []byte(`[{"op":"copy","from":"/price","path":"/weight"}]`), nil), http.StatusOK)
+			if got.Weight != 350 {
+				t.Fatalf("после JSON Patch %+v", got)
+			}
+
+			tests := []struct {
+				name   string
+				method string
+				path   string
+				body   string
+				field  string
+				code   ErrorCode
+			}{
+				{"без изображения", http.MethodPost, "/product", `{"name":"Кружка","price":300}`, "image_url", CodeValidationFailed},
+				{"ссылка и данные вместе", http.MethodPost, "/product", `{"name":"Кружка","price":300,"image_url":"https://cdn.example.com/a.png","image_data":"` + encoded + `"}`, "image_data", CodeValidationFailed},
+				{"ссылка не http", http.MethodPost, "/product", `{"name":"Кружка","price":300,"image_url":"ftp://cdn.example.com/a.png"}`, "image_url", CodeValidationFailed},
+				{"не base64", http.MethodPost, "/product", `{"name":"Кружка","price":300,"image_data":"не base64"}`, "image_data", CodeValidationFailed},
+				{"не изображение", http.MethodPost, "/product", `{"name":"Кружка","price":300,"image_data":"` + base64.StdEncoding.EncodeToString([]byte("hello")) + `"}`, "image_data", CodeValidationFailed},
+				{"нулевая цена", http.MethodPost, "/product", `{"name":"Кружка","price":0,"image_url":"https://cdn.example.com/a.png"}`, "price", CodeValidationFailed},
+				{"цена строкой", http.MethodPost, "/product", `{"name":"Кружка","price":"300","image_url":"https://cdn.example.com/a.png"}`, "price", CodeValidationFailed},
+				{"изменение с нулевой ценой", http.MethodPatch, linkedPath, `{"price":0}`, "price", CodeValidationFailed},
+				{"изменение с плохой ссылкой", http.MethodPatch, linkedPath, `{"image_url":"cdn.example.com/a.png"}`, "image_url", CodeValidationFailed},
+				{"изменение без изменений", http.MethodPatch, linkedPath, `{"name":"Кружка"}`, "", CodeNoUpdateData},
+				{"удаление имени", http.MethodPatch, linkedPath, `{"name":null}`, "name", CodeValidationFailed},
+				{"удаление изображения", http.MethodPatch, linkedPath, `{"image":null}`, "image", CodeValidationFailed},
+				{"чужой загруженный файл", http.MethodPatch, linkedPath, `{"image":"` + uploaded.Image + `"}`, "image", CodeValidationFailed},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					w := s.sendJSON(tt.method, tt.path, tt.body)
+					expectError(t, w, tt.code)
+					if tt.field != "" && !strings.Contains(w.Body.String(), `"field":"`+tt.field+`"`) {
+						t.Fatalf("нет ошибки поля %s: %s", tt.field, w.Body)
+					}
+				})
+			}
+
+			uploadsConfig.MaxFileSize = 4
+			w := s.sendJSON(http.MethodPost, "/product", `{"name":"Кружка","price":300,"image_data":"`+encoded+`"}`)
+			uploadsConfig.MaxFileSize = defaultConfig().Uploads.MaxFileSize
+			expectError(t, w, CodeImageTooLarge)
+			if files := uploadedFiles(t); len(files) != 2 {
+				t.Fatalf("после ошибок в директории загрузок %v", files)
+			}
+
+			for _, p := range []Product{linked, uploaded} {
+				expectStatus(t, s.sendJSON(http.MethodDelete, fmt.Sprintf("/product/%d", p.Id), ""), http.StatusOK)
+			}
+		})
+
+		t.Run("delete", func(t *testing.T) {
+			expectStatus(t, s.sendJSON(http.MethodDelete, productPath, ""), http.StatusOK)
+			if !imageExists(product.Image) {
+				t.Fatalf("изображение удалено вместе с товаром до очистки корзины")
+			}
+			expectError(t, s.sendJSON(http.MethodGet, productPath, ""), CodeProductNotFound)
+			expectError(t, s.sendJSON(http.MethodDelete, productPath, ""), CodeProductNotFound)
+			expectError(t, s.sendJSON(http.MethodDelete, "/product/abc", ""), CodeInvalidParameter)
+		})
+	})
+}
+
+func TestUserRoutes(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		s := newTestServer(t)
+		user := s.createUser(User{Name: "Мария", Latitude: 59.93, Longitude: 30.31})
+		if user.Id == 0 {
+			t.Fatalf("пользователь создан без ID: %+v", user)
+		}
+		userPath := fmt.Sprintf("/user/%d", user.Id)
+		getUser := func() User {
+			t.Helper()
+			return decodeResponse[User](t, s.sendJSON(http.MethodGet, userPath, ""))
+		}
+
+		t.Run("invalid create", func(t *testing.T) {
+			tests := []struct {
+				name string
+				body string
+				code ErrorCode
+			}{
+				{"без координат", `{"name":"Иван"}`, CodeValidationFailed},
+				{"широта вне диапазона", `{"name":"Иван","latitude":91,"longitude":30}`, CodeValidationFailed},
+				{"пустое имя", `{"name":"","latitude":55,"longitude":37}`, CodeValidationFailed},
+				{"корзина не массив", `{"name":"Иван","latitude":55,"longitude":37,"cart":"1"}`, CodeValidationFailed},
+				{"некорректный JSON", `{"name":`, CodeInvalidBody},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					expectError(t, s.sendJSON(http.MethodPost, "/user", tt.body), tt.code)
+				})
+			}
+		})
+
+		t.Run("read", func(t *testing.T) {
+			if users := decodeResponse[[]User](t, s.sendJSON(http.MethodGet, "/users", "")); len(users) != 1 || users[0].Id != user.Id {
+				t.Fatalf("список пользователей %+v", users)
+			}
+			if got := getUser(); got.Name != "Мария" || got.Latitude != 59.93 || got.Longitude != 30.31 {
+				t.Fatalf("пользователь %+v", got)
+			}
+			expectError(t, s.sendJSON(http.MethodGet, "/user/abc", ""), CodeInvalidParameter)
+			expectError(t, s.sendJSON(http.MethodGet, "/user/999", ""), CodeUserNotFound)
+		})
+
+		t.Run("update", func(t *testing.T) {
+			expectStatus(t, s.sendJSON(http.MethodPatch, userPath, `{"longitude":30.36}`), http.StatusOK)
+			if got := getUser(); got.Name != "Мария" || got.Longitude != 30.36 || got.Latitude != 59.93 {
+				t.Fatalf("долгота не обновлена: %+v", got)
+			}
+			w := s.sendJSON(http.MethodPatch, userPath, `{"name":"Мария Иванова","latitude":59.94,"cart":[3,1,3]}`)
+			expectStatus(t, w, http.StatusOK)
+			result := decodeResponse[struct{ User User }](t, w)
+			if got := result.User; got.Name != "Мария Иванова" || got.Latitude != 59.94 || got.Longitude != 30.36 || formatCart(got.Cart) != "3,1,3" {
+				t.Fatalf("после обновления %+v", got)
+			}
+		})
+
+		t.Run("merge patch", func(t *testing.T) {
+			patch := func(body string) User {
+				t.Helper()
+				w := s.do(http.MethodPatch, userPath, mimeMergePatch, []byte(body), nil)
+				expectStatus(t, w, http.StatusOK)
+				return decodeResponse[struct{ User User }](t, w).User
+			}
+			if got := patch(`{"latitude":0,"longitude":0}`); got.Latitude != 0 || got.Longitude != 0 || got.Name != "Мария Иванова" {
+				t.Fatalf("нулевые координаты не сохранены: %+v", got)
+			}
+			if got := getUser(); got.Latitude != 0 || got.Longitude != 0 {
+				t.Fatalf("нулевые координаты не сохранены в базе: %+v", got)
+			}
+			if got := patch(`{"cart":[]}`); len(got.Cart) != 0 {
+				t.Fatalf("корзина не очищена: %+v", got)
+			}
+			patch(`{"cart":[2]}`)
+			if got := patch(`{"cart":null,"latitude":59.94,"longitude":30.36}`); len(got.Cart) != 0 || got.Latitude != 59.94 {
+				t.Fatalf("корзина не очищена через null: %+v", got)
+			}
+		})
+
+		t.Run("json patch", func(t *testing.T) {
+			patch := func(body string) *httptest.ResponseRecorder {
+				return s.do(http.MethodPatch, userPath, mimeJSONPatch, []byte(body), nil)
+			}
+			expectStatus(t, patch(`[{"op":"add","path":"/cart/-","value":5},{"op":"add","path":"/cart/-","value":7}]`), http.StatusOK)
+			expectStatus(t, patch(`[{"op":"test","path":"/cart/0","value":5},{"op":"remove","path":"/cart/0"}]`), http.StatusOK)
+			if got := getUser(); formatCart(got.Cart) != "7" {
+				t.Fatalf("корзина после JSON Patch %+v", got.Cart)
+			}
+			expectError(t, patch(`[{"op":"test","path":"/name","value":"Иван"},{"op":"replace","path":"/name","value":"Иван"}]`), CodePatchFailed)
+			expectError(t, patch(`[{"op":"remove","path":"/cart/5"}]`), CodePatchFailed)
+			expectError(t, patch(`[{"op":"remove","path":"/name"}]`), CodeValidationFailed)
+			expectError(t, patch(`{"op":"add"}`), CodeValidationFailed)
+			if got := getUser(); got.Name != "Мария Иванова" || formatCart(got.Cart) != "7" {
+				t.Fatalf("неудачный патч изменил пользователя: %+v", got)
+			}
+		})
+
+		t.Run("invalid update", func(t *testing.T) {
+			tests := []struct {
+				name string
+				path string
+				body string
+				code ErrorCode
+			}{
+				{"без изменений", userPath, `{"name":"Мария Иванова","latitude":59.94}`, CodeNoUpdateData},
+				{"пустой патч", userPath, `{}`, CodeNoUpdateData},
+				{"удаление имени", userPath, `{"name":null}`, CodeValidationFailed},
+				{"удаление координаты", userPath, `{"latitude":null}`, CodeValidationFailed},
+				{"широта вне диапазона", userPath, `{"latitude":91}`, CodeValidationFailed},
+				{"не объект", userPath, `[1]`, CodeValidationFailed},
+				{"некорректный ID", "/user/abc", `{"name":"Мария"}`, CodeInvalidParameter},
+				{"несуществующий пользователь", "/user/999", `{"name":"Мария"}`, CodeUserNotFound},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					expectError(t, s.sendJSON(http.MethodPatch, tt.path, tt.body), tt.code)
+				})
+			}
+		})
+
+		t.Run("delete", func(t *testing.T) {
+			expectStatus(t, s.sendJSON(http.MethodDelete, userPath, ""), http.StatusOK)
+			expectError(t, s.sendJSON(http.MethodGet, userPath, ""), CodeUserNotFound)
+			expectError(t, s.sendJSON(http.MethodDelete, userPath, ""), CodeUserNotFound)
+			expectError(t, s.sendJSON(http.MethodDelete, "/user/abc", ""), CodeInvalidParameter)
+		})
+	})
+}
+
+func TestTrash(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		s := newTestServer(t)
+		s.addDeliveryZone()
+		type trash struct {
+			Products      []Product `json:"products"`
+			Users         []User    `json:"users"`
+			RetentionDays int       `json:"retention_days"`
+		}
+		getTrash := func() trash {
+			t.Helper()
+			return decodeResponse[trash](t, s.sendJSON(http.MethodGet, "/trash", ""))
+		}
+		purge := func(deletedBefore time.Time) {
+			t.Helper()
+			if err := purgeTrash(context.Background(), s.handlers, deletedBefore); err != nil {
+				t.Fatalf("purgeTrash: %v", err)
+			}
+		}
+
+		product := s.createProduct("Чайник", 1990, 800)
+		kept := s.createProduct("Кружка", 300, 250)
+		productPath := fmt.Sprintf("/product/%d", product.Id)
+		user := s.createUser(User{Name: "Иван", Latitude: 55.76, Longitude: 37.64, Cart: []int64{product.Id}})
+		userPath := fmt.Sprintf("/user/%d", user.Id)
+		if got := getTrash(); len(got.Products) != 0 || len(got.Users) != 0 || got.RetentionDays != trashRetentionDays {
+			t.Fatalf("корзина удаленных до удаления %+v", got)
+		}
+
+		t.Run("delete and restore", func(t *testing.T) {
+			expectStatus(t, s.sendJSON(http.MethodDelete, productPath, ""), http.StatusOK)
+			expectStatus(t, s.sendJSON(http.MethodDelete, userPath, ""), http.StatusOK)
+			if products := decodeResponse[[]Product](t, s.sendJSON(http.MethodGet, "/products", "")); len(products) != 1 || products[0].Id != kept.Id {
+				t.Fatalf("удаленный товар в списке: %+v", products)
+			}
+			if users := decodeResponse[[]User](t, s.sendJSON(http.MethodGet, "/users", "")); len(users) != 0 {
+				t.Fatalf("удаленный пользователь в списке: %+v", users)
+			}
+			expectError(t, s.sendJSON(http.MethodPatch, productPath, `{"price":2000}`), CodeProductNotFound)
+			expectError(t, s.sendJSON(http.MethodPost, userPath+"/checkout", ""), CodeUserNotFound)
+
+			got := getTrash()
+			if len(got.Products) != 1 || got.Products[0].Id != product.Id || got.Products[0].DeletedAt == nil || len(got.Users) != 1 || got.Users[0].Id != user.Id {
+				t.Fatalf("корзина удаленных %+v", got)
+			}
+
+			w := s.sendJSON(http.MethodPost, productPath+"/restore", "")
+			expectStatus(t, w, http.StatusOK)
+			restored := decodeResponse[struct{ Product Product }](t, w).Product
+			if restored.DeletedAt != nil || restored.Name != product.Name || restored.Version != 3 || w.Header().Get("ETag") != `"3"` {
+				t.Fatalf("восстановленный товар %+v, ETag %q", restored, w.Header().Get("ETag"))
+			}
+			expectStatus(t, s.sendJSON(http.MethodGet, productPath, ""), http.StatusOK)
+			expectStatus(t, s.sendJSON(http.MethodPost, userPath+"/restore", ""), http.StatusOK)
+			if got := decodeResponse[User](t, s.sendJSON(http.MethodGet, userPath, "")); formatCart(got.Cart) != strconv.FormatInt(product.Id, 10) {
+				t.Fatalf("корзина восстановленного пользователя %+v", got)
+			}
+
+			expectError(t, s.sendJSON(http.MethodPost, productPath+"/restore", ""), CodeProductNotFound)
+			expectError(t, s.sendJSON(http.MethodPost, userPath+"/restore", ""), CodeUserNotFound)
+			expectError(t, s.sendJSON(http.MethodPost, "/product/999/restore", ""), CodeProductNotFound)
+			expectError(t, s.sendJSON(http.MethodPost, "/product/abc/restore", ""), CodeInvalidParameter)
+		})
+
+		t.Run("cart with deleted product", func(t *testing.T) {
+			expectStatus(t, s.sendJSON(http.MethodDelete, productPath, ""), http.StatusOK)
+			s.addPaymentMethod(user.Id, `{"type":"cash"}`)
+			expectError(t, s.sendJSON(http.MethodPost, userPath+"/checkout", ""), CodeCartEmpty)
+
+			expectStatus(t, s.sendJSON(http.MethodPatch, userPath, fmt.Sprintf(`{"cart":[%d,%d]}`, product.Id, kept.Id)), http.StatusOK)
+			cart := decodeResponse[CartTotals](t, s.sendJSON(http.MethodGet, userPath+"/cart", ""))
+			if len(cart.UnavailableProducts) != 1 || cart.UnavailableProducts[0] != product.Id || len(cart.Items) != 1 || cart.Items[0].ProductId != kept.Id || cart.Subtotal != kept.Price {
+				t.Fatalf("корзина с удаленным товаром %+v", cart)
+			}
+			if order := s.checkout(user.Id); len(order.Items) != 1 || order.Items[0].ProductId != kept.Id {
+				t.Fatalf("заказ из корзины с удаленным товаром %+v", order)
+			}
+			expectStatus(t, s.sendJSON(http.MethodPost, productPath+"/restore", ""), http.StatusOK)
+		})
+
+		t.Run("purge", func(t *testing.T) {
+			customer := s.createUser(User{Name: "Олег", Latitude: 55.76, Longitude: 37.64})
+			order := s.placeOrder(kept, `{"type":"cash"}`)
+			buyerPath := fmt.Sprintf("/user/%d", order.UserId)
+
+			expectStatus(t, s.sendJSON(http.MethodDelete, productPath, ""), http.StatusOK)
+			expectStatus(t, s.sendJSON(http.MethodDelete, fmt.Sprintf("/user/%d", customer.Id), ""), http.StatusOK)
+			expectStatus(t, s.sendJSON(http.MethodDelete, buyerPath, ""), http.StatusOK)
+
+			purge(time.Now().UTC().Add(-time.Hour))
+			if got := getTrash(); len(got.Products) != 1 || len(got.Users) != 2 || !imageExists(product.Image) {
+				t.Fatalf("очищены записи моложе срока хранения: %+v", got)
+			}
+
+			purge(time.Now().UTC().Add(time.Second))
+			got := getTrash()
+			if len(got.Products) != 0 || imageExists(product.Image) {
+				t.Fatalf("товар не удален окончательно: %+v", got)
+			}
+			// Покупатель остается в корзине: на него ссылаются заказы.
+			if len(got.Users) != 1 || fmt.Sprintf("/user/%d", got.Users[0].Id) != buyerPath {
+				t.Fatalf("пользователи в корзине после очистки %+v", got.Users)
+			}
+			expectError(t, s.sendJSON(http.MethodPost, productPath+"/restore", ""), CodeProductNotFound)
+			entries := decodeResponse[[]AuditEntry](t, s.sendJSON(http.MethodGet, fmt.Sprintf("/audit?entity=product&id=%d", product.Id), ""))
+			if len(entries) == 0 || entries[0].Action != AuditActionPurge || entries[0].Actor != systemActor {
+				t.Fatalf("окончательное удаление не записано в журнал: %+v", entries)
+			}
+			if !imageExists(kept.Image) {
+				t.Fatalf("удалено изображение товара не из корзины")
+			}
+			expectStatus(t, s.sendJSON(http.MethodGet, fmt.Sprintf("/order/%d", order.Id), ""), http.StatusOK)
+		})
+	})
+}
+
+func TestAuditLog(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		s := newTestServer(t)
+		admin := http.Header{}
+		admin.Set(actorHeader, "maria@shop.example")
+		admin.Set(requestIdHeader, "req-audit-1")
+		getAudit := func(query string) []AuditEntry {
+			t.Helper()
+			return decodeResponse[[]AuditEntry](t, s.sendJSON(http.MethodGet, "/audit"+query, ""))
+		}
+
+		product := s.createProduct("Чайник", 1990, 800)
+		productPath := fmt.Sprintf("/product/%d", product.Id)
+		expectStatus(t, s.do(http.MethodPatch, productPath, "application/json", []byte(`{"price":2100}`), admin), http.StatusOK)
+		expectStatus(t, s.sendJSON(http.MethodDelete, productPath, ""), http.StatusOK)
+		expectStatus(t, s.sendJSON(http.MethodPost, productPath+"/restore", ""), http.StatusOK)
+		user := s.createUser(User{Name: "Иван", Latitude: 55.76, Longitude: 37.64})
+		expectStatus(t, s.sendJSON(http.MethodPatch, fmt.Sprintf("/user/%d", user.Id), `{"cart":[1]}`), http.StatusOK)
+		expectError(t, s.sendJSON(http.MethodPatch, productPath, `{"price":0}`), CodeValidationFailed)
+
+		entries := getAudit(fmt.Sprintf("?entity=product&id=%d", product.Id))
+		var actions []string
+		for _, e := range entries {
+			actions = append(actions, e.Action)
+		}
+		if strings.Join(actions, ",") != "restore,delete,update,create" {
+			t.Fatalf("действия в журнале товара %v", actions)
+		}
+		update := entries[2]
+		if update.Actor != "maria@shop.example" || update.RequestId != "req-audit-1" || update.IP == "" || update.EntityType != AuditEntityProduct || update.EntityId != product.Id || update.CreatedAt.IsZero() {
+			t.Fatalf("запись об изменении %+v", update)
+		}
+		if len(update.Changes) != 2 || string(update.Changes["price"].Before) != "1990" || string(update.Changes["price"].After) != "2100" || string(update.Changes["version"].After) != "2" {
+			t.Fatalf("изменения цены %+v", update.Changes)
+		}
+		if create := entries[3]; create.Actor != anonymousActor || string(create.Changes["name"].Before) != "null" || string(create.Changes["name"].After) != `"Чайник"` {
+			t.Fatalf("запись о создании %+v", create)
+		}
+		if deleted := entries[1]; string(deleted.Changes["price"].Before) != "2100" || string(deleted.Changes["price"].After) != "null" {
+			t.Fatalf("запись об удалении %+v", deleted)
+		}
+
+		userEntries := getAudit(fmt.Sprintf("?entity=user&id=%d", user.Id))
+		if len(userEntries) != 2 || userEntries[0].Action != AuditActionUpdate || string(userEntries[0].Changes["cart"].Before) != "null" || string(userEntries[0].Changes["cart"].After) != "[1]" {
+			t.Fatalf("журнал пользователя %+v", userEntries)
+		}
+		if all := getAudit(""); len(all) != 6 || all[0].EntityType != AuditEntityUser {
+			t.Fatalf("весь журнал %+v", all)
+		}
+		if limited := getAudit("?entity=product&limit=1"); len(limited) != 1 || limited[0].Action != AuditActionRestore {
+			t.Fatalf("журнал с limit=1 %+v", limited)
+		}
+
+		// Изменения настроек магазина, заказов и возвратов тоже попадают в
+		// журнал; удаление хранит удаленную запись.
+		w := s.sendJSON(http.MethodPost, "/coupon", `{"code":"AUDIT","type":"percent","value":10}`)
+		expectStatus(t, w, http.StatusCreated)
+		coupon := decodeResponse[struct {
+			Coupon Coupon `json:"coupon"`
+		}](t, w).Coupon
+		expectStatus(t, s.do(http.MethodDelete, fmt.Sprintf("/coupon/%d", coupon.Id), "", nil, admin), http.StatusOK)
+		couponEntries := getAudit(fmt.Sprintf("?entity=coupon&id=%d", coupon.Id))
+		if len(couponEntries) != 2 || couponEntries[0].Action != AuditActionDelete || couponEntries[0].Actor != "maria@shop.example" ||
+			string(couponEntries[0].Changes["code"].Before) != `"AUDIT"` || couponEntries[1].Action != AuditActionCreate {
+			t.Fatalf("журнал купона %+v", couponEntries)
+		}
+		expectStatus(t, s.sendJSON(http.MethodPut, "/exchange-rate/USD", `{"rate":"91"}`), http.StatusOK)
+		if rates := getAudit("?entity=exchange_rate"); len(rates) != 1 || string(rates[0].Changes["rate"].After) != `"91"` || string(rates[0].Changes["currency"].After) != `"USD"` {
+			t.Fatalf("журнал курсов %+v", rates)
+		}
+
+		for _, query := range []string{"?entity=payment", "?id=1", "?entity=product&id=abc", "?limit=0"} {
+			expectError(t, s.sendJSON(http.MethodGet, "/audit"+query, ""), CodeInvalidParameter)
+		}
+	})
+}
+
+func TestPriceHistory(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		s := newTestServer(t)
+		setPrice := func(product Product, price int, source string) *httptest.ResponseRecorder {
+			header := http.Header{}
+			header.Set(actorHeader, "pricing-bot")
+			if source != "" {
+				header.Set(priceSourceHeader, source)
+			}
+			return s.do(http.MethodPatch, fmt.Sprintf("/product/%d", product.Id), "application/json", []byte(fmt.Sprintf(`{"price":%d}`, price)), header)
+		}
+		getPrices := func(product Product) []PriceChange {
+			t.Helper()
+			return decodeResponse[[]PriceChange](t, s.sendJSON(http.MethodGet, fmt.Sprintf("/product/%d/prices", product.Id), ""))
+		}
+
+		kettle := s.createProduct("Чайник", 1000, 800)
+		iron := s.createProduct("Утюг", 500, 1200)
+		expectStatus(t, setPrice(kettle, 1200, PriceSourceSupplierSync), http.StatusOK)
+		expectStatus(t, s.sendJSON(http.MethodPatch, fmt.Sprintf("/product/%d", kettle.Id), `{"weight":900}`), http.StatusOK)
+		expectStatus(t, setPrice(kettle, 900, ""), http.StatusOK)
+		expectStatus(t, setPrice(iron, 1000, PriceSourceRule), http.StatusOK)
+		expectError(t, setPrice(iron, 1500, "competitor"), CodeInvalidParameter)
+
+		history := getPrices(kettle)
+		if len(history) != 3 || history[0].Price != 1000 || history[0].PreviousPrice != nil || history[0].Source != PriceSourceManual || history[0].Actor != anonymousActor {
+			t.Fatalf("история цены чайника %+v", history)
+		}
+		if h := history[1]; h.Price != 1200 || h.PreviousPrice == nil || *h.PreviousPrice != 1000 || h.Source != PriceSourceSupplierSync || h.Actor != "pricing-bot" {
+			t.Fatalf("изменение цены поставщиком %+v", h)
+		}
+		if h := history[2]; h.Price != 900 || *h.PreviousPrice != 1200 || h.Source != PriceSourceManual || h.ChangedAt.Before(history[1].ChangedAt) {
+			t.Fatalf("ручное изменение цены %+v", h)
+		}
+		if got := getPrices(iron); len(got) != 2 || got[1].Price != 1000 || got[1].Source != PriceSourceRule {
+			t.Fatalf("история цены утюга %+v", got)
+		}
+		tomorrow := time.Now().UTC().AddDate(0, 0, 1).Format(time.DateOnly)
+		if got := decodeResponse[[]PriceChange](t, s.sendJSON(http.MethodGet, fmt.Sprintf("/product/%d/prices?from=%s", kettle.Id, tomorrow), "")); len(got) != 0 {
+			t.Fatalf("история цены за будущий период %+v", got)
+		}
+
+		type report struct {
+			From     time.Time       `json:"from"`
+			To       time.Time       `json:"to"`
+			Products []PriceMovement `json:"products"`
+		}
+		got := decodeResponse[report](t, s.sendJSON(http.MethodGet, "/reports/price-changes", ""))
+		if len(got.Products) != 2 || got.To.Sub(got.From) != defaultPriceReportPeriod {
+			t.Fatalf("отчет об изменениях цен %+v", got)
+		}
+		if m := got.Products[0]; m.ProductId != iron.Id || m.Name != "Утюг" || m.StartPrice != 500 || m.EndPrice != 1000 || m.Change != 500 || m.ChangePercent != 100 || m.Changes != 1 {
+			t.Fatalf("изменение цены утюга %+v", m)
+		}
+		if m := got.Products[1]; m.ProductId != kettle.Id || m.StartPrice != 1000 || m.EndPrice != 900 || m.Change != -100 || m.ChangePercent != -10 || m.Changes != 2 {
+			t.Fatalf("изменение цены чайника %+v", m)
+		}
+		if got := decodeResponse[report](t, s.sendJSON(http.MethodGet, "/reports/price-changes?limit=1&to="+tomorrow, "")); len(got.Products) != 1 || got.Products[0].ProductId != iron.Id {
+			t.Fatalf("отчет с limit=1 %+v", got)
+		}
+		if got := decodeResponse[report](t, s.sendJSON(http.MethodGet, "/reports/price-changes?to=2020-01-01", "")); len(got.Products) != 0 {
+			t.Fatalf("отчет за прошлый период %+v", got)
+		}
+
+		expectError(t, s.sendJSON(http.MethodGet, "/product/999/prices", ""), CodeProductNotFound)
+		for _, query := range []string{"?from=yesterday", "?from=2026-02-01&to=2026-01-01", "?limit=0", "?limit=101"} {
+			expectError(t, s.sendJSON(http.MethodGet, "/reports/price-changes"+query, ""), CodeInvalidParameter)
+		}
+	})
+}
+
+func TestCartPricePolicy(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		s := newTestServer(t)
+		s.addDeliveryZone()
+		t.Cleanup(func() { cartPricePolicy = CartPriceCurrent })
+
+		setPrice := func(product Product, price int) {
+			t.Helper()
+			expectStatus(t, s.sendJSON(http.MethodPatch, fmt.Sprintf("/product/%d", product.Id), fmt.Sprintf(`{"price":%d}`, price)), http.StatusOK)
+		}
+		// Чайник дорожает, утюг дешевеет после того, как их положили в
+		// корзину; фен добавляется уже по новой цене.
+		placeOrder := func(policy string) Order {
+			t.Helper()
+			cartPricePolicy = CartPriceCurrent
+			kettle := s.createProduct("Чайник", 1000, 800)
+			iron := s.createProduct("Утюг", 2000, 1200)
+			dryer := s.createProduct("Фен", 700, 500)
+			user := s.createUser(User{Name: "Покупатель", Latitude: 55.76, Longitude: 37.64, Cart: []int64{kettle.Id, iron.Id}})
+			s.addPaymentMethod(user.Id, `{"type":"cash"}`)
+			setPrice(kettle, 1500)
+			setPrice(iron, 1800)
+			expectStatus(t, s.sendJSON(http.MethodPatch, fmt.Sprintf("/user/%d", user.Id), fmt.Sprintf(`{"cart":[%d,%d,%d,%d]}`, kettle.Id, iron.Id, kettle.Id, dryer.Id)), http.StatusOK)
+			setPrice(dryer, 800)
+
+			cartPricePolicy = policy
+			quote := decodeResponse[ShippingQuote](t, s.sendJSON(http.MethodPost, "/shipping/quote", fmt.Sprintf(`{"user_id":%d}`, user.Id)))
+			order := s.checkout(user.Id)
+			if quote.Subtotal != order.Subtotal {
+				t.Fatalf("%s: сумма в расчете доставки %d, в заказе %d", policy, quote.Subtotal, order.Subtotal)
+			}
+			return order
+		}
+		itemPrices := func(order Order) []int {
+			var prices []int
+			for _, item := range order.Items {
+				prices = append(prices, item.Price)
+			}
+			return prices
+		}
+
+		cases := []struct {
+			policy   string
+			prices   []int
+			subtotal int
+		}{
+			{CartPriceCurrent, []int{1500, 1800, 800}, 1500*2 + 1800 + 800},
+			{CartPriceAdded, []int{1000, 2000, 700}, 1000*2 + 2000 + 700},
+			{CartPriceLowest, []int{1000, 1800, 700}, 1000*2 + 1800 + 700},
+		}
+		for _, tc := range cases {
+			order := placeOrder(tc.policy)
+			if fmt.Sprint(itemPrices(order)) != fmt.Sprint(tc.prices) || order.Subtotal != tc.subtotal || order.Total != tc.subtotal+order.ShippingCost {
+				t.Fatalf("%s: цены %v, сумма %d, итого %d", tc.policy, itemPrices(order), order.Subtotal, order.Total)
+			}
+			var left int
+			if err := db.QueryRow("SELECT COUNT(*) FROM cart_prices WHERE user_id = ?", order.UserId).Scan(&left); err != nil || left != 0 {
+				t.Fatalf("%s: после оформления осталось цен корзины %d, %v", tc.policy, left, err)
+			}
+		}
+	})
+}
+
+func TestCurrencies(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		s := newTestServer(t)
+		s.addDeliveryZone()
+		setRate := func(currency, rate string) *httptest.ResponseRecorder {
+			return s.sendJSON(http.MethodPut, "/exchange-rate/"+currency, fmt.Sprintf(`{"rate":%q}`, rate))
+		}
+		getPriced := func(product Product, currency string) PricedProduct {
+			t.Helper()
+			return decodeResponse[PricedProduct](t, s.sendJSON(http.MethodGet, fmt.Sprintf("/product/%d?currency=%s", product.Id, currency), ""))
+		}
+
+		w := s.sendJSON(http.MethodPost, "/product", `{"name":"Наушники","price":1000,"currency":"usd","image_url":"https://cdn.example.com/headphones.png"}`)
+		expectStatus(t, w, http.StatusCreated)
+		headphones := decodeResponse[struct {
+			Product Product `json:"product"`
+		}](t, w).Product
+		kettle := s.createProduct("Чайник", 1990, 800)
+		if headphones.Currency != "USD" || kettle.Currency != baseCurrency {
+			t.Fatalf("валюты товаров %q, %q", headphones.Currency, kettle.Currency)
+		}
+
+		rates := decodeResponse[struct {
+			Base  string         `json:"base"`
+			Rates []ExchangeRate `json:"rates"`
+		}](t, s.sendJSON(http.MethodGet, "/exchange-rates", ""))
+		if rates.Base != baseCurrency || len(rates.Rates) != len(fixtureRates) || rates.Rates[3].Currency != "USD" || rates.Rates[3].Rate != "90" || rates.Rates[3].Source != "fixture" {
+			t.Fatalf("курсы валют %+v", rates)
+		}
+		// Повторное обновление с теми же курсами не пишет историю.
+		countRates := func() (n int) {
+			t.Helper()
+			if err := db.QueryRow("SELECT COUNT(*) FROM exchange_rates").Scan(&n); err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+		before := countRates()
+		if err := refreshExchangeRates(context.Background()); err != nil || countRates() != before {
+			t.Fatalf("после обновления тех же курсов записей %d вместо %d, %v", countRates(), before, err)
+		}
+
+		// 10 долларов по 90 рублей — 900 рублей или 4500 тенге.
+		if p := getPriced(headphones, "RUB"); p.Price != 90000 || p.Currency != "RUB" || p.OriginalPrice != 1000 || p.OriginalCurrency != "USD" {
+			t.Fatalf("цена наушников в рублях %+v", p)
+		}
+		if p := getPriced(headphones, "kzt"); p.Price != 450000 || p.Currency != "KZT" {
+			t.Fatalf("цена наушников в тенге %+v", p)
+		}
+		// 19,90 рубля — 0,199 евро, округляется до 20 центов.
+		products := decodeResponse[[]PricedProduct](t, s.sendJSON(http.MethodGet, "/products?currency=EUR", ""))
+		if len(products) != 2 || products[1].Price != 20 || products[1].Currency != "EUR" || products[0].Price != 900 {
+			t.Fatalf("товары в евро %+v", products)
+		}
+		if got := decodeResponse[Product](t, s.sendJSON(http.MethodGet, fmt.Sprintf("/product/%d", headphones.Id), "")); got.Price != 1000 || got.Currency != "USD" {
+			t.Fatalf("товар без пересчета %+v", got)
+		}
+		expectError(t, s.sendJSON(http.MethodGet, "/products?currency=GBP", ""), CodeInvalidParameter)
+		w = s.sendJSON(http.MethodPost, "/product", `{"name":"Зонт","price":500,"currency":"GBP","image_url":"https://cdn.example.com/umbrella.png"}`)
+		expectError(t, w, CodeValidationFailed)
+		if body := decodeResponse[struct {
+			Error ErrorBody `json:"error"`
+		}](t, w); len(body.Error.Fields) != 1 || body.Error.Fields[0].Field != "currency" || body.Error.Fields[0].Code != "oneof" {
+			t.Fatalf("ошибки полей %+v", body.Error.Fields)
+		}
+
+		// ETag цены в валюте зависит от валюты и курса, а не только от
+		// версии товара.
+		pricedPath := fmt.Sprintf("/product/%d?currency=RUB", headphones.Id)
+		tag := s.sendJSON(http.MethodGet, pricedPath, "").Header().Get("ETag")
+		if tag == etag(headphones.Version) || tag == s.sendJSON(http.MethodGet, fmt.Sprintf("/product/%d?currency=KZT", headphones.Id), "").Header().Get("ETag") {
+			t.Fatalf("ETag цены в рублях %q", tag)
+		}
+		expectStatus(t, s.do(http.MethodGet, pricedPath, "", nil, http.Header{"If-None-Match": {etag(headphones.Version)}}), http.StatusOK)
+		expectStatus(t, s.do(http.MethodGet, pricedPath, "", nil, http.Header{"If-None-Match": {tag}}), http.StatusNotModified)
+
+		expectStatus(t, setRate("usd", "92.50"), http.StatusOK)
+		if p := getPriced(headphones, "RUB"); p.Price != 92500 {
+			t.Fatalf("цена наушников после смены курса %+v", p)
+		}
+		expectStatus(t, s.do(http.MethodGet, pricedPath, "", nil, http.Header{"If-None-Match": {tag}}), http.StatusOK)
+		expectError(t, setRate("RUB", "2"), CodeInvalidParameter)
+		expectError(t, setRate("GBP", "2"), CodeInvalidParameter)
+		expectError(t, setRate("EUR", "-1"), CodeValidationFailed)
+
+		user := s.createUser(User{Name: "Покупатель", Latitude: 55.76, Longitude: 37.64, Cart: []int64{headphones.Id, kettle.Id, kettle.Id}})
+		s.addPaymentMethod(user.Id, `{"type":"cash"}`)
+		quote := decodeResponse[ShippingQuote](t, s.sendJSON(http.MethodPost, "/shipping/quote", fmt.Sprintf(`{"user_id":%d}`, user.Id)))
+		if quote.Currency != baseCurrency || quote.Subtotal != 92500+1990*2 || len(quote.Options) != 1 {
+			t.Fatalf("расчет доставки %+v", quote)
+		}
+		expectError(t, s.sendJSON(http.MethodPost, fmt.Sprintf("/user/%d/checkout", user.Id), `{"currency":"GBP"}`), CodeValidationFailed)
+
+		w = s.sendJSON(http.MethodPost, fmt.Sprintf("/user/%d/checkout", user.Id), `{"currency":"KZT"}`)
+		expectStatus(t, w, http.StatusCreated)
+		order := decodeResponse[struct {
+			Order Order `json:"order"`
+		}](t, w).Order
+		// 10 долларов по 92,5 рубля и два чайника по 19,90 рубля при 0,2
+		// рубля за тенге.
+		if order.Currency != "KZT" || len(order.Items) != 2 || order.Items[0].Price != 462500 || order.Items[1].Price != 9950 || order.Subtotal != 462500+9950*2 {
+			t.Fatalf("заказ в тенге %+v", order)
+		}
+		if order.ShippingCost != quote.Options[0].Price*5 || order.Total != order.Subtotal+order.ShippingCost || order.Amount != order.Total {
+			t.Fatalf("доставка %d и итог %d заказа в тенге", order.ShippingCost, order.Total)
+		}
+		if fmt.Sprint(order.ExchangeRates) != fmt.Sprint(RateSnapshot{"KZT": "0.2", "RUB": "1", "USD": "92.5"}) {
+			t.Fatalf("курсы заказа %v", order.ExchangeRates)
+		}
+
+		// Новый курс не меняет оформленный заказ.
+		expectStatus(t, setRate("KZT", "0.25"), http.StatusOK)
+		if got := s.getOrder(order.Id); got.Total != order.Total || got.Currency != "KZT" || got.ExchangeRates["KZT"] != "0.2" {
+			t.Fatalf("заказ после смены курса %+v", got)
+		}
+		if p := getPriced(headphones, "KZT"); p.Price != 370000 {
+			t.Fatalf("цена наушников по новому курсу %+v", p)
+		}
+
+		exchangeRates = &rateCache{}
+		expectError(t, s.sendJSON(http.MethodGet, fmt.Sprintf("/product/%d?currency=RUB", headphones.Id), ""), CodeExchangeRateUnavailable)
+		expectError(t, s.sendJSON(http.MethodPost, "/shipping/quote", fmt.Sprintf(`{"latitude":55.76,"longitude":37.64,"cart":[%d]}`, headphones.Id)), CodeExchangeRateUnavailable)
+		if p := getPriced(kettle, "RUB"); p.Price != 1990 {
+			t.Fatalf("цена в своей валюте без курсов %+v", p)
+		}
+		if err := loadExchangeRates(context.Background()); err != nil {
+			t.Fatalf("loadExchangeRates: %v", err)
+		}
+		if got := exchangeRates.snapshot(); got["KZT"] != "0.25" || got["USD"] != "92.5" || got["EUR"] != "100" {
+			t.Fatalf("курсы из базы %v", got)
+		}
+	})
+}
+
+func TestDiscounts(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		s := newTestServer(t)
+		s.addDeliveryZone()
+		createProduct := func(body string) Product {
+			t.Helper()
+			w := s.sendJSON(http.MethodPost, "/product", body)
+			expectStatus(t, w, http.StatusCreated)
+			return decodeResponse[struct {
+				Product Product `json:"product"`
+			}](t, w).Product
+		}
+		addCoupon := func(body string) Coupon {
+			t.Helper()
+			w := s.sendJSON(http.MethodPost, "/coupon", body)
+			expectStatus(t, w, http.StatusCreated)
+			return decodeResponse[struct {
+				Coupon Coupon `json:"coupon"`
+			}](t, w).Coupon
+		}
+		getCart := func(userId int64, coupon string) CartTotals {
+			t.Helper()
+			w := s.sendJSON(http.MethodGet, fmt.Sprintf("/user/%d/cart?coupon=%s", userId, coupon), "")
+			expectStatus(t, w, http.StatusOK)
+			return decodeResponse[CartTotals](t, w)
+		}
+		checkout := func(userId int64, coupon string) *httptest.ResponseRecorder {
+			return s.sendJSON(http.MethodPost, fmt.Sprintf("/user/%d/checkout", userId), fmt.Sprintf(`{"coupon":%q}`, coupon))
+		}
+		buyer := func(cart ...int64) User {
+			t.Helper()
+			user := s.createUser(User{Name: "Покупатель", Latitude: 55.76, Longitude: 37.64, Cart: cart})
+			s.addPaymentMethod(user.Id, `{"type":"cash"}`)
+			return user
+		}
+
+		kettle := createProduct(`{"name":"Чайник","price":1000,"category":"kitchen","image_url":"https://cdn.example.com/kettle.png"}`)
+		mug := createProduct(`{"name":"Кружка","price":300,"category":"kitchen","image_url":"https://cdn.example.com/mug.png"}`)
+		book := createProduct(`{"name":"Книга","price":500,"image_url":"https://cdn.example.com/book.png"}`)
+		if kettle.Category != "kitchen" || book.Category != "" {
+			t.Fatalf("категории товаров %q, %q", kettle.Category, book.Category)
+		}
+
+		w := s.sendJSON(http.MethodPost, "/promotion", `{"name":"2+1 на кухню","buy_quantity":2,"get_quantity":1,"categories":["kitchen"]}`)
+		expectStatus(t, w, http.StatusCreated)
+		promotion := decodeResponse[struct {
+			Promotion Promotion `json:"promotion"`
+		}](t, w).Promotion
+		if promotion.Percent != 100 {
+			t.Fatalf("акция %+v", promotion)
+		}
+		expectError(t, s.sendJSON(http.MethodPost, "/promotion", `{"name":"Без количества","get_quantity":1}`), CodeValidationFailed)
+
+		// Из чайника и двух кружек бесплатна одна кружка.
+		user := buyer(kettle.Id, mug.Id, mug.Id, book.Id)
+		cart := getCart(user.Id, "")
+		if cart.Subtotal != 2100 || cart.Discount != 300 || len(cart.Discounts) != 1 || cart.Discounts[0].PromotionId != promotion.Id ||
+			len(cart.Items) != 3 || cart.Items[1].ProductId != mug.Id || cart.Items[1].Quantity != 2 || cart.Items[1].Discount != 300 {
+			t.Fatalf("корзина с акцией %+v", cart)
+		}
+		if cart.ShippingRateId == nil || cart.ShippingCost == 0 || cart.Total != cart.Subtotal-cart.Discount+cart.ShippingCost {
+			t.Fatalf("доставка и итог корзины %+v", cart)
+		}
+
+		kitchen10 := addCoupon(`{"code":"kitchen10","type":"percent","value":10,"categories":["kitchen"]}`)
+		addCoupon(fmt.Sprintf(`{"code":"BOOK","type":"fixed","value":250,"product_ids":[%d]}`, book.Id))
+		addCoupon(`{"code":"FREESHIP","type":"free_shipping"}`)
+		addCoupon(`{"code":"GARDEN","type":"percent","value":5,"categories":["garden"]}`)
+		addCoupon(`{"code":"BIG","type":"fixed","value":100,"min_total":5000}`)
+		addCoupon(`{"code":"LATER","type":"percent","value":5,"starts_at":"2999-01-01T00:00:00Z"}`)
+		if kitchen10.Code != "KITCHEN10" || kitchen10.Currency != baseCurrency {
+			t.Fatalf("купон %+v", kitchen10)
+		}
+
+		// 10% от чайника и оставшейся после акции кружки: 130, делятся
+		// пропорционально стоимости.
+		cart = getCart(user.Id, "kitchen10")
+		if cart.Discount != 430 || len(cart.Discounts) != 2 || cart.Discounts[1].Code != "KITCHEN10" || cart.Discounts[1].Amount != 130 ||
+			cart.Items[0].Discount != 100 || cart.Items[1].Discount != 330 || cart.Items[2].Discount != 0 {
+			t.Fatalf("корзина с процентным купоном %+v", cart)
+		}
+		if cart = getCart(user.Id, "BOOK"); cart.Discount != 550 || cart.Items[2].Discount != 250 {
+			t.Fatalf("корзина с купоном на товар %+v", cart)
+		}
+		cart = getCart(user.Id, "FREESHIP")
+		if line := cart.Discounts[1]; line.Target != DiscountTargetShipping || line.Amount != cart.ShippingCost || cart.Total != cart.Subtotal-300 {
+			t.Fatalf("корзина с бесплатной доставкой %+v", cart)
+		}
+		for code, want := range map[string]ErrorCode{"NOPE": CodeCouponNotFound, "GARDEN": CodeCouponNotApplicable, "BIG": CodeCouponMinTotal, "LATER": CodeCouponInactive} {
+			expectError(t, s.sendJSON(http.MethodGet, fmt.Sprintf("/user/%d/cart?coupon=%s", user.Id, code), ""), want)
+		}
+
+		w = s.sendJSON(http.MethodPost, "/coupon", `{"code":"Kitchen10","type":"percent","value":5}`)
+		expectError(t, w, CodeValidationFailed)
+		if body := decodeResponse[struct {
+			Error ErrorBody `json:"error"`
+		}](t, w); len(body.Error.Fields) != 1 || body.Error.Fields[0].Code != "unique" {
+			t.Fatalf("ошибки полей %+v", body.Error.Fields)
+		}
+		expectError(t, s.sendJSON(http.MethodPost, "/coupon", `{"code":"HALF","type":"percent","value":150}`), CodeValidationFailed)
+		expectError(t, s.sendJSON(http.MethodPost, "/coupon", `{"code":"HALF","type":"gift","value":5}`), CodeValidationFailed)
+		expectError(t, s.sendJSON(http.MethodPost, "/coupon", `{"code":"HALF","type":"fixed","value":5,"product_ids":[999]}`), CodeValidationFailed)
+
+		w = checkout(user.Id, "kitchen10")
+		expectStatus(t, w, http.StatusCreated)
+		order := decodeResponse[struct {
+			Order Order `json:"order"`
+		}](t, w).Order
+		if order.Discount != 430 || len(order.Discounts) != 2 || order.Total != 2100-430+order.ShippingCost || order.Amount != order.Total {
+			t.Fatalf("заказ со скидками %+v", order)
+		}
+		if got := s.getOrder(order.Id); got.Discount != 430 || len(got.Discounts) != 2 || got.Discounts[0].Type != DiscountPromotion || got.Items[1].Discount != 330 {
+			t.Fatalf("сохраненный заказ %+v", got)
+		}
+
+		// Купон на одно использование.
+		addCoupon(`{"code":"ONCE","type":"fixed","value":100,"usage_limit":1}`)
+		first, second := buyer(book.Id), buyer(book.Id)
+		expectStatus(t, checkout(first.Id, "ONCE"), http.StatusCreated)
+		expectError(t, s.sendJSON(http.MethodGet, fmt.Sprintf("/user/%d/cart?coupon=ONCE", second.Id), ""), CodeCouponExhausted)
+		expectError(t, checkout(second.Id, "ONCE"), CodeCouponExhausted)
+
+		// Купон на одно использование каждым пользователем.
+		addCoupon(`{"code":"EACH","type":"percent","value":5,"per_user_limit":1}`)
+		expectStatus(t, checkout(second.Id, "EACH"), http.StatusCreated)
+		expectStatus(t, s.sendJSON(http.MethodPatch, fmt.Sprintf("/user/%d", second.Id), fmt.Sprintf(`{"cart":[%d]}`, book.Id)), http.StatusOK)
+		expectError(t, checkout(second.Id, "EACH"), CodeCouponUserLimit)
+		expectStatus(t, s.sendJSON(http.MethodPatch, fmt.Sprintf("/user/%d", first.Id), fmt.Sprintf(`{"cart":[%d]}`, book.Id)), http.StatusOK)
+		expectStatus(t, checkout(first.Id, "EACH"), http.StatusCreated)
+
+		coupons := decodeResponse[[]Coupon](t, s.sendJSON(http.MethodGet, "/coupons", ""))
+		if len(coupons) != 8 || coupons[0].UsedCount != 1 || coupons[6].UsedCount != 1 || coupons[7].UsedCount != 2 {
+			t.Fatalf("купоны %+v", coupons)
+		}
+		expectError(t, s.sendJSON(http.MethodDelete, "/coupon/999", ""), CodeCouponNotFound)
+		expectStatus(t, s.sendJSON(http.MethodDelete, fmt.Sprintf("/coupon/%d", kitchen10.Id), ""), http.StatusOK)
+		expectStatus(t, s.sendJSON(http.MethodDelete, fmt.Sprintf("/promotion/%d", promotion.Id), ""), http.StatusOK)
+		expectError(t, s.sendJSON(http.MethodDelete, fmt.Sprintf("/promotion/%d", promotion.Id), ""), CodePromotionNotFound)
+		third := buyer(kettle.Id, mug.Id, mug.Id)
+		if cart := getCart(third.Id, ""); cart.Discount != 0 || len(cart.Discounts) != 0 {
+			t.Fatalf("корзина без акций %+v", cart)
+		}
+
+		// Возврат кружки возмещает ее цену за вычетом доли скидки: 330 на
+		// две кружки, по 165 на каждую.
+		expectStatus(t, s.sendJSON(http.MethodPost, fmt.Sprintf("/order/%d/shipment", order.Id), `{"carrier":"cdek","tracking_number":"TRK-1"}`), http.StatusCreated)
+		s.pollUntilDelivered()
+		mugItem := order.Items[1].Id
+		for range 2 {
+			ret := s.createReturn(order.Id, strconv.FormatInt(mugItem, 10))
+			returnAction(t, s.sendJSON(http.MethodPost, fmt.Sprintf("/return/%d/approve", ret.Id), ""), ReturnStatusApproved)
+			ret = returnAction(t, s.sendJSON(http.MethodPost, fmt.Sprintf("/return/%d/refund", ret.Id), ""), ReturnStatusRefunded)
+			if ret.RefundedAmount != 135 {
+				t.Fatalf("возмещение кружки %+v", ret)
+			}
+		}
+		if got := s.getOrder(order.Id); got.Status != OrderStatusDelivered {
+			t.Fatalf("после частичного возврата статус заказа %s", got.Status)
+		}
+		// После возврата всех позиций заказ со скидками считается
+		// возвращенным, хотя возмещено меньше Subtotal.
+		ret := s.createReturn(order.Id, fmt.Sprintf("%d:1,%d:1", order.Items[0].Id, order.Items[2].Id))
+		returnAction(t, s.sendJSON(http.MethodPost, fmt.Sprintf("/return/%d/approve", ret.Id), ""), ReturnStatusApproved)
+		if ret = returnAction(t, s.sendJSON(http.MethodPost, fmt.Sprintf("/return/%d/refund", ret.Id), ""), ReturnStatusRefunded); ret.RefundedAmount != 900+500 {
+			t.Fatalf("возмещение чайника и книги %+v", ret)
+		}
+		if got := s.getOrder(order.Id); got.Status != OrderStatusRefunded {
+			t.Fatalf("после полного возврата статус заказа %s", got.Status)
+		}
+	})
+}
+
+func TestTaxes(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		saved := taxConfig
+		t.Cleanup(func() { taxConfig = saved })
+		taxConfig.Categories = map[string]string{"books": "reduced"}
+
+		s := newTestServer(t)
+		s.addDeliveryZone()
+		w := s.sendJSON(http.MethodPost, "/tax/zone", `{"name":"Россия","country":"ru","latitude":55.75,"longitude":37.62,"radius_km":5000}`)
+		expectStatus(t, w, http.StatusCreated)
+		zone := decodeResponse[struct {
+			Zone TaxZone `json:"zone"`
+		}](t, w).Zone
+		if zone.Country != "RU" {
+			t.Fatalf("налоговая зона %+v", zone)
+		}
+		for _, body := range []string{
+			fmt.Sprintf(`{"zone_id":%d,"tax_class":"standard","name":"НДС","rate":"20"}`, zone.Id),
+			fmt.Sprintf(`{"zone_id":%d,"tax_class":"reduced","name":"НДС","rate":"10.00"}`, zone.Id),
+		} {
+			expectStatus(t, s.sendJSON(http.MethodPost, "/tax/rate", body), http.StatusCreated)
+		}
+		rates := decodeResponse[[]TaxRate](t, s.sendJSON(http.MethodGet, "/tax/rates", ""))
+		if len(rates) != 2 || rates[1].Rate != "10" {
+			t.Fatalf("ставки налога %+v", rates)
+		}
+
+		errorTests := []struct {
+			name, method, path, body string
+			code                     ErrorCode
+		}{
+			{"зона без границы", http.MethodPost, "/tax/zone", `{"name":"Без границы","country":"RU"}`, CodeInvalidZoneShape},
+			{"код страны из трех букв", http.MethodPost, "/tax/zone", `{"name":"Россия","country":"RUS","radius_km":10}`, CodeValidationFailed},
+			{"ставка больше 100%", http.MethodPost, "/tax/rate", fmt.Sprintf(`{"zone_id":%d,"tax_class":"luxury","name":"НДС","rate":"120"}`, zone.Id), CodeValidationFailed},
+			{"ставка не числом", http.MethodPost, "/tax/rate", fmt.Sprintf(`{"zone_id":%d,"tax_class":"luxury","name":"НДС","rate":"двадцать"}`, zone.Id), CodeValidationFailed},
+			{"повтор класса", http.MethodPost, "/tax/rate", fmt.Sprintf(`{"zone_id":%d,"tax_class":"standard","name":"НДС","rate":"18"}`, zone.Id), CodeValidationFailed},
+			{"несуществующая зона", http.MethodPost, "/tax/rate", `{"zone_id":999,"tax_class":"standard","name":"НДС","rate":"20"}`, CodeValidationFailed},
+			{"удаление несуществующей зоны", http.MethodDelete, "/tax/zone/999", "", CodeTaxZoneNotFound},
+			{"удаление несуществующей ставки", http.MethodDelete, "/tax/rate/999", "", CodeTaxRateNotFound},
+		}
+		for _, tt := range errorTests {
+			t.Run(tt.name, func(t *testing.T) {
+				expectError(t, s.sendJSON(tt.method, tt.path, tt.body), tt.code)
+			})
+		}
+
+		kettle := s.createProduct("Чайник", 1990, 800)
+		w = s.sendJSON(http.MethodPost, "/product", `{"name":"Книга","price":500,"category":"books","image_url":"https://cdn.example.com/book.png"}`)
+		expectStatus(t, w, http.StatusCreated)
+		book := decodeResponse[struct {
+			Product Product `json:"product"`
+		}](t, w).Product
+		user := s.createUser(User{Name: "Покупатель", Latitude: 55.76, Longitude: 37.64, Cart: []int64{kettle.Id, kettle.Id, book.Id}})
+		s.addPaymentMethod(user.Id, `{"type":"cash"}`)
+		twenty := big.NewRat(20, 1)
+
+		// Цены включают налог: он выделяется из цен и доставки и не меняет
+		// итог. Из книги за 500 по ставке 10% — 45,45, округляется до 45.
+		cart := decodeResponse[CartTotals](t, s.sendJSON(http.MethodGet, fmt.Sprintf("/user/%d/cart", user.Id), ""))
+		standard := 1990*2 + cart.ShippingCost
+		if !cart.PricesIncludeTax || len(cart.Taxes) != 2 || cart.Taxes[0].TaxClass != "reduced" || cart.Taxes[0].Amount != 45 ||
+			cart.Taxes[1].Taxable != standard || cart.Taxes[1].Amount != taxAmount(standard, twenty, true) || cart.Taxes[1].Country != "RU" {
+			t.Fatalf("налоги корзины %+v", cart.Taxes)
+		}
+		if cart.Tax != cart.Taxes[0].Amount+cart.Taxes[1].Amount || cart.Total != cart.Subtotal+cart.ShippingCost || cart.Items[1].Tax != 45 {
+			t.Fatalf("корзина с налогом %+v", cart)
+		}
+
+		// Вне налоговых зон налога нет.
+		faraway := s.createUser(User{Name: "Олег", Latitude: 43.11, Longitude: 131.88, Cart: []int64{kettle.Id}})
+		if cart := decodeResponse[CartTotals](t, s.sendJSON(http.MethodGet, fmt.Sprintf("/user/%d/cart", faraway.Id), "")); cart.Tax != 0 || len(cart.Taxes) != 0 {
+			t.Fatalf("корзина вне налоговых зон %+v", cart)
+		}
+
+		// Налог сверху цен входит в итог заказа.
+		taxConfig.PricesIncludeTax = false
+		order := s.checkout(user.Id)
+		tax := 50 + taxAmount(standard, twenty, false)
+		if order.PricesIncludeTax || order.Tax != tax || order.Total != order.Subtotal+order.ShippingCost+tax || order.Amount != order.Total {
+			t.Fatalf("заказ с налогом сверху %+v", order)
+		}
+		got := s.getOrder(order.Id)
+		if got.Tax != tax || len(got.Taxes) != 2 || got.PricesIncludeTax || got.Items[1].Tax != 50 || got.Items[0].Tax+got.Items[1].Tax >= tax {
+			t.Fatalf("сохраненный заказ с налогом %+v", got)
+		}
+
+		// Возврат книги возмещает ее цену вместе с налогом.
+		expectStatus(t, s.sendJSON(http.MethodPost, fmt.Sprintf("/order/%d/shipment", order.Id), `{"carrier":"cdek","tracking_number":"TRK-1"}`), http.StatusCreated)
+		s.pollUntilDelivered()
+		ret := s.createReturn(order.Id, strconv.FormatInt(got.Items[1].Id, 10))
+		returnAction(t, s.sendJSON(http.MethodPost, fmt.Sprintf("/return/%d/approve", ret.Id), ""), ReturnStatusApproved)
+		if ret = returnAction(t, s.sendJSON(http.MethodPost, fmt.Sprintf("/return/%d/refund", ret.Id), ""), ReturnStatusRefunded); ret.RefundedAmount != 550 {
+			t.Fatalf("возмещение книги %+v", ret)
+		}
+
+		expectStatus(t, s.sendJSON(http.MethodDelete, fmt.Sprintf("/tax/zone/%d", zone.Id), ""), http.StatusOK)
+		if rates := decodeResponse[[]TaxRate](t, s.sendJSON(http.MethodGet, "/tax/rates", "")); len(rates) != 0 {
+			t.Fatalf("ставки удаленной зоны %+v", rates)
+		}
+	})
+}
+
+func TestConditionalRequests(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		s := newTestServer(t)
+		s.addDeliveryZone()
+		product := s.createProduct("Чайник", 1990, 800)
+		productPath := fmt.Sprintf("/product/%d", product.Id)
+		withHeader := func(name, value string) http.Header {
+			return http.Header{name: {value}}
+		}
+		patchProduct := func(ifMatch, body string) *httptest.ResponseRecorder {
+			return s.do(http.MethodPatch, productPath, "application/json", []byte(body), withHeader("If-Match", ifMatch))
+		}
+
+		t.Run("etag", func(t *testing.T) {
+			w := s.sendJSON(http.MethodGet, productPath, "")
+			expectStatus(t, w, http.StatusOK)
+			if got := w.Header().Get("ETag"); got != `"1"` || decodeResponse[Product](t, w).Version != 1 {
+				t.Fatalf("ETag нового товара %q: %s", got, w.Body)
+			}
+			for _, ifNoneMatch := range []string{`"1"`, `W/"1"`, `"7", "1"`, "*"} {
+				w = s.do(http.MethodGet, productPath, "", nil, withHeader("If-None-Match", ifNoneMatch))
+				expectStatus(t, w, http.StatusNotModified)
+				if w.Body.Len() != 0 || w.Header().Get("ETag") != `"1"` {
+					t.Fatalf("If-None-Match %s: ETag %q, тело %q", ifNoneMatch, w.Header().Get("ETag"), w.Body)
+				}
+			}
+			expectStatus(t, s.do(http.MethodGet, productPath, "", nil, withHeader("If-None-Match", `"2"`)), http.StatusOK)
+		})
+
+		t.Run("if-match", func(t *testing.T) {
+			expectError(t, patchProduct(`"7"`, `{"price":2100}`), CodePreconditionFailed)
+			expectError(t, patchProduct(`W/"1"`, `{"price":2100}`), CodePreconditionFailed)
+			w := patchProduct(`"1"`, `{"price":2100}`)
+			expectStatus(t, w, http.StatusOK)
+			if got := w.Header().Get("ETag"); got != `"2"` {
+				t.Fatalf("ETag после изменения %q", got)
+			}
+			expectError(t, patchProduct(`"1"`, `{"price":2200}`), CodePreconditionFailed)
+			expectStatus(t, patchProduct("*", `{"price":2200}`), http.StatusOK)
+			expectStatus(t, s.sendJSON(http.MethodPatch, productPath, `{"price":2300}`), http.StatusOK)
+			if got := decodeResponse[Product](t, s.sendJSON(http.MethodGet, productPath, "")); got.Price != 2300 || got.Version != 4 {
+				t.Fatalf("товар после изменений %+v", got)
+			}
+
+			expectError(t, s.do(http.MethodDelete, productPath, "", nil, withHeader("If-Match", `"3"`)), CodePreconditionFailed)
+			expectStatus(t, s.do(http.MethodDelete, productPath, "", nil, withHeader("If-Match", `"4"`)), http.StatusOK)
+			expectError(t, s.sendJSON(http.MethodGet, productPath, ""), CodeProductNotFound)
+		})
+
+		t.Run("user version", func(t *testing.T) {
+			cartProduct := s.createProduct("Кружка", 300, 250)
+			user := s.createUser(User{Name: "Иван", Latitude: 55.76, Longitude: 37.64, Cart: []int64{cartProduct.Id}})
+			userPath := fmt.Sprintf("/user/%d", user.Id)
+			s.addPaymentMethod(user.Id, `{"type":"cash"}`)
+			s.checkout(user.Id)
+			// Оформление заказа очищает корзину, и закэшированная версия
+			// пользователя устаревает.
+			expectStatus(t, s.do(http.MethodGet, userPath, "", nil, withHeader("If-None-Match", `"1"`)), http.StatusOK)
+			expectError(t, s.do(http.MethodDelete, userPath, "", nil, withHeader("If-Match", `"1"`)), CodePreconditionFailed)
+			w := s.do(http.MethodPatch, userPath, "application/json", []byte(`{"name":"Иван Петров"}`), withHeader("If-Match", `"2"`))
+			expectStatus(t, w, http.StatusOK)
+			if got := w.Header().Get("ETag"); got != `"3"` {
+				t.Fatalf("ETag пользователя после изменения %q", got)
+			}
+		})
+
+		t.Run("required", func(t *testing.T) {
+			requireIfMatch = true
+			t.Cleanup(func() { requireIfMatch = false })
+			product := s.createProduct("Тарелка", 500, 400)
+			productPath := fmt.Sprintf("/product/%d", product.Id)
+			expectError(t, s.sendJSON(http.MethodPatch, productPath, `{"price":600}`), CodePreconditionRequired)
+			expectError(t, s.sendJSON(http.MethodDelete, productPath, ""), CodePreconditionRequired)
+			expectStatus(t, s.do(http.MethodPatch, productPath, "application/json", []byte(`{"price":600}`), withHeader("If-Match", `"1"`)), http.StatusOK)
+		})
+	})
+}
+
+func TestShippingRoutes(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		s := newTestServer(t)
+		rate := s.addDeliveryZone()
+		product := s.createProduct("Чайник", 1990, 800)
+		nearby := s.createUser(User{Name: "Иван", Latitude: 55.76, Longitude: 37.64, Cart: []int64{product.Id}})
+		faraway := s.createUser(User{Name: "Олег", Latitude: 43.11, Longitude: 131.88, Cart: []int64{product.Id}})
+		empty := s.createUser(User{Name: "Анна", Latitude: 55.76, Longitude: 37.64})
+
+		t.Run("create", func(t *testing.T) {
+			warehouses := decodeResponse[[]Warehouse](t, s.sendJSON(http.MethodGet, "/warehouses", ""))
+			if len(warehouses) != 1 {
+				t.Fatalf("склады %+v", warehouses)
+			}
+			polygon := fmt.Sprintf(`{"name":"Центр","warehouse_id":%d,"polygon":[[55.7,37.5],[55.8,37.5],[55.8,37.7],[55.7,37.7]]}`, warehouses[0].Id)
+			expectStatus(t, s.sendJSON(http.MethodPost, "/shipping/zone", polygon), http.StatusCreated)
+			if zones := decodeResponse[[]ShippingZone](t, s.sendJSON(http.MethodGet, "/shipping/zones", "")); len(zones) != 2 || len(zones[1].Polygon) != 4 {
+				t.Fatalf("зоны доставки %+v", zones)
+			}
+			if rates := decodeResponse[[]ShippingRate](t, s.sendJSON(http.MethodGet, "/shipping/rates", "")); len(rates) != 1 || rates[0] != rate {
+				t.Fatalf("тарифы %+v, ожидался %+v", rates, rate)
+			}
+		})
+
+		t.Run("invalid create", func(t *testing.T) {
+			tests := []struct {
+				name string
+				path string
+				body string
+				code ErrorCode
+			}{
+				{"склад без координат", "/warehouse", `{"name":"Казань"}`, CodeValidationFailed},
+				{"широта склада вне диапазона", "/warehouse", `{"name":"Казань","latitude":91,"longitude":49.1}`, CodeValidationFailed},
+				{"зона без радиуса и границ", "/shipping/zone", fmt.Sprintf(`{"name":"Зона","warehouse_id":%d}`, rate.ZoneId), CodeInvalidZoneShape},
+				{"зона несуществующего склада", "/shipping/zone", `{"name":"Зона","warehouse_id":999,"radius_km":10}`, CodeValidationFailed},
+				{"тариф несуществующей зоны", "/shipping/rate", `{"zone_id":999,"name":"Почта"}`, CodeValidationFailed},
+				{"отрицательная цена", "/shipping/rate", fmt.Sprintf(`{"zone_id":%d,"name":"Почта","base_price":-1}`, rate.ZoneId), CodeValidationFailed},
+				{"вес до меньше веса от", "/shipping/rate", fmt.Sprintf(`{"zone_id":%d,"name":"Почта","min_weight":1000,"max_weight":500}`, rate.ZoneId), CodeValidationFailed},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					expectError(t, s.sendJSON(http.MethodPost, tt.path, tt.body), tt.code)
+				})
+			}
+
+			// Нулевые координаты — настоящая точка, а не отсутствующее значение.
+			w := s.sendJSON(http.MethodPost, "/warehouse", `{"name":"Гвинейский залив","latitude":0,"longitude":0}`)
+			expectStatus(t, w, http.StatusCreated)
+			if got := decodeResponse[struct {
+				Warehouse Warehouse `json:"warehouse"`
+			}](t, w).Warehouse; got.Id == 0 || got.Latitude != 0 || got.Longitude != 0 {
+				t.Fatalf("склад на экваторе %+v", got)
+			}
+		})
+
+		t.Run("quote", func(t *testing.T) {
+			tests := []struct {
+				name    string
+				body    string
+				options int
+			}{
+				{"по координатам", fmt.Sprintf(`{"latitude":55.76,"longitude":37.64,"cart":[%d]}`, product.Id), 1},
+				{"по пользователю", fmt.Sprintf(`{"user_id":%d}`, nearby.Id), 1},
+				{"вне зоны доставки", fmt.Sprintf(`{"user_id":%d}`, faraway.Id), 0},
+				{"адрес из запроса важнее адреса пользователя", fmt.Sprintf(`{"user_id":%d,"latitude":55.76,"longitude":37.64}`, faraway.Id), 1},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					w := s.sendJSON(http.MethodPost, "/shipping/quote", tt.body)
+					expectStatus(t, w, http.StatusOK)
+					quote := decodeResponse[ShippingQuote](t, w)
+					if quote.Subtotal != 1990 || quote.Weight != 800 || len(quote.Options) != tt.options {
+						t.Fatalf("расчет доставки %+v", quote)
+					}
+					if tt.options > 0 && (quote.Options[0].RateId != rate.Id || quote.Options[0].Price <= rate.BasePrice) {
+						t.Fatalf("вариант доставки %+v", quote.Options[0])
+					}
+				})
+			}
+
+			errorTests := []struct {
+				name string
+				body string
+				code ErrorCode
+			}{
+				{"без адреса", fmt.Sprintf(`{"cart":[%d]}`, product.Id), CodeShippingAddressRequired},
+				{"пустая корзина", fmt.Sprintf(`{"user_id":%d}`, empty.Id), CodeCartEmpty},
+				{"несуществующий товар", `{"latitude":55.76,"longitude":37.64,"cart":[999]}`, CodeCartProductNotFound},
+				{"несуществующий пользователь", `{"user_id":999}`, CodeUserNotFound},
+			}
+			for _, tt := range errorTests {
+				t.Run(tt.name, func(t *testing.T) {
+					expectError(t, s.sendJSON(http.MethodPost, "/shipping/quote", tt.body), tt.code)
+				})
+			}
+		})
+
+		t.Run("delete", func(t *testing.T) {
+			tests := []struct {
+				path string
+				code ErrorCode
+			}{
+				{fmt.Sprintf("/shipping/rate/%d", rate.Id), CodeShippingRateNotFound},
+				{fmt.Sprintf("/shipping/zone/%d", rate.ZoneId), CodeShippingZoneNotFound},
+			}
+			for _, tt := range tests {
+				expectStatus(t, s.sendJSON(http.MethodDelete, tt.path, ""), http.StatusOK)
+				expectError(t, s.sendJSON(http.MethodDelete, tt.path, ""), tt.code)
+			}
+			expectError(t, s.sendJSON(http.MethodDelete, "/warehouse/999", ""), CodeWarehouseNotFound)
+			expectError(t, s.sendJSON(http.MethodDelete, "/shipping/zone/abc", ""), CodeInvalidParameter)
+		})
+	})
+}
+
+func TestPaymentMethodRoutes(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		s := newTestServer(t)
+		user := s.createUser(User{Name: "Мария", Latitude: 59.93, Longitude: 30.31})
+		base := fmt.Sprintf("/user/%d", user.Id)
+
+		card := s.addPaymentMethod(user.Id, `{"type":"card","card_token":"tok_4242424242"}`)
+		if !card.IsDefault || card.CardToken == "tok_4242424242" || !strings.HasSuffix(card.CardToken, "4242") {
+			t.Fatalf("карта %+v", card)
+		}
+		wallet := s.addPaymentMethod(user.Id, `{"type":"wallet","is_default":true}`)
+		methods := decodeResponse[[]PaymentMethod](t, s.sendJSON(http.MethodGet, base+"/payment-methods", ""))
+		if len(methods) != 2 || methods[0].IsDefault || !methods[1].IsDefault || methods[1].Id != wallet.Id {
+			t.Fatalf("способы оплаты %+v", methods)
+		}
+
+		tests := []struct {
+			name   string
+			method string
+			path   string
+			body   string
+			code   ErrorCode
+		}{
+			{"неизвестный тип", http.MethodPost, base + "/payment-method", `{"type":"crypto"}`, CodeValidationFailed},
+			{"карта без токена", http.MethodPost, base + "/payment-method", `{"type":"card"}`, CodeValidationFailed},
+			{"без типа", http.MethodPost, base + "/payment-method", `{}`, CodeValidationFailed},
+			{"несуществующий пользователь", http.MethodPost, "/user/999/payment-method", `{"type":"cash"}`, CodeUserNotFound},
+			{"некорректный ID пользователя", http.MethodGet, "/user/abc/payment-methods", "", CodeInvalidParameter},
+			{"удаление чужого способа", http.MethodDelete, fmt.Sprintf("/user/999/payment-method/%d", card.Id), "", CodePaymentMethodNotFound},
+			{"удаление несуществующего", http.MethodDelete, base + "/payment-method/999", "", CodePaymentMethodNotFound},
+			{"некорректный ID способа", http.MethodDelete, base + "/payment-method/abc", "", CodeInvalidParameter},
+			{"по умолчанию несуществующий", http.MethodPost, base + "/payment-method/999/default", "", CodePaymentMethodNotFound},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				expectError(t, s.sendJSON(tt.method, tt.path, tt.body), tt.code)
+			})
+		}
+	})
+}
+
+// TestOrderLifecycle проводит оплаченный картой заказ через все этапы:
+// оформление, оплату вебхуком, отправку, доставку, возврат и возмещение.
+func TestOrderLifecycle(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		s := newTestServer(t)
+		rate := s.addDeliveryZone()
+		product := s.createProduct("Чайник", 1000, 500)
+		user := s.createUser(User{Name: "Мария", Latitude: 55.76, Longitude: 37.64, Cart: []int64{product.Id, product.Id}})
+		card := s.addPaymentMethod(user.Id, `{"type":"card","card_token":"tok_4242424242"}`)
+
+		order := s.checkout(user.Id)
+		if order.Status != OrderStatusPending || order.PaymentType != PaymentTypeCard || *order.PaymentMethodId != card.Id || *order.ShippingRateId != rate.Id {
+			t.Fatalf("заказ %+v", order)
+		}
+		if len(order.Items) != 1 || order.Items[0].Quantity != 2 || order.Subtotal != 2000 || order.Total != order.Subtotal+order.ShippingCost {
+			t.Fatalf("состав заказа %+v", order)
+		}
+		if got := decodeResponse[User](t, s.sendJSON(http.MethodGet, fmt.Sprintf("/user/%d", user.Id), "")); len(got.Cart) != 0 {
+			t.Fatalf("корзина после оформления %v", got.Cart)
+		}
+		if orders := decodeResponse[[]Order](t, s.sendJSON(http.MethodGet, fmt.Sprintf("/orders?user_id=%d", user.Id), "")); len(orders) != 1 || len(orders[0].Items) != 1 {
+			t.Fatalf("заказы пользователя %+v", orders)
+		}
+		orderPath := fmt.Sprintf("/order/%d", order.Id)
+
+		w := s.sendJSON(http.MethodPost, orderPath+"/pay", "")
+		expectStatus(t, w, http.StatusCreated)
+		payment := decodeResponse[struct {
+			Payment Payment `json:"payment"`
+		}](t, w).Payment
+		if payment.Amount != order.Total || payment.Status != PaymentStatusCreated || payment.IntentId == "" {
+			t.Fatalf("платеж %+v", payment)
+		}
+
+		expectStatus(t, s.webhook("evt_1", PaymentEventAuthorized, payment.IntentId, payment.Amount), http.StatusOK)
+		if w := s.webhook("evt_1", PaymentEventAuthorized, payment.IntentId, payment.Amount); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "уже обработано") {
+			t.Fatalf("повторный вебхук: %d %s", w.Code, w.Body)
+		}
+		if got := s.getOrder(order.Id); got.Status != OrderStatusPaid {
+			t.Fatalf("статус после оплаты %s", got.Status)
+		}
+		payments := decodeResponse[[]Payment](t, s.sendJSON(http.MethodGet, orderPath+"/payments", ""))
+		if len(payments) != 1 || payments[0].Status != PaymentStatusSucceeded {
+			t.Fatalf("платежи заказа %+v", payments)
+		}
+
+		expectStatus(t, s.sendJSON(http.MethodPost, orderPath+"/shipment", `{"carrier":"cdek","tracking_number":"TRK-1"}`), http.StatusCreated)
+		s.pollUntilDelivered()
+		tracking := decodeResponse[struct {
+			Status    string     `json:"status"`
+			Shipments []Shipment `json:"shipments"`
+		}](t, s.sendJSON(http.MethodGet, orderPath+"/tracking", ""))
+		if tracking.Status != OrderStatusDelivered || len(tracking.Shipments) != 1 || tracking.Shipments[0].Status != ShipmentStatusDelivered ||
+			len(tracking.Shipments[0].Events) != len(fakeTrackingSteps)+1 {
+			t.Fatalf("отслеживание %+v", tracking)
+		}
+
+		itemId := order.Items[0].Id
+		ret := s.createReturn(order.Id, fmt.Sprintf("%d:1", itemId), formFile{"photos", "damage.jpg", testImage})
+		if ret.Status != ReturnStatusRequested || len(ret.Photos) != 1 || !imageExists(ret.Photos[0]) || !strings.HasSuffix(ret.Photos[0], ".png") {
+			t.Fatalf("возврат %+v", ret)
+		}
+		if returns := decodeResponse[[]Return](t, s.sendJSON(http.MethodGet, fmt.Sprintf("/returns?order_id=%d&status=requested", order.Id), "")); len(returns) != 1 {
+			t.Fatalf("возвраты заказа %+v", returns)
+		}
+		returnPath := fmt.Sprintf("/return/%d", ret.Id)
+		if got := decodeResponse[Return](t, s.sendJSON(http.MethodGet, returnPath, "")); got.Reason != "Не подошел" || len(got.Items) != 1 {
+			t.Fatalf("возврат %+v", got)
+		}
+
+		returnAction(t, s.sendJSON(http.MethodPost, returnPath+"/approve", `{"comment":"Ок"}`), ReturnStatusApproved)
+		returnAction(t, s.sendJSON(http.MethodPost, returnPath+"/tracking", `{"carrier":"cdek","tracking_number":"RET-1"}`), ReturnStatusShipped)
+		returnAction(t, s.sendJSON(http.MethodPost, returnPath+"/receive", ""), ReturnStatusReceived)
+		ret = returnAction(t, s.sendJSON(http.MethodPost, returnPath+"/refund", ""), ReturnStatusRefunded)
+		if ret.RefundedAmount != 1000 || len(ret.Refunds) != 1 || ret.Refunds[0].ProviderRefundId == "" || len(ret.History) != 5 {
+			t.Fatalf("возмещение %+v", ret)
+		}
+		if got := s.getOrder(order.Id); got.Status != OrderStatusDelivered {
+			t.Fatalf("после частичного возврата статус заказа %s", got.Status)
+		}
+
+		second := s.createReturn(order.Id, strconv.FormatInt(itemId, 10))
+		returnAction(t, s.sendJSON(http.MethodPost, fmt.Sprintf("/return/%d/approve", second.Id), ""), ReturnStatusApproved)
+		returnAction(t, s.sendJSON(http.MethodPost, fmt.Sprintf("/return/%d/refund", second.Id), ""), ReturnStatusRefunded)
+		if got := s.getOrder(order.Id); got.Status != OrderStatusRefunded {
+			t.Fatalf("после полного возврата статус заказа %s", got.Status)
+		}
+	})
+}
+
+func TestOrderErrors(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		s := newTestServer(t)
+		s.addDeliveryZone()
+		product := s.createProduct("Чайник", 1000, 500)
+		cashOrder := s.placeOrder(product, `{"type":"cash"}`)
+		cardOrder := s.placeOrder(product, `{"type":"card","card_token":"tok_4242424242"}`)
+
+		emptyCart := s.createUser(User{Name: "Анна", Latitude: 55.76, Longitude: 37.64})
+		s.addPaymentMethod(emptyCart.Id, `{"type":"cash"}`)
+		noPayment := s.createUser(User{Name: "Иван", Latitude: 55.76, Longitude: 37.64, Cart: []int64{product.Id}})
+		unknownProduct := s.createUser(User{Name: "Петр", Latitude: 55.76, Longitude: 37.64, Cart: []int64{999}})
+		s.addPaymentMethod(unknownProduct.Id, `{"type":"cash"}`)
+		faraway := s.createUser(User{Name: "Олег", Latitude: 43.11, Longitude: 131.88, Cart: []int64{product.Id}})
+		s.addPaymentMethod(faraway.Id, `{"type":"cash"}`)
+		withCart := s.createUser(User{Name: "Ольга", Latitude: 55.76, Longitude: 37.64, Cart: []int64{product.Id}})
+		s.addPaymentMethod(withCart.Id, `{"type":"cash"}`)
+
+		tests := []struct {
+			name   string
+			method string
+			path   string
+			body   string
+			code   ErrorCode
+		}{
+			{"оформление с некорректным ID", http.MethodPost, "/user/abc/checkout", "", CodeInvalidParameter},
+			{"оформление несуществующим пользователем", http.MethodPost, "/user/999/checkout", "", CodeUserNotFound},
+			{"пустая корзина", http.MethodPost, fmt.Sprintf("/user/%d/checkout", emptyCart.Id), "", CodeCartEmpty},
+			{"без способа оплаты", http.MethodPost, fmt.Sprintf("/user/%d/checkout", noPayment.Id), "", CodePaymentMethodNotSelected},
+			{"несуществующий товар в корзине", http.MethodPost, fmt.Sprintf("/user/%d/checkout", unknownProduct.Id), "", CodeCartProductNotFound},
+			{"вне зоны доставки", http.MethodPost, fmt.Sprintf("/user/%d/checkout", faraway.Id), "", CodeShippingUnavailable},
+			{"несуществующий способ оплаты", http.MethodPost, fmt.Sprintf("/user/%d/checkout", noPayment.Id), `{"payment_method_id":999}`, CodePaymentMethodNotSelected},
+			{"несуществующий тариф", http.MethodPost, fmt.Sprintf("/user/%d/checkout", withCart.Id), `{"shipping_rate_id":999}`, CodeShippingUnavailable},
+			{"заказы с некорректным фильтром", http.MethodGet, "/orders?user_id=abc", "", CodeInvalidParameter},
+			{"несуществующий заказ", http.MethodGet, "/order/999", "", CodeOrderNotFound},
+			{"некорректный ID заказа", http.MethodGet, "/order/abc", "", CodeInvalidParameter},
+			{"неизвестный статус", http.MethodPatch, fmt.Sprintf("/order/%d/status", cashOrder.Id), `{"status":"lost"}`, CodeInvalidOrderStatus},
+			{"статус без значения", http.MethodPatch, fmt.Sprintf("/order/%d/status", cashOrder.Id), `{}`, CodeValidationFailed},
+			{"статус несуществующего заказа", http.MethodPatch, "/order/999/status", `{"status":"paid"}`, CodeOrderNotFound},
+			{"ручная оплата", http.MethodPatch, fmt.Sprintf("/order/%d/status", cardOrder.Id), `{"status":"paid"}`, CodeInvalidOrderTransition},
+			{"ручной возврат денег", http.MethodPatch, fmt.Sprintf("/order/%d/status", cashOrder.Id), `{"status":"refunded"}`, CodeInvalidOrderTransition},
+			{"отправка неоплаченного заказа картой", http.MethodPatch, fmt.Sprintf("/order/%d/status", cardOrder.Id), `{"status":"shipped"}`, CodeOrderNotShippable},
+			{"доставка без отправки", http.MethodPatch, fmt.Sprintf("/order/%d/status", cashOrder.Id), `{"status":"delivered"}`, CodeInvalidOrderTransition},
+			{"оплата заказа с оплатой при получении", http.MethodPost, fmt.Sprintf("/order/%d/pay", cashOrder.Id), "", CodePaymentOnDelivery},
+			{"оплата несуществующего заказа", http.MethodPost, "/order/999/pay", "", CodeOrderNotFound},
+			{"платежи с некорректным ID", http.MethodGet, "/order/abc/payments", "", CodeInvalidParameter},
+			{"отправка неоплаченного заказа", http.MethodPost, fmt.Sprintf("/order/%d/shipment", cardOrder.Id), `{"carrier":"cdek","tracking_number":"TRK"}`, CodeOrderNotShippable},
+			{"отправка без трек-номера", http.MethodPost, fmt.Sprintf("/order/%d/shipment", cashOrder.Id), `{"carrier":"cdek"}`, CodeValidationFailed},
+			{"отправка лишних единиц", http.MethodPost, fmt.Sprintf("/order/%d/shipment", cashOrder.Id),
+				fmt.Sprintf(`{"carrier":"cdek","tracking_number":"TRK","items":[{"order_item_id":%d,"quantity":3}]}`, cashOrder.Items[0].Id), CodeShipmentQuantity},
+			{"отслеживание несуществующего заказа", http.MethodGet, "/order/999/tracking", "", CodeOrderNotFound},
+			{"возврат недоставленного заказа", http.MethodPost, fmt.Sprintf("/order/%d/return", cashOrder.Id), "", CodeOrderNotDelivered},
+			{"возврат несуществующего заказа", http.MethodPost, "/order/999/return", "", CodeOrderNotFound},
+			{"несуществующий возврат", http.MethodGet, "/return/999", "", CodeReturnNotFound},
+			{"одобрение несуществующего возврата", http.MethodPost, "/return/999/approve", "", CodeReturnNotFound},
+			{"возвраты с некорректным фильтром", http.MethodGet, "/returns?order_id=abc", "", CodeInvalidParameter},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				expectError(t, s.sendJSON(tt.method, tt.path, tt.body), tt.code)
+			})
+		}
+
+		t.Run("status transitions", func(t *testing.T) {
+			order := s.placeOrder(product, `{"type":"cash"}`)
+			statusPath := fmt.Sprintf("/order/%d/status", order.Id)
+			expectStatus(t, s.sendJSON(http.MethodPatch, statusPath, `{"status":"cancelled"}`), http.StatusOK)
+			expectError(t, s.sendJSON(http.MethodPatch, statusPath, `{"status":"shipped"}`), CodeInvalidOrderTransition)
+			if got := s.getOrder(order.Id); got.Status != OrderStatusCancelled {
+				t.Fatalf("статус отмененного заказа %s", got.Status)
+			}
+			entries := decodeResponse[[]AuditEntry](t, s.sendJSON(http.MethodGet, fmt.Sprintf("/audit?entity=order&id=%d", order.Id), ""))
+			if len(entries) != 1 || string(entries[0].Changes["status"].Before) != `"pending"` || string(entries[0].Changes["status"].After) != `"cancelled"` {
+				t.Fatalf("журнал заказа %+v", entries)
+			}
+		})
+
+		t.Run("webhooks", func(t *testing.T) {
+			payload, header := s.provider.Webhook("evt_1", PaymentEventSucceeded, "fake_pi_1", 100)
+			header.Set(fakeSignatureHeader, "00"+header.Get(fakeSignatureHeader)[2:])
+			expectError(t, s.do(http.MethodPost, "/webhooks/payments", "application/json", payload, header), CodeInvalidSignature)
+			expectError(t, s.webhook("", PaymentEventSucceeded, "fake_pi_1", 100), CodeInvalidEvent)
+			if w := s.webhook("evt_unknown", PaymentEventSucceeded, "fake_pi_999", 100); w.Code != http.StatusOK {
+				t.Fatalf("вебхук неизвестного платежа: %d %s", w.Code, w.Body)
+			}
+
+			type payResult struct {
+				Payment      Payment `json:"payment"`
+				ClientSecret string  `json:"client_secret"`
+			}
+			w := s.sendJSON(http.MethodPost, fmt.Sprintf("/order/%d/pay", cardOrder.Id), "")
+			expectStatus(t, w, http.StatusCreated)
+			first := decodeResponse[payResult](t, w)
+			intentId := first.Payment.IntentId
+			// Повторная попытка оплаты получает то же намерение, а не второе.
+			w = s.sendJSON(http.MethodPost, fmt.Sprintf("/order/%d/pay", cardOrder.Id), "")
+			expectStatus(t, w, http.StatusOK)
+			if again := decodeResponse[payResult](t, w); again.Payment.Id != first.Payment.Id || again.ClientSecret != first.ClientSecret {
+				t.Fatalf("повторная оплата %+v, ожидалась %+v", again, first)
+			}
+			// Событие с другой суммой не оплачивает заказ.
+			expectStatus(t, s.webhook("evt_short", PaymentEventSucceeded, intentId, cardOrder.Amount-1), http.StatusOK)
+			if got := s.getOrder(cardOrder.Id); got.Status != OrderStatusPending {
+				t.Fatalf("статус после события с другой суммой %s", got.Status)
+			}
+			expectStatus(t, s.webhook("evt_2", PaymentEventSucceeded, intentId, cardOrder.Amount), http.StatusOK)
+			expectError(t, s.sendJSON(http.MethodPost, fmt.Sprintf("/order/%d/pay", cardOrder.Id), ""), CodeOrderNotAwaitingPayment)
+			// Запоздавшая ошибка оплаты не отменяет списание.
+			expectStatus(t, s.webhook("evt_late", PaymentEventFailed, intentId, cardOrder.Amount), http.StatusOK)
+			payments := decodeResponse[[]Payment](t, s.sendJSON(http.MethodGet, fmt.Sprintf("/order/%d/payments", cardOrder.Id), ""))
+			if len(payments) != 1 || payments[0].Status != PaymentStatusSucceeded {
+				t.Fatalf("платежи после запоздавшей ошибки %+v", payments)
+			}
+		})
+
+		t.Run("payment for cancelled order", func(t *testing.T) {
+			payCancelled := func() (Order, string) {
+				t.Helper()
+				order := s.placeOrder(product, `{"type":"card","card_token":"tok_4242424242"}`)
+				w := s.sendJSON(http.MethodPost, fmt.Sprintf("/order/%d/pay", order.Id), "")
+				expectStatus(t, w, http.StatusCreated)
+				intentId := decodeResponse[struct {
+					Payment Payment `json:"payment"`
+				}](t, w).Payment.IntentId
+				expectStatus(t, s.sendJSON(http.MethodPatch, fmt.Sprintf("/order/%d/status", order.Id), `{"status":"cancelled"}`), http.StatusOK)
+				return order, intentId
+			}
+			checkPayment := func(order Order, status string) {
+				t.Helper()
+				payments := decodeResponse[[]Payment](t, s.sendJSON(http.MethodGet, fmt.Sprintf("/order/%d/payments", order.Id), ""))
+				if len(payments) != 1 || payments[0].Status != status || payments[0].Error == "" {
+					t.Fatalf("платежи отмененного заказа %+v, ожидался статус %s", payments, status)
+				}
+				if got := s.getOrder(order.Id); got.Status != OrderStatusCancelled {
+					t.Fatalf("статус отмененного заказа после оплаты %s", got.Status)
+				}
+			}
+
+			// Списанные деньги не теряются: платеж уходит на ручную проверку.
+			order, intentId := payCancelled()
+			expectStatus(t, s.webhook("evt_cancelled_paid", PaymentEventSucceeded, intentId, order.Amount), http.StatusOK)
+			checkPayment(order, PaymentStatusReview)
+
+			// Авторизация по отмененному заказу не списывается.
+			order, intentId = payCancelled()
+			expectStatus(t, s.webhook("evt_cancelled_auth", PaymentEventAuthorized, intentId, order.Amount), http.StatusOK)
+			checkPayment(order, PaymentStatusFailed)
+			if intent := s.provider.intents[intentId]; intent.Status == "succeeded" {
+				t.Fatalf("авторизация отмененного заказа списана: %+v", intent)
+			}
+		})
+
+		t.Run("payments disabled", func(t *testing.T) {
+			if err := defaultConfig().Validate(); err != nil {
+				t.Fatalf("конфигурация по умолчанию: %v", err)
+			}
+			paymentProvider = newPaymentProvider(defaultConfig().Payments)
+			defer func() { paymentProvider = s.provider }()
+			expectError(t, s.sendJSON(http.MethodPost, fmt.Sprintf("/order/%d/pay", cardOrder.Id), ""), CodePaymentsDisabled)
+			expectError(t, s.webhook("evt_disabled", PaymentEventSucceeded, "fake_pi_1", 100), CodePaymentsDisabled)
+		})
+
+		t.Run("partial shipments", func(t *testing.T) {
+			shipmentPath := fmt.Sprintf("/order/%d/shipment", cashOrder.Id)
+			itemId := cashOrder.Items[0].Id
+			expectStatus(t, s.sendJSON(http.MethodPost, shipmentPath, fmt.Sprintf(`{"carrier":"cdek","tracking_number":"TRK-1","items":[{"order_item_id":%d,"quantity":1}]}`, itemId)), http.StatusCreated)
+			expectError(t, s.sendJSON(http.MethodPost, shipmentPath, fmt.Sprintf(`{"carrier":"cdek","tracking_number":"TRK-2","items":[{"order_item_id":%d,"quantity":2}]}`, itemId)), CodeShipmentQuantity)
+			expectStatus(t, s.sendJSON(http.MethodPost, shipmentPath, `{"carrier":"cdek","tracking_number":"TRK-2"}`), http.StatusCreated)
+			expectError(t, s.sendJSON(http.MethodPost, shipmentPath, `{"carrier":"cdek","tracking_number":"TRK-3"}`), CodeOrderFullyShipped)
+			s.pollUntilDelivered()
+			if got := s.getOrder(cashOrder.Id); got.Status != OrderStatusDelivered {
+				t.Fatalf("статус после доставки %s", got.Status)
+			}
+			expectError(t, s.sendJSON(http.MethodPost, shipmentPath, `{"carrier":"cdek","tracking_number":"TRK-4"}`), CodeOrderNotShippable)
+			expectError(t, s.sendJSON(http.MethodPatch, fmt.Sprintf("/order/%d/status", cashOrder.Id), `{"status":"cancelled"}`), CodeInvalidOrderTransition)
+		})
+
+		t.Run("returns", func(t *testing.T) {
+			returnPath := fmt.Sprintf("/order/%d/return", cashOrder.Id)
+			itemId := cashOrder.Items[0].Id
+			formTests := []struct {
+				name   string
+				fields map[string]string
+				code   ErrorCode
+			}{
+				{"без причины", map[string]string{"items": strconv.FormatInt(itemId, 10)}, CodeValidationFailed},
+				{"некорректные позиции", map[string]string{"reason": "Брак", "items": "первая"}, CodeValidationFailed},
+				{"больше, чем куплено", map[string]string{"reason": "Брак", "items": fmt.Sprintf("%d:3", itemId)}, CodeReturnQuantity},
+				{"чужая позиция", map[string]string{"reason": "Брак", "items": "999"}, CodeReturnQuantity},
+			}
+			for _, tt := range formTests {
+				t.Run(tt.name, func(t *testing.T) {
+					expectError(t, s.form(http.MethodPost, returnPath, tt.fields), tt.code)
+				})
+			}
+
+			rejected := s.createReturn(cashOrder.Id, fmt.Sprintf("%d:2", itemId))
+			base := fmt.Sprintf("/return/%d", rejected.Id)
+			expectError(t, s.sendJSON(http.MethodPost, base+"/refund", ""), CodeReturnNotApproved)
+			expectError(t, s.sendJSON(http.MethodPost, base+"/tracking", `{"carrier":"cdek","tracking_number":"RET"}`), CodeReturnNotAwaitingShip)
+			expectError(t, s.sendJSON(http.MethodPost, base+"/receive", ""), CodeInvalidReturnTransition)
+			returnAction(t, s.sendJSON(http.MethodPost, base+"/reject", `{"comment":"Следы использования"}`), ReturnStatusRejected)
+			expectError(t, s.sendJSON(http.MethodPost, base+"/approve", ""), CodeInvalidReturnTransition)
+
+			approved := s.createReturn(cashOrder.Id, fmt.Sprintf("%d:2", itemId))
+			base = fmt.Sprintf("/return/%d", approved.Id)
+			returnAction(t, s.sendJSON(http.MethodPost, base+"/approve", ""), ReturnStatusApproved)
+			expectError(t, s.sendJSON(http.MethodPost, base+"/tracking", `{"carrier":"cdek"}`), CodeValidationFailed)
+			expectError(t, s.sendJSON(http.MethodPost, base+"/refund", `{"amount":2001}`), CodeInvalidRefundAmount)
+			ret := returnAction(t, s.sendJSON(http.MethodPost, base+"/refund", `{"amount":500}`), ReturnStatusRefunded)
+			if ret.RefundedAmount != 500 || len(ret.Refunds) != 1 || ret.Refunds[0].PaymentId != nil {
+				t.Fatalf("возмещение заказа с оплатой при получении %+v", ret)
+			}
+			expectError(t, s.sendJSON(http.MethodPost, base+"/refund", `{"amount":1501}`), CodeInvalidRefundAmount)
+
+			// Заказ картой, доставленный без успешной оплаты: вернуть деньги
+			// нечем, и возврат не должен считаться проведенным.
+			unpaid := s.placeOrder(product, `{"type":"card","card_token":"tok_4242424242"}`)
+			if _, err := db.Exec("UPDATE orders SET status = ? WHERE id = ?", OrderStatusDelivered, unpaid.Id); err != nil {
+				t.Fatalf("статус заказа: %v", err)
+			}
+			unpaidReturn := s.createReturn(unpaid.Id, strconv.FormatInt(unpaid.Items[0].Id, 10))
+			base = fmt.Sprintf("/return/%d", unpaidReturn.Id)
+			returnAction(t, s.sendJSON(http.MethodPost, base+"/approve", ""), ReturnStatusApproved)
+			expectError(t, s.sendJSON(http.MethodPost, base+"/refund", ""), CodeRefundNoPayment)
+			if got := decodeResponse[Return](t, s.sendJSON(http.MethodGet, base, "")); got.Status != ReturnStatusApproved || got.RefundedAmount != 0 || len(got.Refunds) != 0 {
+				t.Fatalf("возврат заказа без оплаты %+v", got)
+			}
+		})
+	})
+}
+
+// TestConcurrentRequests проверяет обработчики, которые должны оставаться
+// корректными при одновременных запросах к одним и тем же данным.
+func TestConcurrentRequests(t *testing.T) {
+	const workers = 8
+	parallel := func(fn func(i int) *httptest.ResponseRecorder) []*httptest.ResponseRecorder {
+		responses := make([]*httptest.ResponseRecorder, workers)
+		var wg sync.WaitGroup
+		for i := range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				responses[i] = fn(i)
+			}()
+		}
+		wg.Wait()
+		return responses
+	}
+	countStatus := func(responses []*httptest.ResponseRecorder, status int) int {
+		n := 0
+		for _, w := range responses {
+			if w.Code == status {
+				n++
+			}
+		}
+		return n
+	}
+
+	forEachDialect(t, func(t *testing.T) {
+		s := newTestServer(t)
+		s.addDeliveryZone()
+
+		t.Run("product uploads", func(t *testing.T) {
+			responses := parallel(func(i int) *httptest.ResponseRecorder {
+				return s.form(http.MethodPost, "/product", map[string]string{"name": fmt.Sprintf("Товар %d", i), "price": "100"},
+					formFile{"image", "photo.png", testImage})
+			})
+			if n := countStatus(responses, http.StatusCreated); n != workers {
+				t.Fatalf("создано %d товаров из %d", n, workers)
+			}
+			products := decodeResponse[[]Product](t, s.sendJSON(http.MethodGet, "/products", ""))
+			images := make(map[string]bool)
+			for _, p := range products {
+				if !imageExists(p.Image) {
+					t.Errorf("изображение %s товара %d отсутствует на диске", p.Image, p.Id)
+				}
+				images[p.Image] = true
+			}
+			if len(products) != workers || len(images) != workers || len(uploadedFiles(t)) != workers {
+				t.Fatalf("товаров %d, разных изображений %d, файлов %v", len(products), len(images), uploadedFiles(t))
+			}
+		})
+
+		product := s.createProduct("Чайник", 1000, 500)
+
+		t.Run("checkout", func(t *testing.T) {
+			user := s.createUser(User{Name: "Мария", Latitude: 55.76, Longitude: 37.64, Cart: []int64{product.Id}})
+			s.addPaymentMethod(user.Id, `{"type":"cash"}`)
+			responses := parallel(func(int) *httptest.ResponseRecorder {
+				return s.sendJSON(http.MethodPost, fmt.Sprintf("/user/%d/checkout", user.Id), "")
+			})
+			if n := countStatus(responses, http.StatusCreated); n != 1 {
+				t.Fatalf("одна корзина оформлена %d раз", n)
+			}
+			for _, w := range responses {
+				if w.Code != http.StatusCreated && !strings.Contains(w.Body.String(), string(CodeCartEmpty)) {
+					expectError(t, w, CodeCartChanged)
+				}
+			}
+			if orders := decodeResponse[[]Order](t, s.sendJSON(http.MethodGet, fmt.Sprintf("/orders?user_id=%d", user.Id), "")); len(orders) != 1 {
+				t.Fatalf("заказов пользователя %d", len(orders))
+			}
+		})
+
+		t.Run("payments", func(t *testing.T) {
+			order := s.placeOrder(product, `{"type":"card","card_token":"tok_4242424242"}`)
+			responses := parallel(func(int) *httptest.ResponseRecorder {
+				return s.sendJSON(http.MethodPost, fmt.Sprintf("/order/%d/pay", order.Id), "")
+			})
+			if n := countStatus(responses, http.StatusCreated); n < 1 || n+countStatus(responses, http.StatusOK) != len(responses) {
+				t.Fatalf("создано платежей %d из %d ответов", n, len(responses))
+			}
+			payments := decodeResponse[[]Payment](t, s.sendJSON(http.MethodGet, fmt.Sprintf("/order/%d/payments", order.Id), ""))
+			open := 0
+			for _, payment := range payments {
+				if payment.Status == PaymentStatusCreated {
+					open++
+				}
+			}
+			if open != 1 {
+				t.Fatalf("незавершенных платежей %d: %+v", open, payments)
+			}
+		})
+
+		t.Run("duplicate webhooks", func(t *testing.T) {
+			order := s.placeOrder(product, `{"type":"card","card_token":"tok_4242424242"}`)
+			w := s.sendJSON(http.MethodPost, fmt.Sprintf("/order/%d/pay", order.Id), "")
+			expectStatus(t, w, http.StatusCreated)
+			intentId := decodeResponse[struct {
+				Payment Payment `json:"payment"`
+			}](t, w).Payment.IntentId
+
+			responses := parallel(func(int) *httptest.ResponseRecorder {
+				return s.webhook("evt_concurrent", PaymentEventAuthorized, intentId, order.Amount)
+			})
+			processed := 0
+			for _, w := range responses {
+				expectStatus(t, w, http.StatusOK)
+				if strings.Contains(w.Body.String(), "Событие обработано") {
+					processed++
+				}
+			}
+			if processed != 1 {
+				t.Fatalf("событие обработано %d раз", processed)
+			}
+			if got := s.getOrder(order.Id); got.Status != OrderStatusPaid {
+				t.Fatalf("статус заказа %s", got.Status)
+			}
+		})
+
+		t.Run("refunds", func(t *testing.T) {
+			order := s.placeOrder(product, `{"type":"card","card_token":"tok_4242424242"}`)
+			w := s.sendJSON(http.MethodPost, fmt.Sprintf("/order/%d/pay", order.Id), "")
+			expectStatus(t, w, http.StatusCreated)
+			intentId := decodeResponse[struct {
+				Payment Payment `json:"payment"`
+			}](t, w).Payment.IntentId
+			expectStatus(t, s.webhook("evt_refunds", PaymentEventSucceeded, intentId, order.Amount), http.StatusOK)
+			expectStatus(t, s.sendJSON(http.MethodPost, fmt.Sprintf("/order/%d/shipment", order.Id), `{"carrier":"cdek","tracking_number":"TRK-R"}`), http.StatusCreated)
+			s.pollUntilDelivered()
+			ret := s.createReturn(order.Id, fmt.Sprintf("%d:2", order.Items[0].Id))
+			returnAction(t, s.sendJSON(http.MethodPost, fmt.Sprintf("/return/%d/approve", ret.Id), ""), ReturnStatusApproved)
+
+			// Восемь возмещений по 300 больше стоимости позиций (2000):
+			// проходят только шесть.
+			responses := parallel(func(int) *httptest.ResponseRecorder {
+				return s.sendJSON(http.MethodPost, fmt.Sprintf("/return/%d/refund", ret.Id), `{"amount":300}`)
+			})
+			if n := countStatus(responses, http.StatusOK); n != 6 {
+				t.Fatalf("успешных возмещений %d", n)
+			}
+			for _, w := range responses {
+				if w.Code != http.StatusOK {
+					expectError(t, w, CodeInvalidRefundAmount)
+				}
+			}
+			got := decodeResponse[Return](t, s.sendJSON(http.MethodGet, fmt.Sprintf("/return/%d", ret.Id), ""))
+			refunded := 0
+			for _, refund := range got.Refunds {
+				refunded += refund.Amount
+			}
+			if got.RefundedAmount != 1800 || len(got.Refunds) != 6 || refunded != 1800 {
+				t.Fatalf("возмещено %d, записей %d на %d", got.RefundedAmount, len(got.Refunds), refunded)
+			}
+			if entries := decodeResponse[[]AuditEntry](t, s.sendJSON(http.MethodGet, "/audit?entity=refund", "")); len(entries) != 6 {
+				t.Fatalf("возмещений в журнале %d", len(entries))
+			}
+		})
+
+		t.Run("conditional updates", func(t *testing.T) {
+			product := s.createProduct("Чайник", 1990, 800)
+			productPath := fmt.Sprintf("/product/%d", product.Id)
+			responses := parallel(func(i int) *httptest.ResponseRecorder {
+				return s.do(http.MethodPatch, productPath, "application/json", []byte(fmt.Sprintf(`{"price":%d}`, 2000+i)), http.Header{"If-Match": {`"1"`}})
+			})
+			if ok, failed := countStatus(responses, http.StatusOK), countStatus(responses, http.StatusPreconditionFailed); ok != 1 || failed != workers-1 {
+				t.Fatalf("успешных изменений %d, отклоненных %d", ok, failed)
+			}
+			if got := decodeResponse[Product](t, s.sendJSON(http.MethodGet, productPath, "")); got.Version != 2 {
+				t.Fatalf("версия после изменения %+v", got)
+			}
+		})
+
+		t.Run("user updates", func(t *testing.T) {
+			user := s.createUser(User{Name: "Иван", Latitude: 55.76, Longitude: 37.64})
+			userPath := fmt.Sprintf("/user/%d", user.Id)
+			responses := parallel(func(i int) *httptest.ResponseRecorder {
+				return s.sendJSON(http.MethodPatch, userPath, fmt.Sprintf(`{"name":"Иван %d"}`, i))
+			})
+			updated, conflicts := countStatus(responses, http.StatusOK), countStatus(responses, http.StatusConflict)
+			if updated == 0 || updated+conflicts != workers {
+				t.Fatalf("успешных изменений %d, конфликтов %d из %d", updated, conflicts, workers)
+			}
+			if got := decodeResponse[User](t, s.sendJSON(http.MethodGet, userPath, "")); got.Version != int64(1+updated) {
+				t.Fatalf("версия %d после %d изменений", got.Version, updated)
+			}
+		})
+
+		t.Run("default payment method", func(t *testing.T) {
+			user := s.createUser(User{Name: "Иван", Latitude: 55.76, Longitude: 37.64})
+			var methods []PaymentMethod
+			for range workers {
+				methods = append(methods, s.addPaymentMethod(user.Id, `{"type":"wallet"}`))
+			}
+			responses := parallel(func(i int) *httptest.ResponseRecorder {
+				return s.sendJSON(http.MethodPost, fmt.Sprintf("/user/%d/payment-method/%d/default", user.Id, methods[i].Id), "")
+			})
+			if n := countStatus(responses, http.StatusOK); n != workers {
+				t.Fatalf("успешных запросов %d из %d", n, workers)
+			}
+			defaults := 0
+			for _, pm := range decodeResponse[[]PaymentMethod](t, s.sendJSON(http.MethodGet, fmt.Sprintf("/user/%d/payment-methods", user.Id), "")) {
+				if pm.IsDefault {
+					defaults++
+				}
+			}
+			if defaults != 1 {
+				t.Fatalf("способов оплаты по умолчанию %d", defaults)
+			}
+		})
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requireIfMatch — изменение и удаление товаров и пользователей без
+// If-Match отклоняются с 428 (см. ServerConfig.RequireIfMatch).
+var requireIfMatch = defaultConfig().Server.RequireIfMatch
+
+// etag возвращает сильный ETag версии объекта.
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+func setETag(c *gin.Context, version int64) {
+	c.Header("ETag", etag(version))
+}
+
+// etagListMatches проверяет, есть ли версия в списке ETag из If-Match или
+// If-None-Match. "*" совпадает с любой версией. При слабом сравнении
+// (If-None-Match) префикс W/ игнорируется, при сильном такие теги не
+// совпадают ни с чем.
+func etagListMatches(header string, version int64, weak bool) bool {
+	return tagListMatches(header, etag(version), weak)
+}
+
+// tagListMatches — etagListMatches для произвольного ETag want.
+func tagListMatches(header, want string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[len("W/"):]
+		}
+		if tag == want {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified отвечает 304, если If-None-Match совпадает с текущей версией
+// объекта. Заголовок ETag выставляется в любом случае.
+func notModified(c *gin.Context, version int64) bool {
+	return notModifiedTag(c, etag(version))
+}
+
+// variantETag возвращает слабый ETag представления объекта, которое зависит
+// не только от версии, например цены в другой валюте. Слабый тег не
+// совпадает с If-Match, так что изменять объект по нему нельзя.
+func variantETag(version int64, variant ...string) string {
+	return `W/"` + strconv.FormatInt(version, 10) + "-" + strings.Join(variant, "-") + `"`
+}
+
+// notModifiedTag — notModified для готового ETag, например variantETag.
+func notModifiedTag(c *gin.Context, tag string) bool {
+	c.Header("ETag", tag)
+	header := c.GetHeader("If-None-Match")
+	if header == "" || !tagListMatches(header, strings.TrimPrefix(tag, "W/"), true) {
+		return false
+	}
+	c.Status(http.StatusNotModified)
+	return true
+}
+
+// checkIfMatch сверяет If-Match с текущей версией объекта перед изменением
+// или удалением. При несовпадении отвечает 412, при отсутствии заголовка,
+// если он обязателен, — 428. При ошибке ответ уже отправлен.
+func checkIfMatch(c *gin.Context, version int64) bool {
+	header := c.GetHeader("If-Match")
+	switch {
+	case header == "" && requireIfMatch:
+		respondError(c, CodePreconditionRequired)
+		return false
+	case header != "" && !etagListMatches(header, version, false):
+		setETag(c, version)
+		respondError(c, CodePreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// respondVersionConflict отвечает на errVersionConflict репозитория: объект
+// изменился между чтением и записью. Если клиент передавал If-Match, это
+// несовпадение предусловия, иначе — конфликт параллельных запросов.
+func respondVersionConflict(c *gin.Context) {
+	if c.GetHeader("If-Match") != "" {
+		respondError(c, CodePreconditionFailed)
+		return
+	}
+	respondError(c, CodeVersionConflict)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const fakeSignatureHeader = "X-Fake-Signature"
+
+// FakePaymentProvider хранит платежи в памяти и подписывает вебхуки
+// HMAC-SHA256 от тела запроса. Используется локально и в тестах.
+type FakePaymentProvider struct {
+	secret string
+
+	mu      sync.Mutex
+	seq     int
+	intents map[string]*PaymentIntent
+	refunds map[string]int
+	// refundKeys — возвраты по ключам идемпотентности.
+	refundKeys map[string]PaymentRefund
+}
+
+type fakeWebhookPayload struct {
+	Id       string `json:"id"`
+	Type     string `json:"type"`
+	IntentId string `json:"intent_id"`
+	Amount   int    `json:"amount"`
+}
+
+func NewFakePaymentProvider(secret string) *FakePaymentProvider {
+	return &FakePaymentProvider{
+		secret:     secret,
+		intents:    make(map[string]*PaymentIntent),
+		refunds:    make(map[string]int),
+		refundKeys: make(map[string]PaymentRefund),
+	}
+}
+
+func (f *FakePaymentProvider) Name() string {
+	return "fake"
+}
+
+func (f *FakePaymentProvider) CreateIntent(ctx context.Context, orderId int64, amount int, currency string) (PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	intent := &PaymentIntent{
+		Id:           fmt.Sprintf("fake_pi_%d", f.seq),
+		ClientSecret: fmt.Sprintf("fake_pi_%d_secret", f.seq),
+		Status:       "requires_payment_method",
+		Amount:       amount,
+		Currency:     currency,
+	}
+	f.intents[intent.Id] = intent
+	return *intent, nil
+}
+
+func (f *FakePaymentProvider) Capture(ctx context.Context, intentId string) (PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	intent, ok := f.intents[intentId]
+	if !ok {
+		return PaymentIntent{}, fmt.Errorf("платеж %s не найден", intentId)
+	}
+	intent.Status = "succeeded"
+	return *intent, nil
+}
+
+func (f *FakePaymentProvider) Refund(ctx context.Context, intentId string, amount int, idempotencyKey string) (PaymentRefund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if refund, ok := f.refundKeys[idempotencyKey]; ok && idempotencyKey != "" {
+		return refund, nil
+	}
+	intent, ok := f.intents[intentId]
+	if !ok {
+		return PaymentRefund{}, fmt.Errorf("платеж %s не найден", intentId)
+	}
+	if f.refunds[intentId]+amount > intent.Amount {
+		return PaymentRefund{}, errors.New("сумма возврата превышает сумму платежа")
+	}
+	f.refunds[intentId] += amount
+	f.seq++
+	refund := PaymentRefund{Id: fmt.Sprintf("fake_re_%d", f.seq), Status: "succeeded", Amount: amount}
+	if idempotencyKey != "" {
+		f.refundKeys[idempotencyKey] = refund
+	}
+	return refund, nil
+}
+
+func (f *FakePaymentProvider) VerifyWebhook(payload []byte, header http.Header) (PaymentEvent, error) {
+	signature, err := hex.DecodeString(header.Get(fakeSignatureHeader))
+	if err != nil || !hmac.Equal(signature, f.sign(payload)) {
+		return PaymentEvent{}, errInvalidWebhookSignature
+	}
+	var body fakeWebhookPayload
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return PaymentEvent{}, err
+	}
+	return PaymentEvent{Id: body.Id, Type: body.Type, IntentId: body.IntentId, Amount: body.Amount}, nil
+}
+
+// Webhook собирает подписанное тело вебхука, как его отправил бы провайдер.
+func (f *FakePaymentProvider) Webhook(eventId, eventType, intentId string, amount int) ([]byte, http.Header) {
+	payload, _ := json.Marshal(fakeWebhookPayload{Id: eventId, Type: eventType, IntentId: intentId, Amount: amount})
+	header := http.Header{}
+	header.Set(fakeSignatureHeader, hex.EncodeToString(f.sign(payload)))
+	return payload, header
+}
+
+func (f *FakePaymentProvider) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(f.secret))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"math/big"
+)
+
+// fixtureRates — курсы FixtureRateProvider к рублю.
+var fixtureRates = map[string]string{
+	"USD": "90",
+	"EUR": "100",
+	"CNY": "12.5",
+	"KZT": "0.2",
+}
+
+// FixtureRateProvider отдает постоянные курсы без обращения к сети.
+// Используется локально и в тестах.
+type FixtureRateProvider struct{}
+
+func NewFixtureRateProvider() *FixtureRateProvider {
+	return &FixtureRateProvider{}
+}
+
+func (f *FixtureRateProvider) Name() string {
+	return "fixture"
+}
+
+func (f *FixtureRateProvider) Rates(ctx context.Context) (map[string]*big.Rat, error) {
+	rates := make(map[string]*big.Rat, len(fixtureRates))
+	for currency, value := range fixtureRates {
+		rates[currency], _ = new(big.Rat).SetString(value)
+	}
+	return rates, nil
+}
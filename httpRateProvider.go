@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// HTTPRateProvider загружает курсы по GET с url в распространенном формате
+// {"base": "USD", "rates": {"RUB": 92.5, "EUR": 0.92}}, где rates — сколько
+// единиц валюты дают за единицу base. Если base не рубль, в ответе должен
+// быть курс рубля.
+type HTTPRateProvider struct {
+	url    string
+	client *http.Client
+}
+
+type httpRatesResponse struct {
+	Base  string                 `json:"base"`
+	Rates map[string]json.Number `json:"rates"`
+}
+
+func NewHTTPRateProvider(url string) *HTTPRateProvider {
+	return &HTTPRateProvider{url: url, client: &http.Client{Timeout: 15 * time.Second}}
+}
+
+func (p *HTTPRateProvider) Name() string {
+	return "http"
+}
+
+func (p *HTTPRateProvider) Rates(ctx context.Context) (map[string]*big.Rat, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("источник курсов вернул статус %d", resp.StatusCode)
+	}
+	var response httpRatesResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("некорректный ответ источника курсов: %w", err)
+	}
+	return ratesToBase(response)
+}
+
+// ratesToBase переводит курсы вида "единиц валюты за единицу base" в курсы
+// к baseCurrency: стоимость единицы валюты в рублях.
+func ratesToBase(response httpRatesResponse) (map[string]*big.Rat, error) {
+	quotes := make(map[string]*big.Rat, len(response.Rates)+1)
+	for currency, value := range response.Rates {
+		rate, ok := new(big.Rat).SetString(value.String())
+		if !ok || rate.Sign() <= 0 {
+			return nil, fmt.Errorf("некорректный курс %s: %s", currency, value)
+		}
+		quotes[strings.ToUpper(currency)] = rate
+	}
+	base := strings.ToUpper(response.Base)
+	quotes[base] = big.NewRat(1, 1)
+	basePrice, ok := quotes[baseCurrency]
+	if !ok {
+		return nil, fmt.Errorf("в ответе источника нет курса %s", baseCurrency)
+	}
+
+	rates := make(map[string]*big.Rat, len(quotes))
+	for currency, quote := range quotes {
+		rates[currency] = new(big.Rat).Quo(basePrice, quote)
+	}
+	return rates, nil
+}
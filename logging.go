@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestIdHeader = "X-Request-ID"
+
+const maxRequestIdLength = 128
+
+type loggerContextKey struct{}
+
+// parseLogLevel принимает debug, info, warn или error.
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return l, fmt.Errorf("неизвестный уровень логирования '%s', ожидается debug, info, warn или error", level)
+	}
+	return l, nil
+}
+
+// newLogger создает JSON-логгер. Уровень должен быть проверен заранее
+// через Config.Validate.
+func newLogger(w io.Writer, cfg LoggingConfig) *slog.Logger {
+	level, _ := parseLogLevel(cfg.Level)
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// requestLog возвращает логгер текущего запроса с request_id, маршрутом
+// и пользователем. Вне запроса возвращается логгер по умолчанию.
+func requestLog(c *gin.Context) *slog.Logger {
+	return loggerFromContext(c.Request.Context())
+}
+
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// requestLogger принимает X-Request-ID от клиента или генерирует новый,
+// возвращает его в ответе, кладет в контекст запроса логгер с полями
+// запроса (и trace_id, если запрос трассируется) и по завершении пишет строку с итогом: статус и время обработки.
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		requestId := c.GetHeader(requestIdHeader)
+		if !isValidRequestId(requestId) {
+			requestId = newRequestId()
+		}
+		c.Header(requestIdHeader, requestId)
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		attrs := []any{"request_id", requestId, "method", c.Request.Method, "route", route}
+		if strings.HasPrefix(route, "/user/:id") {
+			attrs = append(attrs, "user_id", c.Param("id"))
+		}
+		if spanContext := trace.SpanContextFromContext(c.Request.Context()); spanContext.HasTraceID() {
+			attrs = append(attrs, "trace_id", spanContext.TraceID().String())
+		}
+		logger := slog.Default().With(attrs...)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), loggerContextKey{}, logger))
+
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		logger.Log(c.Request.Context(), level, "Запрос обработан",
+			"path", c.Request.URL.Path,
+			"status", status,
+			"latency_ms", float64(time.Since(start).Microseconds())/1000,
+			"bytes", c.Writer.Size(),
+			"client_ip", c.ClientIP(),
+		)
+	}
+}
+
+func isValidRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLength {
+		return false
+	}
+	for _, ch := range id {
+		isAlnum := ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9'
+		if !isAlnum && !strings.ContainsRune("-_.:", ch) {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
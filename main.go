@@ -1,29 +1,44 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
-	"log"
-    "strings"
-    "strconv"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
 	"github.com/gin-gonic/gin"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 type Product struct {
-	Id    int64  `json:"id"`
-	Name  string `json:"name" binding:"required"`
-	Price int    `json:"price" binding:"required"`
-	Image string `json:"image" binding:"required"`
+	Id   int64  `json:"id"`
+	Name string `json:"name"`
+	// Price — цена в минимальных единицах валюты Currency (копейках для
+	// рубля).
+	Price    int    `json:"price"`
+	Currency string `json:"currency"`
+	// Category — категория товара, по ней ограничиваются купоны и акции.
+	Category string `json:"category"`
+	Image    string `json:"image"`
+	Weight   int    `json:"weight"`
+	// Version увеличивается при каждом изменении и отдается в ETag.
+	Version int64 `json:"version"`
+	// DeletedAt задан у товаров в корзине удаленных (см. getTrash).
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 type User struct {
-	Id        int64   `json:"id"`
-	Name      string  `json:"name" binding:"required"`
-	Latitude  float64 `json:"latitude" binding:"required"`
-	Longitude float64 `json:"longitude" binding:"required"`
-	Is_card   bool    `json:"is_card"`
-	Cart      []int64 `json:"cart"`
+	Id        int64      `json:"id"`
+	Name      string     `json:"name"`
+	Latitude  float64    `json:"latitude"`
+	Longitude float64    `json:"longitude"`
+	Cart      []int64    `json:"cart"`
+	Version   int64      `json:"version"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 func convertInt64ToStringSlice(intSlice []int64) []string {
@@ -41,9 +56,9 @@ func parseCart(cart string) []int64 {
 	}
 	parts := strings.Split(cart, ",")
 	for _, part := range parts {
-		num, err := strconv.ParseInt(part, 10, 64)
+		num, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
 		if err != nil {
-			log.Println("Некорректные данные в cart:", part)
+			slog.Warn("Некорректные данные в cart", "value", part)
 			continue
 		}
 		result = append(result, num)
@@ -51,61 +66,221 @@ func parseCart(cart string) []int64 {
 	return result
 }
 
-var db *sql.DB
+func inTx(ctx context.Context, fn func(tx *Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+var db *DB
+
+// fatal пишет ошибку в лог и завершает процесс.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
 
 func main() {
-	r := gin.Default()
-	var err error
-	db, err = sql.Open("sqlite3", "shop.db")
+	cfg, args, err := loadConfig(os.Args[1:], os.Getenv)
 	if err != nil {
-		log.Fatalf("Ошибка создания базы данных\n%v",err)
+		fatal("Ошибка загрузки конфигурации", err)
+	}
+	if len(args) > 0 && args[0] == "config" {
+		if err := runConfigCommand(cfg, args[1:]); err != nil {
+			fatal("Ошибка конфигурации", err)
+		}
+		return
+	}
+	if err := cfg.validateBase(); err != nil {
+		fatal("Некорректная конфигурация", err)
+	}
+	slog.SetDefault(newLogger(os.Stderr, cfg.Logging))
+	if cfg.Logging.Level != "debug" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	uploadsConfig = cfg.Uploads
+	requireIfMatch = cfg.Server.RequireIfMatch
+	trashRetentionDays = cfg.Trash.RetentionDays
+	cartPricePolicy = cfg.Cart.PricePolicy
+	taxConfig = cfg.Tax
+
+	db, err = openDB(cfg.Database.DSN)
+	if err != nil {
+		fatal("Ошибка создания базы данных", err)
 	}
 	defer db.Close()
 
 	err = db.Ping()
 	if err != nil {
-		log.Fatalf("Ошибка подключения базы данных\n%v",err)
-	}
-
-	productTable := `
-		CREATE TABLE IF NOT EXISTS products (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT NOT NULL,
-			price INTEGER,
-			image TEXT NOT NULL
-		)
-	`
-	_, err = db.Exec(productTable)
+		fatal("Ошибка подключения базы данных", err)
+	}
+
+	migrations, err := loadMigrations(migrationFiles, migrationsDir(db.Dialect))
 	if err != nil {
-		log.Fatalf("Ошибка создания таблицы продуктов\n%v",err)
-	}
-
-	userTable := `
-		CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT NOT NULL,
-			latitude REAL,
-			longitude REAL,
-			is_card INTEGER,
-			cart TEXT 
-		)
-	`
-	_, err = db.Exec(userTable)
+		fatal("Ошибка чтения миграций", err)
+	}
+	if len(args) > 0 && args[0] == "migrate" {
+		if err := runMigrateCommand(migrations, args[1:]); err != nil {
+			fatal("Ошибка миграции", err)
+		}
+		return
+	}
+	if err := cfg.Payments.Validate(); err != nil {
+		fatal("Некорректная конфигурация", err)
+	}
+	applied, err := migrateUp(migrations)
 	if err != nil {
-		log.Fatalf("Ошибка создания таблицы пользователей\n%v",err)
+		fatal("Ошибка применения миграций", err)
 	}
+	for _, m := range applied {
+		slog.Info("Применена миграция", "version", m.Version, "name", m.Name)
+	}
+
+	shutdownTracing, err := setupTracing(context.Background(), cfg.Tracing)
+	if err != nil {
+		fatal("Ошибка настройки трассировки", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("Ошибка отправки трасс при остановке", "error", err)
+		}
+	}()
+
+	registerDBStatsMetrics(db)
+	paymentProvider = newPaymentProvider(cfg.Payments)
+	rateProvider = newRateProvider(cfg.Rates)
+	if err := loadExchangeRates(context.Background()); err != nil {
+		fatal("Ошибка чтения курсов валют", err)
+	}
+	handlers := NewHandlers(NewSQLProductRepository(db), NewSQLUserRepository(db), NewSQLAuditRepository(db), NewSQLPriceHistoryRepository(db))
+	r := newRouter(handlers)
+
+	carrierTracker = NewFakeCarrierTracker()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	srv := newHTTPServer(cfg.Server, r)
+	workers := []func(ctx context.Context){func(ctx context.Context) {
+		runShipmentPoller(ctx, carrierTracker, cfg.Shipments.PollInterval)
+	}, func(ctx context.Context) {
+		runTrashPurger(ctx, handlers, cfg.Trash.RetentionDays, cfg.Trash.PurgeInterval)
+	}}
+	if rateProvider != nil {
+		workers = append(workers, func(ctx context.Context) {
+			runRateUpdater(ctx, cfg.Rates.RefreshInterval)
+		})
+	}
+	err = serve(ctx, srv, cfg.Server.ShutdownTimeout, workers...)
+	if err != nil {
+		fatal("Ошибка HTTP-сервера", err)
+	}
+	slog.Info("Сервер остановлен")
+}
+
+func newRouter(h *Handlers) *gin.Engine {
+	r := gin.New()
+	r.Use(requestTracing(), requestLogger(), requestMetrics(), gin.CustomRecovery(func(c *gin.Context, _ any) {
+		respondError(c, CodeInternal)
+	}))
+	r.NoRoute(func(c *gin.Context) {
+		respondError(c, CodeRouteNotFound)
+	})
+	r.Use(validateRequests())
+
+	r.GET("/metrics", metricsHandler())
+
+	r.GET("/healthz", healthz)
+	r.GET("/readyz", readyz)
+
+	r.GET("/openapi.json", serveOpenAPISpec)
+	r.GET("/docs", serveSwaggerUI)
+
+	r.GET("/products", h.getProducts)
+	r.GET("/product/:id", h.getProduct)
+	r.DELETE("/product/:id", h.deleteProduct)
+	r.POST("/product", h.addProduct)
+	r.PATCH("/product/:id", h.updateProduct)
+	r.POST("/product/:id/restore", h.restoreProduct)
+	r.GET("/product/:id/prices", h.getProductPrices)
+	r.GET("/reports/price-changes", h.getPriceChangesReport)
+
+	r.GET("/exchange-rates", getExchangeRates)
+	r.PUT("/exchange-rate/:currency", h.setExchangeRate)
+
+	r.GET("/users", h.getUsers)
+	r.GET("/user/:id", h.getUser)
+	r.DELETE("/user/:id", h.deleteUser)
+	r.POST("/user", h.addUser)
+	r.PATCH("/user/:id", h.updateUser)
+	r.POST("/user/:id/restore", h.restoreUser)
+
+	r.GET("/trash", h.getTrash)
+	r.GET("/audit", h.getAudit)
+
+	r.GET("/warehouses", getWarehouses)
+	r.POST("/warehouse", h.addWarehouse)
+	r.DELETE("/warehouse/:id", h.deleteWarehouse)
+
+	r.GET("/shipping/zones", getShippingZones)
+	r.POST("/shipping/zone", h.addShippingZone)
+	r.DELETE("/shipping/zone/:id", h.deleteShippingZone)
+
+	r.GET("/shipping/rates", getShippingRates)
+	r.POST("/shipping/rate", h.addShippingRate)
+	r.DELETE("/shipping/rate/:id", h.deleteShippingRate)
+
+	r.POST("/shipping/quote", quoteShipping)
+
+	r.GET("/tax/zones", getTaxZones)
+	r.POST("/tax/zone", h.addTaxZone)
+	r.DELETE("/tax/zone/:id", h.deleteTaxZone)
+
+	r.GET("/tax/rates", getTaxRates)
+	r.POST("/tax/rate", h.addTaxRate)
+	r.DELETE("/tax/rate/:id", h.deleteTaxRate)
+
+	r.GET("/coupons", getCoupons)
+	r.POST("/coupon", h.addCoupon)
+	r.DELETE("/coupon/:id", h.deleteCoupon)
+
+	r.GET("/promotions", getPromotions)
+	r.POST("/promotion", h.addPromotion)
+	r.DELETE("/promotion/:id", h.deletePromotion)
+
+	r.GET("/user/:id/payment-methods", getPaymentMethods)
+	r.POST("/user/:id/payment-method", addPaymentMethod)
+	r.DELETE("/user/:id/payment-method/:methodId", deletePaymentMethod)
+	r.POST("/user/:id/payment-method/:methodId/default", setDefaultPaymentMethod)
+
+	r.GET("/user/:id/cart", getCart)
+	r.POST("/user/:id/checkout", checkout)
+	r.GET("/orders", getOrders)
+	r.GET("/order/:id", getOrder)
+	r.PATCH("/order/:id/status", h.updateOrderStatus)
+	r.POST("/order/:id/pay", requirePayments(), payOrder)
+	r.GET("/order/:id/payments", getOrderPayments)
+
+	r.POST("/webhooks/payments", requirePayments(), paymentWebhook)
 
-	r.GET("/products", getProducts)
-	r.GET("/product/:id", getProduct)
-	r.DELETE("/product/:id", deleteProduct)
-	r.POST("/product", addProduct)
-	r.PATCH("/product/:id", updateProduct)
+	r.POST("/order/:id/return", h.createReturn)
+	r.GET("/returns", getReturns)
+	r.GET("/return/:id", getReturn)
+	r.POST("/return/:id/approve", h.approveReturn)
+	r.POST("/return/:id/reject", h.rejectReturn)
+	r.POST("/return/:id/tracking", h.addReturnTracking)
+	r.POST("/return/:id/receive", h.receiveReturn)
+	r.POST("/return/:id/refund", h.refundReturn)
 
-	r.GET("/users", getUsers)
-	r.GET("/user/:id", getUser)
-	r.DELETE("/user/:id", deleteUser)
-	r.POST("/user", addUser)
-	r.PATCH("/user/:id", updateUser)
+	r.POST("/order/:id/shipment", h.addShipment)
+	r.GET("/order/:id/tracking", getOrderTracking)
 
-	r.Run(":8080")
+	return r
 }
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryProductRepository и memoryUserRepository хранят данные в памяти
+// процесса. Используются в тестах обработчиков вместо файла базы данных.
+// Удаленные записи остаются в map с заполненным DeletedAt.
+type memoryProductRepository struct {
+	mu       sync.RWMutex
+	seq      int64
+	products map[int64]Product
+}
+
+type memoryUserRepository struct {
+	mu    sync.RWMutex
+	seq   int64
+	users map[int64]User
+}
+
+type memoryAuditRepository struct {
+	mu      sync.RWMutex
+	entries []AuditEntry
+}
+
+type memoryPriceHistoryRepository struct {
+	mu      sync.RWMutex
+	changes []PriceChange
+}
+
+func NewMemoryProductRepository() ProductRepository {
+	return &memoryProductRepository{products: make(map[int64]Product)}
+}
+
+func NewMemoryUserRepository() UserRepository {
+	return &memoryUserRepository{users: make(map[int64]User)}
+}
+
+func NewMemoryAuditRepository() AuditRepository {
+	return &memoryAuditRepository{}
+}
+
+func NewMemoryPriceHistoryRepository() PriceHistoryRepository {
+	return &memoryPriceHistoryRepository{}
+}
+
+func (r *memoryProductRepository) List(ctx context.Context) ([]Product, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var products []Product
+	for _, p := range r.products {
+		if p.DeletedAt == nil {
+			products = append(products, p)
+		}
+	}
+	sort.Slice(products, func(i, j int) bool { return products[i].Id < products[j].Id })
+	return products, nil
+}
+
+func (r *memoryProductRepository) ListDeleted(ctx context.Context) ([]Product, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var products []Product
+	for _, p := range r.products {
+		if p.DeletedAt != nil {
+			products = append(products, p)
+		}
+	}
+	sort.Slice(products, func(i, j int) bool { return products[i].DeletedAt.Before(*products[j].DeletedAt) })
+	return products, nil
+}
+
+func (r *memoryProductRepository) Get(ctx context.Context, id int64) (Product, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.products[id]
+	if !ok || p.DeletedAt != nil {
+		return Product{}, errNotFound
+	}
+	return p, nil
+}
+
+func (r *memoryProductRepository) Create(ctx context.Context, product *Product) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	product.Id = r.seq
+	product.Version = 1
+	r.products[product.Id] = *product
+	return nil
+}
+
+func (r *memoryProductRepository) Update(ctx context.Context, product Product) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current, ok := r.products[product.Id]
+	if !ok || current.DeletedAt != nil {
+		return errNotFound
+	}
+	if current.Version != product.Version {
+		return errVersionConflict
+	}
+	product.Version++
+	r.products[product.Id] = product
+	return nil
+}
+
+func (r *memoryProductRepository) Delete(ctx context.Context, id, version int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current, ok := r.products[id]
+	if !ok || current.DeletedAt != nil {
+		return errNotFound
+	}
+	if current.Version != version {
+		return errVersionConflict
+	}
+	now := time.Now().UTC()
+	current.DeletedAt = &now
+	current.Version++
+	r.products[id] = current
+	return nil
+}
+
+func (r *memoryProductRepository) Restore(ctx context.Context, id int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current, ok := r.products[id]
+	if !ok || current.DeletedAt == nil {
+		return errNotFound
+	}
+	current.DeletedAt = nil
+	current.Version++
+	r.products[id] = current
+	return nil
+}
+
+func (r *memoryProductRepository) Purge(ctx context.Context, deletedBefore time.Time) ([]Product, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var purged []Product
+	for id, p := range r.products {
+		if p.DeletedAt != nil && p.DeletedAt.Before(deletedBefore) {
+			purged = append(purged, p)
+			delete(r.products, id)
+		}
+	}
+	return purged, nil
+}
+
+func (r *memoryUserRepository) List(ctx context.Context) ([]User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var users []User
+	for _, u := range r.users {
+		if u.DeletedAt == nil {
+			users = append(users, copyUser(u))
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	return users, nil
+}
+
+func (r *memoryUserRepository) ListDeleted(ctx context.Context) ([]User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var users []User
+	for _, u := range r.users {
+		if u.DeletedAt != nil {
+			users = append(users, copyUser(u))
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].DeletedAt.Before(*users[j].DeletedAt) })
+	return users, nil
+}
+
+func (r *memoryUserRepository) Get(ctx context.Context, id int64) (User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	u, ok := r.users[id]
+	if !ok || u.DeletedAt != nil {
+		return User{}, errNotFound
+	}
+	return copyUser(u), nil
+}
+
+func (r *memoryUserRepository) Create(ctx context.Context, user *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	user.Id = r.seq
+	user.Version = 1
+	r.users[user.Id] = copyUser(*user)
+	return nil
+}
+
+func (r *memoryUserRepository) Update(ctx context.Context, user User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current, ok := r.users[user.Id]
+	if !ok || current.DeletedAt != nil {
+		return errNotFound
+	}
+	if current.Version != user.Version {
+		return errVersionConflict
+	}
+	user.Version++
+	r.users[user.Id] = copyUser(user)
+	return nil
+}
+
+func (r *memoryUserRepository) Delete(ctx context.Context, id, version int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current, ok := r.users[id]
+	if !ok || current.DeletedAt != nil {
+		return errNotFound
+	}
+	if current.Version != version {
+		return errVersionConflict
+	}
+	now := time.Now().UTC()
+	current.DeletedAt = &now
+	current.Version++
+	r.users[id] = current
+	return nil
+}
+
+func (r *memoryUserRepository) Restore(ctx context.Context, id int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current, ok := r.users[id]
+	if !ok || current.DeletedAt == nil {
+		return errNotFound
+	}
+	current.DeletedAt = nil
+	current.Version++
+	r.users[id] = current
+	return nil
+}
+
+// Purge удаляет всех просроченных пользователей: заказов в памяти нет.
+func (r *memoryUserRepository) Purge(ctx context.Context, deletedBefore time.Time) ([]User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var purged []User
+	for id, u := range r.users {
+		if u.DeletedAt != nil && u.DeletedAt.Before(deletedBefore) {
+			purged = append(purged, copyUser(u))
+			delete(r.users, id)
+		}
+	}
+	return purged, nil
+}
+
+// copyUser копирует корзину, чтобы вызывающий код не менял хранимые данные.
+// Пустая корзина хранится как nil — так же, как ее читает SQL-реализация.
+func copyUser(u User) User {
+	if len(u.Cart) == 0 {
+		u.Cart = nil
+	} else {
+		u.Cart = append([]int64(nil), u.Cart...)
+	}
+	return u
+}
+
+func (r *memoryAuditRepository) Record(ctx context.Context, entry *AuditEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry.Id = int64(len(r.entries)) + 1
+	r.entries = append(r.entries, *entry)
+	return nil
+}
+
+func (r *memoryAuditRepository) List(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var entries []AuditEntry
+	for i := len(r.entries) - 1; i >= 0 && len(entries) < filter.Limit; i-- {
+		e := r.entries[i]
+		if (filter.EntityType == "" || e.EntityType == filter.EntityType) && (filter.EntityId == 0 || e.EntityId == filter.EntityId) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (r *memoryPriceHistoryRepository) Record(ctx context.Context, change *PriceChange) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	change.Id = int64(len(r.changes)) + 1
+	r.changes = append(r.changes, *change)
+	return nil
+}
+
+func (r *memoryPriceHistoryRepository) List(ctx context.Context, filter PriceHistoryFilter) ([]PriceChange, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var changes []PriceChange
+	for _, change := range r.changes {
+		if (filter.ProductId == 0 || change.ProductId == filter.ProductId) &&
+			(filter.From.IsZero() || !change.ChangedAt.Before(filter.From)) &&
+			(filter.To.IsZero() || change.ChangedAt.Before(filter.To)) {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry — реестр метрик сервиса, отдаваемых на /metrics.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shop_http_requests_total",
+		Help: "Количество HTTP-запросов по маршруту, методу и статусу.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "shop_http_request_duration_seconds",
+		Help:    "Время обработки HTTP-запросов.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "shop_db_query_duration_seconds",
+		Help:    "Время выполнения запросов к базе данных по типу операции.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation"})
+
+	imageUploadSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "shop_image_upload_size_bytes",
+		Help:    "Размер загруженных изображений.",
+		Buckets: prometheus.ExponentialBuckets(16<<10, 4, 7),
+	})
+
+	productsCreatedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "shop_products_created_total",
+		Help: "Количество созданных товаров.",
+	})
+
+	cartUpdatesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "shop_cart_updates_total",
+		Help: "Количество изменений корзин пользователей.",
+	})
+
+	ordersPlacedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shop_orders_placed_total",
+		Help: "Количество оформленных заказов по способу оплаты.",
+	}, []string{"payment_type"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestsTotal,
+		httpRequestDuration,
+		dbQueryDuration,
+		imageUploadSize,
+		productsCreatedTotal,
+		cartUpdatesTotal,
+		ordersPlacedTotal,
+	)
+}
+
+// registerDBStatsMetrics добавляет метрики пула соединений из db.Stats().
+func registerDBStatsMetrics(db *DB) {
+	metricsRegistry.MustRegister(collectors.NewDBStatsCollector(db.DB, string(db.Dialect)))
+}
+
+// requestMetrics считает запросы и время их обработки по шаблону маршрута
+// Gin, чтобы ID в пути не размножали ряды метрик.
+func requestMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequestsTotal.WithLabelValues(route, c.Request.Method, status).Inc()
+		httpRequestDuration.WithLabelValues(route, c.Request.Method, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{Registry: metricsRegistry}))
+}
+
+// observeQuery записывает длительность запроса к базе с момента start.
+func observeQuery(operation string, start time.Time) {
+	dbQueryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Миграции лежат отдельно для каждого диалекта: migrations/sqlite и
+// migrations/postgres. Номера версий в обоих каталогах должны совпадать.
+//
+//go:embed migrations/sqlite/*.sql migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+func migrationsDir(dialect Dialect) string {
+	return path.Join("migrations", string(dialect))
+}
+
+// Migration — пара скриптов NNNN_name.up.sql / NNNN_name.down.sql.
+// Контрольная сумма считается по up-скрипту: изменение уже примененной
+// миграции останавливает запуск.
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+type AppliedMigration struct {
+	Version   int
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+func loadMigrations(files fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		versionStr, migrationName, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(versionStr)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("некорректное имя файла миграции %s", name)
+		}
+		content, err := fs.ReadFile(files, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, exists := byVersion[version]
+		if !exists {
+			m = &Migration{Version: version, Name: migrationName}
+			byVersion[version] = m
+		} else if m.Name != migrationName {
+			return nil, fmt.Errorf("у миграции %d разные имена: %s и %s", version, m.Name, migrationName)
+		}
+		if direction == "up" {
+			m.Up = string(content)
+			sum := sha256.Sum256(content)
+			m.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("у миграции %04d_%s нет up-скрипта", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func ensureMigrationsTable() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		)
+	`)
+	return err
+}
+
+func appliedMigrations() (map[int]AppliedMigration, error) {
+	if err := ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT version,name,checksum,applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]AppliedMigration)
+	for rows.Next() {
+		var m AppliedMigration
+		if err := rows.Scan(&m.Version, &m.Name, &m.Checksum, &m.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied[m.Version] = m
+	}
+	return applied, rows.Err()
+}
+
+// verifyMigrations сверяет контрольные суммы примененных миграций с
+// встроенными в бинарник.
+func verifyMigrations(migrations []Migration, applied map[int]AppliedMigration) error {
+	known := make(map[int]Migration)
+	for _, m := range migrations {
+		known[m.Version] = m
+	}
+	for version, a := range applied {
+		m, ok := known[version]
+		if !ok {
+			return fmt.Errorf("миграция %04d_%s применена, но отсутствует в бинарнике", version, a.Name)
+		}
+		if m.Checksum != a.Checksum {
+			return fmt.Errorf("контрольная сумма миграции %04d_%s не совпадает с примененной", version, m.Name)
+		}
+	}
+	return nil
+}
+
+// legacyTables — по таблице на каждую миграцию, повторяющую схему, которую
+// до появления миграций создавал при запуске main.go (0001–0006). Таблицы
+// создавались в том же порядке, поэтому по ним видно, до какой миграции
+// дошла такая база.
+var legacyTables = []string{"products", "shipping_rates", "order_items", "payment_events", "refunds", "shipment_events"}
+
+func tableExists(name string) (bool, error) {
+	query := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+	if db.Dialect == DialectPostgres {
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?"
+	}
+	var count int
+	err := db.QueryRow(query, name).Scan(&count)
+	return count > 0, err
+}
+
+// stampLegacySchema отмечает примененными базовые миграции, таблицы которых
+// уже есть в базе, созданной версией без миграций (schema_migrations пуста).
+// Остальные миграции затем выполняются как обычно.
+func stampLegacySchema(migrations []Migration, applied map[int]AppliedMigration) error {
+	if len(applied) > 0 {
+		return nil
+	}
+	var present []Migration
+	for i, table := range legacyTables {
+		exists, err := tableExists(table)
+		if err != nil {
+			return err
+		}
+		if !exists || i >= len(migrations) {
+			break
+		}
+		present = append(present, migrations[i])
+	}
+	if len(present) == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	return inTx(context.Background(), func(tx *Tx) error {
+		for _, m := range present {
+			if _, err := tx.Exec("INSERT INTO schema_migrations (version,name,checksum,applied_at) VALUES (?,?,?,?)",
+				m.Version, m.Name, m.Checksum, now); err != nil {
+				return err
+			}
+			applied[m.Version] = AppliedMigration{Version: m.Version, Name: m.Name, Checksum: m.Checksum, AppliedAt: now}
+			slog.Info("Миграция отмечена примененной для существующей схемы", "version", m.Version, "name", m.Name)
+		}
+		return nil
+	})
+}
+
+// migrateUp применяет все новые миграции по порядку, каждую в отдельной
+// транзакции, и возвращает список примененных. База, созданная до появления
+// миграций, сначала получает отметки о базовых миграциях (stampLegacySchema).
+func migrateUp(migrations []Migration) ([]Migration, error) {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyMigrations(migrations, applied); err != nil {
+		return nil, err
+	}
+	if err := stampLegacySchema(migrations, applied); err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		err := inTx(context.Background(), func(tx *Tx) error {
+			if _, err := tx.Exec(m.Up); err != nil {
+				return err
+			}
+			_, err := tx.Exec("INSERT INTO schema_migrations (version,name,checksum,applied_at) VALUES (?,?,?,?)",
+				m.Version, m.Name, m.Checksum, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			return done, fmt.Errorf("миграция %04d_%s: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// migrateDown откатывает steps последних примененных миграций.
+func migrateDown(migrations []Migration, steps int) ([]Migration, error) {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyMigrations(migrations, applied); err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if m.Down == "" {
+			return done, fmt.Errorf("у миграции %04d_%s нет down-скрипта", m.Version, m.Name)
+		}
+		err := inTx(context.Background(), func(tx *Tx) error {
+			if _, err := tx.Exec(m.Down); err != nil {
+				return err
+			}
+			_, err := tx.Exec("DELETE FROM schema_migrations WHERE version = ?", m.Version)
+			return err
+		})
+		if err != nil {
+			return done, fmt.Errorf("откат миграции %04d_%s: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+func printMigrationStatus(w io.Writer, migrations []Migration) error {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+	for _, m := range migrations {
+		status, appliedAt := "pending", ""
+		if a, ok := applied[m.Version]; ok {
+			status, appliedAt = "applied", a.AppliedAt.Format(time.RFC3339)
+			if a.Checksum != m.Checksum {
+				status = "checksum mismatch"
+			}
+		}
+		fmt.Fprintf(tw, "%04d\t%s\t%s\t%s\n", m.Version, m.Name, status, appliedAt)
+	}
+	return tw.Flush()
+}
+
+// runMigrateCommand обрабатывает подкоманду "migrate up|down [N]|status".
+func runMigrateCommand(migrations []Migration, args []string) error {
+	var err error
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		done, err := migrateUp(migrations)
+		for _, m := range done {
+			fmt.Printf("Применена миграция %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Println("Новых миграций нет")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps <= 0 {
+				return fmt.Errorf("некорректное количество шагов отката: %s", args[1])
+			}
+		}
+		done, err := migrateDown(migrations, steps)
+		for _, m := range done {
+			fmt.Printf("Откачена миграция %04d_%s\n", m.Version, m.Name)
+		}
+		return err
+	case "status":
+		return printMigrationStatus(os.Stdout, migrations)
+	default:
+		return fmt.Errorf("неизвестная команда migrate %s, ожидается up, down или status", command)
+	}
+}
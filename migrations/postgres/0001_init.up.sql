@@ -0,0 +1,15 @@
+CREATE TABLE products (
+	id BIGSERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	price INTEGER,
+	image TEXT NOT NULL
+);
+
+CREATE TABLE users (
+	id BIGSERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	latitude DOUBLE PRECISION,
+	longitude DOUBLE PRECISION,
+	is_card BOOLEAN,
+	cart TEXT
+);
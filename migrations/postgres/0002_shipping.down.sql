@@ -0,0 +1,4 @@
+DROP TABLE shipping_rates;
+DROP TABLE shipping_zones;
+DROP TABLE warehouses;
+ALTER TABLE products DROP COLUMN weight;
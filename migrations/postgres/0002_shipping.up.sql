@@ -0,0 +1,29 @@
+ALTER TABLE products ADD COLUMN weight INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE warehouses (
+	id BIGSERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	latitude DOUBLE PRECISION NOT NULL,
+	longitude DOUBLE PRECISION NOT NULL
+);
+
+CREATE TABLE shipping_zones (
+	id BIGSERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	warehouse_id BIGINT NOT NULL REFERENCES warehouses(id) ON DELETE CASCADE,
+	radius_km DOUBLE PRECISION NOT NULL DEFAULT 0,
+	polygon TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE shipping_rates (
+	id BIGSERIAL PRIMARY KEY,
+	zone_id BIGINT NOT NULL REFERENCES shipping_zones(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	min_weight INTEGER NOT NULL DEFAULT 0,
+	max_weight INTEGER NOT NULL DEFAULT 0,
+	min_total INTEGER NOT NULL DEFAULT 0,
+	base_price INTEGER NOT NULL DEFAULT 0,
+	price_per_km INTEGER NOT NULL DEFAULT 0,
+	free_threshold INTEGER NOT NULL DEFAULT 0,
+	delivery_days INTEGER NOT NULL DEFAULT 0
+);
@@ -0,0 +1,42 @@
+CREATE TABLE payment_methods (
+	id BIGSERIAL PRIMARY KEY,
+	user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	type TEXT NOT NULL,
+	provider TEXT NOT NULL DEFAULT '',
+	card_token TEXT NOT NULL DEFAULT '',
+	is_default BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE orders (
+	id BIGSERIAL PRIMARY KEY,
+	user_id BIGINT NOT NULL REFERENCES users(id),
+	status TEXT NOT NULL,
+	subtotal INTEGER NOT NULL,
+	shipping_cost INTEGER NOT NULL,
+	total INTEGER NOT NULL,
+	shipping_rate_id BIGINT,
+	latitude DOUBLE PRECISION NOT NULL,
+	longitude DOUBLE PRECISION NOT NULL,
+	payment_method_id BIGINT REFERENCES payment_methods(id) ON DELETE SET NULL,
+	payment_type TEXT NOT NULL,
+	amount INTEGER NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE order_items (
+	id BIGSERIAL PRIMARY KEY,
+	order_id BIGINT NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+	product_id BIGINT NOT NULL,
+	name TEXT NOT NULL,
+	price INTEGER NOT NULL,
+	quantity INTEGER NOT NULL
+);
+
+-- Устаревший флаг users.is_card становится способом оплаты по умолчанию.
+INSERT INTO payment_methods (user_id, type, provider, card_token, is_default, created_at)
+SELECT id, CASE WHEN is_card THEN 'card' ELSE 'cash' END, '', '', TRUE, CURRENT_TIMESTAMP
+FROM users
+WHERE is_card IS NOT NULL;
+
+UPDATE users SET is_card = NULL;
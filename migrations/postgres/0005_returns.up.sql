@@ -0,0 +1,43 @@
+CREATE TABLE returns (
+	id BIGSERIAL PRIMARY KEY,
+	order_id BIGINT NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+	user_id BIGINT NOT NULL,
+	status TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	carrier TEXT NOT NULL DEFAULT '',
+	tracking_number TEXT NOT NULL DEFAULT '',
+	refunded_amount INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE return_items (
+	id BIGSERIAL PRIMARY KEY,
+	return_id BIGINT NOT NULL REFERENCES returns(id) ON DELETE CASCADE,
+	order_item_id BIGINT NOT NULL REFERENCES order_items(id),
+	quantity INTEGER NOT NULL
+);
+
+CREATE TABLE return_photos (
+	id BIGSERIAL PRIMARY KEY,
+	return_id BIGINT NOT NULL REFERENCES returns(id) ON DELETE CASCADE,
+	image TEXT NOT NULL
+);
+
+CREATE TABLE return_history (
+	id BIGSERIAL PRIMARY KEY,
+	return_id BIGINT NOT NULL REFERENCES returns(id) ON DELETE CASCADE,
+	status TEXT NOT NULL,
+	comment TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE refunds (
+	id BIGSERIAL PRIMARY KEY,
+	return_id BIGINT NOT NULL REFERENCES returns(id) ON DELETE CASCADE,
+	payment_id BIGINT REFERENCES payments(id),
+	provider_refund_id TEXT NOT NULL DEFAULT '',
+	amount INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,26 @@
+CREATE TABLE shipments (
+	id BIGSERIAL PRIMARY KEY,
+	order_id BIGINT NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+	carrier TEXT NOT NULL,
+	tracking_number TEXT NOT NULL,
+	status TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE shipment_items (
+	id BIGSERIAL PRIMARY KEY,
+	shipment_id BIGINT NOT NULL REFERENCES shipments(id) ON DELETE CASCADE,
+	order_item_id BIGINT NOT NULL REFERENCES order_items(id),
+	quantity INTEGER NOT NULL
+);
+
+CREATE TABLE shipment_events (
+	id BIGSERIAL PRIMARY KEY,
+	shipment_id BIGINT NOT NULL REFERENCES shipments(id) ON DELETE CASCADE,
+	status TEXT NOT NULL,
+	description TEXT NOT NULL DEFAULT '',
+	location TEXT NOT NULL DEFAULT '',
+	occurred_at TIMESTAMPTZ NOT NULL,
+	UNIQUE (shipment_id, status, occurred_at)
+);
@@ -0,0 +1,13 @@
+CREATE TABLE audit_log (
+	id BIGSERIAL PRIMARY KEY,
+	actor TEXT NOT NULL,
+	action TEXT NOT NULL,
+	entity_type TEXT NOT NULL,
+	entity_id BIGINT NOT NULL,
+	changes TEXT NOT NULL,
+	ip TEXT NOT NULL DEFAULT '',
+	request_id TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX audit_log_entity ON audit_log (entity_type, entity_id);
@@ -0,0 +1,7 @@
+DROP TABLE tax_rates;
+DROP TABLE tax_zones;
+
+ALTER TABLE order_items DROP COLUMN tax;
+ALTER TABLE orders DROP COLUMN prices_include_tax;
+ALTER TABLE orders DROP COLUMN taxes;
+ALTER TABLE orders DROP COLUMN tax;
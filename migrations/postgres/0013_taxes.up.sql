@@ -0,0 +1,31 @@
+-- Налог заказа, его разбивка по ставкам в JSON и режим цен: включают ли
+-- цены товаров и доставки налог. Налог позиции — часть налога, пришедшаяся
+-- на все единицы позиции.
+ALTER TABLE orders ADD COLUMN tax INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN taxes TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE orders ADD COLUMN prices_include_tax BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE order_items ADD COLUMN tax INTEGER NOT NULL DEFAULT 0;
+
+-- Налоговые зоны: страна (ISO 3166-1) и, при необходимости, регион с
+-- границей — радиусом вокруг точки или многоугольником, как у зон
+-- доставки.
+CREATE TABLE tax_zones (
+	id BIGSERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	country TEXT NOT NULL,
+	region TEXT NOT NULL DEFAULT '',
+	latitude DOUBLE PRECISION NOT NULL DEFAULT 0,
+	longitude DOUBLE PRECISION NOT NULL DEFAULT 0,
+	radius_km DOUBLE PRECISION NOT NULL DEFAULT 0,
+	polygon TEXT NOT NULL DEFAULT ''
+);
+
+-- Ставки зоны по налоговым классам; rate — процент десятичной строкой.
+CREATE TABLE tax_rates (
+	id BIGSERIAL PRIMARY KEY,
+	zone_id BIGINT NOT NULL REFERENCES tax_zones(id) ON DELETE CASCADE,
+	tax_class TEXT NOT NULL,
+	name TEXT NOT NULL,
+	rate TEXT NOT NULL,
+	UNIQUE (zone_id, tax_class)
+);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS products (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	price INTEGER,
+	image TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	latitude REAL,
+	longitude REAL,
+	is_card INTEGER,
+	cart TEXT
+);
@@ -0,0 +1,29 @@
+ALTER TABLE products ADD COLUMN weight INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE warehouses (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	latitude REAL NOT NULL,
+	longitude REAL NOT NULL
+);
+
+CREATE TABLE shipping_zones (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	warehouse_id INTEGER NOT NULL REFERENCES warehouses(id) ON DELETE CASCADE,
+	radius_km REAL NOT NULL DEFAULT 0,
+	polygon TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE shipping_rates (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	zone_id INTEGER NOT NULL REFERENCES shipping_zones(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	min_weight INTEGER NOT NULL DEFAULT 0,
+	max_weight INTEGER NOT NULL DEFAULT 0,
+	min_total INTEGER NOT NULL DEFAULT 0,
+	base_price INTEGER NOT NULL DEFAULT 0,
+	price_per_km INTEGER NOT NULL DEFAULT 0,
+	free_threshold INTEGER NOT NULL DEFAULT 0,
+	delivery_days INTEGER NOT NULL DEFAULT 0
+);
@@ -0,0 +1,8 @@
+UPDATE users SET is_card = (
+	SELECT pm.type = 'card' FROM payment_methods pm
+	WHERE pm.user_id = users.id AND pm.is_default = 1
+);
+
+DROP TABLE order_items;
+DROP TABLE orders;
+DROP TABLE payment_methods;
@@ -0,0 +1,42 @@
+CREATE TABLE payment_methods (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	type TEXT NOT NULL,
+	provider TEXT NOT NULL DEFAULT '',
+	card_token TEXT NOT NULL DEFAULT '',
+	is_default INTEGER NOT NULL DEFAULT 0,
+	created_at DATETIME NOT NULL
+);
+
+CREATE TABLE orders (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	status TEXT NOT NULL,
+	subtotal INTEGER NOT NULL,
+	shipping_cost INTEGER NOT NULL,
+	total INTEGER NOT NULL,
+	shipping_rate_id INTEGER,
+	latitude REAL NOT NULL,
+	longitude REAL NOT NULL,
+	payment_method_id INTEGER REFERENCES payment_methods(id) ON DELETE SET NULL,
+	payment_type TEXT NOT NULL,
+	amount INTEGER NOT NULL,
+	created_at DATETIME NOT NULL
+);
+
+CREATE TABLE order_items (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+	product_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	price INTEGER NOT NULL,
+	quantity INTEGER NOT NULL
+);
+
+-- Устаревший флаг users.is_card становится способом оплаты по умолчанию.
+INSERT INTO payment_methods (user_id, type, provider, card_token, is_default, created_at)
+SELECT id, CASE WHEN is_card THEN 'card' ELSE 'cash' END, '', '', 1, CURRENT_TIMESTAMP
+FROM users
+WHERE is_card IS NOT NULL;
+
+UPDATE users SET is_card = NULL;
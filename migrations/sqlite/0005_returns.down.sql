@@ -0,0 +1,5 @@
+DROP TABLE refunds;
+DROP TABLE return_history;
+DROP TABLE return_photos;
+DROP TABLE return_items;
+DROP TABLE returns;
@@ -0,0 +1,43 @@
+CREATE TABLE returns (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	carrier TEXT NOT NULL DEFAULT '',
+	tracking_number TEXT NOT NULL DEFAULT '',
+	refunded_amount INTEGER NOT NULL DEFAULT 0,
+	created_at DATETIME NOT NULL,
+	updated_at DATETIME NOT NULL
+);
+
+CREATE TABLE return_items (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	return_id INTEGER NOT NULL REFERENCES returns(id) ON DELETE CASCADE,
+	order_item_id INTEGER NOT NULL REFERENCES order_items(id),
+	quantity INTEGER NOT NULL
+);
+
+CREATE TABLE return_photos (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	return_id INTEGER NOT NULL REFERENCES returns(id) ON DELETE CASCADE,
+	image TEXT NOT NULL
+);
+
+CREATE TABLE return_history (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	return_id INTEGER NOT NULL REFERENCES returns(id) ON DELETE CASCADE,
+	status TEXT NOT NULL,
+	comment TEXT NOT NULL DEFAULT '',
+	created_at DATETIME NOT NULL
+);
+
+CREATE TABLE refunds (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	return_id INTEGER NOT NULL REFERENCES returns(id) ON DELETE CASCADE,
+	payment_id INTEGER REFERENCES payments(id),
+	provider_refund_id TEXT NOT NULL DEFAULT '',
+	amount INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	created_at DATETIME NOT NULL
+);
@@ -0,0 +1,26 @@
+CREATE TABLE shipments (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+	carrier TEXT NOT NULL,
+	tracking_number TEXT NOT NULL,
+	status TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	updated_at DATETIME NOT NULL
+);
+
+CREATE TABLE shipment_items (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	shipment_id INTEGER NOT NULL REFERENCES shipments(id) ON DELETE CASCADE,
+	order_item_id INTEGER NOT NULL REFERENCES order_items(id),
+	quantity INTEGER NOT NULL
+);
+
+CREATE TABLE shipment_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	shipment_id INTEGER NOT NULL REFERENCES shipments(id) ON DELETE CASCADE,
+	status TEXT NOT NULL,
+	description TEXT NOT NULL DEFAULT '',
+	location TEXT NOT NULL DEFAULT '',
+	occurred_at DATETIME NOT NULL,
+	UNIQUE (shipment_id, status, occurred_at)
+);
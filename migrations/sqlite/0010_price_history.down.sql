@@ -0,0 +1,2 @@
+DROP TABLE cart_prices;
+DROP TABLE price_history;
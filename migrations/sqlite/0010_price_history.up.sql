@@ -0,0 +1,22 @@
+CREATE TABLE price_history (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	product_id INTEGER NOT NULL,
+	price INTEGER NOT NULL,
+	previous_price INTEGER,
+	source TEXT NOT NULL,
+	actor TEXT NOT NULL DEFAULT '',
+	changed_at DATETIME NOT NULL
+);
+
+CREATE INDEX price_history_product ON price_history (product_id, changed_at);
+CREATE INDEX price_history_changed_at ON price_history (changed_at);
+
+-- Цена товара на момент добавления в корзину. У товаров, добавленных до
+-- этой миграции, записи нет, и для них берется текущая цена.
+CREATE TABLE cart_prices (
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	product_id INTEGER NOT NULL,
+	price INTEGER NOT NULL,
+	added_at DATETIME NOT NULL,
+	PRIMARY KEY (user_id, product_id)
+);
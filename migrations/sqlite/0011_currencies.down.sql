@@ -0,0 +1,18 @@
+DROP TABLE exchange_rates;
+
+ALTER TABLE orders DROP COLUMN exchange_rates;
+ALTER TABLE orders DROP COLUMN currency;
+ALTER TABLE cart_prices DROP COLUMN currency;
+ALTER TABLE price_history DROP COLUMN currency;
+ALTER TABLE products DROP COLUMN currency;
+
+UPDATE cart_prices SET price = price / 100;
+UPDATE price_history SET price = price / 100, previous_price = previous_price / 100;
+UPDATE returns SET refunded_amount = refunded_amount / 100;
+UPDATE refunds SET amount = amount / 100;
+UPDATE payments SET amount = amount / 100;
+UPDATE order_items SET price = price / 100;
+UPDATE orders SET subtotal = subtotal / 100, shipping_cost = shipping_cost / 100, total = total / 100, amount = amount / 100;
+UPDATE shipping_rates SET min_total = min_total / 100, base_price = base_price / 100,
+	price_per_km = price_per_km / 100, free_threshold = free_threshold / 100;
+UPDATE products SET price = price / 100;
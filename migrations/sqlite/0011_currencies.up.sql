@@ -0,0 +1,31 @@
+-- Суммы хранились в целых рублях. Дальше все суммы хранятся в минимальных
+-- единицах валюты (для рубля — в копейках).
+UPDATE products SET price = price * 100;
+UPDATE shipping_rates SET min_total = min_total * 100, base_price = base_price * 100,
+	price_per_km = price_per_km * 100, free_threshold = free_threshold * 100;
+UPDATE orders SET subtotal = subtotal * 100, shipping_cost = shipping_cost * 100, total = total * 100, amount = amount * 100;
+UPDATE order_items SET price = price * 100;
+UPDATE payments SET amount = amount * 100;
+UPDATE refunds SET amount = amount * 100;
+UPDATE returns SET refunded_amount = refunded_amount * 100;
+UPDATE price_history SET price = price * 100, previous_price = previous_price * 100;
+UPDATE cart_prices SET price = price * 100;
+
+ALTER TABLE products ADD COLUMN currency TEXT NOT NULL DEFAULT 'RUB';
+ALTER TABLE price_history ADD COLUMN currency TEXT NOT NULL DEFAULT 'RUB';
+ALTER TABLE cart_prices ADD COLUMN currency TEXT NOT NULL DEFAULT 'RUB';
+ALTER TABLE orders ADD COLUMN currency TEXT NOT NULL DEFAULT 'RUB';
+-- Курсы к рублю, по которым посчитаны суммы заказа, в JSON.
+ALTER TABLE orders ADD COLUMN exchange_rates TEXT NOT NULL DEFAULT '{}';
+
+-- История курсов: сколько рублей стоит единица валюты. Курс хранится
+-- десятичной строкой без потери точности.
+CREATE TABLE exchange_rates (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	currency TEXT NOT NULL,
+	rate TEXT NOT NULL,
+	source TEXT NOT NULL,
+	fetched_at DATETIME NOT NULL
+);
+
+CREATE INDEX exchange_rates_currency ON exchange_rates (currency, id);
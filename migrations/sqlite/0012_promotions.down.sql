@@ -0,0 +1,8 @@
+DROP TABLE promotions;
+DROP TABLE coupon_redemptions;
+DROP TABLE coupons;
+
+ALTER TABLE order_items DROP COLUMN discount;
+ALTER TABLE orders DROP COLUMN discounts;
+ALTER TABLE orders DROP COLUMN discount;
+ALTER TABLE products DROP COLUMN category;
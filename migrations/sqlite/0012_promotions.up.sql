@@ -0,0 +1,54 @@
+ALTER TABLE products ADD COLUMN category TEXT NOT NULL DEFAULT '';
+
+-- Скидка заказа и ее разбивка по строкам в JSON. Скидка позиции — часть
+-- скидок, пришедшаяся на все единицы позиции; по ней считается сумма
+-- возврата.
+ALTER TABLE orders ADD COLUMN discount INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN discounts TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE order_items ADD COLUMN discount INTEGER NOT NULL DEFAULT 0;
+
+-- Купоны. value — процент для percent и сумма в минимальных единицах
+-- currency для fixed. Нулевые лимиты не ограничивают использование.
+-- product_ids и categories — JSON-массивы; пустые — купон действует на
+-- всю корзину.
+CREATE TABLE coupons (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	code TEXT NOT NULL UNIQUE,
+	type TEXT NOT NULL,
+	value INTEGER NOT NULL DEFAULT 0,
+	currency TEXT NOT NULL DEFAULT 'RUB',
+	min_total INTEGER NOT NULL DEFAULT 0,
+	starts_at DATETIME,
+	ends_at DATETIME,
+	usage_limit INTEGER NOT NULL DEFAULT 0,
+	per_user_limit INTEGER NOT NULL DEFAULT 0,
+	used_count INTEGER NOT NULL DEFAULT 0,
+	product_ids TEXT NOT NULL DEFAULT '',
+	categories TEXT NOT NULL DEFAULT '',
+	created_at DATETIME NOT NULL
+);
+
+CREATE TABLE coupon_redemptions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	coupon_id INTEGER NOT NULL REFERENCES coupons(id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL,
+	order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+	created_at DATETIME NOT NULL
+);
+
+CREATE INDEX coupon_redemptions_user ON coupon_redemptions (coupon_id, user_id);
+
+-- Автоматические акции «купи buy_quantity, получи get_quantity со скидкой
+-- percent процентов» на товары из product_ids и categories.
+CREATE TABLE promotions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	buy_quantity INTEGER NOT NULL,
+	get_quantity INTEGER NOT NULL,
+	percent INTEGER NOT NULL,
+	product_ids TEXT NOT NULL DEFAULT '',
+	categories TEXT NOT NULL DEFAULT '',
+	starts_at DATETIME,
+	ends_at DATETIME,
+	created_at DATETIME NOT NULL
+);
@@ -0,0 +1,2 @@
+DROP INDEX payments_open_order;
+ALTER TABLE payments DROP COLUMN client_secret;
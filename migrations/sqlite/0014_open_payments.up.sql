@@ -0,0 +1,8 @@
+ALTER TABLE payments ADD COLUMN client_secret TEXT NOT NULL DEFAULT '';
+
+-- У заказа может быть только один незавершенный платеж: более старые
+-- помечаются неуспешными, их намерения клиенту больше не выдаются.
+UPDATE payments SET status = 'failed', error = 'Заменен более новым платежом'
+WHERE status = 'created' AND id NOT IN (SELECT MAX(id) FROM payments WHERE status = 'created' GROUP BY order_id);
+
+CREATE UNIQUE INDEX payments_open_order ON payments (order_id) WHERE status = 'created';
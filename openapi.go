@@ -0,0 +1,226 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/gin-gonic/gin"
+)
+
+// openapiSpec — описание API в формате OpenAPI 3. По нему же проверяются
+// входящие запросы, поэтому при изменении обработчиков документ нужно
+// обновлять вместе с ними.
+//
+//go:embed openapi.json
+var openapiSpec []byte
+
+var openapiDoc = mustLoadOpenAPI(openapiSpec)
+
+// openapiRoutes — операции документа по ключу "МЕТОД /путь/:параметр",
+// где путь записан так же, как в маршрутах Gin.
+var openapiRoutes = indexOpenAPIRoutes(openapiDoc)
+
+func mustLoadOpenAPI(data []byte) *openapi3.T {
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(data)
+	if err == nil {
+		err = doc.Validate(loader.Context)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("некорректный openapi.json: %v", err))
+	}
+	return doc
+}
+
+func indexOpenAPIRoutes(doc *openapi3.T) map[string]*routers.Route {
+	index := make(map[string]*routers.Route)
+	for path, item := range doc.Paths.Map() {
+		for method, operation := range item.Operations() {
+			index[method+" "+ginPath(path)] = &routers.Route{
+				Spec:      doc,
+				Path:      path,
+				PathItem:  item,
+				Method:    method,
+				Operation: operation,
+			}
+		}
+	}
+	return index
+}
+
+// ginPath переводит путь OpenAPI /user/{id} в запись Gin /user/:id.
+func ginPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			segments[i] = ":" + segment[1:len(segment)-1]
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// openapiRoute возвращает операцию документа для текущего маршрута Gin и
+// параметры пути, или nil, если маршрут не описан.
+func openapiRoute(c *gin.Context) (*routers.Route, map[string]string) {
+	route, ok := openapiRoutes[c.Request.Method+" "+c.FullPath()]
+	if !ok {
+		return nil, nil
+	}
+	params := make(map[string]string, len(c.Params))
+	for _, p := range c.Params {
+		params[p.Key] = p.Value
+	}
+	return route, params
+}
+
+func serveOpenAPISpec(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", openapiSpec)
+}
+
+func serveSwaggerUI(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(swaggerUIPage))
+}
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="ru">
+<head>
+  <meta charset="utf-8">
+  <title>Shop API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.onload = () => { window.ui = SwaggerUIBundle({ url: "/openapi.json", dom_id: "#swagger-ui" }); };
+  </script>
+</body>
+</html>
+`
+
+// validateRequests проверяет запросы к маршрутам, описанным в openapi.json:
+// параметры пути, Content-Type и тело. Нарушения схемы возвращаются как
+// validation_failed с ошибками полей, некорректный параметр пути — как
+// invalid_parameter. Маршруты вне документа пропускаются без проверки.
+func validateRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route, params := openapiRoute(c)
+		if route == nil {
+			c.Next()
+			return
+		}
+		err := openapi3filter.ValidateRequest(c.Request.Context(), &openapi3filter.RequestValidationInput{
+			Request:    c.Request,
+			PathParams: params,
+			Route:      route,
+			Options:    &openapi3filter.Options{MultiError: true},
+		})
+		if err == nil {
+			c.Next()
+			return
+		}
+		requestLog(c).Warn("Запрос не соответствует openapi.json", "error", err)
+		if isParameterError(err) {
+			respondError(c, CodeInvalidParameter)
+			return
+		}
+		if fields := openapiFieldErrors(err); len(fields) > 0 {
+			respondFieldErrors(c, fields...)
+			return
+		}
+		respondError(c, CodeInvalidBody)
+	}
+}
+
+// walkOpenAPIErrors обходит ошибки валидатора, раскрывая MultiError.
+func walkOpenAPIErrors(err error, visit func(err error)) {
+	if multi, ok := err.(openapi3.MultiError); ok {
+		for _, e := range multi {
+			walkOpenAPIErrors(e, visit)
+		}
+		return
+	}
+	visit(err)
+}
+
+func isParameterError(err error) bool {
+	found := false
+	walkOpenAPIErrors(err, func(err error) {
+		var requestErr *openapi3filter.RequestError
+		if errors.As(err, &requestErr) && requestErr.Parameter != nil {
+			found = true
+		}
+	})
+	return found
+}
+
+func openapiFieldErrors(err error) []FieldError {
+	var fields []FieldError
+	walkOpenAPIErrors(err, func(err error) {
+		var requestErr *openapi3filter.RequestError
+		if errors.As(err, &requestErr) {
+			if multi, ok := requestErr.Err.(openapi3.MultiError); ok {
+				fields = append(fields, openapiFieldErrors(multi)...)
+				return
+			}
+		}
+		var schemaErr *openapi3.SchemaError
+		var parseErr *openapi3filter.ParseError
+		switch {
+		case errors.As(err, &schemaErr):
+			fields = append(fields, schemaFieldError(schemaErr))
+		case errors.As(err, &parseErr) && len(parseErr.Path()) > 0:
+			path := make([]string, 0, len(parseErr.Path()))
+			for _, p := range parseErr.Path() {
+				path = append(path, fmt.Sprint(p))
+			}
+			fields = append(fields, FieldError{Field: strings.Join(path, "."), Code: "type"})
+		}
+	})
+	return fields
+}
+
+// schemaFieldError переводит нарушение ключевого слова JSON Schema в код
+// ошибки поля из fieldMessages.
+func schemaFieldError(err *openapi3.SchemaError) FieldError {
+	field := FieldError{Field: strings.Join(err.JSONPointer(), "."), Code: "invalid"}
+	schema := err.Schema
+	switch err.SchemaField {
+	case "required", "nullable":
+		// Пустое значение поля формы валидатор разбирает как null.
+		field.Code = "required"
+	case "type", "format":
+		field.Code = "type"
+	case "minimum":
+		field.Code = "min"
+		if schema.ExclusiveMin {
+			field.Code = "gt"
+		}
+		if schema.Min != nil {
+			field.Param = strconv.FormatFloat(*schema.Min, 'f', -1, 64)
+		}
+	case "maximum":
+		field.Code = "max"
+		if schema.Max != nil {
+			field.Param = strconv.FormatFloat(*schema.Max, 'f', -1, 64)
+		}
+	case "minLength":
+		field.Code = "min_length"
+		field.Param = strconv.FormatUint(schema.MinLength, 10)
+	case "enum":
+		field.Code = "oneof"
+		values := make([]string, 0, len(schema.Enum))
+		for _, v := range schema.Enum {
+			values = append(values, fmt.Sprint(v))
+		}
+		field.Param = strings.Join(values, " ")
+	}
+	return field
+}
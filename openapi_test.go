@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/gin-gonic/gin"
+)
+
+func TestOpenAPIErrorCodesDocumented(t *testing.T) {
+	var documented []string
+	for _, v := range openapiDoc.Components.Schemas["ErrorCode"].Value.Enum {
+		documented = append(documented, v.(string))
+	}
+	for code := range errorDefinitions {
+		if !slices.Contains(documented, string(code)) {
+			t.Errorf("код %s не описан в ErrorCode в openapi.json", code)
+		}
+	}
+	for _, code := range documented {
+		if _, ok := errorDefinitions[ErrorCode(code)]; !ok {
+			t.Errorf("код %s из openapi.json не используется", code)
+		}
+	}
+}
+
+func TestOpenAPIRoutesDocumented(t *testing.T) {
+	router := newRouter(NewHandlers(NewMemoryProductRepository(), NewMemoryUserRepository(), NewMemoryAuditRepository(), NewMemoryPriceHistoryRepository()))
+	registered := make(map[string]bool)
+	for _, route := range router.Routes() {
+		key := route.Method + " " + route.Path
+		registered[key] = true
+		isProductOrUser := route.Path == "/products" || route.Path == "/users" || route.Path == "/trash" || route.Path == "/audit" || route.Path == "/reports/price-changes" ||
+			strings.HasPrefix(route.Path, "/exchange-rate") ||
+			strings.HasPrefix(route.Path, "/product") || strings.HasPrefix(route.Path, "/user")
+		if _, ok := openapiRoutes[key]; isProductOrUser && !ok {
+			t.Errorf("маршрут %s не описан в openapi.json", key)
+		}
+	}
+	for key := range openapiRoutes {
+		if !registered[key] {
+			t.Errorf("операция %s из openapi.json не зарегистрирована", key)
+		}
+	}
+}
+
+// TestResponsesMatchOpenAPI прогоняет запросы к товарам и пользователям
+// через настоящий роутер и проверяет каждый ответ по openapi.json.
+func TestResponsesMatchOpenAPI(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	previousUploads := uploadsConfig
+	uploadsConfig.Dir = t.TempDir()
+	t.Cleanup(func() { uploadsConfig = previousUploads })
+	// Товары и пользователи хранятся в памяти, база нужна для курсов валют.
+	useTestDB(t, filepath.Join(t.TempDir(), "shop.db")+"?_foreign_keys=on")
+
+	router := newRouter(NewHandlers(NewMemoryProductRepository(), NewMemoryUserRepository(), NewMemoryAuditRepository(), NewMemoryPriceHistoryRepository()))
+	covered := make(map[string]bool)
+
+	do := func(method, path, contentType string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var route *openapi3filter.RequestValidationInput
+		for key, found := range openapiRoutes {
+			if params, ok := matchRoute(key, method+" "+req.URL.Path); ok {
+				route = &openapi3filter.RequestValidationInput{Request: req, PathParams: params, Route: found}
+				covered[found.Operation.OperationID+" "+strconv.Itoa(w.Code)] = true
+			}
+		}
+		if route == nil {
+			t.Fatalf("%s %s не описан в openapi.json", method, path)
+		}
+		err := openapi3filter.ValidateResponse(context.Background(), &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: route,
+			Status:                 w.Code,
+			Header:                 w.Header(),
+			Body:                   io.NopCloser(bytes.NewReader(w.Body.Bytes())),
+			Options:                &openapi3filter.Options{IncludeResponseStatus: true},
+		})
+		if err != nil {
+			t.Errorf("%s %s: ответ %d не соответствует openapi.json: %v\n%s", method, path, w.Code, err, w.Body)
+		}
+		return w
+	}
+	jsonBody := func(method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		return do(method, path, "application/json", []byte(body), nil)
+	}
+	form := func(method, path string, fields map[string]string, withImage bool) *httptest.ResponseRecorder {
+		t.Helper()
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for name, value := range fields {
+			mw.WriteField(name, value)
+		}
+		if withImage {
+			part, _ := mw.CreateFormFile("image", "photo.png")
+			part.Write([]byte("\x89PNG\r\n\x1a\n"))
+		}
+		mw.Close()
+		return do(method, path, mw.FormDataContentType(), buf.Bytes(), nil)
+	}
+	expect := func(w *httptest.ResponseRecorder, status int) {
+		t.Helper()
+		if w.Code != status {
+			t.Fatalf("статус %d, ожидался %d: %s", w.Code, status, w.Body)
+		}
+	}
+
+	expect(jsonBody(http.MethodPost, "/user", `{"name":"Мария","latitude":59.93,"longitude":30.31}`), http.StatusCreated)
+	expect(jsonBody(http.MethodPost, "/user", `{"name":"Мария"}`), http.StatusBadRequest)
+	expect(jsonBody(http.MethodGet, "/users", ""), http.StatusOK)
+	expect(jsonBody(http.MethodGet, "/user/1", ""), http.StatusOK)
+	expect(do(http.MethodGet, "/user/1", "", nil, map[string]string{"If-None-Match": `"1"`}), http.StatusNotModified)
+	expect(do(http.MethodPatch, "/user/1", "application/json", []byte(`{"name":"Иван"}`), map[string]string{"If-Match": `"9"`}), http.StatusPreconditionFailed)
+	expect(jsonBody(http.MethodGet, "/user/2", ""), http.StatusNotFound)
+	expect(do(http.MethodGet, "/user/abc", "", nil, map[string]string{"Accept": problemContentType}), http.StatusBadRequest)
+	expect(jsonBody(http.MethodPatch, "/user/1", `{"name":"Мария","latitude":55.75,"longitude":37.62,"cart":[1]}`), http.StatusOK)
+	expect(jsonBody(http.MethodPatch, "/user/2", `{"name":"Иван","latitude":55.75,"longitude":37.62}`), http.StatusNotFound)
+	expect(do(http.MethodPatch, "/user/1", mimeMergePatch, []byte(`{"latitude":0,"cart":null}`), nil), http.StatusOK)
+	expect(do(http.MethodPatch, "/user/1", mimeJSONPatch, []byte(`[{"op":"add","path":"/cart/-","value":1}]`), nil), http.StatusOK)
+	expect(do(http.MethodPatch, "/user/1", mimeJSONPatch, []byte(`[{"op":"test","path":"/name","value":"Иван"}]`), nil), http.StatusConflict)
+
+	expect(form(http.MethodPost, "/product", map[string]string{"name": "Чайник", "price": "1990", "weight": "800"}, true), http.StatusCreated)
+	expect(form(http.MethodPost, "/product", map[string]string{"name": "Чайник", "price": "дорого"}, true), http.StatusBadRequest)
+	expect(jsonBody(http.MethodPost, "/product", `{"name":"Кружка","price":300,"image_url":"https://cdn.example.com/mug.png"}`), http.StatusCreated)
+	expect(jsonBody(http.MethodPost, "/product", `{"name":"Кружка","price":0}`), http.StatusBadRequest)
+	expect(jsonBody(http.MethodPost, "/product", `{"name":"Наушники","price":1000,"currency":"USD","image_url":"https://cdn.example.com/headphones.png"}`), http.StatusCreated)
+	expect(jsonBody(http.MethodGet, "/products", ""), http.StatusOK)
+	expect(jsonBody(http.MethodGet, "/products?currency=eur", ""), http.StatusOK)
+	expect(jsonBody(http.MethodGet, "/products?currency=GBP", ""), http.StatusBadRequest)
+	expect(jsonBody(http.MethodGet, "/product/3?currency=RUB", ""), http.StatusOK)
+	expect(jsonBody(http.MethodGet, "/exchange-rates", ""), http.StatusOK)
+	expect(jsonBody(http.MethodPut, "/exchange-rate/usd", `{"rate":"92.5"}`), http.StatusOK)
+	expect(jsonBody(http.MethodPut, "/exchange-rate/usd", `{"rate":"дорого"}`), http.StatusBadRequest)
+	expect(jsonBody(http.MethodGet, "/product/1", ""), http.StatusOK)
+	expect(jsonBody(http.MethodGet, "/product/99", ""), http.StatusNotFound)
+	expect(form(http.MethodPatch, "/product/1", map[string]string{"name": "Электрочайник"}, false), http.StatusOK)
+	expect(do(http.MethodGet, "/product/1", "", nil, map[string]string{"If-None-Match": `"2"`}), http.StatusNotModified)
+	expect(form(http.MethodPatch, "/product/1", nil, false), http.StatusBadRequest)
+	expect(jsonBody(http.MethodPatch, "/product/2", `{"price":350,"image_data":"iVBORw0KGgo="}`), http.StatusOK)
+	expect(do(http.MethodPatch, "/product/2", mimeMergePatch, []byte(`{"weight":500}`), nil), http.StatusOK)
+	expect(do(http.MethodPatch, "/product/2", mimeJSONPatch, []byte(`[{"op":"replace","path":"/price","value":400}]`), nil), http.StatusOK)
+	expect(form(http.MethodPatch, "/product/99", map[string]string{"name": "Электрочайник"}, false), http.StatusNotFound)
+	expect(jsonBody(http.MethodDelete, "/product/1", ""), http.StatusOK)
+	expect(jsonBody(http.MethodDelete, "/product/1", ""), http.StatusNotFound)
+	expect(jsonBody(http.MethodDelete, "/user/1", ""), http.StatusOK)
+	expect(jsonBody(http.MethodDelete, "/user/1", ""), http.StatusNotFound)
+	expect(jsonBody(http.MethodGet, "/trash", ""), http.StatusOK)
+	expect(jsonBody(http.MethodGet, "/audit?entity=product&id=1", ""), http.StatusOK)
+	expect(jsonBody(http.MethodGet, "/audit?entity=payment", ""), http.StatusBadRequest)
+	expect(jsonBody(http.MethodGet, "/product/2/prices", ""), http.StatusOK)
+	expect(jsonBody(http.MethodGet, "/product/2/prices?from=yesterday", ""), http.StatusBadRequest)
+	expect(jsonBody(http.MethodGet, "/reports/price-changes?from=2020-01-01", ""), http.StatusOK)
+	expect(jsonBody(http.MethodPost, "/product/1/restore", ""), http.StatusOK)
+	expect(jsonBody(http.MethodPost, "/product/1/restore", ""), http.StatusNotFound)
+	expect(jsonBody(http.MethodPost, "/user/1/restore", ""), http.StatusOK)
+	expect(jsonBody(http.MethodPost, "/user/1/restore", ""), http.StatusNotFound)
+	// Корзина и оформление читают товары и пользователей из базы, а не из
+	// репозиториев в памяти.
+	ctx := context.Background()
+	kettle := Product{Name: "Чайник", Price: 1990, Currency: baseCurrency, Image: "https://cdn.example.com/kettle.png", Weight: 800}
+	if err := NewSQLProductRepository(db).Create(ctx, &kettle); err != nil {
+		t.Fatalf("товар в базе: %v", err)
+	}
+	buyer := User{Name: "Мария", Latitude: 55.76, Longitude: 37.64, Cart: []int64{kettle.Id}}
+	if err := NewSQLUserRepository(db).Create(ctx, &buyer); err != nil {
+		t.Fatalf("пользователь в базе: %v", err)
+	}
+	for _, query := range []string{
+		"INSERT INTO warehouses (name,latitude,longitude) VALUES ('Москва',55.75,37.62)",
+		"INSERT INTO shipping_zones (name,warehouse_id,radius_km) VALUES ('Москва',1,50)",
+		"INSERT INTO shipping_rates (zone_id,name,base_price,delivery_days) VALUES (1,'Курьер',300,2)",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	buyerPath := fmt.Sprintf("/user/%d", buyer.Id)
+	expect(jsonBody(http.MethodGet, buyerPath+"/payment-methods", ""), http.StatusOK)
+	expect(jsonBody(http.MethodPost, buyerPath+"/payment-method", `{"type":"crypto"}`), http.StatusBadRequest)
+	expect(jsonBody(http.MethodPost, "/user/999/payment-method", `{"type":"cash"}`), http.StatusNotFound)
+	expect(jsonBody(http.MethodPost, buyerPath+"/payment-method", `{"type":"card","card_token":"tok_4242424242"}`), http.StatusCreated)
+	expect(jsonBody(http.MethodPost, buyerPath+"/payment-method", `{"type":"cash"}`), http.StatusCreated)
+	expect(jsonBody(http.MethodPost, buyerPath+"/payment-method/2/default", ""), http.StatusOK)
+	expect(jsonBody(http.MethodPost, buyerPath+"/payment-method/99/default", ""), http.StatusNotFound)
+	expect(jsonBody(http.MethodDelete, buyerPath+"/payment-method/1", ""), http.StatusOK)
+	expect(jsonBody(http.MethodGet, buyerPath+"/cart?currency=usd", ""), http.StatusOK)
+	expect(jsonBody(http.MethodGet, buyerPath+"/cart?coupon=NOPE", ""), http.StatusNotFound)
+	expect(jsonBody(http.MethodPost, buyerPath+"/checkout", `{"currency":"GBP"}`), http.StatusBadRequest)
+	expect(jsonBody(http.MethodPost, buyerPath+"/checkout", ""), http.StatusCreated)
+	expect(jsonBody(http.MethodPost, buyerPath+"/checkout", ""), http.StatusBadRequest)
+
+	exchangeRates = &rateCache{}
+	expect(jsonBody(http.MethodGet, "/product/3?currency=RUB", ""), http.StatusServiceUnavailable)
+
+	for _, route := range openapiRoutes {
+		for status := range route.Operation.Responses.Map() {
+			if strings.HasPrefix(status, "2") && !covered[route.Operation.OperationID+" "+status] {
+				t.Errorf("ответ %s операции %s не проверен", status, route.Operation.OperationID)
+			}
+		}
+	}
+}
+
+// matchRoute сопоставляет "МЕТОД /путь" запроса с ключом openapiRoutes.
+func matchRoute(pattern, path string) (map[string]string, bool) {
+	patternParts := strings.Split(pattern, "/")
+	pathParts := strings.Split(path, "/")
+	if len(patternParts) != len(pathParts) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, part := range patternParts {
+		if name, ok := strings.CutPrefix(part, ":"); ok {
+			params[name] = pathParts[i]
+		} else if part != pathParts[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
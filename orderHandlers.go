@@ -0,0 +1,337 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CheckoutRequest — параметры оформления заказа. Currency — валюта заказа,
+// по умолчанию базовая; Coupon — код купона.
+type CheckoutRequest struct {
+	PaymentMethodId int64  `json:"payment_method_id"`
+	ShippingRateId  int64  `json:"shipping_rate_id"`
+	Currency        string `json:"currency"`
+	Coupon          string `json:"coupon"`
+}
+
+type OrderStatusRequest struct {
+	Status string `json:"status" binding:"required"`
+}
+
+// checkout оформляет заказ из корзины пользователя: фиксирует цены товаров
+// (по cartPricePolicy), стоимость доставки и выбранный способ оплаты, после
+// чего очищает корзину.
+// Если тариф доставки не указан, выбирается самый дешевый из доступных.
+// Цены товаров и доставка пересчитываются в валюту заказа по текущим
+// курсам, которые сохраняются в заказе. Скидки акций и купона и налоги
+// считаются как в GET /user/:id/cart.
+func checkout(c *gin.Context) {
+	userId, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+
+	var request CheckoutRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			respondBindingError(c, err)
+			return
+		}
+	}
+	currency, ok := currencyField(c, request.Currency)
+	if !ok {
+		return
+	}
+
+	lat, lon, cartStr, err := loadUserCart(c.Request.Context(), userId)
+	if err == sql.ErrNoRows {
+		respondError(c, CodeUserNotFound)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при получении пользователя с ID", "user_id", userId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	cart := parseCart(cartStr)
+	if len(cart) == 0 {
+		respondError(c, CodeCartEmpty)
+		return
+	}
+
+	var pm PaymentMethod
+	if request.PaymentMethodId != 0 {
+		pm, err = loadPaymentMethod(c.Request.Context(), userId, request.PaymentMethodId)
+	} else {
+		pm, err = loadDefaultPaymentMethod(c.Request.Context(), userId)
+	}
+	if err == sql.ErrNoRows {
+		respondError(c, CodePaymentMethodNotSelected)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при получении способа оплаты пользователя", "user_id", userId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+
+	totals, coupon, err := priceCart(c.Request.Context(), cartRequest{
+		userId:         userId,
+		lat:            lat,
+		lon:            lon,
+		cart:           cart,
+		currency:       currency,
+		shippingRateId: request.ShippingRateId,
+		coupon:         request.Coupon,
+	})
+	if err != nil {
+		respondCartError(c, err)
+		return
+	}
+	// Все товары корзины удалены: оформлять нечего.
+	if len(totals.Items) == 0 {
+		respondError(c, CodeCartEmpty)
+		return
+	}
+	if totals.ShippingRateId == nil {
+		respondError(c, CodeShippingUnavailable)
+		return
+	}
+
+	methodId := pm.Id
+	order := Order{
+		UserId:           userId,
+		Status:           OrderStatusPending,
+		Items:            totals.Items,
+		Subtotal:         totals.Subtotal,
+		Discount:         totals.Discount,
+		Discounts:        totals.Discounts,
+		ShippingCost:     totals.ShippingCost,
+		Tax:              totals.Tax,
+		Taxes:            totals.Taxes,
+		PricesIncludeTax: totals.PricesIncludeTax,
+		Total:            totals.Total,
+		ShippingRateId:   totals.ShippingRateId,
+		Latitude:         lat,
+		Longitude:        lon,
+		PaymentMethodId:  &methodId,
+		PaymentType:      pm.Type,
+		Currency:         currency,
+		ExchangeRates:    totals.ExchangeRates,
+		CreatedAt:        time.Now().UTC(),
+	}
+	order.Amount = order.Total
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		requestLog(c).Error("Ошибка начала транзакции", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	defer tx.Rollback()
+
+	ratesJSON, err := json.Marshal(order.ExchangeRates)
+	if err != nil {
+		requestLog(c).Error("Ошибка кодирования курсов заказа", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	discountsJSON, err := json.Marshal(order.Discounts)
+	if err != nil {
+		requestLog(c).Error("Ошибка кодирования скидок заказа", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	taxesJSON, err := json.Marshal(order.Taxes)
+	if err != nil {
+		requestLog(c).Error("Ошибка кодирования налогов заказа", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	order.Id, err = tx.Insert("INSERT INTO orders (user_id,status,subtotal,discount,discounts,shipping_cost,tax,taxes,prices_include_tax,total,shipping_rate_id,latitude,longitude,payment_method_id,payment_type,amount,currency,exchange_rates,created_at) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+		order.UserId, order.Status, order.Subtotal, order.Discount, string(discountsJSON), order.ShippingCost, order.Tax, string(taxesJSON), order.PricesIncludeTax, order.Total, order.ShippingRateId, order.Latitude, order.Longitude, order.PaymentMethodId, order.PaymentType, order.Amount, order.Currency, string(ratesJSON), order.CreatedAt)
+	if err != nil {
+		requestLog(c).Error("Ошибка при добавлении заказа в базу данных", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	for i := range order.Items {
+		item := &order.Items[i]
+		item.Id, err = tx.Insert("INSERT INTO order_items (order_id,product_id,name,price,quantity,discount,tax) VALUES (?,?,?,?,?,?,?)",
+			order.Id, item.ProductId, item.Name, item.Price, item.Quantity, item.Discount, item.Tax)
+		if err != nil {
+			requestLog(c).Error("Ошибка при добавлении позиции заказа", "order_id", order.Id, "error", err)
+			respondError(c, CodeInternal)
+			return
+		}
+	}
+	if coupon != nil {
+		if err := redeemCoupon(tx, *coupon, userId, order.Id, order.CreatedAt); err != nil {
+			respondCartError(c, err)
+			return
+		}
+	}
+	// Корзина очищается, только если не изменилась с момента чтения: так
+	// параллельные оформления одной корзины не создадут два заказа. Версия
+	// пользователя растет, чтобы сменился его ETag.
+	result, err := tx.Exec("UPDATE users SET cart = '', version = version + 1 WHERE id = ? AND cart = ?", userId, cartStr)
+	if err != nil {
+		requestLog(c).Error("Ошибка очистки корзины пользователя", "user_id", userId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if cleared, err := result.RowsAffected(); err != nil || cleared == 0 {
+		requestLog(c).Warn("Корзина изменилась во время оформления заказа", "user_id", userId, "error", err)
+		respondError(c, CodeCartChanged)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM cart_prices WHERE user_id = ?", userId); err != nil {
+		requestLog(c).Error("Ошибка очистки цен корзины пользователя", "user_id", userId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		requestLog(c).Error("Ошибка фиксации транзакции", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+
+	ordersPlacedTotal.WithLabelValues(order.PaymentType).Inc()
+	c.JSON(http.StatusCreated, gin.H{"message": "Заказ успешно оформлен", "order": order})
+}
+
+func getOrders(c *gin.Context) {
+	query := "SELECT " + orderColumns + " FROM orders"
+	var args []interface{}
+	if userIdStr := c.Query("user_id"); userIdStr != "" {
+		userId, err := strconv.ParseInt(userIdStr, 10, 64)
+		if err != nil {
+			respondError(c, CodeInvalidParameter)
+			return
+		}
+		query += " WHERE user_id = ?"
+		args = append(args, userId)
+	}
+	query += " ORDER BY id"
+
+	rows, err := db.QueryContext(c.Request.Context(), query, args...)
+	if err != nil {
+		requestLog(c).Error("Ошибка получения заказов", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	defer rows.Close()
+	orders := []Order{}
+	var ids []int64
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			requestLog(c).Error("Ошибка сканирования заказа", "error", err)
+			respondError(c, CodeInternal)
+			return
+		}
+		orders = append(orders, order)
+		ids = append(ids, order.Id)
+	}
+	if err := rows.Err(); err != nil {
+		requestLog(c).Error("Ошибка итерации по заказам", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+
+	items, err := loadOrderItems(c.Request.Context(), ids...)
+	if err != nil {
+		requestLog(c).Error("Ошибка получения позиций заказов", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	for i := range orders {
+		orders[i].Items = items[orders[i].Id]
+	}
+	c.JSON(http.StatusOK, orders)
+}
+
+func getOrder(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+
+	order, err := loadOrder(c.Request.Context(), id)
+	if err == sql.ErrNoRows {
+		respondError(c, CodeOrderNotFound)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при получении заказа по ID", "order_id", id, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	c.JSON(http.StatusOK, order)
+}
+
+func (h *Handlers) updateOrderStatus(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+
+	var request OrderStatusRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+	if !isValidOrderStatus(request.Status) {
+		respondError(c, CodeInvalidOrderStatus)
+		return
+	}
+
+	var status, paymentType string
+	err = db.QueryRowContext(c.Request.Context(), "SELECT status,payment_type FROM orders WHERE id = ?", id).Scan(&status, &paymentType)
+	if err == sql.ErrNoRows {
+		respondError(c, CodeOrderNotFound)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при получении заказа по ID", "order_id", id, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if !canTransitionOrder(status, request.Status) {
+		respondErrorDetails(c, CodeInvalidOrderTransition, map[string]any{"from": status, "to": request.Status})
+		return
+	}
+	// Неоплаченный заказ с онлайн-оплатой отправлять нельзя, как и в addShipment.
+	if status == OrderStatusPending && request.Status == OrderStatusShipped && paymentType != PaymentTypeCash {
+		respondError(c, CodeOrderNotShippable)
+		return
+	}
+
+	// Условие на прежний статус не дает перезаписать переход, сделанный
+	// одновременно, например оплату заказа.
+	result, err := db.ExecContext(c.Request.Context(), "UPDATE orders SET status = ? WHERE id = ? AND status = ?", request.Status, id, status)
+	if err != nil {
+		requestLog(c).Error("Ошибка при обновлении статуса заказа", "order_id", id, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		requestLog(c).Error("Ошибка получения количества затронутых строк при обновлении", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if rowsAffected == 0 {
+		respondErrorDetails(c, CodeInvalidOrderTransition, map[string]any{"from": status, "to": request.Status})
+		return
+	}
+	h.audit(c, AuditActionUpdate, AuditEntityOrder, id, gin.H{"status": status}, gin.H{"status": request.Status})
+	c.JSON(http.StatusOK, gin.H{"message": "Статус заказа обновлен", "status": request.Status})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const (
+	PaymentTypeCash   = "cash"
+	PaymentTypeCard   = "card"
+	PaymentTypeWallet = "wallet"
+)
+
+const (
+	OrderStatusPending   = "pending"
+	OrderStatusPaid      = "paid"
+	OrderStatusShipped   = "shipped"
+	OrderStatusDelivered = "delivered"
+	OrderStatusCancelled = "cancelled"
+	OrderStatusRefunded  = "refunded"
+)
+
+var orderStatuses = []string{
+	OrderStatusPending,
+	OrderStatusPaid,
+	OrderStatusShipped,
+	OrderStatusDelivered,
+	OrderStatusCancelled,
+	OrderStatusRefunded,
+}
+
+// orderStatusTransitions перечисляет переходы статусов заказа, доступные
+// через PATCH /order/:id/status. Статусы paid и refunded выставляют только
+// обработка платежей и возврат денег, поэтому вручную в них перейти нельзя.
+// Из pending в shipped можно только заказ с оплатой при получении, это
+// проверяет updateOrderStatus.
+var orderStatusTransitions = map[string][]string{
+	OrderStatusPending: {OrderStatusShipped, OrderStatusCancelled},
+	OrderStatusPaid:    {OrderStatusShipped},
+	OrderStatusShipped: {OrderStatusDelivered},
+}
+
+// PaymentMethod — сохраненный способ оплаты пользователя. Для карт хранится
+// только маскированный токен платежного провайдера.
+type PaymentMethod struct {
+	Id        int64     `json:"id"`
+	UserId    int64     `json:"user_id"`
+	Type      string    `json:"type" binding:"required"`
+	Provider  string    `json:"provider"`
+	CardToken string    `json:"card_token"`
+	IsDefault bool      `json:"is_default"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type OrderItem struct {
+	Id        int64  `json:"id"`
+	ProductId int64  `json:"product_id"`
+	Name      string `json:"name"`
+	Price     int    `json:"price"`
+	Quantity  int    `json:"quantity"`
+	// Discount и Tax — скидка и налог на все единицы позиции вместе.
+	Discount int `json:"discount"`
+	Tax      int `json:"tax"`
+}
+
+type Order struct {
+	Id           int64       `json:"id"`
+	UserId       int64       `json:"user_id"`
+	Status       string      `json:"status"`
+	Items        []OrderItem `json:"items"`
+	Subtotal     int         `json:"subtotal"`
+	Discount     int         `json:"discount"`
+	Discounts    []Discount  `json:"discounts"`
+	ShippingCost int         `json:"shipping_cost"`
+	Tax          int         `json:"tax"`
+	Taxes        []TaxLine   `json:"taxes"`
+	// PricesIncludeTax — цены и доставка заказа включают налог; иначе
+	// налог входит в Total отдельно.
+	PricesIncludeTax bool    `json:"prices_include_tax"`
+	Total            int     `json:"total"`
+	ShippingRateId   *int64  `json:"shipping_rate_id"`
+	Latitude         float64 `json:"latitude"`
+	Longitude        float64 `json:"longitude"`
+	PaymentMethodId  *int64  `json:"payment_method_id"`
+	PaymentType      string  `json:"payment_type"`
+	Amount           int     `json:"amount"`
+	// Currency — валюта всех сумм заказа. ExchangeRates — курсы к базовой
+	// валюте, по которым при оформлении пересчитаны цены товаров и
+	// доставка; после оформления суммы заказа от курсов не зависят.
+	Currency      string       `json:"currency"`
+	ExchangeRates RateSnapshot `json:"exchange_rates"`
+	CreatedAt     time.Time    `json:"created_at"`
+}
+
+func isValidPaymentType(paymentType string) bool {
+	switch paymentType {
+	case PaymentTypeCash, PaymentTypeCard, PaymentTypeWallet:
+		return true
+	}
+	return false
+}
+
+func isValidOrderStatus(status string) bool {
+	for _, s := range orderStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func canTransitionOrder(from, to string) bool {
+	for _, status := range orderStatusTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// maskCardToken оставляет видимыми только последние четыре символа токена.
+func maskCardToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	if len(token) <= 4 {
+		return "****" + token
+	}
+	return "**** " + token[len(token)-4:]
+}
+
+func scanPaymentMethod(row interface{ Scan(...interface{}) error }) (PaymentMethod, error) {
+	var pm PaymentMethod
+	err := row.Scan(&pm.Id, &pm.UserId, &pm.Type, &pm.Provider, &pm.CardToken, &pm.IsDefault, &pm.CreatedAt)
+	return pm, err
+}
+
+const paymentMethodColumns = "id,user_id,type,provider,card_token,is_default,created_at"
+
+func loadPaymentMethod(ctx context.Context, userId, methodId int64) (PaymentMethod, error) {
+	row := db.QueryRowContext(ctx, "SELECT "+paymentMethodColumns+" FROM payment_methods WHERE id = ? AND user_id = ?", methodId, userId)
+	return scanPaymentMethod(row)
+}
+
+func loadDefaultPaymentMethod(ctx context.Context, userId int64) (PaymentMethod, error) {
+	row := db.QueryRowContext(ctx, "SELECT "+paymentMethodColumns+" FROM payment_methods WHERE user_id = ? ORDER BY is_default DESC, id LIMIT 1", userId)
+	return scanPaymentMethod(row)
+}
+
+const orderColumns = "id,user_id,status,subtotal,discount,discounts,shipping_cost,tax,taxes,prices_include_tax,total,shipping_rate_id,latitude,longitude,payment_method_id,payment_type,amount,currency,exchange_rates,created_at"
+
+func scanOrder(row interface{ Scan(...interface{}) error }) (Order, error) {
+	var o Order
+	var shippingRateId, paymentMethodId sql.NullInt64
+	var ratesJSON, discountsJSON, taxesJSON string
+	err := row.Scan(&o.Id, &o.UserId, &o.Status, &o.Subtotal, &o.Discount, &discountsJSON, &o.ShippingCost, &o.Tax, &taxesJSON, &o.PricesIncludeTax, &o.Total, &shippingRateId,
+		&o.Latitude, &o.Longitude, &paymentMethodId, &o.PaymentType, &o.Amount, &o.Currency, &ratesJSON, &o.CreatedAt)
+	if err != nil {
+		return o, err
+	}
+	if err := json.Unmarshal([]byte(ratesJSON), &o.ExchangeRates); err != nil {
+		return o, err
+	}
+	if err := json.Unmarshal([]byte(discountsJSON), &o.Discounts); err != nil {
+		return o, err
+	}
+	if err := json.Unmarshal([]byte(taxesJSON), &o.Taxes); err != nil {
+		return o, err
+	}
+	if shippingRateId.Valid {
+		o.ShippingRateId = &shippingRateId.Int64
+	}
+	if paymentMethodId.Valid {
+		o.PaymentMethodId = &paymentMethodId.Int64
+	}
+	return o, nil
+}
+
+func loadOrderItems(ctx context.Context, orderIds ...int64) (map[int64][]OrderItem, error) {
+	items := make(map[int64][]OrderItem)
+	if len(orderIds) == 0 {
+		return items, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(orderIds)), ",")
+	args := make([]interface{}, len(orderIds))
+	for i, id := range orderIds {
+		args[i] = id
+	}
+	rows, err := db.QueryContext(ctx, "SELECT id,order_id,product_id,name,price,quantity,discount,tax FROM order_items WHERE order_id IN ("+placeholders+") ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item OrderItem
+		var orderId int64
+		if err := rows.Scan(&item.Id, &orderId, &item.ProductId, &item.Name, &item.Price, &item.Quantity, &item.Discount, &item.Tax); err != nil {
+			return nil, err
+		}
+		items[orderId] = append(items[orderId], item)
+	}
+	return items, rows.Err()
+}
+
+func loadOrder(ctx context.Context, id int64) (Order, error) {
+	order, err := scanOrder(db.QueryRowContext(ctx, "SELECT "+orderColumns+" FROM orders WHERE id = ?", id))
+	if err != nil {
+		return order, err
+	}
+	items, err := loadOrderItems(ctx, id)
+	if err != nil {
+		return order, err
+	}
+	order.Items = items[id]
+	return order, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// Типы тела PATCH-запросов. Обычный application/json разбирается так же,
+// как merge-patch.
+const (
+	mimeMergePatch = "application/merge-patch+json"
+	mimeJSONPatch  = "application/json-patch+json"
+)
+
+// applyPatch применяет тело PATCH-запроса к JSON-представлению ресурса
+// current, раскладывает результат в target и проверяет его тегами binding.
+//
+// application/json и application/merge-patch+json — JSON Merge Patch
+// (RFC 7396): отсутствующие поля не меняются, null удаляет значение.
+// application/json-patch+json — список операций JSON Patch (RFC 6902).
+// При ошибке ответ уже отправлен и возвращается false.
+func applyPatch(c *gin.Context, current, target any) bool {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		respondError(c, CodeInvalidBody)
+		return false
+	}
+	document, err := json.Marshal(current)
+	if err != nil {
+		requestLog(c).Error("Ошибка сериализации ресурса для патча", "error", err)
+		respondError(c, CodeInternal)
+		return false
+	}
+
+	var patched []byte
+	if c.ContentType() == mimeJSONPatch {
+		patch, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			requestLog(c).Warn("Некорректный JSON Patch", "error", err)
+			respondError(c, CodeInvalidBody)
+			return false
+		}
+		patched, err = patch.Apply(document)
+		if err != nil {
+			requestLog(c).Warn("Ошибка применения JSON Patch", "error", err)
+			respondError(c, CodePatchFailed)
+			return false
+		}
+	} else {
+		// Merge patch не объектом заменил бы ресурс целиком, что для наших
+		// ресурсов бессмысленно.
+		var members map[string]json.RawMessage
+		if err := json.Unmarshal(body, &members); err != nil || members == nil {
+			respondError(c, CodeInvalidBody)
+			return false
+		}
+		patched, err = jsonpatch.MergePatch(document, body)
+		if err != nil {
+			requestLog(c).Warn("Ошибка применения JSON Merge Patch", "error", err)
+			respondError(c, CodeInvalidBody)
+			return false
+		}
+	}
+
+	if err := json.Unmarshal(patched, target); err != nil {
+		respondBindingError(c, err)
+		return false
+	}
+	if err := binding.Validator.ValidateStruct(target); err != nil {
+		respondBindingError(c, err)
+		return false
+	}
+	return true
+}
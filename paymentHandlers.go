@@ -0,0 +1,355 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requirePayments отвечает payments_disabled, если платежный провайдер не
+// настроен.
+func requirePayments() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if paymentProvider == nil {
+			respondError(c, CodePaymentsDisabled)
+			return
+		}
+		c.Next()
+	}
+}
+
+// payOrder создает у провайдера новый платеж по заказу. Каждая попытка
+// оплаты записывается в таблицу payments отдельной строкой. Пока у заказа
+// есть незавершенный платеж, новый не создается (см. reuseOpenPayment):
+// два оплаченных намерения списали бы деньги дважды.
+func payOrder(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+
+	order, err := loadOrder(c.Request.Context(), id)
+	if err == sql.ErrNoRows {
+		respondError(c, CodeOrderNotFound)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при получении заказа по ID", "order_id", id, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if order.PaymentType == PaymentTypeCash {
+		respondError(c, CodePaymentOnDelivery)
+		return
+	}
+	if order.Status != OrderStatusPending {
+		respondError(c, CodeOrderNotAwaitingPayment)
+		return
+	}
+	if reuseOpenPayment(c, order.Id) {
+		return
+	}
+
+	// Платежные системы принимают код валюты строчными буквами.
+	currency := strings.ToLower(order.Currency)
+	now := time.Now().UTC()
+	payment := Payment{
+		OrderId:   order.Id,
+		Provider:  paymentProvider.Name(),
+		Amount:    order.Amount,
+		Currency:  currency,
+		Status:    PaymentStatusCreated,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	intent, intentErr := paymentProvider.CreateIntent(c.Request.Context(), order.Id, order.Amount, currency)
+	if intentErr != nil {
+		requestLog(c).Error("Ошибка создания платежа для заказа", "order_id", order.Id, "error", intentErr)
+		payment.Status = PaymentStatusFailed
+		payment.Error = intentErr.Error()
+	} else {
+		payment.IntentId = intent.Id
+	}
+
+	payment.Id, err = db.InsertContext(c.Request.Context(), "INSERT INTO payments (order_id,provider,intent_id,amount,currency,status,error,client_secret,created_at,updated_at) VALUES (?,?,?,?,?,?,?,?,?,?)",
+		payment.OrderId, payment.Provider, payment.IntentId, payment.Amount, payment.Currency, payment.Status, payment.Error, intent.ClientSecret, payment.CreatedAt, payment.UpdatedAt)
+	// Одновременный запрос успел записать свой платеж: уникальный индекс
+	// payments_open_order не дает завести второй, клиент получает первый.
+	if err != nil && intentErr == nil && reuseOpenPayment(c, order.Id) {
+		requestLog(c).Warn("Намерение платежа не использовано: у заказа уже есть незавершенный платеж", "order_id", order.Id, "intent_id", intent.Id)
+		return
+	}
+	if err != nil {
+		requestLog(c).Error("Ошибка при сохранении платежа заказа", "order_id", order.Id, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if intentErr != nil {
+		respondError(c, CodePaymentProviderFailed)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"payment": payment, "client_secret": intent.ClientSecret})
+}
+
+// reuseOpenPayment отвечает на запрос оплаты, если у заказа уже есть
+// незавершенный платеж: created возвращается вместе с client_secret для
+// повторной попытки, authorized — ошибкой payment_in_progress. false —
+// незавершенного платежа нет.
+func reuseOpenPayment(c *gin.Context, orderId int64) bool {
+	payment, clientSecret, err := loadOpenPayment(c.Request.Context(), orderId)
+	if err == sql.ErrNoRows {
+		return false
+	} else if err != nil {
+		requestLog(c).Error("Ошибка получения незавершенного платежа заказа", "order_id", orderId, "error", err)
+		respondError(c, CodeInternal)
+		return true
+	}
+	if payment.Status != PaymentStatusCreated || clientSecret == "" {
+		respondErrorDetails(c, CodePaymentInProgress, map[string]any{"payment_id": payment.Id})
+		return true
+	}
+	c.JSON(http.StatusOK, gin.H{"payment": payment, "client_secret": clientSecret})
+	return true
+}
+
+func getOrderPayments(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+
+	rows, err := db.QueryContext(c.Request.Context(), "SELECT "+paymentColumns+" FROM payments WHERE order_id = ? ORDER BY id", id)
+	if err != nil {
+		requestLog(c).Error("Ошибка получения платежей заказа", "order_id", id, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	defer rows.Close()
+	payments := []Payment{}
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			requestLog(c).Error("Ошибка сканирования платежа", "error", err)
+			respondError(c, CodeInternal)
+			return
+		}
+		payments = append(payments, payment)
+	}
+	if err := rows.Err(); err != nil {
+		requestLog(c).Error("Ошибка итерации по платежам", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	c.JSON(http.StatusOK, payments)
+}
+
+// paymentWebhook принимает уведомления провайдера. Каждое событие
+// обрабатывается не более одного раза: его ID записывается в payment_events
+// в той же транзакции, что и изменение платежа и заказа.
+func paymentWebhook(c *gin.Context) {
+	payload, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		respondError(c, CodeInvalidBody)
+		return
+	}
+	event, err := paymentProvider.VerifyWebhook(payload, c.Request.Header)
+	if errors.Is(err, errInvalidWebhookSignature) {
+		requestLog(c).Warn("Получен вебхук с неверной подписью")
+		respondError(c, CodeInvalidSignature)
+		return
+	} else if err != nil || event.Id == "" {
+		requestLog(c).Warn("Ошибка разбора вебхука", "error", err)
+		respondError(c, CodeInvalidEvent)
+		return
+	}
+	provider := paymentProvider.Name()
+
+	var seen int
+	err = db.QueryRowContext(c.Request.Context(), "SELECT COUNT(*) FROM payment_events WHERE provider = ? AND event_id = ?", provider, event.Id).Scan(&seen)
+	if err != nil {
+		requestLog(c).Error("Ошибка проверки события", "event_id", event.Id, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if seen > 0 {
+		c.JSON(http.StatusOK, gin.H{"message": "Событие уже обработано"})
+		return
+	}
+
+	var payment Payment
+	if event.Type != "" {
+		payment, err = loadPaymentByIntent(c.Request.Context(), provider, event.IntentId)
+		if err == sql.ErrNoRows {
+			requestLog(c).Warn("Вебхук ссылается на неизвестный платеж", "event_id", event.Id, "intent_id", event.IntentId)
+			event.Type = ""
+		} else if err != nil {
+			requestLog(c).Error("Ошибка получения платежа", "intent_id", event.IntentId, "error", err)
+			respondError(c, CodeInternal)
+			return
+		}
+	}
+
+	if (event.Type == PaymentEventAuthorized || event.Type == PaymentEventSucceeded) && event.Amount != payment.Amount {
+		// Событие фиксируется, но заказ не считается оплаченным: сумму
+		// нужно проверить вручную.
+		requestLog(c).Warn("Сумма события не совпадает с суммой платежа", "event_id", event.Id, "payment_id", payment.Id,
+			"event_amount", event.Amount, "payment_amount", payment.Amount)
+		event.Type = ""
+	}
+
+	paymentStatus, paymentError, orderStatus, orderFrom := "", "", "", ""
+	switch event.Type {
+	case PaymentEventAuthorized:
+		if !canTransitionPayment(payment.Status, PaymentStatusSucceeded) {
+			break
+		}
+		// Заказ, который уже не ждет оплаты (например, отменен), не
+		// списывается: без списания авторизация истечет сама.
+		var status string
+		err := db.QueryRowContext(c.Request.Context(), "SELECT status FROM orders WHERE id = ?", payment.OrderId).Scan(&status)
+		if err != nil {
+			requestLog(c).Error("Ошибка получения статуса заказа", "order_id", payment.OrderId, "error", err)
+			respondError(c, CodeInternal)
+			return
+		}
+		if status != OrderStatusPending {
+			requestLog(c).Warn("Авторизация платежа по заказу, который не ожидает оплаты, не списана", "payment_id", payment.Id,
+				"order_id", payment.OrderId, "order_status", status)
+			paymentStatus, paymentError = PaymentStatusFailed, "Заказ в статусе "+status+" не ожидает оплаты, платеж не списан"
+			break
+		}
+		if _, err := paymentProvider.Capture(c.Request.Context(), payment.IntentId); err != nil {
+			requestLog(c).Error("Ошибка списания платежа", "intent_id", payment.IntentId, "error", err)
+			respondError(c, CodePaymentCaptureFailed)
+			return
+		}
+		paymentStatus, orderStatus, orderFrom = PaymentStatusSucceeded, OrderStatusPaid, OrderStatusPending
+	case PaymentEventSucceeded:
+		paymentStatus, orderStatus, orderFrom = PaymentStatusSucceeded, OrderStatusPaid, OrderStatusPending
+	case PaymentEventFailed:
+		paymentStatus = PaymentStatusFailed
+	case PaymentEventRefunded:
+		// Платеж на проверке не оплачивал заказ, его возврат заказ не меняет.
+		if event.Amount >= payment.Amount {
+			paymentStatus = PaymentStatusRefunded
+			if payment.Status == PaymentStatusSucceeded {
+				orderStatus = OrderStatusRefunded
+			}
+		}
+	}
+	if paymentStatus != "" && !canTransitionPayment(payment.Status, paymentStatus) {
+		paymentStatus, orderStatus = "", ""
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		requestLog(c).Error("Ошибка начала транзакции", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO payment_events (provider,event_id,type,received_at) VALUES (?,?,?,?) ON CONFLICT DO NOTHING",
+		provider, event.Id, event.Type, time.Now().UTC())
+	if err != nil {
+		requestLog(c).Error("Ошибка сохранения события", "event_id", event.Id, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+		c.JSON(http.StatusOK, gin.H{"message": "Событие уже обработано"})
+		return
+	}
+
+	if paymentStatus != "" {
+		// Условие на статус защищает от события, обработанного одновременно
+		// и уже переведшего платеж дальше.
+		from := paymentTransitions[paymentStatus]
+		query := "UPDATE payments SET status = ?, updated_at = ?"
+		args := []interface{}{paymentStatus, time.Now().UTC()}
+		if paymentError != "" {
+			query += ", error = ?"
+			args = append(args, paymentError)
+		}
+		query += " WHERE id = ? AND status IN (?" + strings.Repeat(",?", len(from)-1) + ")"
+		args = append(args, payment.Id)
+		for _, status := range from {
+			args = append(args, status)
+		}
+		result, err := tx.Exec(query, args...)
+		if err != nil {
+			requestLog(c).Error("Ошибка обновления платежа", "payment_id", payment.Id, "error", err)
+			respondError(c, CodeInternal)
+			return
+		}
+		if updated, err := result.RowsAffected(); err != nil {
+			requestLog(c).Error("Ошибка получения количества затронутых строк при обновлении", "error", err)
+			respondError(c, CodeInternal)
+			return
+		} else if updated == 0 {
+			orderStatus = ""
+		}
+	}
+	if orderStatus != "" {
+		query, args := "UPDATE orders SET status = ? WHERE id = ?", []interface{}{orderStatus, payment.OrderId}
+		if orderFrom != "" {
+			query += " AND status = ?"
+			args = append(args, orderFrom)
+		}
+		result, err := tx.Exec(query, args...)
+		if err != nil {
+			requestLog(c).Error("Ошибка обновления статуса заказа", "order_id", payment.OrderId, "error", err)
+			respondError(c, CodeInternal)
+			return
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			requestLog(c).Error("Ошибка получения количества затронутых строк при обновлении", "error", err)
+			respondError(c, CodeInternal)
+			return
+		}
+		if updated == 0 && orderStatus == OrderStatusPaid {
+			if !holdPaymentForReview(c, tx, payment) {
+				return
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		requestLog(c).Error("Ошибка фиксации транзакции", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Событие обработано"})
+}
+
+// holdPaymentForReview переводит списанный платеж на ручную проверку, если
+// заказ к моменту оплаты уже не ожидал ее (например, был отменен): деньги
+// нужно вернуть или зачесть вручную. false — ответ с ошибкой уже отправлен.
+func holdPaymentForReview(c *gin.Context, tx *Tx, payment Payment) bool {
+	var status string
+	if err := tx.QueryRow("SELECT status FROM orders WHERE id = ?", payment.OrderId).Scan(&status); err != nil {
+		requestLog(c).Error("Ошибка получения статуса заказа", "order_id", payment.OrderId, "error", err)
+		respondError(c, CodeInternal)
+		return false
+	}
+	requestLog(c).Error("Оплачен заказ, который не ожидает оплаты: платеж требует ручной проверки", "payment_id", payment.Id,
+		"order_id", payment.OrderId, "order_status", status)
+	_, err := tx.Exec("UPDATE payments SET status = ?, error = ?, updated_at = ? WHERE id = ?",
+		PaymentStatusReview, "Оплачен заказ в статусе "+status+", нужен возврат или ручная проверка", time.Now().UTC(), payment.Id)
+	if err != nil {
+		requestLog(c).Error("Ошибка обновления платежа", "payment_id", payment.Id, "error", err)
+		respondError(c, CodeInternal)
+		return false
+	}
+	return true
+}
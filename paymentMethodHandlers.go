@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func getPaymentMethods(c *gin.Context) {
+	userId, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+
+	rows, err := db.QueryContext(c.Request.Context(), "SELECT "+paymentMethodColumns+" FROM payment_methods WHERE user_id = ? ORDER BY id", userId)
+	if err != nil {
+		requestLog(c).Error("Ошибка получения способов оплаты пользователя", "user_id", userId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	defer rows.Close()
+	methods := []PaymentMethod{}
+	for rows.Next() {
+		pm, err := scanPaymentMethod(rows)
+		if err != nil {
+			requestLog(c).Error("Ошибка сканирования способа оплаты", "error", err)
+			respondError(c, CodeInternal)
+			return
+		}
+		methods = append(methods, pm)
+	}
+	if err := rows.Err(); err != nil {
+		requestLog(c).Error("Ошибка итерации по способам оплаты", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	c.JSON(http.StatusOK, methods)
+}
+
+func addPaymentMethod(c *gin.Context) {
+	userId, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+
+	var pm PaymentMethod
+	if err := c.ShouldBindJSON(&pm); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+	if !isValidPaymentType(pm.Type) {
+		respondFieldErrors(c, FieldError{Field: "type", Code: "oneof", Param: PaymentTypeCash + " " + PaymentTypeCard + " " + PaymentTypeWallet})
+		return
+	}
+	if pm.Type == PaymentTypeCard && pm.CardToken == "" {
+		respondFieldErrors(c, FieldError{Field: "card_token", Code: "required"})
+		return
+	}
+
+	var count int
+	err = db.QueryRowContext(c.Request.Context(), "SELECT COUNT(*) FROM users WHERE id = ? AND deleted_at IS NULL", userId).Scan(&count)
+	if err != nil {
+		requestLog(c).Error("Ошибка проверки пользователя", "user_id", userId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if count == 0 {
+		respondError(c, CodeUserNotFound)
+		return
+	}
+
+	err = db.QueryRowContext(c.Request.Context(), "SELECT COUNT(*) FROM payment_methods WHERE user_id = ?", userId).Scan(&count)
+	if err != nil {
+		requestLog(c).Error("Ошибка подсчета способов оплаты пользователя", "user_id", userId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+
+	pm.UserId = userId
+	pm.CardToken = maskCardToken(pm.CardToken)
+	pm.IsDefault = pm.IsDefault || count == 0
+	pm.CreatedAt = time.Now().UTC()
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		requestLog(c).Error("Ошибка начала транзакции", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	defer tx.Rollback()
+
+	if pm.IsDefault {
+		if _, err := tx.Exec("UPDATE payment_methods SET is_default = ? WHERE user_id = ?", false, userId); err != nil {
+			requestLog(c).Error("Ошибка сброса способа оплаты по умолчанию", "error", err)
+			respondError(c, CodeInternal)
+			return
+		}
+	}
+	pm.Id, err = tx.Insert("INSERT INTO payment_methods (user_id,type,provider,card_token,is_default,created_at) VALUES (?,?,?,?,?,?)",
+		pm.UserId, pm.Type, pm.Provider, pm.CardToken, pm.IsDefault, pm.CreatedAt)
+	if err != nil {
+		requestLog(c).Error("Ошибка при добавлении способа оплаты в базу данных", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		requestLog(c).Error("Ошибка фиксации транзакции", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "Способ оплаты успешно добавлен", "payment_method": pm})
+}
+
+func deletePaymentMethod(c *gin.Context) {
+	userId, errUser := strconv.ParseInt(c.Param("id"), 10, 64)
+	methodId, errMethod := strconv.ParseInt(c.Param("methodId"), 10, 64)
+	if errUser != nil || errMethod != nil {
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+
+	pm, err := loadPaymentMethod(c.Request.Context(), userId, methodId)
+	if err == sql.ErrNoRows {
+		respondError(c, CodePaymentMethodNotFound)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при получении способа оплаты", "method_id", methodId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		requestLog(c).Error("Ошибка начала транзакции", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM payment_methods WHERE id = ?", methodId); err != nil {
+		requestLog(c).Error("Ошибка при удалении способа оплаты", "method_id", methodId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if pm.IsDefault {
+		_, err := tx.Exec("UPDATE payment_methods SET is_default = ? WHERE id = (SELECT MIN(id) FROM payment_methods WHERE user_id = ?)", true, userId)
+		if err != nil {
+			requestLog(c).Error("Ошибка назначения нового способа оплаты по умолчанию", "error", err)
+			respondError(c, CodeInternal)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		requestLog(c).Error("Ошибка фиксации транзакции", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Способ оплаты успешно удален!"})
+}
+
+func setDefaultPaymentMethod(c *gin.Context) {
+	userId, errUser := strconv.ParseInt(c.Param("id"), 10, 64)
+	methodId, errMethod := strconv.ParseInt(c.Param("methodId"), 10, 64)
+	if errUser != nil || errMethod != nil {
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+
+	pm, err := loadPaymentMethod(c.Request.Context(), userId, methodId)
+	if err == sql.ErrNoRows {
+		respondError(c, CodePaymentMethodNotFound)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при получении способа оплаты", "method_id", methodId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+
+	_, err = db.ExecContext(c.Request.Context(), "UPDATE payment_methods SET is_default = (id = ?) WHERE user_id = ?", methodId, userId)
+	if err != nil {
+		requestLog(c).Error("Ошибка при смене способа оплаты по умолчанию", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	pm.IsDefault = true
+	c.JSON(http.StatusOK, gin.H{"message": "Способ оплаты по умолчанию изменен", "payment_method": pm})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	PaymentStatusCreated    = "created"
+	PaymentStatusAuthorized = "authorized"
+	PaymentStatusSucceeded  = "succeeded"
+	PaymentStatusFailed     = "failed"
+	PaymentStatusRefunded   = "refunded"
+	// PaymentStatusReview — деньги списаны, но заказ уже не ожидал оплаты
+	// (например, отменен): платеж нужно вернуть или зачесть вручную.
+	PaymentStatusReview = "review"
+)
+
+// Типы событий вебхука, к которым провайдеры приводят свои собственные.
+const (
+	PaymentEventAuthorized = "payment.authorized"
+	PaymentEventSucceeded  = "payment.succeeded"
+	PaymentEventFailed     = "payment.failed"
+	PaymentEventRefunded   = "payment.refunded"
+)
+
+var errInvalidWebhookSignature = errors.New("неверная подпись вебхука")
+
+type PaymentIntent struct {
+	Id           string `json:"id"`
+	ClientSecret string `json:"client_secret"`
+	Status       string `json:"status"`
+	Amount       int    `json:"amount"`
+	Currency     string `json:"currency"`
+}
+
+type PaymentRefund struct {
+	Id     string `json:"id"`
+	Status string `json:"status"`
+	Amount int    `json:"amount"`
+}
+
+// paymentTransitions — из каких статусов платеж может перейти в статус по
+// событию вебхука. Статусы меняются только вперед: запоздавший
+// payment.failed не отменяет списание, а повторный payment.succeeded не
+// возвращает платеж из refunded. Неуспешный платеж может пройти при
+// повторной попытке оплаты того же намерения. Платеж на проверке
+// закрывается возвратом денег.
+var paymentTransitions = map[string][]string{
+	PaymentStatusSucceeded: {PaymentStatusCreated, PaymentStatusAuthorized, PaymentStatusFailed},
+	PaymentStatusFailed:    {PaymentStatusCreated, PaymentStatusAuthorized},
+	PaymentStatusRefunded:  {PaymentStatusSucceeded, PaymentStatusReview},
+}
+
+func canTransitionPayment(from, to string) bool {
+	for _, status := range paymentTransitions[to] {
+		if status == from {
+			return true
+		}
+	}
+	return false
+}
+
+// PaymentEvent — событие вебхука после проверки подписи. Неинтересные нам
+// события провайдера имеют пустой Type.
+type PaymentEvent struct {
+	Id       string
+	Type     string
+	IntentId string
+	Amount   int
+}
+
+// PaymentProvider — платежный шлюз. Суммы передаются в тех же единицах,
+// что и цены продуктов.
+type PaymentProvider interface {
+	Name() string
+	CreateIntent(ctx context.Context, orderId int64, amount int, currency string) (PaymentIntent, error)
+	Capture(ctx context.Context, intentId string) (PaymentIntent, error)
+	// Refund с ключом idempotencyKey, уже использованным для возврата,
+	// не возвращает деньги второй раз, а отдает прежний возврат.
+	Refund(ctx context.Context, intentId string, amount int, idempotencyKey string) (PaymentRefund, error)
+	VerifyWebhook(payload []byte, header http.Header) (PaymentEvent, error)
+}
+
+type Payment struct {
+	Id        int64     `json:"id"`
+	OrderId   int64     `json:"order_id"`
+	Provider  string    `json:"provider"`
+	IntentId  string    `json:"intent_id"`
+	Amount    int       `json:"amount"`
+	Currency  string    `json:"currency"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const (
+	PaymentProviderNone   = "none"
+	PaymentProviderFake   = "fake"
+	PaymentProviderStripe = "stripe"
+)
+
+// paymentProvider — nil, если онлайн-оплата отключена (провайдер none).
+var paymentProvider PaymentProvider
+
+// newPaymentProvider создает провайдера из конфигурации. Для none
+// возвращается nil: оплата заказов и вебхуки отвечают payments_disabled.
+func newPaymentProvider(cfg PaymentsConfig) PaymentProvider {
+	switch cfg.Provider {
+	case PaymentProviderStripe:
+		return NewStripeProvider(cfg.StripeSecretKey, cfg.StripeWebhookSecret)
+	case PaymentProviderFake:
+		slog.Info("Используется фейковый платежный провайдер")
+		return NewFakePaymentProvider(cfg.WebhookSecret)
+	default:
+		slog.Info("Онлайн-оплата отключена")
+		return nil
+	}
+}
+
+const paymentColumns = "id,order_id,provider,intent_id,amount,currency,status,error,created_at,updated_at"
+
+func scanPayment(row interface{ Scan(...interface{}) error }) (Payment, error) {
+	var p Payment
+	err := row.Scan(&p.Id, &p.OrderId, &p.Provider, &p.IntentId, &p.Amount, &p.Currency, &p.Status, &p.Error, &p.CreatedAt, &p.UpdatedAt)
+	return p, err
+}
+
+func loadPaymentByIntent(ctx context.Context, provider, intentId string) (Payment, error) {
+	return scanPayment(db.QueryRowContext(ctx, "SELECT "+paymentColumns+" FROM payments WHERE provider = ? AND intent_id = ?", provider, intentId))
+}
+
+// loadOpenPayment возвращает последний незавершенный (created или
+// authorized) платеж заказа и client_secret его намерения.
+func loadOpenPayment(ctx context.Context, orderId int64) (Payment, string, error) {
+	var p Payment
+	var clientSecret string
+	err := db.QueryRowContext(ctx, "SELECT "+paymentColumns+",client_secret FROM payments WHERE order_id = ? AND status IN (?,?) ORDER BY id DESC LIMIT 1",
+		orderId, PaymentStatusCreated, PaymentStatusAuthorized).
+		Scan(&p.Id, &p.OrderId, &p.Provider, &p.IntentId, &p.Amount, &p.Currency, &p.Status, &p.Error, &p.CreatedAt, &p.UpdatedAt, &clientSecret)
+	return p, clientSecret, err
+}
+
+// loadSucceededPayment возвращает последнюю успешную оплату заказа.
+func loadSucceededPayment(ctx context.Context, orderId int64) (Payment, error) {
+	return scanPayment(db.QueryRowContext(ctx, "SELECT "+paymentColumns+" FROM payments WHERE order_id = ? AND status = ? ORDER BY id DESC LIMIT 1", orderId, PaymentStatusSucceeded))
+}
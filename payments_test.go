@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStripeRefundIdempotencyKey(t *testing.T) {
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/refunds" {
+			t.Errorf("запрос %s", r.URL.Path)
+		}
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"re_1","status":"succeeded","amount":500}`))
+	}))
+	defer server.Close()
+
+	stripe := NewStripeProvider("sk_test", "whsec_test")
+	stripe.baseURL = server.URL
+	// Повтор того же возмещения и следующее возмещение того же возврата.
+	for _, offset := range []int{0, 0, 500} {
+		if _, err := stripe.Refund(context.Background(), "pi_1", 500, refundIdempotencyKey(7, offset, 500)); err != nil {
+			t.Fatalf("Refund: %v", err)
+		}
+	}
+	if len(keys) != 3 || keys[0] == "" || keys[1] != keys[0] || keys[2] == keys[0] {
+		t.Fatalf("ключи идемпотентности %q", keys)
+	}
+
+	fake := NewFakePaymentProvider("secret")
+	intent, _ := fake.CreateIntent(context.Background(), 1, 1000, "rub")
+	first, _ := fake.Refund(context.Background(), intent.Id, 600, refundIdempotencyKey(1, 0, 600))
+	again, err := fake.Refund(context.Background(), intent.Id, 600, refundIdempotencyKey(1, 0, 600))
+	if err != nil || again != first || fake.refunds[intent.Id] != 600 {
+		t.Fatalf("повтор возмещения %+v, %v; возвращено %d", again, err, fake.refunds[intent.Id])
+	}
+}
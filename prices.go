@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// priceSourceHeader — откуда пришла новая цена при добавлении или изменении
+// товара. Без заголовка изменение считается ручным.
+const priceSourceHeader = "X-Price-Source"
+
+const (
+	PriceSourceManual       = "manual"
+	PriceSourceRule         = "rule"
+	PriceSourceSupplierSync = "supplier_sync"
+)
+
+// Политики цены товаров корзины при расчете доставки и оформлении заказа:
+// текущая цена, цена на момент добавления в корзину или меньшая из двух.
+const (
+	CartPriceCurrent = "current"
+	CartPriceAdded   = "added"
+	CartPriceLowest  = "lowest"
+)
+
+// cartPricePolicy — какую цену товара в корзине берет оформление заказа
+// (см. CartConfig).
+var cartPricePolicy = defaultConfig().Cart.PricePolicy
+
+const (
+	defaultPriceReportPeriod = 30 * 24 * time.Hour
+	defaultPriceReportLimit  = 20
+	maxPriceReportLimit      = 100
+)
+
+// PriceChange — точка истории цены товара. PreviousPrice пустая у цены,
+// с которой товар был добавлен; при смене валюты товара PreviousPrice
+// указана в прежней валюте.
+type PriceChange struct {
+	Id            int64     `json:"id"`
+	ProductId     int64     `json:"product_id"`
+	Price         int       `json:"price"`
+	PreviousPrice *int      `json:"previous_price"`
+	Currency      string    `json:"currency"`
+	Source        string    `json:"source"`
+	Actor         string    `json:"actor"`
+	ChangedAt     time.Time `json:"changed_at"`
+}
+
+// PriceHistoryFilter выбирает изменения цен. Нулевые поля не ограничивают
+// выборку; To не включается в период.
+type PriceHistoryFilter struct {
+	ProductId int64
+	From      time.Time
+	To        time.Time
+}
+
+// PriceMovement — изменение цены товара за период: от цены до первого
+// изменения в периоде до цены после последнего, в валюте Currency.
+type PriceMovement struct {
+	ProductId     int64   `json:"product_id"`
+	Name          string  `json:"name"`
+	StartPrice    int     `json:"start_price"`
+	EndPrice      int     `json:"end_price"`
+	Currency      string  `json:"currency"`
+	Change        int     `json:"change"`
+	ChangePercent float64 `json:"change_percent"`
+	Changes       int     `json:"changes"`
+}
+
+func isValidPriceSource(source string) bool {
+	switch source {
+	case PriceSourceManual, PriceSourceRule, PriceSourceSupplierSync:
+		return true
+	}
+	return false
+}
+
+func isValidCartPricePolicy(policy string) bool {
+	switch policy {
+	case CartPriceCurrent, CartPriceAdded, CartPriceLowest:
+		return true
+	}
+	return false
+}
+
+// priceSource возвращает источник цены из заголовка запроса. При
+// некорректном значении ответ уже отправлен.
+func priceSource(c *gin.Context) (string, bool) {
+	source := c.GetHeader(priceSourceHeader)
+	if source == "" {
+		return PriceSourceManual, true
+	}
+	if !isValidPriceSource(source) {
+		respondError(c, CodeInvalidParameter)
+		return "", false
+	}
+	return source, true
+}
+
+// recordPrice записывает в историю новую цену товара. Как и журнал
+// изменений, история пишется после сохранения товара, поэтому ошибка
+// только логируется.
+func (h *Handlers) recordPrice(c *gin.Context, source string, productId int64, previousPrice *int, price int, currency string) {
+	change := PriceChange{
+		ProductId:     productId,
+		Price:         price,
+		PreviousPrice: previousPrice,
+		Currency:      currency,
+		Source:        source,
+		Actor:         requestActor(c),
+		ChangedAt:     time.Now().UTC(),
+	}
+	if err := h.prices.Record(c.Request.Context(), &change); err != nil {
+		requestLog(c).Error("Ошибка записи истории цены", "product_id", productId, "error", err)
+	}
+}
+
+// getProductPrices возвращает историю цены товара от старых изменений к
+// новым, при необходимости за период from–to.
+func (h *Handlers) getProductPrices(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+	filter := PriceHistoryFilter{ProductId: id}
+	if filter.From, err = parsePeriodBound(c.Query("from")); err != nil {
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+	if filter.To, err = parsePeriodBound(c.Query("to")); err != nil {
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+
+	if _, err := h.products.Get(c.Request.Context(), id); err == errNotFound {
+		respondError(c, CodeProductNotFound)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при получении продукта по ID", "product_id", id, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	changes, err := h.prices.List(c.Request.Context(), filter)
+	if err != nil {
+		requestLog(c).Error("Ошибка получения истории цены", "product_id", id, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if changes == nil {
+		changes = []PriceChange{}
+	}
+	c.JSON(http.StatusOK, changes)
+}
+
+// getPriceChangesReport возвращает товары с самым большим изменением цены
+// за период from–to (по умолчанию последние 30 дней), по убыванию
+// изменения в процентах.
+func (h *Handlers) getPriceChangesReport(c *gin.Context) {
+	from, err := parsePeriodBound(c.Query("from"))
+	if err != nil {
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+	to, err := parsePeriodBound(c.Query("to"))
+	if err != nil {
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+	if from.IsZero() {
+		from = to.Add(-defaultPriceReportPeriod)
+	}
+	if !from.Before(to) {
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+	limit := defaultPriceReportLimit
+	if limitStr := c.Query("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxPriceReportLimit {
+			respondError(c, CodeInvalidParameter)
+			return
+		}
+	}
+
+	changes, err := h.prices.List(c.Request.Context(), PriceHistoryFilter{From: from, To: to})
+	if err != nil {
+		requestLog(c).Error("Ошибка получения истории цен", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	products, err := h.products.List(c.Request.Context())
+	if err != nil {
+		requestLog(c).Error("Ошибка получения продуктов", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	names := make(map[int64]string, len(products))
+	for _, p := range products {
+		names[p.Id] = p.Name
+	}
+
+	movements := priceMovements(changes)
+	if len(movements) > limit {
+		movements = movements[:limit]
+	}
+	for i := range movements {
+		movements[i].Name = names[movements[i].ProductId]
+	}
+	c.JSON(http.StatusOK, gin.H{"from": from, "to": to, "products": movements})
+}
+
+// priceMovements сворачивает изменения цен, упорядоченные по времени, в
+// изменение цены каждого товара. Товары, цена которых вернулась к
+// исходной, не попадают в результат. Для товара, добавленного в периоде,
+// начальная цена — цена при добавлении. Цены в разных валютах не
+// сравниваются: если валюта товара сменилась, изменение считается от цены
+// в новой валюте.
+func priceMovements(changes []PriceChange) []PriceMovement {
+	byProduct := make(map[int64]*PriceMovement)
+	var movements []*PriceMovement
+	for _, change := range changes {
+		m, ok := byProduct[change.ProductId]
+		if !ok {
+			m = &PriceMovement{ProductId: change.ProductId, StartPrice: change.Price, Currency: change.Currency}
+			if change.PreviousPrice != nil {
+				m.StartPrice = *change.PreviousPrice
+			}
+			byProduct[change.ProductId] = m
+			movements = append(movements, m)
+		} else if m.Currency != change.Currency {
+			m.Currency, m.StartPrice, m.EndPrice, m.Changes = change.Currency, change.Price, change.Price, 0
+			continue
+		}
+		m.EndPrice = change.Price
+		if change.PreviousPrice != nil {
+			m.Changes++
+		}
+	}
+
+	result := []PriceMovement{}
+	for _, m := range movements {
+		m.Change = m.EndPrice - m.StartPrice
+		if m.Change == 0 {
+			continue
+		}
+		if m.StartPrice != 0 {
+			m.ChangePercent = math.Round(float64(m.Change)*10000/float64(m.StartPrice)) / 100
+		}
+		result = append(result, *m)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		pi, pj := math.Abs(result[i].ChangePercent), math.Abs(result[j].ChangePercent)
+		if pi != pj {
+			return pi > pj
+		}
+		return absInt(result[i].Change) > absInt(result[j].Change)
+	})
+	return result
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// parsePeriodBound разбирает границу периода: время в RFC 3339 или дату
+// 2006-01-02 (начало дня UTC). Пустая строка — граница не задана.
+func parsePeriodBound(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t.UTC(), err
+}
+
+// cartItemPrices возвращает цены товаров корзины по политике
+// cartPricePolicy: added — цены из cart_prices на момент добавления в
+// корзину. Товары без сохраненной цены идут по текущей.
+func cartItemPrices(ctx context.Context, userId int64, products map[int64]Product) (map[int64]int, error) {
+	prices := make(map[int64]int, len(products))
+	for id, p := range products {
+		prices[id] = p.Price
+	}
+	if cartPricePolicy == CartPriceCurrent {
+		return prices, nil
+	}
+	added, err := loadCartPrices(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	for id, price := range added {
+		current, ok := prices[id]
+		if !ok || (cartPricePolicy == CartPriceLowest && current < price) {
+			continue
+		}
+		prices[id] = price
+	}
+	return prices, nil
+}
+
+func loadCartPrices(ctx context.Context, userId int64) (map[int64]int, error) {
+	// Цена, запомненная в другой валюте, не действует после смены валюты
+	// товара.
+	rows, err := db.QueryContext(ctx, "SELECT cart_prices.product_id, cart_prices.price FROM cart_prices "+
+		"JOIN products ON products.id = cart_prices.product_id AND products.currency = cart_prices.currency WHERE cart_prices.user_id = ?", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	prices := make(map[int64]int)
+	for rows.Next() {
+		var productId int64
+		var price int
+		if err := rows.Scan(&productId, &price); err != nil {
+			return nil, err
+		}
+		prices[productId] = price
+	}
+	return prices, rows.Err()
+}
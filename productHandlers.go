@@ -1,333 +1,557 @@
 package main
 
 import (
-	"database/sql"
-	"fmt"
-	"log"
+	"errors"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
-func getProducts(c *gin.Context) {
-	rows, err := db.Query("SELECT id,name,price,image FROM products")
+// ProductRequest — JSON-тело добавления товара. Изображение передается
+// ссылкой в image_url или содержимым в base64 в image_data. Без currency
+// цена считается в рублях.
+type ProductRequest struct {
+	Name      string `json:"name" binding:"required"`
+	Price     int    `json:"price" binding:"required,gt=0"`
+	Currency  string `json:"currency"`
+	Category  string `json:"category"`
+	Weight    int    `json:"weight" binding:"min=0"`
+	ImageURL  string `json:"image_url" binding:"omitempty,http_url"`
+	ImageData string `json:"image_data"`
+}
+
+// ProductPatch — товар после применения к нему JSON Merge Patch или JSON
+// Patch. Новое изображение передается в image_url или image_data; в самом
+// поле image допускается только внешняя ссылка.
+type ProductPatch struct {
+	Name      string `json:"name" binding:"required"`
+	Price     int    `json:"price" binding:"required,gt=0"`
+	Currency  string `json:"currency"`
+	Category  string `json:"category"`
+	Weight    int    `json:"weight" binding:"min=0"`
+	Image     string `json:"image"`
+	ImageURL  string `json:"image_url" binding:"omitempty,http_url"`
+	ImageData string `json:"image_data"`
+}
+
+// ProductFormChanges — изменения товара из multipart-формы. Отсутствующие
+// поля не меняются.
+type ProductFormChanges struct {
+	Name     *string
+	Price    *int
+	Currency *string
+	Category *string
+	Weight   *int
+}
+
+// PricedProduct — товар с ценой, пересчитанной в запрошенную валюту по
+// текущему курсу. OriginalPrice и OriginalCurrency — цена, заданная у
+// товара.
+type PricedProduct struct {
+	Product
+	OriginalPrice    int    `json:"original_price"`
+	OriginalCurrency string `json:"original_currency"`
+}
+
+// getProducts возвращает товары; с параметром currency цены пересчитаны в
+// эту валюту.
+func (h *Handlers) getProducts(c *gin.Context) {
+	currency, ok := requestCurrency(c)
+	if !ok {
+		return
+	}
+	products, err := h.products.List(c.Request.Context())
 	if err != nil {
-		log.Println("Ошибка получения продуктов")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения продуктов"})
+		requestLog(c).Error("Ошибка получения продуктов", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if currency == "" {
+		c.JSON(http.StatusOK, products)
 		return
 	}
-	defer rows.Close()
-	var products []Product
-	for rows.Next() {
-		var p Product
-		if err := rows.Scan(&p.Id, &p.Name, &p.Price, &p.Image); err != nil {
-			log.Printf("Ошибка сканирования продукта: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Ошибка сканирования продукта: %v", err)})
+
+	rates := exchangeRates.snapshot()
+	priced := make([]PricedProduct, 0, len(products))
+	for _, product := range products {
+		p, err := priceProduct(product, currency, rates)
+		if err != nil {
+			respondConversionError(c, err)
+			return
 		}
-		products = append(products, p)
+		priced = append(priced, p)
 	}
-	if err := rows.Err(); err != nil {
-		log.Printf("Ошибка итерации по продуктам: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка итерации по продуктам: " + err.Error()})
-		return
+	c.JSON(http.StatusOK, priced)
+}
+
+// priceProduct пересчитывает цену товара в валюту currency.
+func priceProduct(product Product, currency string, rates RateSnapshot) (PricedProduct, error) {
+	price, err := rates.convert(product.Price, product.Currency, currency)
+	if err != nil {
+		return PricedProduct{}, err
 	}
-	c.JSON(http.StatusOK, products)
+	priced := PricedProduct{Product: product, OriginalPrice: product.Price, OriginalCurrency: product.Currency}
+	priced.Price, priced.Currency = price, currency
+	return priced, nil
 }
 
-func getProduct(c *gin.Context) {
+// currencyField проверяет валюту из поля currency тела запроса; пустая
+// строка — базовая валюта. При ошибке ответ уже отправлен.
+func currencyField(c *gin.Context, currency string) (string, bool) {
+	if currency == "" {
+		return baseCurrency, true
+	}
+	currency = strings.ToUpper(currency)
+	if !isSupportedCurrency(currency) {
+		respondFieldErrors(c, FieldError{Field: "currency", Code: "oneof", Param: supportedCurrencies()})
+		return "", false
+	}
+	return currency, true
+}
+
+func (h *Handlers) getProduct(c *gin.Context) {
 	idStr := c.Param("id")
 
-	id, err := strconv.Atoi(idStr)
+	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil {
-		log.Println("Ошибка преоброзования пармтера")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Ошибка преоброзования пармтера"})
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+	currency, ok := requestCurrency(c)
+	if !ok {
 		return
 	}
 
-	row := db.QueryRow("SELECT id,name,price,image FROM products WHERE id = ?", id)
-
-	var product Product
-
-	err = row.Scan(&product.Id, &product.Name, &product.Price, &product.Image)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Продукт не найден"})
+	product, err := h.products.Get(c.Request.Context(), id)
+	if err == errNotFound {
+		respondError(c, CodeProductNotFound)
 		return
 	} else if err != nil {
-		log.Printf("Ошибка при получении продукта по ID %d: %v", id, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении продукта: " + err.Error()})
+		requestLog(c).Error("Ошибка при получении продукта по ID", "product_id", id, "error", err)
+		respondError(c, CodeInternal)
 		return
 	}
 
-	c.JSON(http.StatusOK, product)
+	if currency == "" {
+		if notModified(c, product.Version) {
+			return
+		}
+		c.JSON(http.StatusOK, product)
+		return
+	}
+	// Цена в валюте меняется вместе с курсом, поэтому ETag включает валюту
+	// и курсы пересчета, а не только версию товара.
+	rates := exchangeRates.snapshot()
+	priced, err := priceProduct(product, currency, rates)
+	if err != nil {
+		respondConversionError(c, err)
+		return
+	}
+	if notModifiedTag(c, variantETag(product.Version, currency, rates[product.Currency], rates[currency])) {
+		return
+	}
+	c.JSON(http.StatusOK, priced)
 }
 
-func deleteProduct(c *gin.Context) {
+// deleteProduct переносит товар в корзину удаленных. Изображение остается
+// на диске до окончательного удаления (см. runTrashPurger).
+func (h *Handlers) deleteProduct(c *gin.Context) {
 	idStr := c.Param("id")
 
-	id, err := strconv.Atoi(idStr)
+	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil {
-		log.Println("Ошибка преоброзования пармтера")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Ошибка преоброзования пармтера"})
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
 		return
 	}
 
-	var imageUrl string
-	rows := db.QueryRow("SELECT image FROM products WHERE id = ?", id)
-	err = rows.Scan(&imageUrl)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Продукт не найден"})
+	product, err := h.products.Get(c.Request.Context(), id)
+	if err == errNotFound {
+		respondError(c, CodeProductNotFound)
 		return
 	} else if err != nil {
-		log.Printf("Ошибка при получении image_url продукта с ID %d: %v", id, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка сервера при подготовке к удалению"})
+		requestLog(c).Error("Ошибка при получении продукта по ID", "product_id", id, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if !checkIfMatch(c, product.Version) {
 		return
 	}
 
-	stmt, err := db.Prepare("DELETE FROM products WHERE id = ?")
-	if err != nil {
-		log.Printf("Ошибка подготовки SQL-запроса на удаление: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка подготовки SQL-запроса"})
+	err = h.products.Delete(c.Request.Context(), id, product.Version)
+	if err == errNotFound {
+		respondError(c, CodeProductNotFound)
+		return
+	} else if err == errVersionConflict {
+		respondVersionConflict(c)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при удалении продукта из базы данных", "error", err)
+		respondError(c, CodeInternal)
 		return
 	}
 
-	result, err := stmt.Exec(id)
+	h.audit(c, AuditActionDelete, AuditEntityProduct, id, product, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Подукт успешно удален!"})
+}
+
+// restoreProduct возвращает товар из корзины удаленных.
+func (h *Handlers) restoreProduct(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
 	if err != nil {
-		log.Printf("Ошибка при удалении продукта из базы данных: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при удалении продукта из базы данных"})
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+
+	err = h.products.Restore(c.Request.Context(), id)
+	if err == errNotFound {
+		respondError(c, CodeProductNotFound)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при восстановлении продукта", "product_id", id, "error", err)
+		respondError(c, CodeInternal)
 		return
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	product, err := h.products.Get(c.Request.Context(), id)
 	if err != nil {
-		log.Printf("Ошибка получения количества затронутых строк при удалении: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при удалении продукта"})
+		requestLog(c).Error("Ошибка при получении восстановленного продукта с ID", "product_id", id, "error", err)
+		respondError(c, CodeInternal)
 		return
 	}
+	h.audit(c, AuditActionRestore, AuditEntityProduct, id, nil, product)
+	setETag(c, product.Version)
+	c.JSON(http.StatusOK, gin.H{"message": "Продукт восстановлен", "product": product})
+}
 
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Продукт не был найден"})
+// addProduct принимает товар как multipart-формой с файлом image, так и
+// JSON с изображением в image_url или image_data.
+func (h *Handlers) addProduct(c *gin.Context) {
+	source, ok := priceSource(c)
+	if !ok {
+		return
+	}
+	var product Product
+	if c.ContentType() == binding.MIMEJSON {
+		product, ok = productFromJSON(c)
+	} else {
+		product, ok = productFromForm(c)
+	}
+	if !ok {
 		return
 	}
 
-	if imageUrl != "" && imageUrl != "/" {
-		filePathOnDisk := filepath.Join(".", imageUrl)
-		if !filepath.HasPrefix(filePathOnDisk, "uploads"+string(filepath.Separator)) {
-			log.Printf("Попытка удалить файл вне директории загрузок: %s", filePathOnDisk)
-		} else {
-			err := os.Remove(filePathOnDisk)
-			if err != nil {
-				log.Printf("Ошибка при удалении файла %s: %v", filePathOnDisk, err)
-			} else {
-				log.Printf("Файл %s успешно удален с диска", filePathOnDisk)
-			}
-		}
+	if err := h.products.Create(c.Request.Context(), &product); err != nil {
+		requestLog(c).Error("Ошибка при добавлении продукта в базу данных", "error", err)
+		removeUploadedImage(c.Request.Context(), product.Image)
+		respondError(c, CodeInternal)
+		return
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "Подукт успешно удален!"})
+	productsCreatedTotal.Inc()
+	h.audit(c, AuditActionCreate, AuditEntityProduct, product.Id, nil, product)
+	h.recordPrice(c, source, product.Id, nil, product.Price, product.Currency)
+	setETag(c, product.Version)
+	c.JSON(http.StatusCreated, gin.H{"message": "Продукт успешно добавлен!", "product": product})
 }
 
-func addProduct(c *gin.Context) {
+func productFromForm(c *gin.Context) (Product, bool) {
 	name := c.PostForm("name")
 	priceStr := c.PostForm("price")
+	weightStr := c.PostForm("weight")
+	currency, ok := currencyField(c, c.PostForm("currency"))
+	if !ok {
+		return Product{}, false
+	}
 
 	imageFile, err := c.FormFile("image")
 	if err != nil {
-		log.Printf("Ошибка при получении файла изображения: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Ошибка при получении файла изображения: %v", err)})
-		return
+		requestLog(c).Warn("Ошибка при получении файла изображения", "error", err)
+		respondFieldErrors(c, FieldError{Field: "image", Code: "required"})
+		return Product{}, false
 	}
 
 	price, err := strconv.Atoi(priceStr)
 	if err != nil {
-		log.Printf("Ошибка парсинга цены '%s': %v", priceStr, err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверное значение цены"})
-		return
+		requestLog(c).Warn("Ошибка парсинга цены", "price", priceStr, "error", err)
+		respondFieldErrors(c, FieldError{Field: "price", Code: "invalid"})
+		return Product{}, false
+	}
+
+	weight := 0
+	if weightStr != "" {
+		weight, err = strconv.Atoi(weightStr)
+		if err != nil || weight < 0 {
+			requestLog(c).Warn("Ошибка парсинга веса", "weight", weightStr, "error", err)
+			respondFieldErrors(c, FieldError{Field: "weight", Code: "invalid"})
+			return Product{}, false
+		}
 	}
 
 	if name == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Имя прдукта не введено"})
-		return
+		respondFieldErrors(c, FieldError{Field: "name", Code: "required"})
+		return Product{}, false
 	}
 	if price <= 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Цена прдукта не введено"})
-		return
+		respondFieldErrors(c, FieldError{Field: "price", Code: "required"})
+		return Product{}, false
 	}
 
-	filename := fmt.Sprintf("%d-%s", time.Now().UnixNano(), filepath.Base(imageFile.Filename))
-
-	uploadDir := filepath.Join(".", "uploads", "images")
-	uploadPath := filepath.Join(uploadDir, filename)
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		log.Printf("Ошибка создания директории для загрузки '%s': %v", uploadDir, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка сервера при сохранении изображения"})
-		return
+	imageUrl, err := saveUploadedImage(c, imageFile)
+	if !handleImageError(c, "image", err) {
+		return Product{}, false
 	}
+	return Product{Name: name, Price: price, Currency: currency, Category: c.PostForm("category"), Image: imageUrl, Weight: weight}, true
+}
 
-	if err := c.SaveUploadedFile(imageFile, uploadPath); err != nil {
-		log.Printf("Ошибка сохранения файла '%s': %v", uploadPath, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка сохранения изображения"})
-		return
+func productFromJSON(c *gin.Context) (Product, bool) {
+	var request ProductRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBindingError(c, err)
+		return Product{}, false
 	}
+	currency, ok := currencyField(c, request.Currency)
+	if !ok {
+		return Product{}, false
+	}
+	imageUrl, ok := requestImage(c, request.ImageURL, request.ImageData)
+	if !ok {
+		return Product{}, false
+	}
+	if imageUrl == "" {
+		respondFieldErrors(c, FieldError{Field: "image_url", Code: "required_without", Param: "image_data"})
+		return Product{}, false
+	}
+	return Product{Name: request.Name, Price: request.Price, Currency: currency, Category: request.Category, Image: imageUrl, Weight: request.Weight}, true
+}
 
-	imageUrl := "/" + filepath.Join("uploads", "images", filename)
+// requestImage возвращает изображение из JSON-запроса: ссылку как есть или
+// URL файла, сохраненного из base64. Пустая строка — изображение не
+// передано. При ошибке ответ уже отправлен.
+func requestImage(c *gin.Context, imageURL, imageData string) (string, bool) {
+	switch {
+	case imageURL != "" && imageData != "":
+		respondFieldErrors(c, FieldError{Field: "image_data", Code: "excluded_with", Param: "image_url"})
+		return "", false
+	case imageURL != "":
+		return imageURL, true
+	case imageData != "":
+		imageUrl, err := saveImageData(c.Request.Context(), imageData)
+		return imageUrl, handleImageError(c, "image_data", err)
+	}
+	return "", true
+}
 
-	product := Product{
-		Name:  name,
-		Price: price,
-		Image: imageUrl,
-	}
+// handleImageError отвечает на ошибку сохранения изображения из поля field.
+// Возвращает true, если ошибки не было.
+func handleImageError(c *gin.Context, field string, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errImageTooLarge):
+		respondErrorDetails(c, CodeImageTooLarge, map[string]any{"max_size": uploadsConfig.MaxFileSize})
+	case errors.Is(err, errInvalidImageData):
+		respondFieldErrors(c, FieldError{Field: field, Code: "image"})
+	default:
+		requestLog(c).Error("Ошибка сохранения изображения", "error", err)
+		respondError(c, CodeInternal)
+	}
+	return false
+}
+
+// updateProduct меняет товар. JSON-тело — JSON Merge Patch или JSON Patch
+// (см. applyPatch); multipart-форма, как и раньше, меняет только переданные
+// непустые поля. В ответе товар, заново прочитанный из базы. Новая цена
+// попадает в историю цен с источником из X-Price-Source.
+func (h *Handlers) updateProduct(c *gin.Context) {
+	idStr := c.Param("id")
 
-	stmt, err := db.Prepare("INSERT INTO products(name,price,image) VALUES(?,?,?)")
+	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil {
-		log.Printf("Ошибка подготовки SQL-запроса: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка подготовки SQL-запроса"})
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+	source, ok := priceSource(c)
+	if !ok {
 		return
 	}
-	defer stmt.Close()
 
-	result, err := stmt.Exec(product.Name, product.Price, product.Image)
-	if err != nil {
-		log.Printf("Ошибка при добавлении продукта в базу данных: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при добавлении продукта в базу данных"})
+	currentProduct, err := h.products.Get(c.Request.Context(), id)
+	if err == errNotFound {
+		respondError(c, CodeProductNotFound)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при получении текущих данных продукта с ID", "product_id", id, "error", err)
+		respondError(c, CodeInternal)
 		return
 	}
-	id, err := result.LastInsertId()
-	if err != nil {
-		log.Printf("Ошибка получения ID нового продукта: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения ID нового продукта"})
+	if !checkIfMatch(c, currentProduct.Version) {
 		return
 	}
-	product.Id = id
-	c.JSON(http.StatusCreated, gin.H{"message": fmt.Sprintf("Продукт успешно добавлен!\n%v", product)})
-}
 
-func updateProduct(c *gin.Context) {
-	idStr := c.Param("id")
+	var product Product
+	switch c.ContentType() {
+	case binding.MIMEJSON, mimeMergePatch, mimeJSONPatch:
+		product, ok = productFromPatch(c, currentProduct)
+	default:
+		product, ok = productFromPatchForm(c, currentProduct)
+	}
+	if !ok {
+		return
+	}
+	if product == currentProduct {
+		respondError(c, CodeNoUpdateData)
+		return
+	}
 
-	id, err := strconv.Atoi(idStr)
+	oldImage := currentProduct.Image
+	imageChanged := product.Image != oldImage
+	err = h.products.Update(c.Request.Context(), product)
 	if err != nil {
-		log.Println("Ошибка преоброзования пармтера")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Ошибка преоброзования пармтера"})
+		if imageChanged {
+			removeUploadedImage(c.Request.Context(), product.Image)
+		}
+		if err == errNotFound {
+			respondError(c, CodeProductNotFound)
+		} else if err == errVersionConflict {
+			respondVersionConflict(c)
+		} else {
+			requestLog(c).Error("Ошибка при обновлении продукта в базе данных", "error", err)
+			respondError(c, CodeInternal)
+		}
 		return
 	}
+	if imageChanged {
+		removeUploadedImage(c.Request.Context(), oldImage)
+	}
 
-	var currentProduct Product
-	row := db.QueryRow("SELECT id,name,price,image FROM products WHERE id = ?", id)
-	err = row.Scan(&currentProduct.Id, &currentProduct.Name, &currentProduct.Price, &currentProduct.Image)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Продукт не найден"})
-		return
-	} else if err != nil {
-		log.Printf("Ошибка при получении текущих данных продукта с ID %d: %v", id, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка сервера при получении данных продукта"})
+	product, err = h.products.Get(c.Request.Context(), id)
+	if err != nil {
+		requestLog(c).Error("Ошибка при получении обновленного продукта с ID", "product_id", id, "error", err)
+		respondError(c, CodeInternal)
 		return
 	}
+	h.audit(c, AuditActionUpdate, AuditEntityProduct, id, currentProduct, product)
+	if product.Price != currentProduct.Price || product.Currency != currentProduct.Currency {
+		h.recordPrice(c, source, id, &currentProduct.Price, product.Price, product.Currency)
+	}
+	setETag(c, product.Version)
+	c.JSON(http.StatusOK, gin.H{"message": "Данные продукта успешно обновлены", "product": product})
+}
 
-	newName := c.PostForm("name")
-	newPriceStr := c.PostForm("price")
-	newImageFile, fileError := c.FormFile("image")
+// productFromPatch применяет JSON-патч к товару current. При ошибке ответ
+// уже отправлен.
+func productFromPatch(c *gin.Context, current Product) (Product, bool) {
+	var patch ProductPatch
+	if !applyPatch(c, current, &patch) {
+		return Product{}, false
+	}
+	currency, ok := currencyField(c, patch.Currency)
+	if !ok {
+		return Product{}, false
+	}
+	product := Product{Id: current.Id, Name: patch.Name, Price: patch.Price, Currency: currency, Category: patch.Category, Image: patch.Image, Weight: patch.Weight, Version: current.Version}
+
+	newImage, ok := requestImage(c, patch.ImageURL, patch.ImageData)
+	switch {
+	case !ok:
+		return Product{}, false
+	case newImage != "":
+		product.Image = newImage
+	case patch.Image == current.Image:
+	case patch.Image == "":
+		respondFieldErrors(c, FieldError{Field: "image", Code: "required"})
+		return Product{}, false
+	case !isExternalImage(patch.Image):
+		// Ссылаться на чужие загруженные файлы нельзя: их удалят вместе
+		// с товаром-владельцем.
+		respondFieldErrors(c, FieldError{Field: "image", Code: "http_url"})
+		return Product{}, false
+	}
+	return product, true
+}
 
-	var updateFields []string
-	var updateValues []interface{}
+// productFromPatchForm применяет к товару current изменения из
+// multipart-формы. При ошибке ответ уже отправлен.
+func productFromPatchForm(c *gin.Context, current Product) (Product, bool) {
+	changes, newImage, ok := productChangesFromForm(c)
+	if !ok {
+		return Product{}, false
+	}
+	product := current
+	if changes.Name != nil {
+		product.Name = *changes.Name
+	}
+	if changes.Price != nil {
+		product.Price = *changes.Price
+	}
+	if changes.Currency != nil {
+		product.Currency = *changes.Currency
+	}
+	if changes.Category != nil {
+		product.Category = *changes.Category
+	}
+	if changes.Weight != nil {
+		product.Weight = *changes.Weight
+	}
+	if newImage != "" {
+		product.Image = newImage
+	}
+	return product, true
+}
 
-	if newName != "" && newName != currentProduct.Name {
-		updateFields = append(updateFields, "name = ?")
-		updateValues = append(updateValues, newName)
-		currentProduct.Name = newName
+// productChangesFromForm разбирает multipart-форму изменения товара и
+// сохраняет новое изображение, если оно передано.
+func productChangesFromForm(c *gin.Context) (ProductFormChanges, string, bool) {
+	var changes ProductFormChanges
+	if name := c.PostForm("name"); name != "" {
+		changes.Name = &name
+	}
+	if category := c.PostForm("category"); category != "" {
+		changes.Category = &category
 	}
 
-	if newPriceStr != "" {
+	if newPriceStr := c.PostForm("price"); newPriceStr != "" {
 		newPrice, priceErr := strconv.Atoi(newPriceStr)
 		if priceErr != nil {
-			log.Println("Ошибка парсинга новой цены")
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Ошибка парсинга новой цены"})
-			return
+			requestLog(c).Warn("Ошибка парсинга новой цены")
+			respondFieldErrors(c, FieldError{Field: "price", Code: "invalid"})
+			return changes, "", false
 		}
 		if newPrice <= 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Цена должна быть больше нуля"})
-			return
-		}
-		if newPrice != currentProduct.Price {
-			updateFields = append(updateFields, "price = ?")
-			updateValues = append(updateValues, newPrice)
-			currentProduct.Price = newPrice
+			respondFieldErrors(c, FieldError{Field: "price", Code: "gt", Param: "0"})
+			return changes, "", false
 		}
+		changes.Price = &newPrice
 	}
 
-    if fileError == nil && newImageFile != nil {
-		if currentProduct.Image != "" && currentProduct.Image != "/" {
-			filePathOnDisk := filepath.Join(".", currentProduct.Image)
-		if strings.HasPrefix(filePathOnDisk, "uploads"+string(filepath.Separator)) {
-				if err := os.Remove(filePathOnDisk); err != nil {
-					log.Printf("Ошибка при удалении старого файла изображения %s: %v", filePathOnDisk, err)
-			} else {
-					log.Printf("Старый файл %s успешно удален с диска", filePathOnDisk)
-				}
-			} else {
-				log.Printf("Попытка удалить файл вне директории загрузок: %s (пропускаем удаление старого файла)", filePathOnDisk)
-			}
-		}
-
-		newFilename := fmt.Sprintf("%d-%s", time.Now().UnixNano(), filepath.Base(newImageFile.Filename))
-		uploadDir := filepath.Join(".", "uploads", "images")  
-		newUploadPath := filepath.Join(uploadDir, newFilename) 
-		
-		if err := os.MkdirAll(uploadDir, 0755); err != nil {
-			log.Printf("Ошибка создания директории для загрузки '%s': %v", uploadDir, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка сервера при сохранении нового изображения"})
-			return
-		}
-
-		if err := c.SaveUploadedFile(newImageFile, newUploadPath); err != nil {
-			log.Printf("Ошибка сохранения нового файла '%s': %v", newUploadPath, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка сохранения нового изображения"})
-			return
+	if newCurrency := c.PostForm("currency"); newCurrency != "" {
+		currency, ok := currencyField(c, newCurrency)
+		if !ok {
+			return changes, "", false
 		}
-
-		newImageUrl := "/" + filepath.Join("uploads", "images", newFilename)
-		updateFields = append(updateFields, "image_url = ?") 
-		updateValues = append(updateValues, newImageUrl)     
-		currentProduct.Image = newImageUrl
+		changes.Currency = &currency
 	}
 
-	if len(updateFields) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Нету данных для обнвления"})
-		return
-	}
-
-	updateQuery := fmt.Sprintf("UPDATE products SET %s WHERE id = ?", strings.Join(updateFields, ", "))
-	updateValues = append(updateValues, id)
-
-	stmt, err := db.Prepare(updateQuery)
-	if err != nil {
-		log.Println("Ошибка подготовки sql запроса")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка подготовки sql запроса"})
-		return
-	}
-	defer stmt.Close()
-
-	result, err := stmt.Exec(updateValues...)
-	if err != nil {
-		log.Printf("Ошибка при обновлении продукта в базе данных: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при обновлении продукта в базе данных"})
-		return
-	}
-
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		log.Printf("Ошибка получения количества затронутых строк при обновлении: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при обновлении продукта"})
-		return
+	if newWeightStr := c.PostForm("weight"); newWeightStr != "" {
+		newWeight, weightErr := strconv.Atoi(newWeightStr)
+		if weightErr != nil || newWeight < 0 {
+			requestLog(c).Warn("Ошибка парсинга нового веса")
+			respondFieldErrors(c, FieldError{Field: "weight", Code: "invalid"})
+			return changes, "", false
+		}
+		changes.Weight = &newWeight
 	}
 
-	if rowsAffected == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "Продукт не найден, и данные не измнеились"})
-		return
+	newImageFile, err := c.FormFile("image")
+	if err != nil || newImageFile == nil {
+		return changes, "", true
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Данные продукта успешно обновленны\n%v", currentProduct)})
+	newImageUrl, err := saveUploadedImage(c, newImageFile)
+	return changes, newImageUrl, handleImageError(c, "image", err)
 }
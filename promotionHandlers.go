@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func getCoupons(c *gin.Context) {
+	coupons, err := loadCoupons(c.Request.Context())
+	if err != nil {
+		requestLog(c).Error("Ошибка получения купонов", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if coupons == nil {
+		coupons = []Coupon{}
+	}
+	c.JSON(http.StatusOK, coupons)
+}
+
+func (h *Handlers) addCoupon(c *gin.Context) {
+	var coupon Coupon
+	if err := c.ShouldBindJSON(&coupon); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+	switch {
+	case coupon.Type == CouponPercent && coupon.Value < 1:
+		respondFieldErrors(c, FieldError{Field: "value", Code: "min", Param: "1"})
+		return
+	case coupon.Type == CouponPercent && coupon.Value > 100:
+		respondFieldErrors(c, FieldError{Field: "value", Code: "max", Param: "100"})
+		return
+	case coupon.Type == CouponFixed && coupon.Value <= 0:
+		respondFieldErrors(c, FieldError{Field: "value", Code: "gt", Param: "0"})
+		return
+	}
+	if coupon.StartsAt != nil && coupon.EndsAt != nil && !coupon.EndsAt.After(*coupon.StartsAt) {
+		respondFieldErrors(c, FieldError{Field: "ends_at", Code: "gtefield", Param: "starts_at"})
+		return
+	}
+	currency, ok := currencyField(c, coupon.Currency)
+	if !ok {
+		return
+	}
+	coupon.Currency = currency
+	coupon.Code = normalizeCouponCode(coupon.Code)
+	if coupon.Code == "" {
+		respondFieldErrors(c, FieldError{Field: "code", Code: "required"})
+		return
+	}
+	if !checkScope(c, coupon.ProductScope) {
+		return
+	}
+
+	var exists int
+	err := db.QueryRowContext(c.Request.Context(), "SELECT COUNT(*) FROM coupons WHERE code = ?", coupon.Code).Scan(&exists)
+	if err != nil {
+		requestLog(c).Error("Ошибка проверки кода купона", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if exists > 0 {
+		respondFieldErrors(c, FieldError{Field: "code", Code: "unique"})
+		return
+	}
+
+	productIds, categories, err := coupon.ProductScope.encode()
+	if err != nil {
+		requestLog(c).Error("Ошибка кодирования товаров купона", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	coupon.UsedCount = 0
+	coupon.CreatedAt = time.Now().UTC()
+	coupon.Id, err = db.InsertContext(c.Request.Context(), "INSERT INTO coupons (code,type,value,currency,min_total,starts_at,ends_at,usage_limit,per_user_limit,product_ids,categories,created_at) VALUES (?,?,?,?,?,?,?,?,?,?,?,?)",
+		coupon.Code, coupon.Type, coupon.Value, coupon.Currency, coupon.MinTotal, coupon.StartsAt, coupon.EndsAt, coupon.UsageLimit, coupon.PerUserLimit, productIds, categories, coupon.CreatedAt)
+	if err != nil {
+		requestLog(c).Error("Ошибка при добавлении купона в базу данных", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	h.audit(c, AuditActionCreate, AuditEntityCoupon, coupon.Id, nil, coupon)
+	c.JSON(http.StatusCreated, gin.H{"message": "Купон успешно добавлен", "coupon": coupon})
+}
+
+func (h *Handlers) deleteCoupon(c *gin.Context) {
+	h.deleteById(c, AuditEntityCoupon, "coupons", CodeCouponNotFound, "Купон успешно удален!")
+}
+
+func getPromotions(c *gin.Context) {
+	promotions, err := loadPromotions(c.Request.Context())
+	if err != nil {
+		requestLog(c).Error("Ошибка получения акций", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if promotions == nil {
+		promotions = []Promotion{}
+	}
+	c.JSON(http.StatusOK, promotions)
+}
+
+func (h *Handlers) addPromotion(c *gin.Context) {
+	var promotion Promotion
+	if err := c.ShouldBindJSON(&promotion); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+	if promotion.Percent == 0 {
+		promotion.Percent = 100
+	}
+	if promotion.StartsAt != nil && promotion.EndsAt != nil && !promotion.EndsAt.After(*promotion.StartsAt) {
+		respondFieldErrors(c, FieldError{Field: "ends_at", Code: "gtefield", Param: "starts_at"})
+		return
+	}
+	if !checkScope(c, promotion.ProductScope) {
+		return
+	}
+
+	productIds, categories, err := promotion.ProductScope.encode()
+	if err != nil {
+		requestLog(c).Error("Ошибка кодирования товаров акции", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	promotion.CreatedAt = time.Now().UTC()
+	promotion.Id, err = db.InsertContext(c.Request.Context(), "INSERT INTO promotions (name,buy_quantity,get_quantity,percent,product_ids,categories,starts_at,ends_at,created_at) VALUES (?,?,?,?,?,?,?,?,?)",
+		promotion.Name, promotion.BuyQuantity, promotion.GetQuantity, promotion.Percent, productIds, categories, promotion.StartsAt, promotion.EndsAt, promotion.CreatedAt)
+	if err != nil {
+		requestLog(c).Error("Ошибка при добавлении акции в базу данных", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	h.audit(c, AuditActionCreate, AuditEntityPromotion, promotion.Id, nil, promotion)
+	c.JSON(http.StatusCreated, gin.H{"message": "Акция успешно добавлена", "promotion": promotion})
+}
+
+func (h *Handlers) deletePromotion(c *gin.Context) {
+	h.deleteById(c, AuditEntityPromotion, "promotions", CodePromotionNotFound, "Акция успешно удалена!")
+}
+
+// checkScope проверяет, что товары из scope существуют. Если нет, ответ
+// уже отправлен.
+func checkScope(c *gin.Context, scope ProductScope) bool {
+	_, err := getProductsByIds(c.Request.Context(), scope.ProductIds)
+	if errors.Is(err, errProductNotFound) {
+		respondFieldErrors(c, FieldError{Field: "product_ids", Code: "not_found"})
+		return false
+	} else if err != nil {
+		requestLog(c).Error("Ошибка проверки товаров", "error", err)
+		respondError(c, CodeInternal)
+		return false
+	}
+	return true
+}
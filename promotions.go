@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Типы купонов: скидка в процентах, фиксированная сумма или бесплатная
+// доставка.
+const (
+	CouponPercent      = "percent"
+	CouponFixed        = "fixed"
+	CouponFreeShipping = "free_shipping"
+)
+
+// Строки скидок заказа: по купону или по автоматической акции. Скидка
+// применяется к товарам или к доставке.
+const (
+	DiscountCoupon    = "coupon"
+	DiscountPromotion = "promotion"
+
+	DiscountTargetItems    = "items"
+	DiscountTargetShipping = "shipping"
+)
+
+// ProductScope ограничивает купон или акцию товарами и категориями. Пустой
+// ProductScope действует на все товары.
+type ProductScope struct {
+	ProductIds []int64  `json:"product_ids"`
+	Categories []string `json:"categories"`
+}
+
+func (s ProductScope) includes(p Product) bool {
+	if len(s.ProductIds) == 0 && len(s.Categories) == 0 {
+		return true
+	}
+	for _, id := range s.ProductIds {
+		if id == p.Id {
+			return true
+		}
+	}
+	for _, category := range s.Categories {
+		if category == p.Category {
+			return true
+		}
+	}
+	return false
+}
+
+// Coupon — код скидки. Value — процент для percent и сумма в минимальных
+// единицах Currency для fixed; MinTotal тоже в Currency. Нулевые
+// UsageLimit и PerUserLimit не ограничивают число использований.
+type Coupon struct {
+	Id           int64      `json:"id"`
+	Code         string     `json:"code" binding:"required"`
+	Type         string     `json:"type" binding:"required,oneof=percent fixed free_shipping"`
+	Value        int        `json:"value" binding:"min=0"`
+	Currency     string     `json:"currency"`
+	MinTotal     int        `json:"min_total" binding:"min=0"`
+	StartsAt     *time.Time `json:"starts_at"`
+	EndsAt       *time.Time `json:"ends_at"`
+	UsageLimit   int        `json:"usage_limit" binding:"min=0"`
+	PerUserLimit int        `json:"per_user_limit" binding:"min=0"`
+	UsedCount    int        `json:"used_count"`
+	ProductScope
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Promotion — автоматическая акция: из каждых BuyQuantity+GetQuantity
+// единиц подходящих товаров GetQuantity самых дешевых получают скидку
+// Percent процентов (100 — бесплатно).
+type Promotion struct {
+	Id          int64      `json:"id"`
+	Name        string     `json:"name" binding:"required"`
+	BuyQuantity int        `json:"buy_quantity" binding:"required,min=1"`
+	GetQuantity int        `json:"get_quantity" binding:"required,min=1"`
+	Percent     int        `json:"percent" binding:"omitempty,min=1,max=100"`
+	StartsAt    *time.Time `json:"starts_at"`
+	EndsAt      *time.Time `json:"ends_at"`
+	ProductScope
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Discount — строка скидки корзины или заказа в валюте заказа.
+type Discount struct {
+	Type        string `json:"type"`
+	Code        string `json:"code,omitempty"`
+	PromotionId int64  `json:"promotion_id,omitempty"`
+	Description string `json:"description"`
+	Target      string `json:"target"`
+	Amount      int    `json:"amount"`
+}
+
+// couponError — купон нельзя применить к корзине; code — ошибка API.
+type couponError struct {
+	code    ErrorCode
+	details map[string]any
+}
+
+func (e *couponError) Error() string {
+	return fmt.Sprintf("купон не применим: %s", e.code)
+}
+
+// activeAt проверяет, что момент now попадает в период действия from–to.
+// Нулевые границы период не ограничивают, to не включается.
+func activeAt(now time.Time, from, to *time.Time) bool {
+	return (from == nil || !now.Before(*from)) && (to == nil || now.Before(*to))
+}
+
+func encodeList[T any](list []T) (string, error) {
+	if len(list) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(list)
+	return string(data), err
+}
+
+func decodeList[T any](value string) ([]T, error) {
+	var result []T
+	if value == "" {
+		return result, nil
+	}
+	err := json.Unmarshal([]byte(value), &result)
+	return result, err
+}
+
+func (s *ProductScope) decode(productIds, categories string) error {
+	var err error
+	if s.ProductIds, err = decodeList[int64](productIds); err != nil {
+		return err
+	}
+	s.Categories, err = decodeList[string](categories)
+	return err
+}
+
+func (s ProductScope) encode() (string, string, error) {
+	productIds, err := encodeList(s.ProductIds)
+	if err != nil {
+		return "", "", err
+	}
+	categories, err := encodeList(s.Categories)
+	return productIds, categories, err
+}
+
+const couponColumns = "id,code,type,value,currency,min_total,starts_at,ends_at,usage_limit,per_user_limit,used_count,product_ids,categories,created_at"
+
+func scanCoupon(row interface{ Scan(...interface{}) error }) (Coupon, error) {
+	var c Coupon
+	var startsAt, endsAt sql.NullTime
+	var productIds, categories string
+	err := row.Scan(&c.Id, &c.Code, &c.Type, &c.Value, &c.Currency, &c.MinTotal, &startsAt, &endsAt,
+		&c.UsageLimit, &c.PerUserLimit, &c.UsedCount, &productIds, &categories, &c.CreatedAt)
+	if err != nil {
+		return c, err
+	}
+	c.StartsAt, c.EndsAt = nullTimePtr(startsAt), nullTimePtr(endsAt)
+	return c, c.ProductScope.decode(productIds, categories)
+}
+
+func loadCoupons(ctx context.Context) ([]Coupon, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+couponColumns+" FROM coupons ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var coupons []Coupon
+	for rows.Next() {
+		coupon, err := scanCoupon(rows)
+		if err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, coupon)
+	}
+	return coupons, rows.Err()
+}
+
+// loadCoupon ищет купон по коду без учета регистра.
+func loadCoupon(ctx context.Context, code string) (Coupon, error) {
+	return scanCoupon(db.QueryRowContext(ctx, "SELECT "+couponColumns+" FROM coupons WHERE code = ?", normalizeCouponCode(code)))
+}
+
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+const promotionColumns = "id,name,buy_quantity,get_quantity,percent,product_ids,categories,starts_at,ends_at,created_at"
+
+func scanPromotion(row interface{ Scan(...interface{}) error }) (Promotion, error) {
+	var p Promotion
+	var startsAt, endsAt sql.NullTime
+	var productIds, categories string
+	err := row.Scan(&p.Id, &p.Name, &p.BuyQuantity, &p.GetQuantity, &p.Percent, &productIds, &categories, &startsAt, &endsAt, &p.CreatedAt)
+	if err != nil {
+		return p, err
+	}
+	p.StartsAt, p.EndsAt = nullTimePtr(startsAt), nullTimePtr(endsAt)
+	return p, p.ProductScope.decode(productIds, categories)
+}
+
+func loadPromotions(ctx context.Context) ([]Promotion, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+promotionColumns+" FROM promotions ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var promotions []Promotion
+	for rows.Next() {
+		promotion, err := scanPromotion(rows)
+		if err != nil {
+			return nil, err
+		}
+		promotions = append(promotions, promotion)
+	}
+	return promotions, rows.Err()
+}
+
+// couponRedemptions возвращает, сколько раз пользователь использовал купон.
+func couponRedemptions(ctx context.Context, couponId, userId int64) (int, error) {
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM coupon_redemptions WHERE coupon_id = ? AND user_id = ?", couponId, userId).Scan(&count)
+	return count, err
+}
+
+// discountUnit — единица товара корзины при расчете скидок. discount —
+// скидка на эту единицу по акции.
+type discountUnit struct {
+	product  Product
+	price    int
+	discount int
+	promoted bool
+}
+
+// cartDiscounts считает скидки корзины в валюте currency: сначала
+// автоматические акции, затем купон coupon (если задан) на то, что
+// осталось после акций. prices — цены товаров в валюте currency. Кроме
+// строк скидок возвращает скидку на товары по каждому товару — по ней
+// позиции заказа получают свою долю скидки.
+func cartDiscounts(cart []int64, products map[int64]Product, prices map[int64]int, promotions []Promotion, coupon *Coupon,
+	currency string, rates RateSnapshot, shippingCost int, now time.Time) ([]Discount, map[int64]int, error) {
+	units := make([]*discountUnit, 0, len(cart))
+	subtotal := 0
+	for _, id := range cart {
+		units = append(units, &discountUnit{product: products[id], price: prices[id]})
+		subtotal += prices[id]
+	}
+	// Дорогие единицы идут первыми: по акции скидку получают самые
+	// дешевые единицы каждой группы.
+	sort.SliceStable(units, func(i, j int) bool {
+		if units[i].price != units[j].price {
+			return units[i].price > units[j].price
+		}
+		return units[i].product.Id < units[j].product.Id
+	})
+
+	discounts := []Discount{}
+	byProduct := make(map[int64]int)
+	for _, promotion := range promotions {
+		if !activeAt(now, promotion.StartsAt, promotion.EndsAt) {
+			continue
+		}
+		if line, ok := applyPromotion(promotion, units, byProduct); ok {
+			discounts = append(discounts, line)
+		}
+	}
+	if coupon == nil {
+		return discounts, byProduct, nil
+	}
+
+	minTotal, err := rates.convert(coupon.MinTotal, coupon.Currency, currency)
+	if err != nil {
+		return nil, nil, err
+	}
+	if subtotal < minTotal {
+		return nil, nil, &couponError{CodeCouponMinTotal, map[string]any{"min_total": minTotal, "currency": currency}}
+	}
+	line := Discount{Type: DiscountCoupon, Code: coupon.Code, Description: "Купон " + coupon.Code, Target: DiscountTargetItems}
+	if coupon.Type == CouponFreeShipping {
+		line.Target, line.Amount = DiscountTargetShipping, shippingCost
+		return append(discounts, line), byProduct, nil
+	}
+
+	// Купон делит скидку между подходящими товарами пропорционально их
+	// стоимости после акций.
+	eligible := make(map[int64]int)
+	base := 0
+	for _, unit := range units {
+		if coupon.includes(unit.product) {
+			eligible[unit.product.Id] += unit.price - unit.discount
+			base += unit.price - unit.discount
+		}
+	}
+	if len(eligible) == 0 {
+		return nil, nil, &couponError{code: CodeCouponNotApplicable}
+	}
+	switch coupon.Type {
+	case CouponPercent:
+		line.Amount = (base*coupon.Value + 50) / 100
+	case CouponFixed:
+		if line.Amount, err = rates.convert(coupon.Value, coupon.Currency, currency); err != nil {
+			return nil, nil, err
+		}
+		line.Amount = min(line.Amount, base)
+	}
+	for id, amount := range allocate(line.Amount, eligible) {
+		byProduct[id] += amount
+	}
+	return append(discounts, line), byProduct, nil
+}
+
+// applyPromotion применяет акцию к единицам корзины, еще не участвовавшим
+// в акциях, и добавляет скидки по товарам в byProduct.
+func applyPromotion(promotion Promotion, units []*discountUnit, byProduct map[int64]int) (Discount, bool) {
+	var eligible []*discountUnit
+	for _, unit := range units {
+		if !unit.promoted && promotion.includes(unit.product) {
+			eligible = append(eligible, unit)
+		}
+	}
+	group := promotion.BuyQuantity + promotion.GetQuantity
+	line := Discount{Type: DiscountPromotion, PromotionId: promotion.Id, Description: promotion.Name, Target: DiscountTargetItems}
+	for start := 0; start+group <= len(eligible); start += group {
+		for i, unit := range eligible[start : start+group] {
+			unit.promoted = true
+			if i < promotion.BuyQuantity {
+				continue
+			}
+			unit.discount = (unit.price*promotion.Percent + 50) / 100
+			byProduct[unit.product.Id] += unit.discount
+			line.Amount += unit.discount
+		}
+	}
+	return line, line.Amount > 0
+}
+
+// allocate делит amount между ключами пропорционально весам weights.
+// Остаток от округления достается ключам с самыми большими весами.
+func allocate(amount int, weights map[int64]int) map[int64]int {
+	ids := make([]int64, 0, len(weights))
+	total := 0
+	for id, weight := range weights {
+		ids = append(ids, id)
+		total += weight
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if weights[ids[i]] != weights[ids[j]] {
+			return weights[ids[i]] > weights[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	result := make(map[int64]int, len(ids))
+	if total == 0 {
+		return result
+	}
+	rest := amount
+	for _, id := range ids {
+		result[id] = amount * weights[id] / total
+		rest -= result[id]
+	}
+	for i := 0; rest > 0; i = (i + 1) % len(ids) {
+		result[ids[i]]++
+		rest--
+	}
+	return result
+}
+
+// checkCoupon проверяет, что купон действует и не исчерпан, в том числе
+// для пользователя userId (0 — пользователь не известен).
+func checkCoupon(ctx context.Context, coupon Coupon, userId int64, now time.Time) error {
+	if !activeAt(now, coupon.StartsAt, coupon.EndsAt) {
+		return &couponError{code: CodeCouponInactive}
+	}
+	if coupon.UsageLimit > 0 && coupon.UsedCount >= coupon.UsageLimit {
+		return &couponError{code: CodeCouponExhausted}
+	}
+	if coupon.PerUserLimit > 0 && userId != 0 {
+		used, err := couponRedemptions(ctx, coupon.Id, userId)
+		if err != nil {
+			return err
+		}
+		if used >= coupon.PerUserLimit {
+			return &couponError{code: CodeCouponUserLimit}
+		}
+	}
+	return nil
+}
+
+// redeemCoupon записывает использование купона заказом в транзакции
+// оформления. Лимиты проверяются заново: параллельные заказы могли
+// использовать купон после расчета корзины.
+func redeemCoupon(tx *Tx, coupon Coupon, userId, orderId int64, now time.Time) error {
+	result, err := tx.Exec("UPDATE coupons SET used_count = used_count + 1 WHERE id = ? AND (usage_limit = 0 OR used_count < usage_limit)", coupon.Id)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return &couponError{code: CodeCouponExhausted}
+	}
+	if coupon.PerUserLimit > 0 {
+		var used int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM coupon_redemptions WHERE coupon_id = ? AND user_id = ?", coupon.Id, userId).Scan(&used); err != nil {
+			return err
+		}
+		if used >= coupon.PerUserLimit {
+			return &couponError{code: CodeCouponUserLimit}
+		}
+	}
+	_, err = tx.Exec("INSERT INTO coupon_redemptions (coupon_id,user_id,order_id,created_at) VALUES (?,?,?,?)", coupon.Id, userId, orderId, now)
+	return err
+}
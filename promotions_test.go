@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		amount  int
+		weights map[int64]int
+		want    map[int64]int
+	}{
+		{130, map[int64]int{1: 1000, 2: 300}, map[int64]int{1: 100, 2: 30}},
+		// Остаток достается самым большим весам, при равных — меньшим ID.
+		{100, map[int64]int{1: 1, 2: 1, 3: 1}, map[int64]int{1: 34, 2: 33, 3: 33}},
+		{5, map[int64]int{1: 100, 2: 300}, map[int64]int{1: 1, 2: 4}},
+		{0, map[int64]int{1: 100}, map[int64]int{1: 0}},
+	}
+	for _, tt := range tests {
+		if got := allocate(tt.amount, tt.weights); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("allocate(%d, %v) = %v; ожидалось %v", tt.amount, tt.weights, got, tt.want)
+		}
+	}
+}
+
+func TestCartDiscounts(t *testing.T) {
+	products := map[int64]Product{
+		1: {Id: 1, Currency: "RUB", Category: "kitchen"},
+		2: {Id: 2, Currency: "RUB", Category: "kitchen"},
+		3: {Id: 3, Currency: "RUB"},
+	}
+	prices := map[int64]int{1: 1000, 2: 333, 3: 500}
+	rates := RateSnapshot{"RUB": "1", "USD": "90"}
+	now := time.Now()
+	halfOff := Promotion{Id: 1, Name: "Вторая за полцены", BuyQuantity: 1, GetQuantity: 1, Percent: 50}
+	// Из пяти единиц получаются две пары: 1000+500 и 333+333, пятая
+	// единица (333) остается без скидки. Половина 333 округляется до 167.
+	cart := []int64{2, 1, 2, 3, 2}
+	discounts, byProduct, err := cartDiscounts(cart, products, prices, []Promotion{halfOff}, nil, "RUB", rates, 0, now)
+	if err != nil || len(discounts) != 1 || discounts[0].Amount != 417 || byProduct[3] != 250 || byProduct[2] != 167 {
+		t.Fatalf("акция: %+v %v %v", discounts, byProduct, err)
+	}
+
+	expired := halfOff
+	past := now.Add(-time.Hour)
+	expired.EndsAt = &past
+	if discounts, _, _ := cartDiscounts(cart, products, prices, []Promotion{expired}, nil, "RUB", rates, 0, now); len(discounts) != 0 {
+		t.Fatalf("закончившаяся акция: %+v", discounts)
+	}
+
+	// 1 доллар — 90 рублей, но не больше стоимости подходящих товаров.
+	coupon := &Coupon{Code: "USD", Type: CouponFixed, Value: 100, Currency: "USD", ProductScope: ProductScope{ProductIds: []int64{3}}}
+	discounts, byProduct, err = cartDiscounts(cart, products, prices, nil, coupon, "RUB", rates, 0, now)
+	if err != nil || discounts[0].Amount != 500 || byProduct[3] != 500 {
+		t.Fatalf("фиксированный купон: %+v %v %v", discounts, byProduct, err)
+	}
+	coupon.MinTotal = 3000
+	if _, _, err := cartDiscounts(cart, products, prices, nil, coupon, "RUB", rates, 0, now); err == nil {
+		t.Fatal("ожидалась ошибка минимальной суммы")
+	}
+}
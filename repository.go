@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	errNotFound        = errors.New("запись не найдена")
+	errVersionConflict = errors.New("версия записи изменилась")
+)
+
+// ProductRepository хранит продукты. Get, Update и Delete возвращают
+// errNotFound, если продукта с таким ID нет. Update и Delete выполняются,
+// только если версия в базе совпадает с переданной (product.Version или
+// version), иначе возвращают errVersionConflict; Update увеличивает версию.
+//
+// Delete не удаляет запись, а переносит ее в корзину удаленных: такие
+// записи видны только в ListDeleted, для остальных методов их нет. Restore
+// возвращает запись из корзины (errNotFound, если ее там нет), Purge
+// окончательно удаляет записи, попавшие в корзину раньше deletedBefore, и
+// возвращает их.
+type ProductRepository interface {
+	List(ctx context.Context) ([]Product, error)
+	Get(ctx context.Context, id int64) (Product, error)
+	Create(ctx context.Context, product *Product) error
+	Update(ctx context.Context, product Product) error
+	Delete(ctx context.Context, id, version int64) error
+	ListDeleted(ctx context.Context) ([]Product, error)
+	Restore(ctx context.Context, id int64) error
+	Purge(ctx context.Context, deletedBefore time.Time) ([]Product, error)
+}
+
+// UserRepository хранит пользователей вместе с корзиной. Ошибки, проверка
+// версий и корзина удаленных — как у ProductRepository; Purge не трогает
+// пользователей с заказами, потому что заказы на них ссылаются.
+//
+// SQL-реализация при сохранении корзины запоминает в cart_prices цену
+// каждого нового товара в ней на момент добавления.
+type UserRepository interface {
+	List(ctx context.Context) ([]User, error)
+	Get(ctx context.Context, id int64) (User, error)
+	Create(ctx context.Context, user *User) error
+	Update(ctx context.Context, user User) error
+	Delete(ctx context.Context, id, version int64) error
+	ListDeleted(ctx context.Context) ([]User, error)
+	Restore(ctx context.Context, id int64) error
+	Purge(ctx context.Context, deletedBefore time.Time) ([]User, error)
+}
+
+// AuditRepository хранит журнал изменений. Record заполняет entry.Id.
+type AuditRepository interface {
+	Record(ctx context.Context, entry *AuditEntry) error
+	List(ctx context.Context, filter AuditFilter) ([]AuditEntry, error)
+}
+
+// PriceHistoryRepository хранит историю цен товаров. Record заполняет
+// change.Id, List возвращает изменения от старых к новым.
+type PriceHistoryRepository interface {
+	Record(ctx context.Context, change *PriceChange) error
+	List(ctx context.Context, filter PriceHistoryFilter) ([]PriceChange, error)
+}
+
+// Handlers содержит зависимости обработчиков, которым нужны репозитории или
+// журнал изменений.
+type Handlers struct {
+	products ProductRepository
+	users    UserRepository
+	audits   AuditRepository
+	prices   PriceHistoryRepository
+}
+
+func NewHandlers(products ProductRepository, users UserRepository, audits AuditRepository, prices PriceHistoryRepository) *Handlers {
+	return &Handlers{products: products, users: users, audits: audits, prices: prices}
+}
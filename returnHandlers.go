@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ReturnCommentRequest struct {
+	Comment string `json:"comment"`
+}
+
+type ReturnTrackingRequest struct {
+	Carrier        string `json:"carrier" binding:"required"`
+	TrackingNumber string `json:"tracking_number" binding:"required"`
+}
+
+type ReturnRefundRequest struct {
+	Amount  int    `json:"amount"`
+	Comment string `json:"comment"`
+}
+
+// createReturn открывает заявку на возврат по доставленному заказу.
+// Принимает multipart-форму: reason, items ("ID позиции:количество" через
+// запятую) и необязательные файлы photos.
+func (h *Handlers) createReturn(c *gin.Context) {
+	orderId, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+
+	order, err := loadOrder(c.Request.Context(), orderId)
+	if err == sql.ErrNoRows {
+		respondError(c, CodeOrderNotFound)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при получении заказа по ID", "order_id", orderId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if order.Status != OrderStatusDelivered {
+		respondError(c, CodeOrderNotDelivered)
+		return
+	}
+
+	reason := c.PostForm("reason")
+	if reason == "" {
+		respondFieldErrors(c, FieldError{Field: "reason", Code: "required"})
+		return
+	}
+	items, err := parseReturnItems(c.PostForm("items"))
+	if err != nil {
+		respondFieldErrors(c, FieldError{Field: "items", Code: "invalid"})
+		return
+	}
+
+	available, err := returnableQuantities(c.Request.Context(), order)
+	if err != nil {
+		requestLog(c).Error("Ошибка подсчета доступных к возврату позиций заказа", "order_id", orderId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	requested := make(map[int64]int)
+	for _, item := range items {
+		requested[item.OrderItemId] += item.Quantity
+	}
+	for itemId, quantity := range requested {
+		if left, ok := available[itemId]; !ok || quantity > left {
+			respondErrorDetails(c, CodeReturnQuantity, map[string]any{"order_item_id": itemId})
+			return
+		}
+	}
+
+	var photos []string
+	if form, err := c.MultipartForm(); err == nil {
+		for _, file := range form.File["photos"] {
+			imageUrl, err := saveUploadedImage(c, file)
+			if err != nil {
+				for _, saved := range photos {
+					removeUploadedImage(c.Request.Context(), saved)
+				}
+				handleImageError(c, "photos", err)
+				return
+			}
+			photos = append(photos, imageUrl)
+		}
+	}
+
+	id, err := insertReturn(c.Request.Context(), order, reason, items, photos)
+	if err != nil {
+		requestLog(c).Error("Ошибка при добавлении возврата по заказу", "order_id", orderId, "error", err)
+		for _, saved := range photos {
+			removeUploadedImage(c.Request.Context(), saved)
+		}
+		respondError(c, CodeInternal)
+		return
+	}
+
+	ret, err := loadReturn(c.Request.Context(), id)
+	if err != nil {
+		requestLog(c).Error("Ошибка при получении возврата", "return_id", id, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	h.audit(c, AuditActionCreate, AuditEntityReturn, ret.Id, nil, ret)
+	c.JSON(http.StatusCreated, gin.H{"message": "Заявка на возврат создана", "return": ret})
+}
+
+func insertReturn(ctx context.Context, order Order, reason string, items []ReturnItem, photos []string) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	id, err := tx.Insert("INSERT INTO returns (order_id,user_id,status,reason,carrier,tracking_number,refunded_amount,created_at,updated_at) VALUES (?,?,?,?,'','',0,?,?)",
+		order.Id, order.UserId, ReturnStatusRequested, reason, now, now)
+	if err != nil {
+		return 0, err
+	}
+	for _, item := range items {
+		if _, err := tx.Exec("INSERT INTO return_items (return_id,order_item_id,quantity) VALUES (?,?,?)", id, item.OrderItemId, item.Quantity); err != nil {
+			return 0, err
+		}
+	}
+	for _, photo := range photos {
+		if _, err := tx.Exec("INSERT INTO return_photos (return_id,image) VALUES (?,?)", id, photo); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec("INSERT INTO return_history (return_id,status,comment,created_at) VALUES (?,?,?,?)", id, ReturnStatusRequested, reason, now); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func getReturns(c *gin.Context) {
+	query := "SELECT " + returnColumns + " FROM returns WHERE 1 = 1"
+	var args []interface{}
+	if status := c.Query("status"); status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	if orderIdStr := c.Query("order_id"); orderIdStr != "" {
+		orderId, err := strconv.ParseInt(orderIdStr, 10, 64)
+		if err != nil {
+			respondError(c, CodeInvalidParameter)
+			return
+		}
+		query += " AND order_id = ?"
+		args = append(args, orderId)
+	}
+	query += " ORDER BY id"
+
+	rows, err := db.QueryContext(c.Request.Context(), query, args...)
+	if err != nil {
+		requestLog(c).Error("Ошибка получения возвратов", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	defer rows.Close()
+	returns := []Return{}
+	for rows.Next() {
+		ret, err := scanReturn(rows)
+		if err != nil {
+			requestLog(c).Error("Ошибка сканирования возврата", "error", err)
+			respondError(c, CodeInternal)
+			return
+		}
+		returns = append(returns, ret)
+	}
+	if err := rows.Err(); err != nil {
+		requestLog(c).Error("Ошибка итерации по возвратам", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	c.JSON(http.StatusOK, returns)
+}
+
+func getReturn(c *gin.Context) {
+	ret, ok := findReturn(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, ret)
+}
+
+func (h *Handlers) approveReturn(c *gin.Context) {
+	h.changeReturnStatus(c, ReturnStatusApproved)
+}
+
+func (h *Handlers) rejectReturn(c *gin.Context) {
+	h.changeReturnStatus(c, ReturnStatusRejected)
+}
+
+func (h *Handlers) receiveReturn(c *gin.Context) {
+	h.changeReturnStatus(c, ReturnStatusReceived)
+}
+
+func (h *Handlers) changeReturnStatus(c *gin.Context, status string) {
+	var request ReturnCommentRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			respondBindingError(c, err)
+			return
+		}
+	}
+	ret, ok := findReturn(c)
+	if !ok {
+		return
+	}
+	if !canTransitionReturn(ret.Status, status) {
+		respondErrorDetails(c, CodeInvalidReturnTransition, map[string]any{"from": ret.Status, "to": status})
+		return
+	}
+
+	err := inTx(c.Request.Context(), func(tx *Tx) error {
+		return setReturnStatus(tx, ret.Id, status, request.Comment)
+	})
+	if err != nil {
+		requestLog(c).Error("Ошибка при обновлении статуса возврата", "return_id", ret.Id, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	h.respondWithReturn(c, ret, "Статус возврата обновлен")
+}
+
+func (h *Handlers) addReturnTracking(c *gin.Context) {
+	var request ReturnTrackingRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+	ret, ok := findReturn(c)
+	if !ok {
+		return
+	}
+	if !canTransitionReturn(ret.Status, ReturnStatusShipped) {
+		respondError(c, CodeReturnNotAwaitingShip)
+		return
+	}
+
+	err := inTx(c.Request.Context(), func(tx *Tx) error {
+		_, err := tx.Exec("UPDATE returns SET carrier = ?, tracking_number = ? WHERE id = ?", request.Carrier, request.TrackingNumber, ret.Id)
+		if err != nil {
+			return err
+		}
+		return setReturnStatus(tx, ret.Id, ReturnStatusShipped, request.Carrier+" "+request.TrackingNumber)
+	})
+	if err != nil {
+		requestLog(c).Error("Ошибка при сохранении трек-номера возврата", "return_id", ret.Id, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	h.respondWithReturn(c, ret, "Трек-номер возврата сохранен")
+}
+
+// refundReturn возвращает деньги по возврату через платежного провайдера.
+// Без суммы возвращается вся оставшаяся стоимость позиций; заказы с оплатой
+// при получении возвращаются вручную и только фиксируются. Заказ картой или
+// кошельком без успешной оплаты вернуть нельзя: отвечает refund_no_payment.
+func (h *Handlers) refundReturn(c *gin.Context) {
+	var request ReturnRefundRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			respondBindingError(c, err)
+			return
+		}
+	}
+	ret, ok := findReturn(c)
+	if !ok {
+		return
+	}
+	if !canTransitionReturn(ret.Status, ReturnStatusRefunded) {
+		respondError(c, CodeReturnNotApproved)
+		return
+	}
+
+	order, err := loadOrder(c.Request.Context(), ret.OrderId)
+	if err != nil {
+		requestLog(c).Error("Ошибка при получении заказа", "order_id", ret.OrderId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	value := returnValue(order, ret.Items)
+	remaining := value - ret.RefundedAmount
+	amount := request.Amount
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount <= 0 || amount > remaining {
+		respondErrorDetails(c, CodeInvalidRefundAmount, map[string]any{"max": remaining})
+		return
+	}
+
+	// Сумма резервируется до обращения к провайдеру, чтобы одновременные
+	// запросы не вернули вместе больше стоимости позиций.
+	offset, reserved, err := reserveRefund(c.Request.Context(), ret.Id, amount, value)
+	if err != nil {
+		requestLog(c).Error("Ошибка резервирования суммы возврата", "return_id", ret.Id, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if !reserved {
+		if ret, err = loadReturn(c.Request.Context(), ret.Id); err != nil {
+			requestLog(c).Error("Ошибка при получении возврата", "return_id", ret.Id, "error", err)
+			respondError(c, CodeInternal)
+			return
+		}
+		respondErrorDetails(c, CodeInvalidRefundAmount, map[string]any{"max": value - ret.RefundedAmount})
+		return
+	}
+	release := func() {
+		if err := releaseRefund(context.WithoutCancel(c.Request.Context()), ret.Id, amount); err != nil {
+			requestLog(c).Error("Ошибка отмены резерва суммы возврата", "return_id", ret.Id, "amount", amount, "error", err)
+		}
+	}
+
+	refund := Refund{ReturnId: ret.Id, Amount: amount, Status: PaymentStatusSucceeded, CreatedAt: time.Now().UTC()}
+	payment, err := loadSucceededPayment(c.Request.Context(), order.Id)
+	if err == nil && paymentProvider == nil {
+		release()
+		respondError(c, CodePaymentsDisabled)
+		return
+	} else if err == nil {
+		providerRefund, err := paymentProvider.Refund(c.Request.Context(), payment.IntentId, amount, refundIdempotencyKey(ret.Id, offset, amount))
+		if err != nil {
+			release()
+			requestLog(c).Error("Ошибка возврата средств по платежу", "intent_id", payment.IntentId, "error", err)
+			respondError(c, CodeRefundFailed)
+			return
+		}
+		refund.PaymentId = &payment.Id
+		refund.ProviderRefundId = providerRefund.Id
+		refund.Status = providerRefund.Status
+	} else if err != sql.ErrNoRows {
+		release()
+		requestLog(c).Error("Ошибка получения платежа заказа", "order_id", order.Id, "error", err)
+		respondError(c, CodeInternal)
+		return
+	} else if order.PaymentType != PaymentTypeCash {
+		// Без успешной оплаты вернуть деньги за карту или кошелек нечем:
+		// записать такой возврат проведенным нельзя.
+		release()
+		respondError(c, CodeRefundNoPayment)
+		return
+	}
+
+	err = inTx(c.Request.Context(), func(tx *Tx) error {
+		var err error
+		refund.Id, err = tx.Insert("INSERT INTO refunds (return_id,payment_id,provider_refund_id,amount,status,created_at) VALUES (?,?,?,?,?,?)",
+			refund.ReturnId, refund.PaymentId, refund.ProviderRefundId, refund.Amount, refund.Status, refund.CreatedAt)
+		if err != nil {
+			return err
+		}
+		if err := setReturnStatus(tx, ret.Id, ReturnStatusRefunded, request.Comment); err != nil {
+			return err
+		}
+		var refundedTotal int
+		err = tx.QueryRow("SELECT COALESCE(SUM(refunded_amount), 0) FROM returns WHERE order_id = ?", order.Id).Scan(&refundedTotal)
+		if err != nil {
+			return err
+		}
+		if refundedTotal >= refundableTotal(order) {
+			_, err = tx.Exec("UPDATE orders SET status = ? WHERE id = ?", OrderStatusRefunded, order.Id)
+		}
+		return err
+	})
+	if err != nil {
+		// Деньги, уже возвращенные провайдером, остаются в резерве, чтобы
+		// их нельзя было вернуть повторно.
+		if refund.PaymentId == nil {
+			release()
+		}
+		requestLog(c).Error("Ошибка сохранения возврата средств по возврату", "return_id", ret.Id, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	h.audit(c, AuditActionCreate, AuditEntityRefund, refund.Id, nil, refund)
+	h.respondWithReturn(c, ret, "Средства возвращены")
+}
+
+func findReturn(c *gin.Context) (Return, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return Return{}, false
+	}
+	ret, err := loadReturn(c.Request.Context(), id)
+	if err == sql.ErrNoRows {
+		respondError(c, CodeReturnNotFound)
+		return ret, false
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при получении возврата", "return_id", id, "error", err)
+		respondError(c, CodeInternal)
+		return ret, false
+	}
+	return ret, true
+}
+
+// respondWithReturn отвечает возвратом после изменения и записывает
+// изменение в журнал; before — возврат до изменения.
+func (h *Handlers) respondWithReturn(c *gin.Context, before Return, message string) {
+	ret, err := loadReturn(c.Request.Context(), before.Id)
+	if err != nil {
+		requestLog(c).Error("Ошибка при получении возврата", "return_id", before.Id, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	h.audit(c, AuditActionUpdate, AuditEntityReturn, ret.Id, before, ret)
+	c.JSON(http.StatusOK, gin.H{"message": message, "return": ret})
+}
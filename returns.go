@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ReturnStatusRequested = "requested"
+	ReturnStatusApproved  = "approved"
+	ReturnStatusRejected  = "rejected"
+	ReturnStatusShipped   = "shipped"
+	ReturnStatusReceived  = "received"
+	ReturnStatusRefunded  = "refunded"
+)
+
+// returnTransitions перечисляет допустимые переходы статусов возврата.
+// Возврат денег возможен после одобрения, не дожидаясь получения товара.
+var returnTransitions = map[string][]string{
+	ReturnStatusRequested: {ReturnStatusApproved, ReturnStatusRejected},
+	ReturnStatusApproved:  {ReturnStatusShipped, ReturnStatusReceived, ReturnStatusRefunded},
+	ReturnStatusShipped:   {ReturnStatusReceived, ReturnStatusRefunded},
+	ReturnStatusReceived:  {ReturnStatusRefunded},
+	ReturnStatusRefunded:  {ReturnStatusRefunded},
+}
+
+var errInvalidReturnItems = errors.New("некорректный список позиций возврата")
+
+type ReturnItem struct {
+	Id          int64 `json:"id"`
+	OrderItemId int64 `json:"order_item_id"`
+	Quantity    int   `json:"quantity"`
+}
+
+type ReturnHistoryEntry struct {
+	Status    string    `json:"status"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Refund struct {
+	Id               int64     `json:"id"`
+	ReturnId         int64     `json:"return_id"`
+	PaymentId        *int64    `json:"payment_id"`
+	ProviderRefundId string    `json:"provider_refund_id"`
+	Amount           int       `json:"amount"`
+	Status           string    `json:"status"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+type Return struct {
+	Id             int64                `json:"id"`
+	OrderId        int64                `json:"order_id"`
+	UserId         int64                `json:"user_id"`
+	Status         string               `json:"status"`
+	Reason         string               `json:"reason"`
+	Carrier        string               `json:"carrier"`
+	TrackingNumber string               `json:"tracking_number"`
+	RefundedAmount int                  `json:"refunded_amount"`
+	Items          []ReturnItem         `json:"items"`
+	Photos         []string             `json:"photos"`
+	History        []ReturnHistoryEntry `json:"history"`
+	Refunds        []Refund             `json:"refunds"`
+	CreatedAt      time.Time            `json:"created_at"`
+	UpdatedAt      time.Time            `json:"updated_at"`
+}
+
+func canTransitionReturn(from, to string) bool {
+	for _, status := range returnTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// parseReturnItems разбирает строку вида "12:1,13:2", где слева ID позиции
+// заказа, а справа количество. Без количества возвращается одна единица.
+func parseReturnItems(items string) ([]ReturnItem, error) {
+	var result []ReturnItem
+	for _, part := range strings.Split(items, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		idStr, qtyStr, hasQty := strings.Cut(part, ":")
+		id, err := strconv.ParseInt(strings.TrimSpace(idStr), 10, 64)
+		if err != nil {
+			return nil, errInvalidReturnItems
+		}
+		quantity := 1
+		if hasQty {
+			quantity, err = strconv.Atoi(strings.TrimSpace(qtyStr))
+			if err != nil || quantity <= 0 {
+				return nil, errInvalidReturnItems
+			}
+		}
+		result = append(result, ReturnItem{OrderItemId: id, Quantity: quantity})
+	}
+	if len(result) == 0 {
+		return nil, errInvalidReturnItems
+	}
+	return result, nil
+}
+
+// returnableQuantities возвращает, сколько единиц каждой позиции заказа еще
+// можно вернуть с учетом уже открытых возвратов (кроме отклоненных).
+func returnableQuantities(ctx context.Context, order Order) (map[int64]int, error) {
+	available := make(map[int64]int)
+	for _, item := range order.Items {
+		available[item.Id] = item.Quantity
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT ri.order_item_id, SUM(ri.quantity)
+		FROM return_items ri JOIN returns r ON r.id = ri.return_id
+		WHERE r.order_id = ? AND r.status <> ?
+		GROUP BY ri.order_item_id
+	`, order.Id, ReturnStatusRejected)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var itemId int64
+		var quantity int
+		if err := rows.Scan(&itemId, &quantity); err != nil {
+			return nil, err
+		}
+		available[itemId] -= quantity
+	}
+	return available, rows.Err()
+}
+
+// returnValue — стоимость возвращаемых позиций по ценам из заказа за
+// вычетом доли скидки позиции на возвращаемые единицы. Если цены заказа
+// не включали налог, добавляется доля налога позиции. Доля скидки
+// округляется вверх, доля налога — вниз, чтобы частичные возвраты позиции
+// в сумме не превысили уплаченное за нее.
+func returnValue(order Order, items []ReturnItem) int {
+	ordered := make(map[int64]OrderItem)
+	for _, item := range order.Items {
+		ordered[item.Id] = item
+	}
+	total := 0
+	for _, item := range items {
+		o, ok := ordered[item.OrderItemId]
+		if !ok {
+			continue
+		}
+		total += o.Price*item.Quantity - (o.Discount*item.Quantity+o.Quantity-1)/o.Quantity
+		if !order.PricesIncludeTax {
+			total += o.Tax * item.Quantity / o.Quantity
+		}
+	}
+	return total
+}
+
+// refundableTotal — сколько можно вернуть по всем позициям заказа: их
+// стоимость по returnValue, без доставки.
+func refundableTotal(order Order) int {
+	items := make([]ReturnItem, 0, len(order.Items))
+	for _, item := range order.Items {
+		items = append(items, ReturnItem{OrderItemId: item.Id, Quantity: item.Quantity})
+	}
+	return returnValue(order, items)
+}
+
+// reserveRefund добавляет amount к возмещенной сумме возврата, если итог не
+// превысит limit. Проверка и изменение — один UPDATE, поэтому одновременные
+// возмещения не превысят limit вместе. Возвращает возмещенную сумму до
+// резерва или false, если сумма не зарезервирована.
+func reserveRefund(ctx context.Context, returnId int64, amount, limit int) (int, bool, error) {
+	var total int
+	err := db.QueryRowContext(ctx, "UPDATE returns SET refunded_amount = refunded_amount + ? WHERE id = ? AND refunded_amount + ? <= ? RETURNING refunded_amount",
+		amount, returnId, amount, limit).Scan(&total)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return total - amount, true, nil
+}
+
+// refundIdempotencyKey — ключ идемпотентности возмещения у провайдера.
+// Резерв с той же суммой до него и тем же amount — повтор того же
+// возмещения (например, после таймаута и отмены резерва), и провайдер не
+// вернет деньги дважды.
+func refundIdempotencyKey(returnId int64, offset, amount int) string {
+	return fmt.Sprintf("return-%d-refund-%d-%d", returnId, offset, amount)
+}
+
+// releaseRefund отменяет резерв reserveRefund, если возмещение не состоялось.
+func releaseRefund(ctx context.Context, returnId int64, amount int) error {
+	_, err := db.ExecContext(ctx, "UPDATE returns SET refunded_amount = refunded_amount - ? WHERE id = ?", amount, returnId)
+	return err
+}
+
+const returnColumns = "id,order_id,user_id,status,reason,carrier,tracking_number,refunded_amount,created_at,updated_at"
+
+func scanReturn(row interface{ Scan(...interface{}) error }) (Return, error) {
+	var r Return
+	err := row.Scan(&r.Id, &r.OrderId, &r.UserId, &r.Status, &r.Reason, &r.Carrier, &r.TrackingNumber, &r.RefundedAmount, &r.CreatedAt, &r.UpdatedAt)
+	return r, err
+}
+
+// loadReturn загружает возврат вместе с позициями, фото, историей и
+// выплатами.
+func loadReturn(ctx context.Context, id int64) (Return, error) {
+	r, err := scanReturn(db.QueryRowContext(ctx, "SELECT "+returnColumns+" FROM returns WHERE id = ?", id))
+	if err != nil {
+		return r, err
+	}
+	r.Items, r.Photos, r.History, r.Refunds = []ReturnItem{}, []string{}, []ReturnHistoryEntry{}, []Refund{}
+
+	rows, err := db.QueryContext(ctx, "SELECT id,order_item_id,quantity FROM return_items WHERE return_id = ? ORDER BY id", id)
+	if err != nil {
+		return r, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item ReturnItem
+		if err := rows.Scan(&item.Id, &item.OrderItemId, &item.Quantity); err != nil {
+			return r, err
+		}
+		r.Items = append(r.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return r, err
+	}
+
+	photoRows, err := db.QueryContext(ctx, "SELECT image FROM return_photos WHERE return_id = ? ORDER BY id", id)
+	if err != nil {
+		return r, err
+	}
+	defer photoRows.Close()
+	for photoRows.Next() {
+		var image string
+		if err := photoRows.Scan(&image); err != nil {
+			return r, err
+		}
+		r.Photos = append(r.Photos, image)
+	}
+	if err := photoRows.Err(); err != nil {
+		return r, err
+	}
+
+	historyRows, err := db.QueryContext(ctx, "SELECT status,comment,created_at FROM return_history WHERE return_id = ? ORDER BY id", id)
+	if err != nil {
+		return r, err
+	}
+	defer historyRows.Close()
+	for historyRows.Next() {
+		var entry ReturnHistoryEntry
+		if err := historyRows.Scan(&entry.Status, &entry.Comment, &entry.CreatedAt); err != nil {
+			return r, err
+		}
+		r.History = append(r.History, entry)
+	}
+	if err := historyRows.Err(); err != nil {
+		return r, err
+	}
+
+	refundRows, err := db.QueryContext(ctx, "SELECT id,return_id,payment_id,provider_refund_id,amount,status,created_at FROM refunds WHERE return_id = ? ORDER BY id", id)
+	if err != nil {
+		return r, err
+	}
+	defer refundRows.Close()
+	for refundRows.Next() {
+		var refund Refund
+		var paymentId sql.NullInt64
+		if err := refundRows.Scan(&refund.Id, &refund.ReturnId, &paymentId, &refund.ProviderRefundId, &refund.Amount, &refund.Status, &refund.CreatedAt); err != nil {
+			return r, err
+		}
+		if paymentId.Valid {
+			refund.PaymentId = &paymentId.Int64
+		}
+		r.Refunds = append(r.Refunds, refund)
+	}
+	return r, refundRows.Err()
+}
+
+// setReturnStatus меняет статус возврата и пишет запись в историю в рамках
+// переданной транзакции.
+func setReturnStatus(tx *Tx, id int64, status, comment string) error {
+	now := time.Now().UTC()
+	if _, err := tx.Exec("UPDATE returns SET status = ?, updated_at = ? WHERE id = ?", status, now, id); err != nil {
+		return err
+	}
+	_, err := tx.Exec("INSERT INTO return_history (return_id,status,comment,created_at) VALUES (?,?,?,?)", id, status, comment, now)
+	return err
+}
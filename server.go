@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const readinessTimeout = 2 * time.Second
+
+func newHTTPServer(cfg ServerConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+// serve запускает сервер и фоновые задачи workers и работает до отмены ctx.
+// После отмены сервер перестает принимать соединения и ждет завершения
+// текущих запросов не дольше shutdownTimeout, затем дожидается остановки
+// фоновых задач.
+func serve(ctx context.Context, srv *http.Server, shutdownTimeout time.Duration, workers ...func(ctx context.Context)) error {
+	workerCtx, stopWorkers := context.WithCancel(ctx)
+	defer stopWorkers()
+	var wg sync.WaitGroup
+	for _, worker := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker(workerCtx)
+		}()
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("Сервер слушает", "addr", srv.Addr)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	var err error
+	select {
+	case err = <-serveErr:
+		// Сервер не запустился или упал — фоновые задачи тоже останавливаем.
+	case <-ctx.Done():
+		slog.Info("Получен сигнал остановки, завершаем обработку запросов")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err = srv.Shutdown(shutdownCtx)
+	}
+	stopWorkers()
+	wg.Wait()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// healthz — проверка живости: процесс отвечает на запросы.
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// readyz — проверка готовности: доступна база данных и в директорию
+// загрузок можно писать.
+func readyz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := gin.H{}
+	ready := true
+	if err := db.PingContext(ctx); err != nil {
+		requestLog(c).Error("Проверка готовности: база данных недоступна", "error", err)
+		checks["database"] = err.Error()
+		ready = false
+	} else {
+		checks["database"] = "ok"
+	}
+	if err := checkDirWritable(uploadsConfig.Dir); err != nil {
+		requestLog(c).Error("Проверка готовности: директория загрузок недоступна", "dir", uploadsConfig.Dir, "error", err)
+		checks["uploads"] = err.Error()
+		ready = false
+	} else {
+		checks["uploads"] = "ok"
+	}
+
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "checks": checks})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "checks": checks})
+}
+
+func checkDirWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
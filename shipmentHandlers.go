@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ShipmentRequest struct {
+	Carrier        string         `json:"carrier" binding:"required"`
+	TrackingNumber string         `json:"tracking_number" binding:"required"`
+	Items          []ShipmentItem `json:"items"`
+}
+
+// addShipment прикрепляет к заказу трек-номер от поставщика. Без списка
+// позиций в отправление попадает все, что еще не было отправлено.
+func (h *Handlers) addShipment(c *gin.Context) {
+	orderId, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+
+	var request ShipmentRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	order, err := loadOrder(c.Request.Context(), orderId)
+	if err == sql.ErrNoRows {
+		respondError(c, CodeOrderNotFound)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при получении заказа по ID", "order_id", orderId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	payable := order.Status == OrderStatusPaid || order.Status == OrderStatusShipped ||
+		(order.Status == OrderStatusPending && order.PaymentType == PaymentTypeCash)
+	if !payable {
+		respondError(c, CodeOrderNotShippable)
+		return
+	}
+
+	shipped, err := shippedQuantities(c.Request.Context(), orderId)
+	if err != nil {
+		requestLog(c).Error("Ошибка подсчета отправленных позиций заказа", "order_id", orderId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	remaining := make(map[int64]int)
+	for _, item := range order.Items {
+		remaining[item.Id] = item.Quantity - shipped[item.Id]
+	}
+
+	items := request.Items
+	if len(items) == 0 {
+		for _, item := range order.Items {
+			if remaining[item.Id] > 0 {
+				items = append(items, ShipmentItem{OrderItemId: item.Id, Quantity: remaining[item.Id]})
+			}
+		}
+		if len(items) == 0 {
+			respondError(c, CodeOrderFullyShipped)
+			return
+		}
+	}
+	for _, item := range items {
+		left, ok := remaining[item.OrderItemId]
+		if !ok || item.Quantity <= 0 || item.Quantity > left {
+			respondErrorDetails(c, CodeShipmentQuantity, map[string]any{"order_item_id": item.OrderItemId})
+			return
+		}
+		remaining[item.OrderItemId] -= item.Quantity
+	}
+
+	now := time.Now().UTC()
+	err = inTx(c.Request.Context(), func(tx *Tx) error {
+		shipmentId, err := tx.Insert("INSERT INTO shipments (order_id,carrier,tracking_number,status,created_at,updated_at) VALUES (?,?,?,?,?,?)",
+			orderId, request.Carrier, request.TrackingNumber, ShipmentStatusCreated, now, now)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if _, err := tx.Exec("INSERT INTO shipment_items (shipment_id,order_item_id,quantity) VALUES (?,?,?)", shipmentId, item.OrderItemId, item.Quantity); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec("INSERT INTO shipment_events (shipment_id,status,description,location,occurred_at) VALUES (?,?,?,'',?)",
+			shipmentId, ShipmentStatusCreated, "Трек-номер присвоен", now)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE orders SET status = ? WHERE id = ?", OrderStatusShipped, orderId)
+		return err
+	})
+	if err != nil {
+		requestLog(c).Error("Ошибка сохранения отправления заказа", "order_id", orderId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+
+	shipments, err := loadOrderShipments(c.Request.Context(), orderId)
+	if err != nil {
+		requestLog(c).Error("Ошибка получения отправлений заказа", "order_id", orderId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	shipment := shipments[len(shipments)-1]
+	h.audit(c, AuditActionCreate, AuditEntityShipment, shipment.Id, nil, shipment)
+	c.JSON(http.StatusCreated, gin.H{"message": "Отправление добавлено", "shipment": shipment})
+}
+
+func getOrderTracking(c *gin.Context) {
+	orderId, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+
+	var status string
+	err = db.QueryRowContext(c.Request.Context(), "SELECT status FROM orders WHERE id = ?", orderId).Scan(&status)
+	if err == sql.ErrNoRows {
+		respondError(c, CodeOrderNotFound)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при получении заказа по ID", "order_id", orderId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+
+	shipments, err := loadOrderShipments(c.Request.Context(), orderId)
+	if err != nil {
+		requestLog(c).Error("Ошибка получения отправлений заказа", "order_id", orderId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"order_id": orderId, "status": status, "shipments": shipments})
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	ShipmentStatusCreated        = "created"
+	ShipmentStatusInTransit      = "in_transit"
+	ShipmentStatusOutForDelivery = "out_for_delivery"
+	ShipmentStatusDelivered      = "delivered"
+	ShipmentStatusException      = "exception"
+)
+
+const defaultShipmentPollInterval = 15 * time.Minute
+
+type TrackingEvent struct {
+	Status      string    `json:"status"`
+	Description string    `json:"description"`
+	Location    string    `json:"location"`
+	OccurredAt  time.Time `json:"occurred_at"`
+}
+
+type ShipmentItem struct {
+	OrderItemId int64 `json:"order_item_id"`
+	Quantity    int   `json:"quantity"`
+}
+
+type Shipment struct {
+	Id             int64           `json:"id"`
+	OrderId        int64           `json:"order_id"`
+	Carrier        string          `json:"carrier"`
+	TrackingNumber string          `json:"tracking_number"`
+	Status         string          `json:"status"`
+	Items          []ShipmentItem  `json:"items"`
+	Events         []TrackingEvent `json:"events"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+// CarrierTracker получает у службы доставки все известные события по
+// трек-номеру в хронологическом порядке.
+type CarrierTracker interface {
+	Track(ctx context.Context, carrier, trackingNumber string) ([]TrackingEvent, error)
+}
+
+// FakeCarrierTracker при каждом запросе продвигает посылку на один шаг:
+// в пути, передана курьеру, доставлена.
+type FakeCarrierTracker struct {
+	mu     sync.Mutex
+	events map[string][]TrackingEvent
+}
+
+var fakeTrackingSteps = []TrackingEvent{
+	{Status: ShipmentStatusInTransit, Description: "Посылка в пути", Location: "Сортировочный центр"},
+	{Status: ShipmentStatusOutForDelivery, Description: "Передана курьеру", Location: "Город получателя"},
+	{Status: ShipmentStatusDelivered, Description: "Вручена получателю", Location: "Город получателя"},
+}
+
+func NewFakeCarrierTracker() *FakeCarrierTracker {
+	return &FakeCarrierTracker{events: make(map[string][]TrackingEvent)}
+}
+
+func (f *FakeCarrierTracker) Track(ctx context.Context, carrier, trackingNumber string) ([]TrackingEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := carrier + "/" + trackingNumber
+	events := f.events[key]
+	if len(events) < len(fakeTrackingSteps) {
+		event := fakeTrackingSteps[len(events)]
+		event.OccurredAt = time.Now().UTC()
+		events = append(events, event)
+		f.events[key] = events
+	}
+	return append([]TrackingEvent(nil), events...), nil
+}
+
+var carrierTracker CarrierTracker
+
+// runShipmentPoller периодически опрашивает службы доставки по всем
+// недоставленным отправлениям, пока не будет отменен ctx.
+func runShipmentPoller(ctx context.Context, tracker CarrierTracker, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := pollShipments(ctx, tracker); err != nil {
+				slog.Error("Ошибка опроса отправлений", "error", err)
+			}
+		}
+	}
+}
+
+func pollShipments(ctx context.Context, tracker CarrierTracker) error {
+	rows, err := db.QueryContext(ctx, "SELECT id,carrier,tracking_number FROM shipments WHERE status <> ?", ShipmentStatusDelivered)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		id                      int64
+		carrier, trackingNumber string
+	}
+	var shipments []pending
+	for rows.Next() {
+		var s pending
+		if err := rows.Scan(&s.id, &s.carrier, &s.trackingNumber); err != nil {
+			rows.Close()
+			return err
+		}
+		shipments = append(shipments, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, s := range shipments {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		events, err := tracker.Track(ctx, s.carrier, s.trackingNumber)
+		if err != nil {
+			slog.Error("Ошибка отслеживания", "carrier", s.carrier, "tracking_number", s.trackingNumber, "error", err)
+			continue
+		}
+		if err := recordTrackingEvents(ctx, s.id, events); err != nil {
+			slog.Error("Ошибка сохранения событий отправления", "shipment_id", s.id, "error", err)
+		}
+	}
+	return nil
+}
+
+// recordTrackingEvents сохраняет новые события отправления, обновляет его
+// статус и, когда все отправления заказа доставлены, переводит заказ в
+// статус delivered.
+func recordTrackingEvents(ctx context.Context, shipmentId int64, events []TrackingEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, event := range events {
+		_, err := tx.Exec("INSERT INTO shipment_events (shipment_id,status,description,location,occurred_at) VALUES (?,?,?,?,?) ON CONFLICT DO NOTHING",
+			shipmentId, event.Status, event.Description, event.Location, event.OccurredAt.UTC())
+		if err != nil {
+			return err
+		}
+	}
+	latest := events[len(events)-1].Status
+	if _, err := tx.Exec("UPDATE shipments SET status = ?, updated_at = ? WHERE id = ?", latest, time.Now().UTC(), shipmentId); err != nil {
+		return err
+	}
+
+	if latest == ShipmentStatusDelivered {
+		var orderId int64
+		var undelivered int
+		if err := tx.QueryRow("SELECT order_id FROM shipments WHERE id = ?", shipmentId).Scan(&orderId); err != nil {
+			return err
+		}
+		err := tx.QueryRow("SELECT COUNT(*) FROM shipments WHERE order_id = ? AND status <> ?", orderId, ShipmentStatusDelivered).Scan(&undelivered)
+		if err != nil {
+			return err
+		}
+		var unshipped int
+		err = tx.QueryRow(`
+			SELECT COALESCE(SUM(oi.quantity), 0) - (
+				SELECT COALESCE(SUM(si.quantity), 0)
+				FROM shipment_items si JOIN shipments s ON s.id = si.shipment_id
+				WHERE s.order_id = ?
+			)
+			FROM order_items oi WHERE oi.order_id = ?
+		`, orderId, orderId).Scan(&unshipped)
+		if err != nil {
+			return err
+		}
+		if undelivered == 0 && unshipped == 0 {
+			_, err := tx.Exec("UPDATE orders SET status = ? WHERE id = ? AND status = ?", OrderStatusDelivered, orderId, OrderStatusShipped)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+const shipmentColumns = "id,order_id,carrier,tracking_number,status,created_at,updated_at"
+
+func loadOrderShipments(ctx context.Context, orderId int64) ([]Shipment, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+shipmentColumns+" FROM shipments WHERE order_id = ? ORDER BY id", orderId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	shipments := []Shipment{}
+	index := make(map[int64]int)
+	for rows.Next() {
+		var s Shipment
+		if err := rows.Scan(&s.Id, &s.OrderId, &s.Carrier, &s.TrackingNumber, &s.Status, &s.CreatedAt, &s.UpdatedAt); err != nil {
+			return nil, err
+		}
+		s.Items, s.Events = []ShipmentItem{}, []TrackingEvent{}
+		index[s.Id] = len(shipments)
+		shipments = append(shipments, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	itemRows, err := db.QueryContext(ctx, "SELECT si.shipment_id,si.order_item_id,si.quantity FROM shipment_items si JOIN shipments s ON s.id = si.shipment_id WHERE s.order_id = ? ORDER BY si.id", orderId)
+	if err != nil {
+		return nil, err
+	}
+	defer itemRows.Close()
+	for itemRows.Next() {
+		var shipmentId int64
+		var item ShipmentItem
+		if err := itemRows.Scan(&shipmentId, &item.OrderItemId, &item.Quantity); err != nil {
+			return nil, err
+		}
+		s := &shipments[index[shipmentId]]
+		s.Items = append(s.Items, item)
+	}
+	if err := itemRows.Err(); err != nil {
+		return nil, err
+	}
+
+	eventRows, err := db.QueryContext(ctx, "SELECT e.shipment_id,e.status,e.description,e.location,e.occurred_at FROM shipment_events e JOIN shipments s ON s.id = e.shipment_id WHERE s.order_id = ? ORDER BY e.occurred_at, e.id", orderId)
+	if err != nil {
+		return nil, err
+	}
+	defer eventRows.Close()
+	for eventRows.Next() {
+		var shipmentId int64
+		var event TrackingEvent
+		if err := eventRows.Scan(&shipmentId, &event.Status, &event.Description, &event.Location, &event.OccurredAt); err != nil {
+			return nil, err
+		}
+		s := &shipments[index[shipmentId]]
+		s.Events = append(s.Events, event)
+	}
+	return shipments, eventRows.Err()
+}
+
+// shippedQuantities возвращает, сколько единиц каждой позиции заказа уже
+// включено в отправления.
+func shippedQuantities(ctx context.Context, orderId int64) (map[int64]int, error) {
+	rows, err := db.QueryContext(ctx, "SELECT si.order_item_id, SUM(si.quantity) FROM shipment_items si JOIN shipments s ON s.id = si.shipment_id WHERE s.order_id = ? GROUP BY si.order_item_id", orderId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	shipped := make(map[int64]int)
+	for rows.Next() {
+		var itemId int64
+		var quantity int
+		if err := rows.Scan(&itemId, &quantity); err != nil {
+			return nil, err
+		}
+		shipped[itemId] = quantity
+	}
+	return shipped, rows.Err()
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+)
+
+const earthRadiusKm = 6371.0
+
+var errProductNotFound = errors.New("продукт не найден")
+
+type Warehouse struct {
+	Id        int64   `json:"id"`
+	Name      string  `json:"name"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// WarehouseInput — склад в теле запроса. Координаты — указатели, как в
+// UserInput: склад на экваторе или нулевом меридиане тоже допустим.
+type WarehouseInput struct {
+	Name      string   `json:"name" binding:"required"`
+	Latitude  *float64 `json:"latitude" binding:"required,min=-90,max=90"`
+	Longitude *float64 `json:"longitude" binding:"required,min=-180,max=180"`
+}
+
+func (w WarehouseInput) warehouse() Warehouse {
+	return Warehouse{Name: w.Name, Latitude: *w.Latitude, Longitude: *w.Longitude}
+}
+
+// ShippingZone описывает область доставки со склада: либо радиус в
+// километрах от склада, либо многоугольник из точек [широта, долгота].
+type ShippingZone struct {
+	Id          int64        `json:"id"`
+	Name        string       `json:"name" binding:"required"`
+	WarehouseId int64        `json:"warehouse_id" binding:"required"`
+	RadiusKm    float64      `json:"radius_km"`
+	Polygon     [][2]float64 `json:"polygon"`
+}
+
+// ShippingRate — строка тарифной таблицы зоны. Нулевой MaxWeight означает
+// отсутствие верхней границы, нулевой FreeThreshold — отсутствие бесплатной
+// доставки.
+type ShippingRate struct {
+	Id            int64  `json:"id"`
+	ZoneId        int64  `json:"zone_id" binding:"required"`
+	Name          string `json:"name" binding:"required"`
+	MinWeight     int    `json:"min_weight"`
+	MaxWeight     int    `json:"max_weight"`
+	MinTotal      int    `json:"min_total"`
+	BasePrice     int    `json:"base_price"`
+	PricePerKm    int    `json:"price_per_km"`
+	FreeThreshold int    `json:"free_threshold"`
+	DeliveryDays  int    `json:"delivery_days"`
+}
+
+type ShippingOption struct {
+	RateId       int64   `json:"rate_id"`
+	Name         string  `json:"name"`
+	ZoneId       int64   `json:"zone_id"`
+	ZoneName     string  `json:"zone_name"`
+	WarehouseId  int64   `json:"warehouse_id"`
+	DistanceKm   float64 `json:"distance_km"`
+	Price        int     `json:"price"`
+	Free         bool    `json:"free"`
+	DeliveryDays int     `json:"delivery_days"`
+}
+
+// ShippingQuote — варианты доставки корзины. Суммы в базовой валюте, в
+// которой заданы тарифы.
+type ShippingQuote struct {
+	Subtotal int              `json:"subtotal"`
+	Currency string           `json:"currency"`
+	Weight   int              `json:"weight"`
+	Options  []ShippingOption `json:"options"`
+}
+
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// pointInPolygon проверяет попадание точки в многоугольник методом
+// трассировки луча. Для зон доставки размером с город плоского
+// приближения достаточно.
+func pointInPolygon(lat, lon float64, polygon [][2]float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		latI, lonI := polygon[i][0], polygon[i][1]
+		latJ, lonJ := polygon[j][0], polygon[j][1]
+		if (lonI > lon) != (lonJ > lon) &&
+			lat < (latJ-latI)*(lon-lonI)/(lonJ-lonI)+latI {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func (z ShippingZone) contains(w Warehouse, lat, lon float64) bool {
+	if len(z.Polygon) >= 3 {
+		return pointInPolygon(lat, lon, z.Polygon)
+	}
+	return z.RadiusKm > 0 && haversineKm(w.Latitude, w.Longitude, lat, lon) <= z.RadiusKm
+}
+
+func (r ShippingRate) applies(weight, subtotal int) bool {
+	if weight < r.MinWeight {
+		return false
+	}
+	if r.MaxWeight > 0 && weight > r.MaxWeight {
+		return false
+	}
+	return subtotal >= r.MinTotal
+}
+
+func (r ShippingRate) price(distanceKm float64, subtotal int) (int, bool) {
+	if r.FreeThreshold > 0 && subtotal >= r.FreeThreshold {
+		return 0, true
+	}
+	return r.BasePrice + int(math.Round(distanceKm*float64(r.PricePerKm))), false
+}
+
+func encodePolygon(polygon [][2]float64) (string, error) {
+	if len(polygon) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(polygon)
+	return string(data), err
+}
+
+func decodePolygon(polygon string) ([][2]float64, error) {
+	var result [][2]float64
+	if polygon == "" {
+		return result, nil
+	}
+	err := json.Unmarshal([]byte(polygon), &result)
+	return result, err
+}
+
+func getProductsByIds(ctx context.Context, ids []int64) (map[int64]Product, error) {
+	products := make(map[int64]Product)
+	if len(ids) == 0 {
+		return products, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := db.QueryContext(ctx, "SELECT id,name,price,currency,category,image,weight FROM products WHERE deleted_at IS NULL AND id IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Product
+		if err := rows.Scan(&p.Id, &p.Name, &p.Price, &p.Currency, &p.Category, &p.Image, &p.Weight); err != nil {
+			return nil, err
+		}
+		products[p.Id] = p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if _, ok := products[id]; !ok {
+			return nil, errProductNotFound
+		}
+	}
+	return products, nil
+}
+
+// calculateShipping подбирает варианты доставки корзины по адресу. Каждый
+// товар в корзине учитывается столько раз, сколько раз встречается его ID.
+// Если корзина принадлежит пользователю userId, цены товаров берутся по
+// cartPricePolicy, иначе текущие. Цены в других валютах пересчитываются в
+// базовую по текущему курсу.
+func calculateShipping(ctx context.Context, lat, lon float64, cart []int64, userId int64) (ShippingQuote, error) {
+	products, err := getProductsByIds(ctx, cart)
+	if err != nil {
+		return ShippingQuote{Currency: baseCurrency, Options: []ShippingOption{}}, err
+	}
+	prices := make(map[int64]int, len(products))
+	for id, p := range products {
+		prices[id] = p.Price
+	}
+	if userId != 0 {
+		if prices, err = cartItemPrices(ctx, userId, products); err != nil {
+			return ShippingQuote{Currency: baseCurrency, Options: []ShippingOption{}}, err
+		}
+	}
+	basePrices, err := exchangeRates.snapshot().convertPrices(prices, products, baseCurrency)
+	if err != nil {
+		return ShippingQuote{Currency: baseCurrency, Options: []ShippingOption{}}, err
+	}
+	return quoteCart(ctx, lat, lon, cart, products, basePrices)
+}
+
+// quoteCart подбирает варианты доставки для уже загруженных товаров корзины
+// по ценам prices в базовой валюте.
+func quoteCart(ctx context.Context, lat, lon float64, cart []int64, products map[int64]Product, prices map[int64]int) (ShippingQuote, error) {
+	quote := ShippingQuote{Currency: baseCurrency, Options: []ShippingOption{}}
+	for _, id := range cart {
+		quote.Subtotal += prices[id]
+		quote.Weight += products[id].Weight
+	}
+
+	warehouses, err := loadWarehouses(ctx)
+	if err != nil {
+		return quote, err
+	}
+	zones, err := loadShippingZones(ctx)
+	if err != nil {
+		return quote, err
+	}
+	rates, err := loadShippingRates(ctx)
+	if err != nil {
+		return quote, err
+	}
+
+	for _, zone := range zones {
+		warehouse, ok := warehouses[zone.WarehouseId]
+		if !ok || !zone.contains(warehouse, lat, lon) {
+			continue
+		}
+		distance := haversineKm(warehouse.Latitude, warehouse.Longitude, lat, lon)
+		for _, rate := range rates {
+			if rate.ZoneId != zone.Id || !rate.applies(quote.Weight, quote.Subtotal) {
+				continue
+			}
+			price, free := rate.price(distance, quote.Subtotal)
+			quote.Options = append(quote.Options, ShippingOption{
+				RateId:       rate.Id,
+				Name:         rate.Name,
+				ZoneId:       zone.Id,
+				ZoneName:     zone.Name,
+				WarehouseId:  warehouse.Id,
+				DistanceKm:   math.Round(distance*100) / 100,
+				Price:        price,
+				Free:         free,
+				DeliveryDays: rate.DeliveryDays,
+			})
+		}
+	}
+
+	sort.SliceStable(quote.Options, func(i, j int) bool {
+		if quote.Options[i].Price != quote.Options[j].Price {
+			return quote.Options[i].Price < quote.Options[j].Price
+		}
+		return quote.Options[i].DeliveryDays < quote.Options[j].DeliveryDays
+	})
+	return quote, nil
+}
+
+func loadWarehouses(ctx context.Context) (map[int64]Warehouse, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id,name,latitude,longitude FROM warehouses")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	warehouses := make(map[int64]Warehouse)
+	for rows.Next() {
+		var w Warehouse
+		if err := rows.Scan(&w.Id, &w.Name, &w.Latitude, &w.Longitude); err != nil {
+			return nil, err
+		}
+		warehouses[w.Id] = w
+	}
+	return warehouses, rows.Err()
+}
+
+func loadShippingZones(ctx context.Context) ([]ShippingZone, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id,name,warehouse_id,radius_km,polygon FROM shipping_zones")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var zones []ShippingZone
+	for rows.Next() {
+		var z ShippingZone
+		var polygon string
+		if err := rows.Scan(&z.Id, &z.Name, &z.WarehouseId, &z.RadiusKm, &polygon); err != nil {
+			return nil, err
+		}
+		if z.Polygon, err = decodePolygon(polygon); err != nil {
+			return nil, err
+		}
+		zones = append(zones, z)
+	}
+	return zones, rows.Err()
+}
+
+func loadShippingRates(ctx context.Context) ([]ShippingRate, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id,zone_id,name,min_weight,max_weight,min_total,base_price,price_per_km,free_threshold,delivery_days FROM shipping_rates")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rates []ShippingRate
+	for rows.Next() {
+		var r ShippingRate
+		if err := rows.Scan(&r.Id, &r.ZoneId, &r.Name, &r.MinWeight, &r.MaxWeight, &r.MinTotal, &r.BasePrice, &r.PricePerKm, &r.FreeThreshold, &r.DeliveryDays); err != nil {
+			return nil, err
+		}
+		rates = append(rates, r)
+	}
+	return rates, rows.Err()
+}
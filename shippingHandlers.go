@@ -0,0 +1,288 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ShippingQuoteRequest struct {
+	UserId    int64    `json:"user_id"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	Cart      []int64  `json:"cart"`
+}
+
+func getWarehouses(c *gin.Context) {
+	warehouses, err := loadWarehouses(c.Request.Context())
+	if err != nil {
+		requestLog(c).Error("Ошибка получения складов", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	result := []Warehouse{}
+	for _, w := range warehouses {
+		result = append(result, w)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	c.JSON(http.StatusOK, result)
+}
+
+func (h *Handlers) addWarehouse(c *gin.Context) {
+	var input WarehouseInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+	warehouse := input.warehouse()
+
+	id, err := db.InsertContext(c.Request.Context(), "INSERT INTO warehouses (name,latitude,longitude) VALUES (?,?,?)", warehouse.Name, warehouse.Latitude, warehouse.Longitude)
+	if err != nil {
+		requestLog(c).Error("Ошибка при добавлении склада в базу данных", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	warehouse.Id = id
+	h.audit(c, AuditActionCreate, AuditEntityWarehouse, id, nil, warehouse)
+	c.JSON(http.StatusCreated, gin.H{"message": "Склад успешно добавлен", "warehouse": warehouse})
+}
+
+func (h *Handlers) deleteWarehouse(c *gin.Context) {
+	h.deleteById(c, AuditEntityWarehouse, "warehouses", CodeWarehouseNotFound, "Склад успешно удален!")
+}
+
+func getShippingZones(c *gin.Context) {
+	zones, err := loadShippingZones(c.Request.Context())
+	if err != nil {
+		requestLog(c).Error("Ошибка получения зон доставки", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if zones == nil {
+		zones = []ShippingZone{}
+	}
+	c.JSON(http.StatusOK, zones)
+}
+
+func (h *Handlers) addShippingZone(c *gin.Context) {
+	var zone ShippingZone
+	if err := c.ShouldBindJSON(&zone); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+	if zone.RadiusKm <= 0 && len(zone.Polygon) < 3 {
+		respondError(c, CodeInvalidZoneShape)
+		return
+	}
+
+	var exists int
+	err := db.QueryRowContext(c.Request.Context(), "SELECT COUNT(*) FROM warehouses WHERE id = ?", zone.WarehouseId).Scan(&exists)
+	if err != nil {
+		requestLog(c).Error("Ошибка проверки склада", "warehouse_id", zone.WarehouseId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if exists == 0 {
+		respondFieldErrors(c, FieldError{Field: "warehouse_id", Code: "not_found"})
+		return
+	}
+
+	polygon, err := encodePolygon(zone.Polygon)
+	if err != nil {
+		respondError(c, CodeInvalidZonePolygon)
+		return
+	}
+
+	id, err := db.InsertContext(c.Request.Context(), "INSERT INTO shipping_zones (name,warehouse_id,radius_km,polygon) VALUES (?,?,?,?)", zone.Name, zone.WarehouseId, zone.RadiusKm, polygon)
+	if err != nil {
+		requestLog(c).Error("Ошибка при добавлении зоны доставки в базу данных", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	zone.Id = id
+	h.audit(c, AuditActionCreate, AuditEntityShippingZone, id, nil, zone)
+	c.JSON(http.StatusCreated, gin.H{"message": "Зона доставки успешно добавлена", "zone": zone})
+}
+
+func (h *Handlers) deleteShippingZone(c *gin.Context) {
+	h.deleteById(c, AuditEntityShippingZone, "shipping_zones", CodeShippingZoneNotFound, "Зона доставки успешно удалена!")
+}
+
+func getShippingRates(c *gin.Context) {
+	rates, err := loadShippingRates(c.Request.Context())
+	if err != nil {
+		requestLog(c).Error("Ошибка получения тарифов доставки", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if rates == nil {
+		rates = []ShippingRate{}
+	}
+	c.JSON(http.StatusOK, rates)
+}
+
+func (h *Handlers) addShippingRate(c *gin.Context) {
+	var rate ShippingRate
+	if err := c.ShouldBindJSON(&rate); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+	var negative []FieldError
+	for _, field := range []struct {
+		name  string
+		value int
+	}{
+		{"min_weight", rate.MinWeight},
+		{"max_weight", rate.MaxWeight},
+		{"min_total", rate.MinTotal},
+		{"base_price", rate.BasePrice},
+		{"price_per_km", rate.PricePerKm},
+		{"free_threshold", rate.FreeThreshold},
+		{"delivery_days", rate.DeliveryDays},
+	} {
+		if field.value < 0 {
+			negative = append(negative, FieldError{Field: field.name, Code: "min", Param: "0"})
+		}
+	}
+	if len(negative) > 0 {
+		respondFieldErrors(c, negative...)
+		return
+	}
+	if rate.MaxWeight > 0 && rate.MaxWeight < rate.MinWeight {
+		respondFieldErrors(c, FieldError{Field: "max_weight", Code: "gtefield", Param: "min_weight"})
+		return
+	}
+
+	var exists int
+	err := db.QueryRowContext(c.Request.Context(), "SELECT COUNT(*) FROM shipping_zones WHERE id = ?", rate.ZoneId).Scan(&exists)
+	if err != nil {
+		requestLog(c).Error("Ошибка проверки зоны доставки", "zone_id", rate.ZoneId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if exists == 0 {
+		respondFieldErrors(c, FieldError{Field: "zone_id", Code: "not_found"})
+		return
+	}
+
+	id, err := db.InsertContext(c.Request.Context(), "INSERT INTO shipping_rates (zone_id,name,min_weight,max_weight,min_total,base_price,price_per_km,free_threshold,delivery_days) VALUES (?,?,?,?,?,?,?,?,?)",
+		rate.ZoneId, rate.Name, rate.MinWeight, rate.MaxWeight, rate.MinTotal, rate.BasePrice, rate.PricePerKm, rate.FreeThreshold, rate.DeliveryDays)
+	if err != nil {
+		requestLog(c).Error("Ошибка при добавлении тарифа доставки в базу данных", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	rate.Id = id
+	h.audit(c, AuditActionCreate, AuditEntityShippingRate, id, nil, rate)
+	c.JSON(http.StatusCreated, gin.H{"message": "Тариф доставки успешно добавлен", "rate": rate})
+}
+
+func (h *Handlers) deleteShippingRate(c *gin.Context) {
+	h.deleteById(c, AuditEntityShippingRate, "shipping_rates", CodeShippingRateNotFound, "Тариф доставки успешно удален!")
+}
+
+// quoteShipping возвращает варианты доставки для корзины. Адрес берется из
+// тела запроса, а если он не указан — из координат пользователя. Корзина
+// также по умолчанию берется у пользователя.
+func quoteShipping(c *gin.Context) {
+	var request ShippingQuoteRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	cart := request.Cart
+	var lat, lon float64
+	if request.Latitude != nil && request.Longitude != nil {
+		lat, lon = *request.Latitude, *request.Longitude
+	} else if request.UserId == 0 {
+		respondError(c, CodeShippingAddressRequired)
+		return
+	}
+
+	if request.UserId != 0 {
+		var userLat, userLon float64
+		var userCart string
+		row := db.QueryRowContext(c.Request.Context(), "SELECT latitude,longitude,cart FROM users WHERE id = ? AND deleted_at IS NULL", request.UserId)
+		err := row.Scan(&userLat, &userLon, &userCart)
+		if err == sql.ErrNoRows {
+			respondError(c, CodeUserNotFound)
+			return
+		} else if err != nil {
+			requestLog(c).Error("Ошибка при получении пользователя с ID", "user_id", request.UserId, "error", err)
+			respondError(c, CodeInternal)
+			return
+		}
+		if request.Latitude == nil || request.Longitude == nil {
+			lat, lon = userLat, userLon
+		}
+		if len(cart) == 0 {
+			if cart, _, err = dropTrashedProducts(c.Request.Context(), parseCart(userCart)); err != nil {
+				requestLog(c).Error("Ошибка проверки товаров корзины", "user_id", request.UserId, "error", err)
+				respondError(c, CodeInternal)
+				return
+			}
+		}
+	}
+
+	if len(cart) == 0 {
+		respondError(c, CodeCartEmpty)
+		return
+	}
+
+	quote, err := calculateShipping(c.Request.Context(), lat, lon, cart, request.UserId)
+	if errors.Is(err, errProductNotFound) {
+		respondError(c, CodeCartProductNotFound)
+		return
+	} else if errors.Is(err, errExchangeRateUnavailable) {
+		respondConversionError(c, err)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка расчета доставки", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	c.JSON(http.StatusOK, quote)
+}
+
+func (h *Handlers) deleteById(c *gin.Context, entityType, table string, notFoundCode ErrorCode, deletedMessage string) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return
+	}
+
+	before, err := auditRow(c.Request.Context(), table, id)
+	if err == sql.ErrNoRows {
+		respondError(c, notFoundCode)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при получении записи перед удалением", "table", table, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+
+	result, err := db.ExecContext(c.Request.Context(), "DELETE FROM "+table+" WHERE id = ?", id)
+	if err != nil {
+		requestLog(c).Error("Ошибка при удалении из", "table", table, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		requestLog(c).Error("Ошибка получения количества затронутых строк при удалении", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if rowsAffected == 0 {
+		respondError(c, notFoundCode)
+		return
+	}
+	h.audit(c, AuditActionDelete, entityType, id, before, nil)
+	c.JSON(http.StatusOK, gin.H{"message": deletedMessage})
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+type sqlProductRepository struct {
+	db *DB
+}
+
+type sqlUserRepository struct {
+	db *DB
+}
+
+type sqlAuditRepository struct {
+	db *DB
+}
+
+type sqlPriceHistoryRepository struct {
+	db *DB
+}
+
+func NewSQLProductRepository(db *DB) ProductRepository {
+	return &sqlProductRepository{db: db}
+}
+
+func NewSQLUserRepository(db *DB) UserRepository {
+	return &sqlUserRepository{db: db}
+}
+
+func NewSQLAuditRepository(db *DB) AuditRepository {
+	return &sqlAuditRepository{db: db}
+}
+
+func NewSQLPriceHistoryRepository(db *DB) PriceHistoryRepository {
+	return &sqlPriceHistoryRepository{db: db}
+}
+
+const productColumns = "id,name,price,currency,category,image,weight,version,deleted_at"
+
+func scanProduct(row interface{ Scan(...interface{}) error }) (Product, error) {
+	var p Product
+	var deletedAt sql.NullTime
+	err := row.Scan(&p.Id, &p.Name, &p.Price, &p.Currency, &p.Category, &p.Image, &p.Weight, &p.Version, &deletedAt)
+	p.DeletedAt = nullTimePtr(deletedAt)
+	return p, err
+}
+
+func (r *sqlProductRepository) List(ctx context.Context) ([]Product, error) {
+	return r.list(ctx, "SELECT "+productColumns+" FROM products WHERE deleted_at IS NULL")
+}
+
+func (r *sqlProductRepository) ListDeleted(ctx context.Context) ([]Product, error) {
+	return r.list(ctx, "SELECT "+productColumns+" FROM products WHERE deleted_at IS NOT NULL ORDER BY deleted_at")
+}
+
+func (r *sqlProductRepository) list(ctx context.Context, query string, args ...interface{}) ([]Product, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var products []Product
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+	return products, rows.Err()
+}
+
+func (r *sqlProductRepository) Get(ctx context.Context, id int64) (Product, error) {
+	p, err := scanProduct(r.db.QueryRowContext(ctx, "SELECT "+productColumns+" FROM products WHERE id = ? AND deleted_at IS NULL", id))
+	if err == sql.ErrNoRows {
+		return p, errNotFound
+	}
+	return p, err
+}
+
+func (r *sqlProductRepository) Create(ctx context.Context, product *Product) error {
+	var err error
+	product.Id, err = r.db.InsertContext(ctx, "INSERT INTO products (name,price,currency,category,image,weight) VALUES (?,?,?,?,?,?)",
+		product.Name, product.Price, product.Currency, product.Category, product.Image, product.Weight)
+	product.Version = 1
+	return err
+}
+
+func (r *sqlProductRepository) Update(ctx context.Context, product Product) error {
+	result, err := r.db.ExecContext(ctx, "UPDATE products SET name = ?, price = ?, currency = ?, category = ?, image = ?, weight = ?, version = version + 1 WHERE id = ? AND version = ? AND deleted_at IS NULL",
+		product.Name, product.Price, product.Currency, product.Category, product.Image, product.Weight, product.Id, product.Version)
+	if err != nil {
+		return err
+	}
+	return r.db.requireVersion(ctx, result, "products", product.Id)
+}
+
+func (r *sqlProductRepository) Delete(ctx context.Context, id, version int64) error {
+	result, err := r.db.ExecContext(ctx, "UPDATE products SET deleted_at = ?, version = version + 1 WHERE id = ? AND version = ? AND deleted_at IS NULL",
+		time.Now().UTC(), id, version)
+	if err != nil {
+		return err
+	}
+	return r.db.requireVersion(ctx, result, "products", id)
+}
+
+func (r *sqlProductRepository) Restore(ctx context.Context, id int64) error {
+	return r.db.restore(ctx, "products", id)
+}
+
+func (r *sqlProductRepository) Purge(ctx context.Context, deletedBefore time.Time) ([]Product, error) {
+	expired, err := r.list(ctx, "SELECT "+productColumns+" FROM products WHERE deleted_at < ?", deletedBefore)
+	if err != nil {
+		return nil, err
+	}
+	var purged []Product
+	for _, p := range expired {
+		ok, err := r.db.purge(ctx, "products", p.Id)
+		if err != nil {
+			return purged, err
+		}
+		if ok {
+			purged = append(purged, p)
+		}
+	}
+	return purged, nil
+}
+
+const userColumns = "id,name,latitude,longitude,cart,version,deleted_at"
+
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	var u User
+	var cart sql.NullString
+	var deletedAt sql.NullTime
+	err := row.Scan(&u.Id, &u.Name, &u.Latitude, &u.Longitude, &cart, &u.Version, &deletedAt)
+	u.Cart = parseCart(cart.String)
+	u.DeletedAt = nullTimePtr(deletedAt)
+	return u, err
+}
+
+func formatCart(cart []int64) string {
+	return strings.Join(convertInt64ToStringSlice(cart), ",")
+}
+
+func (r *sqlUserRepository) List(ctx context.Context) ([]User, error) {
+	return r.list(ctx, "SELECT "+userColumns+" FROM users WHERE deleted_at IS NULL")
+}
+
+func (r *sqlUserRepository) ListDeleted(ctx context.Context) ([]User, error) {
+	return r.list(ctx, "SELECT "+userColumns+" FROM users WHERE deleted_at IS NOT NULL ORDER BY deleted_at")
+}
+
+func (r *sqlUserRepository) list(ctx context.Context, query string, args ...interface{}) ([]User, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (r *sqlUserRepository) Get(ctx context.Context, id int64) (User, error) {
+	u, err := scanUser(r.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = ? AND deleted_at IS NULL", id))
+	if err == sql.ErrNoRows {
+		return u, errNotFound
+	}
+	return u, err
+}
+
+func (r *sqlUserRepository) Create(ctx context.Context, user *User) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	id, err := tx.Insert("INSERT INTO users (name,latitude,longitude,cart) VALUES (?,?,?,?)",
+		user.Name, user.Latitude, user.Longitude, formatCart(user.Cart))
+	if err != nil {
+		return err
+	}
+	if err := syncCartPrices(tx, id, user.Cart); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	user.Id = id
+	user.Version = 1
+	return nil
+}
+
+func (r *sqlUserRepository) Update(ctx context.Context, user User) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("UPDATE users SET name = ?, latitude = ?, longitude = ?, cart = ?, version = version + 1 WHERE id = ? AND version = ? AND deleted_at IS NULL",
+		user.Name, user.Latitude, user.Longitude, formatCart(user.Cart), user.Id, user.Version)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result); err == errNotFound {
+		tx.Rollback()
+		return r.db.requireVersion(ctx, result, "users", user.Id)
+	} else if err != nil {
+		return err
+	}
+	if err := syncCartPrices(tx, user.Id, user.Cart); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// syncCartPrices приводит cart_prices пользователя в соответствие с
+// корзиной: запоминает текущую цену новых товаров и забывает цены
+// убранных. Цена товара, который уже лежал в корзине, не меняется.
+func syncCartPrices(tx *Tx, userId int64, cart []int64) error {
+	if len(cart) == 0 {
+		_, err := tx.Exec("DELETE FROM cart_prices WHERE user_id = ?", userId)
+		return err
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(cart)), ",")
+	args := []interface{}{userId}
+	for _, id := range cart {
+		args = append(args, id)
+	}
+	if _, err := tx.Exec("DELETE FROM cart_prices WHERE user_id = ? AND product_id NOT IN ("+placeholders+")", args...); err != nil {
+		return err
+	}
+	args = append([]interface{}{userId, time.Now().UTC()}, args[1:]...)
+	args = append(args, userId)
+	_, err := tx.Exec("INSERT INTO cart_prices (user_id,product_id,price,currency,added_at) SELECT ?, id, price, currency, ? FROM products WHERE deleted_at IS NULL AND id IN ("+placeholders+") "+
+		"AND NOT EXISTS (SELECT 1 FROM cart_prices WHERE cart_prices.user_id = ? AND cart_prices.product_id = products.id)", args...)
+	return err
+}
+
+func (r *sqlUserRepository) Delete(ctx context.Context, id, version int64) error {
+	result, err := r.db.ExecContext(ctx, "UPDATE users SET deleted_at = ?, version = version + 1 WHERE id = ? AND version = ? AND deleted_at IS NULL",
+		time.Now().UTC(), id, version)
+	if err != nil {
+		return err
+	}
+	return r.db.requireVersion(ctx, result, "users", id)
+}
+
+func (r *sqlUserRepository) Restore(ctx context.Context, id int64) error {
+	return r.db.restore(ctx, "users", id)
+}
+
+func (r *sqlUserRepository) Purge(ctx context.Context, deletedBefore time.Time) ([]User, error) {
+	expired, err := r.list(ctx, "SELECT "+userColumns+" FROM users WHERE deleted_at < ? AND NOT EXISTS (SELECT 1 FROM orders WHERE orders.user_id = users.id)", deletedBefore)
+	if err != nil {
+		return nil, err
+	}
+	var purged []User
+	for _, u := range expired {
+		ok, err := r.db.purge(ctx, "users", u.Id)
+		if err != nil {
+			return purged, err
+		}
+		if ok {
+			purged = append(purged, u)
+		}
+	}
+	return purged, nil
+}
+
+func (r *sqlAuditRepository) Record(ctx context.Context, entry *AuditEntry) error {
+	changes, err := json.Marshal(entry.Changes)
+	if err != nil {
+		return err
+	}
+	entry.Id, err = r.db.InsertContext(ctx, "INSERT INTO audit_log (actor,action,entity_type,entity_id,changes,ip,request_id,created_at) VALUES (?,?,?,?,?,?,?,?)",
+		entry.Actor, entry.Action, entry.EntityType, entry.EntityId, string(changes), entry.IP, entry.RequestId, entry.CreatedAt)
+	return err
+}
+
+func (r *sqlAuditRepository) List(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	query := "SELECT id,actor,action,entity_type,entity_id,changes,ip,request_id,created_at FROM audit_log WHERE 1 = 1"
+	var args []interface{}
+	if filter.EntityType != "" {
+		query += " AND entity_type = ?"
+		args = append(args, filter.EntityType)
+	}
+	if filter.EntityId != 0 {
+		query += " AND entity_id = ?"
+		args = append(args, filter.EntityId)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, filter.Limit)
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var changes string
+		if err := rows.Scan(&e.Id, &e.Actor, &e.Action, &e.EntityType, &e.EntityId, &changes, &e.IP, &e.RequestId, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(changes), &e.Changes); err != nil {
+			return nil, err
+		}
+		e.CreatedAt = e.CreatedAt.UTC()
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (r *sqlPriceHistoryRepository) Record(ctx context.Context, change *PriceChange) error {
+	var err error
+	change.Id, err = r.db.InsertContext(ctx, "INSERT INTO price_history (product_id,price,previous_price,currency,source,actor,changed_at) VALUES (?,?,?,?,?,?,?)",
+		change.ProductId, change.Price, change.PreviousPrice, change.Currency, change.Source, change.Actor, change.ChangedAt)
+	return err
+}
+
+func (r *sqlPriceHistoryRepository) List(ctx context.Context, filter PriceHistoryFilter) ([]PriceChange, error) {
+	query := "SELECT id,product_id,price,previous_price,currency,source,actor,changed_at FROM price_history WHERE 1 = 1"
+	var args []interface{}
+	if filter.ProductId != 0 {
+		query += " AND product_id = ?"
+		args = append(args, filter.ProductId)
+	}
+	if !filter.From.IsZero() {
+		query += " AND changed_at >= ?"
+		args = append(args, filter.From)
+	}
+	if !filter.To.IsZero() {
+		query += " AND changed_at < ?"
+		args = append(args, filter.To)
+	}
+	query += " ORDER BY changed_at, id"
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var changes []PriceChange
+	for rows.Next() {
+		var change PriceChange
+		var previousPrice sql.NullInt64
+		if err := rows.Scan(&change.Id, &change.ProductId, &change.Price, &previousPrice, &change.Currency, &change.Source, &change.Actor, &change.ChangedAt); err != nil {
+			return nil, err
+		}
+		if previousPrice.Valid {
+			price := int(previousPrice.Int64)
+			change.PreviousPrice = &price
+		}
+		change.ChangedAt = change.ChangedAt.UTC()
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	utc := t.Time.UTC()
+	return &utc
+}
+
+// restore возвращает запись table из корзины удаленных.
+func (db *DB) restore(ctx context.Context, table string, id int64) error {
+	result, err := db.ExecContext(ctx, "UPDATE "+table+" SET deleted_at = NULL, version = version + 1 WHERE id = ? AND deleted_at IS NOT NULL", id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+// purge окончательно удаляет запись table, если ее не успели восстановить.
+func (db *DB) purge(ctx context.Context, table string, id int64) (bool, error) {
+	result, err := db.ExecContext(ctx, "DELETE FROM "+table+" WHERE id = ? AND deleted_at IS NOT NULL", id)
+	if err != nil {
+		return false, err
+	}
+	switch err := requireAffected(result); err {
+	case nil:
+		return true, nil
+	case errNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// requireVersion разбирает результат изменения строки table с условием на
+// версию: если строка не затронута, отличает удаленную запись
+// (errNotFound) от измененной другим запросом (errVersionConflict).
+func (db *DB) requireVersion(ctx context.Context, result sql.Result, table string, id int64) error {
+	err := requireAffected(result)
+	if err != errNotFound {
+		return err
+	}
+	var exists int
+	err = db.QueryRowContext(ctx, "SELECT 1 FROM "+table+" WHERE id = ? AND deleted_at IS NULL", id).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	} else if err != nil {
+		return err
+	}
+	return errVersionConflict
+}
+
+func requireAffected(result sql.Result) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return errNotFound
+	}
+	return nil
+}
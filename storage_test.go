@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// forEachDialect запускает fn на временной базе SQLite и, если задан
+// TEST_POSTGRES_DSN (например, postgres://postgres@localhost/shop_test?sslmode=disable),
+// на PostgreSQL. База PostgreSQL очищается откатом всех миграций до и после
+// теста, поэтому для нее нужна отдельная пустая база.
+func forEachDialect(t *testing.T, fn func(t *testing.T)) {
+	t.Run("sqlite", func(t *testing.T) {
+		useTestDB(t, filepath.Join(t.TempDir(), "shop.db")+"?_foreign_keys=on")
+		fn(t)
+	})
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv("TEST_POSTGRES_DSN")
+		if dsn == "" {
+			t.Skip("TEST_POSTGRES_DSN не задан")
+		}
+		useTestDB(t, dsn)
+		fn(t)
+	})
+}
+
+func useTestDB(t *testing.T, dsn string) {
+	t.Helper()
+	testDB, err := openDB(dsn)
+	if err != nil {
+		t.Fatalf("openDB: %v", err)
+	}
+	if err := testDB.Ping(); err != nil {
+		testDB.Close()
+		t.Fatalf("ping: %v", err)
+	}
+	previous := db
+	db = testDB
+
+	migrations, err := loadMigrations(migrationFiles, migrationsDir(testDB.Dialect))
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+	if _, err := migrateDown(migrations, len(migrations)); err != nil {
+		t.Fatalf("migrateDown: %v", err)
+	}
+	if _, err := migrateUp(migrations); err != nil {
+		t.Fatalf("migrateUp: %v", err)
+	}
+	// Курсы валют кэшируются в памяти, поэтому каждая база начинает с
+	// постоянных курсов FixtureRateProvider.
+	previousRates, previousProvider := exchangeRates, rateProvider
+	exchangeRates, rateProvider = &rateCache{}, NewFixtureRateProvider()
+	if err := refreshExchangeRates(context.Background()); err != nil {
+		t.Fatalf("refreshExchangeRates: %v", err)
+	}
+	t.Cleanup(func() {
+		exchangeRates, rateProvider = previousRates, previousProvider
+		if _, err := migrateDown(migrations, len(migrations)); err != nil {
+			t.Errorf("migrateDown: %v", err)
+		}
+		testDB.Close()
+		db = previous
+	})
+}
+
+func TestParseDatabaseDSN(t *testing.T) {
+	tests := []struct {
+		dsn       string
+		dialect   Dialect
+		driverDSN string
+		wantErr   bool
+	}{
+		{dsn: "shop.db?_foreign_keys=on", dialect: DialectSQLite, driverDSN: "shop.db?_foreign_keys=on"},
+		{dsn: "sqlite:///var/lib/shop.db", dialect: DialectSQLite, driverDSN: "/var/lib/shop.db"},
+		{dsn: "postgres://u:p@localhost/shop", dialect: DialectPostgres, driverDSN: "postgres://u:p@localhost/shop"},
+		{dsn: "postgresql://localhost/shop", dialect: DialectPostgres, driverDSN: "postgresql://localhost/shop"},
+		{dsn: "mysql://localhost/shop", wantErr: true},
+		{dsn: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		dialect, driverDSN, err := parseDatabaseDSN(tt.dsn)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseDatabaseDSN(%q): ожидалась ошибка", tt.dsn)
+			}
+			continue
+		}
+		if err != nil || dialect != tt.dialect || driverDSN != tt.driverDSN {
+			t.Errorf("parseDatabaseDSN(%q) = %q, %q, %v; ожидалось %q, %q", tt.dsn, dialect, driverDSN, err, tt.dialect, tt.driverDSN)
+		}
+	}
+}
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		query   string
+		want    string
+	}{
+		{DialectSQLite, "SELECT * FROM users WHERE id = ?", "SELECT * FROM users WHERE id = ?"},
+		{DialectPostgres, "SELECT * FROM users WHERE id = ?", "SELECT * FROM users WHERE id = $1"},
+		{DialectPostgres, "UPDATE t SET a = ?, b = ? WHERE id IN (?,?)", "UPDATE t SET a = $1, b = $2 WHERE id IN ($3,$4)"},
+		{DialectPostgres, "INSERT INTO t (a,b,c) VALUES (?,'who?','it''s ?',?)", "INSERT INTO t (a,b,c) VALUES ($1,'who?','it''s ?',$2)"},
+		{DialectPostgres, "SELECT 1", "SELECT 1"},
+	}
+	for _, tt := range tests {
+		if got := rebind(tt.dialect, tt.query); got != tt.want {
+			t.Errorf("rebind(%s, %q) = %q, ожидалось %q", tt.dialect, tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestMigrationsMatchAcrossDialects(t *testing.T) {
+	sqlite, err := loadMigrations(migrationFiles, migrationsDir(DialectSQLite))
+	if err != nil {
+		t.Fatal(err)
+	}
+	postgres, err := loadMigrations(migrationFiles, migrationsDir(DialectPostgres))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sqlite) != len(postgres) {
+		t.Fatalf("миграций SQLite %d, PostgreSQL %d", len(sqlite), len(postgres))
+	}
+	for i := range sqlite {
+		if sqlite[i].Version != postgres[i].Version || sqlite[i].Name != postgres[i].Name {
+			t.Errorf("миграции расходятся: %04d_%s и %04d_%s", sqlite[i].Version, sqlite[i].Name, postgres[i].Version, postgres[i].Name)
+		}
+		if sqlite[i].Down == "" || postgres[i].Down == "" {
+			t.Errorf("у миграции %04d_%s нет down-скрипта", sqlite[i].Version, sqlite[i].Name)
+		}
+	}
+}
+
+func TestMigrationsRoundTrip(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		migrations, err := loadMigrations(migrationFiles, migrationsDir(db.Dialect))
+		if err != nil {
+			t.Fatal(err)
+		}
+		done, err := migrateDown(migrations, len(migrations))
+		if err != nil || len(done) != len(migrations) {
+			t.Fatalf("migrateDown: откачено %d из %d, %v", len(done), len(migrations), err)
+		}
+		done, err = migrateUp(migrations)
+		if err != nil || len(done) != len(migrations) {
+			t.Fatalf("migrateUp: применено %d из %d, %v", len(done), len(migrations), err)
+		}
+		if done, err = migrateUp(migrations); err != nil || len(done) != 0 {
+			t.Fatalf("повторный migrateUp: применено %d, %v", len(done), err)
+		}
+	})
+}
+
+// TestLegacySchemaMigration проверяет запуск на базе, созданной до
+// появления миграций: миграции, таблицы которых уже есть, отмечаются
+// примененными, остальные выполняются.
+func TestLegacySchemaMigration(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		migrations, err := loadMigrations(migrationFiles, migrationsDir(db.Dialect))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 1 — схема исходного main.go (только products и users),
+		// len(legacyTables) — последней версии без миграций.
+		for _, legacy := range []int{1, len(legacyTables)} {
+			if _, err := migrateDown(migrations, len(migrations)); err != nil {
+				t.Fatalf("migrateDown: %v", err)
+			}
+			for _, m := range migrations[:legacy] {
+				if _, err := db.Exec(m.Up); err != nil {
+					t.Fatalf("%04d_%s: %v", m.Version, m.Name, err)
+				}
+			}
+			if _, err := db.Exec("INSERT INTO products (name,price,image) VALUES ('Чайник',1500,'')"); err != nil {
+				t.Fatal(err)
+			}
+
+			done, err := migrateUp(migrations)
+			if err != nil || len(done) != len(migrations)-legacy || done[0].Version != legacy+1 {
+				t.Fatalf("схема до %04d: применено %d, %v", legacy, len(done), err)
+			}
+			applied, err := appliedMigrations()
+			if err != nil || len(applied) != len(migrations) {
+				t.Fatalf("отмечено миграций %d, %v", len(applied), err)
+			}
+			var price int
+			if err := db.QueryRow("SELECT price FROM products WHERE name = 'Чайник'").Scan(&price); err != nil || price != 150000 {
+				t.Fatalf("товар после миграции: цена %d, %v", price, err)
+			}
+		}
+	})
+}
+
+// TestCurrencyMigration проверяет перевод сумм из целых рублей в копейки
+// и обратно.
+func TestCurrencyMigration(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		migrations, err := loadMigrations(migrationFiles, migrationsDir(db.Dialect))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Откатываются 0011_currencies и все миграции после нее.
+		steps := 0
+		for _, m := range migrations {
+			if m.Version >= 11 {
+				steps++
+			}
+		}
+		if _, err := migrateDown(migrations, steps); err != nil {
+			t.Fatalf("migrateDown: %v", err)
+		}
+		if _, err := db.Exec("INSERT INTO products (name,price,image,weight) VALUES ('Чайник',1500,'',900)"); err != nil {
+			t.Fatal(err)
+		}
+		readPrice := func() int {
+			t.Helper()
+			var price int
+			if err := db.QueryRow("SELECT price FROM products").Scan(&price); err != nil {
+				t.Fatal(err)
+			}
+			return price
+		}
+
+		if _, err := migrateUp(migrations); err != nil {
+			t.Fatalf("migrateUp: %v", err)
+		}
+		var currency string
+		if err := db.QueryRow("SELECT currency FROM products").Scan(&currency); err != nil || currency != "RUB" || readPrice() != 150000 {
+			t.Fatalf("после миграции цена %d %q, %v", readPrice(), currency, err)
+		}
+		if _, err := migrateDown(migrations, steps); err != nil {
+			t.Fatalf("migrateDown: %v", err)
+		}
+		if price := readPrice(); price != 1500 {
+			t.Fatalf("после отката миграции цена %d", price)
+		}
+		if _, err := migrateUp(migrations); err != nil {
+			t.Fatalf("migrateUp: %v", err)
+		}
+	})
+}
+
+func TestProductRepository(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		ctx := context.Background()
+		repo := NewSQLProductRepository(db)
+
+		first := Product{Name: "Чайник", Price: 1500, Image: "/uploads/images/kettle.png", Weight: 900}
+		second := Product{Name: "Кружка", Price: 300, Image: "/uploads/images/mug.png", Weight: 250}
+		if err := repo.Create(ctx, &first); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if err := repo.Create(ctx, &second); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if first.Id == 0 || second.Id <= first.Id {
+			t.Fatalf("некорректные ID: %d, %d", first.Id, second.Id)
+		}
+
+		if first.Version != 1 {
+			t.Fatalf("версия нового товара %d", first.Version)
+		}
+		first.Price = 1400
+		if err := repo.Update(ctx, first); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		first.Version++
+		got, err := repo.Get(ctx, first.Id)
+		if err != nil || got != first {
+			t.Fatalf("Get = %+v, %v; ожидалось %+v", got, err, first)
+		}
+		stale := first
+		stale.Version--
+		stale.Price = 1300
+		if err := repo.Update(ctx, stale); !errors.Is(err, errVersionConflict) {
+			t.Fatalf("Update устаревшей версии: %v", err)
+		}
+		if err := repo.Delete(ctx, first.Id, stale.Version); !errors.Is(err, errVersionConflict) {
+			t.Fatalf("Delete устаревшей версии: %v", err)
+		}
+		if got, _ := repo.Get(ctx, first.Id); got != first {
+			t.Fatalf("товар изменен по устаревшей версии: %+v", got)
+		}
+
+		products, err := repo.List(ctx)
+		if err != nil || len(products) != 2 {
+			t.Fatalf("List = %d товаров, %v", len(products), err)
+		}
+
+		if err := repo.Delete(ctx, second.Id, second.Version); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := repo.Get(ctx, second.Id); !errors.Is(err, errNotFound) {
+			t.Fatalf("Get удаленного товара: %v", err)
+		}
+		if err := repo.Update(ctx, second); !errors.Is(err, errNotFound) {
+			t.Fatalf("Update удаленного товара: %v", err)
+		}
+		if err := repo.Delete(ctx, second.Id, second.Version); !errors.Is(err, errNotFound) {
+			t.Fatalf("Delete удаленного товара: %v", err)
+		}
+	})
+}
+
+func TestUserRepository(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		ctx := context.Background()
+		repo := NewSQLUserRepository(db)
+
+		user := User{Name: "Иван", Latitude: 55.75, Longitude: 37.62, Cart: []int64{3, 1, 3}}
+		if err := repo.Create(ctx, &user); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		got, err := repo.Get(ctx, user.Id)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if got.Name != user.Name || got.Latitude != user.Latitude || got.Longitude != user.Longitude || formatCart(got.Cart) != "3,1,3" {
+			t.Fatalf("Get = %+v, ожидалось %+v", got, user)
+		}
+
+		user.Cart = nil
+		if err := repo.Update(ctx, user); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if got, err = repo.Get(ctx, user.Id); err != nil || got.Cart != nil || got.Version != 2 {
+			t.Fatalf("после очистки корзины = %+v, %v", got, err)
+		}
+		if err := repo.Update(ctx, user); !errors.Is(err, errVersionConflict) {
+			t.Fatalf("Update устаревшей версии: %v", err)
+		}
+		if err := repo.Delete(ctx, user.Id, got.Version); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := repo.Get(ctx, user.Id); !errors.Is(err, errNotFound) {
+			t.Fatalf("Get удаленного пользователя: %v", err)
+		}
+	})
+}
+
+func TestInsertInTransaction(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Insert("INSERT INTO warehouses (name,latitude,longitude) VALUES (?,?,?)", "Отмененный", 1.0, 2.0); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+		tx.Rollback()
+
+		var id int64
+		err = inTx(context.Background(), func(tx *Tx) error {
+			id, err = tx.Insert("INSERT INTO warehouses (name,latitude,longitude) VALUES (?,?,?)", "Основной", 55.7, 37.6)
+			return err
+		})
+		if err != nil || id == 0 {
+			t.Fatalf("Insert в транзакции: id=%d, %v", id, err)
+		}
+		warehouses, err := loadWarehouses(context.Background())
+		if err != nil || len(warehouses) != 1 || warehouses[id].Name != "Основной" {
+			t.Fatalf("loadWarehouses = %+v, %v", warehouses, err)
+		}
+	})
+}
+
+func TestPaymentEventIsRecordedOnce(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		insert := func() int64 {
+			result, err := db.Exec("INSERT INTO payment_events (provider,event_id,type,received_at) VALUES (?,?,?,?) ON CONFLICT DO NOTHING",
+				"fake", "evt_1", PaymentEventSucceeded, time.Now().UTC())
+			if err != nil {
+				t.Fatalf("Exec: %v", err)
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+		if n := insert(); n != 1 {
+			t.Fatalf("первая вставка затронула %d строк", n)
+		}
+		if n := insert(); n != 0 {
+			t.Fatalf("повторная вставка затронула %d строк", n)
+		}
+	})
+}
+
+func TestDefaultPaymentMethod(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	forEachDialect(t, func(t *testing.T) {
+		users := NewSQLUserRepository(db)
+		user := User{Name: "Мария", Latitude: 59.93, Longitude: 30.31}
+		if err := users.Create(context.Background(), &user); err != nil {
+			t.Fatal(err)
+		}
+		router := newRouter(NewHandlers(NewSQLProductRepository(db), users, NewSQLAuditRepository(db), NewSQLPriceHistoryRepository(db)))
+		do := func(method, path, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+		base := "/user/" + strconv.FormatInt(user.Id, 10)
+
+		if w := do(http.MethodPost, base+"/payment-method", `{"type":"card","card_token":"tok_4242424242"}`); w.Code != http.StatusCreated {
+			t.Fatalf("добавление карты: %d %s", w.Code, w.Body)
+		}
+		if w := do(http.MethodPost, base+"/payment-method", `{"type":"cash"}`); w.Code != http.StatusCreated {
+			t.Fatalf("добавление наличных: %d %s", w.Code, w.Body)
+		}
+		defaultType := func() string {
+			pm, err := loadDefaultPaymentMethod(context.Background(), user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return pm.Type
+		}
+		if got := defaultType(); got != PaymentTypeCard {
+			t.Fatalf("способ по умолчанию %s, ожидалась карта", got)
+		}
+
+		var methods []PaymentMethod
+		w := do(http.MethodGet, base+"/payment-methods", "")
+		if err := json.Unmarshal(w.Body.Bytes(), &methods); err != nil || len(methods) != 2 {
+			t.Fatalf("список способов оплаты: %s", w.Body)
+		}
+		cash := methods[1].Id
+		if w := do(http.MethodPost, base+"/payment-method/"+strconv.FormatInt(cash, 10)+"/default", ""); w.Code != http.StatusOK {
+			t.Fatalf("смена способа по умолчанию: %d %s", w.Code, w.Body)
+		}
+		if got := defaultType(); got != PaymentTypeCash {
+			t.Fatalf("способ по умолчанию %s, ожидались наличные", got)
+		}
+		if w := do(http.MethodDelete, base+"/payment-method/"+strconv.FormatInt(cash, 10), ""); w.Code != http.StatusOK {
+			t.Fatalf("удаление способа оплаты: %d %s", w.Code, w.Body)
+		}
+		if got := defaultType(); got != PaymentTypeCard {
+			t.Fatalf("после удаления способ по умолчанию %s, ожидалась карта", got)
+		}
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	stripeAPIBase            = "https://api.stripe.com/v1"
+	stripeSignatureHeader    = "Stripe-Signature"
+	stripeSignatureTolerance = 5 * time.Minute
+)
+
+// StripeProvider работает с REST API Stripe (и совместимыми с ним шлюзами).
+// Платежи создаются с ручным списанием: после авторизации приходит
+// вебхук, и средства списываются через Capture.
+// Суммы, как и в магазине, передаются в минимальных единицах валюты.
+type StripeProvider struct {
+	apiKey        string
+	webhookSecret string
+	baseURL       string
+	client        *http.Client
+}
+
+type stripeIntent struct {
+	Id           string `json:"id"`
+	ClientSecret string `json:"client_secret"`
+	Status       string `json:"status"`
+	Amount       int    `json:"amount"`
+	Currency     string `json:"currency"`
+}
+
+type stripeEvent struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object struct {
+			Id             string `json:"id"`
+			Amount         int    `json:"amount"`
+			AmountRefunded int    `json:"amount_refunded"`
+			PaymentIntent  string `json:"payment_intent"`
+		} `json:"object"`
+	} `json:"data"`
+}
+
+type stripeError struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func NewStripeProvider(apiKey, webhookSecret string) *StripeProvider {
+	return &StripeProvider{
+		apiKey:        apiKey,
+		webhookSecret: webhookSecret,
+		baseURL:       stripeAPIBase,
+		client:        &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+func (s *StripeProvider) Name() string {
+	return "stripe"
+}
+
+func (s *StripeProvider) CreateIntent(ctx context.Context, orderId int64, amount int, currency string) (PaymentIntent, error) {
+	form := url.Values{}
+	form.Set("amount", strconv.Itoa(amount))
+	form.Set("currency", currency)
+	form.Set("capture_method", "manual")
+	form.Set("metadata[order_id]", strconv.FormatInt(orderId, 10))
+
+	var intent stripeIntent
+	err := s.post(ctx, "/payment_intents", form, fmt.Sprintf("order-%d-%d", orderId, time.Now().UnixNano()), &intent)
+	if err != nil {
+		return PaymentIntent{}, err
+	}
+	return intent.toPaymentIntent(), nil
+}
+
+func (s *StripeProvider) Capture(ctx context.Context, intentId string) (PaymentIntent, error) {
+	var intent stripeIntent
+	err := s.post(ctx, "/payment_intents/"+url.PathEscape(intentId)+"/capture", url.Values{}, "capture-"+intentId, &intent)
+	if err != nil {
+		return PaymentIntent{}, err
+	}
+	return intent.toPaymentIntent(), nil
+}
+
+func (s *StripeProvider) Refund(ctx context.Context, intentId string, amount int, idempotencyKey string) (PaymentRefund, error) {
+	form := url.Values{}
+	form.Set("payment_intent", intentId)
+	form.Set("amount", strconv.Itoa(amount))
+
+	var refund struct {
+		Id     string `json:"id"`
+		Status string `json:"status"`
+		Amount int    `json:"amount"`
+	}
+	err := s.post(ctx, "/refunds", form, idempotencyKey, &refund)
+	if err != nil {
+		return PaymentRefund{}, err
+	}
+	return PaymentRefund{Id: refund.Id, Status: refund.Status, Amount: refund.Amount}, nil
+}
+
+// VerifyWebhook проверяет заголовок Stripe-Signature вида t=...,v1=... —
+// HMAC-SHA256 от "t.тело" с секретом вебхука.
+func (s *StripeProvider) VerifyWebhook(payload []byte, header http.Header) (PaymentEvent, error) {
+	var timestamp string
+	var signatures [][]byte
+	for _, part := range strings.Split(header.Get(stripeSignatureHeader), ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			if sig, err := hex.DecodeString(value); err == nil {
+				signatures = append(signatures, sig)
+			}
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return PaymentEvent{}, errInvalidWebhookSignature
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > stripeSignatureTolerance || age < -stripeSignatureTolerance {
+		return PaymentEvent{}, errInvalidWebhookSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.webhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+	valid := false
+	for _, sig := range signatures {
+		if hmac.Equal(sig, expected) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return PaymentEvent{}, errInvalidWebhookSignature
+	}
+
+	var event stripeEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return PaymentEvent{}, err
+	}
+	result := PaymentEvent{Id: event.Id, IntentId: event.Data.Object.Id, Amount: event.Data.Object.Amount}
+	switch event.Type {
+	case "payment_intent.amount_capturable_updated":
+		result.Type = PaymentEventAuthorized
+	case "payment_intent.succeeded":
+		result.Type = PaymentEventSucceeded
+	case "payment_intent.payment_failed", "payment_intent.canceled":
+		result.Type = PaymentEventFailed
+	case "charge.refunded":
+		result.Type = PaymentEventRefunded
+		result.IntentId = event.Data.Object.PaymentIntent
+		result.Amount = event.Data.Object.AmountRefunded
+	}
+	return result, nil
+}
+
+func (s *StripeProvider) post(ctx context.Context, path string, form url.Values, idempotencyKey string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.baseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.apiKey, "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		var apiErr stripeError
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error.Message != "" {
+			return errors.New(apiErr.Error.Message)
+		}
+		return fmt.Errorf("stripe вернул статус %d", resp.StatusCode)
+	}
+	return json.Unmarshal(body, out)
+}
+
+func (i stripeIntent) toPaymentIntent() PaymentIntent {
+	return PaymentIntent{
+		Id:           i.Id,
+		ClientSecret: i.ClientSecret,
+		Status:       i.Status,
+		Amount:       i.Amount,
+		Currency:     i.Currency,
+	}
+}
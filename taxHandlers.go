@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func getTaxZones(c *gin.Context) {
+	zones, err := loadTaxZones(c.Request.Context())
+	if err != nil {
+		requestLog(c).Error("Ошибка получения налоговых зон", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if zones == nil {
+		zones = []TaxZone{}
+	}
+	c.JSON(http.StatusOK, zones)
+}
+
+func (h *Handlers) addTaxZone(c *gin.Context) {
+	var zone TaxZone
+	if err := c.ShouldBindJSON(&zone); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+	if zone.RadiusKm <= 0 && len(zone.Polygon) < 3 {
+		respondError(c, CodeInvalidZoneShape)
+		return
+	}
+	zone.Country = strings.ToUpper(zone.Country)
+	zone.Region = strings.ToUpper(zone.Region)
+
+	polygon, err := encodePolygon(zone.Polygon)
+	if err != nil {
+		respondError(c, CodeInvalidZonePolygon)
+		return
+	}
+
+	id, err := db.InsertContext(c.Request.Context(), "INSERT INTO tax_zones (name,country,region,latitude,longitude,radius_km,polygon) VALUES (?,?,?,?,?,?,?)",
+		zone.Name, zone.Country, zone.Region, zone.Latitude, zone.Longitude, zone.RadiusKm, polygon)
+	if err != nil {
+		requestLog(c).Error("Ошибка при добавлении налоговой зоны в базу данных", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	zone.Id = id
+	h.audit(c, AuditActionCreate, AuditEntityTaxZone, id, nil, zone)
+	c.JSON(http.StatusCreated, gin.H{"message": "Налоговая зона успешно добавлена", "zone": zone})
+}
+
+func (h *Handlers) deleteTaxZone(c *gin.Context) {
+	h.deleteById(c, AuditEntityTaxZone, "tax_zones", CodeTaxZoneNotFound, "Налоговая зона успешно удалена!")
+}
+
+func getTaxRates(c *gin.Context) {
+	rates, err := loadTaxRates(c.Request.Context())
+	if err != nil {
+		requestLog(c).Error("Ошибка получения ставок налога", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if rates == nil {
+		rates = []TaxRate{}
+	}
+	c.JSON(http.StatusOK, rates)
+}
+
+func (h *Handlers) addTaxRate(c *gin.Context) {
+	var rate TaxRate
+	if err := c.ShouldBindJSON(&rate); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+	percent, ok := new(big.Rat).SetString(rate.Rate)
+	switch {
+	case !ok:
+		respondFieldErrors(c, FieldError{Field: "rate", Code: "invalid"})
+		return
+	case percent.Sign() < 0:
+		respondFieldErrors(c, FieldError{Field: "rate", Code: "min", Param: "0"})
+		return
+	case percent.Cmp(big.NewRat(100, 1)) > 0:
+		respondFieldErrors(c, FieldError{Field: "rate", Code: "max", Param: "100"})
+		return
+	}
+	rate.Rate = formatRate(percent)
+
+	var exists int
+	err := db.QueryRowContext(c.Request.Context(), "SELECT COUNT(*) FROM tax_zones WHERE id = ?", rate.ZoneId).Scan(&exists)
+	if err != nil {
+		requestLog(c).Error("Ошибка проверки налоговой зоны", "zone_id", rate.ZoneId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if exists == 0 {
+		respondFieldErrors(c, FieldError{Field: "zone_id", Code: "not_found"})
+		return
+	}
+	err = db.QueryRowContext(c.Request.Context(), "SELECT COUNT(*) FROM tax_rates WHERE zone_id = ? AND tax_class = ?", rate.ZoneId, rate.TaxClass).Scan(&exists)
+	if err != nil {
+		requestLog(c).Error("Ошибка проверки ставки налога", "zone_id", rate.ZoneId, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if exists > 0 {
+		respondFieldErrors(c, FieldError{Field: "tax_class", Code: "unique"})
+		return
+	}
+
+	id, err := db.InsertContext(c.Request.Context(), "INSERT INTO tax_rates (zone_id,tax_class,name,rate) VALUES (?,?,?,?)", rate.ZoneId, rate.TaxClass, rate.Name, rate.Rate)
+	if err != nil {
+		requestLog(c).Error("Ошибка при добавлении ставки налога в базу данных", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	rate.Id = id
+	h.audit(c, AuditActionCreate, AuditEntityTaxRate, id, nil, rate)
+	c.JSON(http.StatusCreated, gin.H{"message": "Ставка налога успешно добавлена", "rate": rate})
+}
+
+func (h *Handlers) deleteTaxRate(c *gin.Context) {
+	h.deleteById(c, AuditEntityTaxRate, "tax_rates", CodeTaxRateNotFound, "Ставка налога успешно удалена!")
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// defaultTaxClass — налоговый класс товаров, категории которых нет в
+// TaxConfig.Categories.
+const defaultTaxClass = "standard"
+
+// shippingTaxKey — ключ доставки среди ID товаров при распределении налога.
+const shippingTaxKey int64 = 0
+
+// taxConfig — режим цен и налоговые классы (см. TaxConfig).
+var taxConfig = defaultConfig().Tax
+
+// TaxZone — область, в которой действуют ставки налога: страна и, при
+// необходимости, регион. Граница задается, как у зоны доставки, радиусом в
+// километрах вокруг точки Latitude, Longitude или многоугольником.
+type TaxZone struct {
+	Id        int64        `json:"id"`
+	Name      string       `json:"name" binding:"required"`
+	Country   string       `json:"country" binding:"required,len=2"`
+	Region    string       `json:"region"`
+	Latitude  float64      `json:"latitude"`
+	Longitude float64      `json:"longitude"`
+	RadiusKm  float64      `json:"radius_km"`
+	Polygon   [][2]float64 `json:"polygon"`
+}
+
+// TaxRate — ставка налога зоны для налогового класса. Rate — процент
+// десятичной строкой, например "20" или "8.875".
+type TaxRate struct {
+	Id       int64  `json:"id"`
+	ZoneId   int64  `json:"zone_id" binding:"required"`
+	TaxClass string `json:"tax_class" binding:"required"`
+	Name     string `json:"name" binding:"required"`
+	Rate     string `json:"rate" binding:"required"`
+}
+
+// TaxLine — налог по одной ставке. Taxable — облагаемая сумма после
+// скидок: с налогом, если цены его включают, иначе без него.
+type TaxLine struct {
+	Country  string `json:"country"`
+	Region   string `json:"region"`
+	Name     string `json:"name"`
+	TaxClass string `json:"tax_class"`
+	Rate     string `json:"rate"`
+	Taxable  int    `json:"taxable"`
+	Amount   int    `json:"amount"`
+}
+
+func (z TaxZone) contains(lat, lon float64) bool {
+	if len(z.Polygon) >= 3 {
+		return pointInPolygon(lat, lon, z.Polygon)
+	}
+	return z.RadiusKm > 0 && haversineKm(z.Latitude, z.Longitude, lat, lon) <= z.RadiusKm
+}
+
+// productTaxClass возвращает налоговый класс товара по его категории.
+func productTaxClass(p Product) string {
+	if class, ok := taxConfig.Categories[p.Category]; ok {
+		return class
+	}
+	return defaultTaxClass
+}
+
+// parseTaxRate разбирает ставку налога в процентах: от 0 до 100.
+func parseTaxRate(value string) (*big.Rat, error) {
+	rate, ok := new(big.Rat).SetString(value)
+	if !ok || rate.Sign() < 0 || rate.Cmp(big.NewRat(100, 1)) > 0 {
+		return nil, fmt.Errorf("некорректная ставка налога: %q", value)
+	}
+	return rate, nil
+}
+
+// taxAmount считает налог со суммы amount по ставке rate процентов. Если
+// цены включают налог, он выделяется из суммы: amount * rate / (100 +
+// rate), иначе начисляется сверху: amount * rate / 100. Налог округляется
+// до минимальной единицы валюты, половина — от нуля.
+func taxAmount(amount int, rate *big.Rat, inclusive bool) int {
+	value := new(big.Rat).SetInt64(int64(amount))
+	value.Mul(value, rate)
+	base := big.NewRat(100, 1)
+	if inclusive {
+		base.Add(base, rate)
+	}
+	return roundRat(value.Quo(value, base))
+}
+
+// findTaxZone выбирает налоговую зону точки lat, lon: зоны региона
+// важнее зон всей страны, среди равных — добавленная раньше. Если точка не
+// входит ни в одну зону, возвращает nil.
+func findTaxZone(zones []TaxZone, lat, lon float64) *TaxZone {
+	var found *TaxZone
+	for i := range zones {
+		zone := &zones[i]
+		if !zone.contains(lat, lon) {
+			continue
+		}
+		if found == nil || (found.Region == "" && zone.Region != "") ||
+			((found.Region == "") == (zone.Region == "") && zone.Id < found.Id) {
+			found = zone
+		}
+	}
+	return found
+}
+
+// cartTaxes считает налоги корзины в зоне zone. items — позиции со
+// скидками, shipping — стоимость доставки после скидок. Налог считается по
+// каждой ставке с общей облагаемой суммы и затем делится между товарами и
+// доставкой пропорционально их сумме, так что налоги позиций в сумме
+// равны налогу строки. Кроме строк налога возвращает налог по каждому
+// товару; налог доставки — под ключом shippingTaxKey.
+func cartTaxes(zone *TaxZone, rates []TaxRate, items []OrderItem, products map[int64]Product, shipping int, inclusive bool) ([]TaxLine, map[int64]int, error) {
+	lines := []TaxLine{}
+	byProduct := make(map[int64]int)
+	if zone == nil {
+		return lines, byProduct, nil
+	}
+	taxable := make(map[string]map[int64]int)
+	add := func(class string, key int64, amount int) {
+		if taxable[class] == nil {
+			taxable[class] = make(map[int64]int)
+		}
+		taxable[class][key] += amount
+	}
+	for _, item := range items {
+		add(productTaxClass(products[item.ProductId]), item.ProductId, item.Price*item.Quantity-item.Discount)
+	}
+	if taxConfig.ShippingClass != "" && shipping > 0 {
+		add(taxConfig.ShippingClass, shippingTaxKey, shipping)
+	}
+
+	zoneRates := make([]TaxRate, 0, len(rates))
+	for _, rate := range rates {
+		if rate.ZoneId == zone.Id {
+			zoneRates = append(zoneRates, rate)
+		}
+	}
+	sort.Slice(zoneRates, func(i, j int) bool { return zoneRates[i].TaxClass < zoneRates[j].TaxClass })
+	for _, rate := range zoneRates {
+		amounts, ok := taxable[rate.TaxClass]
+		if !ok {
+			continue
+		}
+		percent, err := parseTaxRate(rate.Rate)
+		if err != nil {
+			return nil, nil, err
+		}
+		line := TaxLine{Country: zone.Country, Region: zone.Region, Name: rate.Name, TaxClass: rate.TaxClass, Rate: rate.Rate}
+		for _, amount := range amounts {
+			line.Taxable += amount
+		}
+		line.Amount = taxAmount(line.Taxable, percent, inclusive)
+		for key, amount := range allocate(line.Amount, amounts) {
+			byProduct[key] += amount
+		}
+		lines = append(lines, line)
+	}
+	return lines, byProduct, nil
+}
+
+const taxZoneColumns = "id,name,country,region,latitude,longitude,radius_km,polygon"
+
+func loadTaxZones(ctx context.Context) ([]TaxZone, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+taxZoneColumns+" FROM tax_zones ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var zones []TaxZone
+	for rows.Next() {
+		var z TaxZone
+		var polygon string
+		if err := rows.Scan(&z.Id, &z.Name, &z.Country, &z.Region, &z.Latitude, &z.Longitude, &z.RadiusKm, &polygon); err != nil {
+			return nil, err
+		}
+		if z.Polygon, err = decodePolygon(polygon); err != nil {
+			return nil, err
+		}
+		zones = append(zones, z)
+	}
+	return zones, rows.Err()
+}
+
+func loadTaxRates(ctx context.Context) ([]TaxRate, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id,zone_id,tax_class,name,rate FROM tax_rates ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rates []TaxRate
+	for rows.Next() {
+		var r TaxRate
+		if err := rows.Scan(&r.Id, &r.ZoneId, &r.TaxClass, &r.Name, &r.Rate); err != nil {
+			return nil, err
+		}
+		rates = append(rates, r)
+	}
+	return rates, rows.Err()
+}
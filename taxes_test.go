@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+)
+
+func TestTaxAmount(t *testing.T) {
+	tests := []struct {
+		amount    int
+		rate      string
+		inclusive bool
+		want      int
+	}{
+		{1000, "20", false, 200},
+		// 1000 * 20 / 120 = 166,67.
+		{1000, "20", true, 167},
+		{1990, "20", true, 332},
+		{110, "10", true, 10},
+		// Половина минимальной единицы округляется от нуля.
+		{25, "10", false, 3},
+		{-25, "10", false, -3},
+		{15, "10", false, 2},
+		{14, "10", false, 1},
+		{999, "8.875", false, 89},
+		{999, "0", false, 0},
+	}
+	for _, tt := range tests {
+		rate, _ := new(big.Rat).SetString(tt.rate)
+		if got := taxAmount(tt.amount, rate, tt.inclusive); got != tt.want {
+			t.Errorf("taxAmount(%d, %s, %v) = %d; ожидалось %d", tt.amount, tt.rate, tt.inclusive, got, tt.want)
+		}
+	}
+}
+
+func TestCartTaxes(t *testing.T) {
+	saved := taxConfig
+	t.Cleanup(func() { taxConfig = saved })
+	taxConfig = TaxConfig{ShippingClass: defaultTaxClass, Categories: map[string]string{"books": "reduced"}}
+
+	zone := &TaxZone{Id: 1, Country: "RU"}
+	rates := []TaxRate{
+		{ZoneId: 1, TaxClass: defaultTaxClass, Name: "НДС", Rate: "20"},
+		{ZoneId: 1, TaxClass: "reduced", Name: "НДС", Rate: "10"},
+		{ZoneId: 2, TaxClass: defaultTaxClass, Name: "Другая зона", Rate: "5"},
+	}
+	products := map[int64]Product{1: {Id: 1}, 2: {Id: 2, Category: "books"}}
+	items := []OrderItem{
+		{ProductId: 1, Price: 333, Quantity: 3},
+		{ProductId: 2, Price: 500, Quantity: 1, Discount: 50},
+	}
+
+	// Налог считается со всей суммы по ставке: 20% от 999 + 300 —
+	// 259,8, а не сумма налогов каждой единицы. Затем он делится между
+	// товаром и доставкой без потери копеек.
+	lines, byProduct, err := cartTaxes(zone, rates, items, products, 300, false)
+	if err != nil {
+		t.Fatalf("cartTaxes: %v", err)
+	}
+	if len(lines) != 2 || lines[0].TaxClass != "reduced" || lines[0].Taxable != 450 || lines[0].Amount != 45 ||
+		lines[1].Taxable != 1299 || lines[1].Amount != 260 {
+		t.Fatalf("строки налога %+v", lines)
+	}
+	if want := map[int64]int{shippingTaxKey: 60, 1: 200, 2: 45}; fmt.Sprint(byProduct) != fmt.Sprint(want) {
+		t.Fatalf("налог по товарам %v; ожидалось %v", byProduct, want)
+	}
+
+	if lines, _, _ := cartTaxes(zone, rates, items, products, 300, true); lines[0].Amount != 41 || lines[1].Amount != 217 {
+		t.Fatalf("строки налога с ценами, включающими налог, %+v", lines)
+	}
+	taxConfig.ShippingClass = ""
+	if lines, _, _ := cartTaxes(zone, rates, items, products, 300, false); lines[1].Taxable != 999 || lines[1].Amount != 200 {
+		t.Fatalf("строки налога без налога на доставку %+v", lines)
+	}
+	if lines, _, _ := cartTaxes(nil, rates, items, products, 300, false); len(lines) != 0 {
+		t.Fatalf("налог вне налоговых зон %+v", lines)
+	}
+}
+
+func TestFindTaxZone(t *testing.T) {
+	zones := []TaxZone{
+		{Id: 1, Country: "RU", Latitude: 55.75, Longitude: 37.62, RadiusKm: 3000},
+		{Id: 2, Country: "RU", Region: "MOW", Polygon: [][2]float64{{55.5, 37.3}, {55.5, 37.9}, {56, 37.9}, {56, 37.3}}},
+		{Id: 3, Country: "RU", Latitude: 55.75, Longitude: 37.62, RadiusKm: 5000},
+	}
+	for _, tt := range []struct {
+		lat, lon float64
+		want     int64
+	}{
+		{55.76, 37.64, 2},
+		{59.94, 30.31, 1},
+		{43.11, 131.88, 0},
+	} {
+		got := findTaxZone(zones, tt.lat, tt.lon)
+		if (got == nil && tt.want != 0) || (got != nil && got.Id != tt.want) {
+			t.Errorf("зона точки %v, %v: %+v; ожидалась %d", tt.lat, tt.lon, got, tt.want)
+		}
+	}
+}
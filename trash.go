@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultTrashRetentionDays = 30
+	defaultTrashPurgeInterval = time.Hour
+)
+
+// trashRetentionDays — сколько дней удаленные товары и пользователи можно
+// восстановить (см. TrashConfig).
+var trashRetentionDays = defaultTrashRetentionDays
+
+// getTrash возвращает удаленные товары и пользователей, которые еще не
+// удалены окончательно, вместе со сроком хранения.
+func (h *Handlers) getTrash(c *gin.Context) {
+	products, err := h.products.ListDeleted(c.Request.Context())
+	if err != nil {
+		requestLog(c).Error("Ошибка получения удаленных продуктов", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	users, err := h.users.ListDeleted(c.Request.Context())
+	if err != nil {
+		requestLog(c).Error("Ошибка получения удаленных пользователей", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if products == nil {
+		products = []Product{}
+	}
+	if users == nil {
+		users = []User{}
+	}
+	c.JSON(http.StatusOK, gin.H{"products": products, "users": users, "retention_days": trashRetentionDays})
+}
+
+// runTrashPurger сразу и затем раз в interval окончательно удаляет записи,
+// пролежавшие в корзине дольше retentionDays, пока не будет отменен ctx.
+func runTrashPurger(ctx context.Context, h *Handlers, retentionDays int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		deletedBefore := time.Now().UTC().AddDate(0, 0, -retentionDays)
+		if err := purgeTrash(ctx, h, deletedBefore); err != nil {
+			slog.Error("Ошибка очистки корзины удаленных", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeTrash окончательно удаляет товары и пользователей, удаленные раньше
+// deletedBefore, вместе с загруженными изображениями товаров.
+func purgeTrash(ctx context.Context, h *Handlers, deletedBefore time.Time) error {
+	products, err := h.products.Purge(ctx, deletedBefore)
+	for _, p := range products {
+		removeUploadedImage(ctx, p.Image)
+		h.recordAudit(ctx, AuditEntry{Actor: systemActor, Action: AuditActionPurge, EntityType: AuditEntityProduct, EntityId: p.Id}, p, nil)
+	}
+	if err != nil {
+		return err
+	}
+	users, err := h.users.Purge(ctx, deletedBefore)
+	for _, u := range users {
+		h.recordAudit(ctx, AuditEntry{Actor: systemActor, Action: AuditActionPurge, EntityType: AuditEntityUser, EntityId: u.Id}, u, nil)
+	}
+	if err != nil {
+		return err
+	}
+	if len(products) > 0 || len(users) > 0 {
+		slog.Info("Корзина удаленных очищена", "products", len(products), "users", len(users))
+	}
+	return nil
+}
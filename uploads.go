@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// uploadsURLPrefix — префикс URL загруженных изображений. Сами файлы лежат
+// в uploadsConfig.Dir.
+const uploadsURLPrefix = "/uploads/images/"
+
+var (
+	errImageTooLarge    = errors.New("файл изображения слишком большой")
+	errInvalidImageData = errors.New("некорректные данные изображения")
+)
+
+var uploadsConfig = defaultConfig().Uploads
+
+// saveUploadedImage сохраняет загруженный файл в директорию загрузок под
+// уникальным именем и возвращает URL, по которому он будет доступен. Как и
+// в saveImageData, тип определяется по содержимому, а не по имени файла:
+// расширение заменяется на расширение найденного типа.
+func saveUploadedImage(c *gin.Context, file *multipart.FileHeader) (string, error) {
+	ext, err := detectImageExtension(file)
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimSuffix(filepath.Base(file.Filename), filepath.Ext(file.Filename)) + ext
+	return storeImage(c.Request.Context(), name, file.Size, func(path string) error {
+		return c.SaveUploadedFile(file, path)
+	})
+}
+
+// detectImageExtension читает начало загруженного файла и возвращает
+// расширение по imageExtensions или errInvalidImageData.
+func detectImageExtension(file *multipart.FileHeader) (string, error) {
+	f, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	ext, ok := imageExtensions[http.DetectContentType(head[:n])]
+	if !ok || n == 0 {
+		return "", errInvalidImageData
+	}
+	return ext, nil
+}
+
+// saveImageData сохраняет изображение, переданное в JSON в base64 (можно в
+// виде data URI). Расширение файла определяется по содержимому, принимаются
+// только PNG, JPEG, GIF и WebP.
+func saveImageData(ctx context.Context, encoded string) (string, error) {
+	if rest, ok := strings.CutPrefix(encoded, "data:"); ok {
+		_, encoded, _ = strings.Cut(rest, ";base64,")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(data) == 0 {
+		return "", errInvalidImageData
+	}
+	ext, ok := imageExtensions[http.DetectContentType(data)]
+	if !ok {
+		return "", errInvalidImageData
+	}
+	return storeImage(ctx, "image"+ext, int64(len(data)), func(path string) error {
+		return os.WriteFile(path, data, 0644)
+	})
+}
+
+var imageExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// storeImage проверяет размер, выбирает уникальное имя для name и
+// записывает файл функцией write.
+func storeImage(ctx context.Context, name string, size int64, write func(path string) error) (string, error) {
+	if size > uploadsConfig.MaxFileSize {
+		return "", errImageTooLarge
+	}
+	filename := fmt.Sprintf("%d-%s", time.Now().UnixNano(), filepath.Base(name))
+
+	uploadDir := uploadsConfig.Dir
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		return "", fmt.Errorf("ошибка создания директории для загрузки '%s': %w", uploadDir, err)
+	}
+
+	uploadPath := filepath.Join(uploadDir, filename)
+	_, span := startFileSpan(ctx, "save", uploadPath)
+	span.SetAttributes(attribute.Int64("file.size", size))
+	err := write(uploadPath)
+	endSpan(span, err)
+	if err != nil {
+		return "", fmt.Errorf("ошибка сохранения файла '%s': %w", uploadPath, err)
+	}
+	imageUploadSize.Observe(float64(size))
+
+	return uploadsURLPrefix + filename, nil
+}
+
+// isExternalImage сообщает, что изображение задано ссылкой на сторонний
+// ресурс, а не загружено к нам.
+func isExternalImage(imageUrl string) bool {
+	return strings.HasPrefix(imageUrl, "http://") || strings.HasPrefix(imageUrl, "https://")
+}
+
+// removeUploadedImage удаляет файл изображения с диска. Внешние ссылки и
+// файлы вне директории загрузок не трогаются, ошибки только логируются.
+func removeUploadedImage(ctx context.Context, imageUrl string) {
+	if imageUrl == "" || imageUrl == "/" || isExternalImage(imageUrl) {
+		return
+	}
+	filename, ok := strings.CutPrefix(imageUrl, uploadsURLPrefix)
+	if !ok || filename == "" || filename != filepath.Base(filename) {
+		loggerFromContext(ctx).Warn("Попытка удалить файл вне директории загрузок", "image", imageUrl)
+		return
+	}
+	filePathOnDisk := filepath.Join(uploadsConfig.Dir, filename)
+	_, span := startFileSpan(ctx, "remove", filePathOnDisk)
+	err := os.Remove(filePathOnDisk)
+	endSpan(span, err)
+	if err != nil {
+		loggerFromContext(ctx).Error("Ошибка при удалении файла", "file", filePathOnDisk, "error", err)
+		return
+	}
+	loggerFromContext(ctx).Info("Файл успешно удален с диска", "file", filePathOnDisk)
+}
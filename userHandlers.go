@@ -1,239 +1,218 @@
 package main
 
 import (
-	"database/sql"
-	"fmt"
-	"log"
 	"net/http"
 	"strconv"
-	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
-func getUsers(c *gin.Context) {
-	rows, err := db.Query("SELECT id,name,latitude,longitude,is_card,cart FROM users")
+// UserInput — пользователь в теле запроса. Координаты — указатели, чтобы
+// отличать нулевую широту или долготу от отсутствующей.
+type UserInput struct {
+	Name      string   `json:"name" binding:"required"`
+	Latitude  *float64 `json:"latitude" binding:"required,min=-90,max=90"`
+	Longitude *float64 `json:"longitude" binding:"required,min=-180,max=180"`
+	Cart      []int64  `json:"cart"`
+}
+
+func (u UserInput) user() User {
+	return User{Name: u.Name, Latitude: *u.Latitude, Longitude: *u.Longitude, Cart: u.Cart}
+}
+
+func (h *Handlers) getUsers(c *gin.Context) {
+	users, err := h.users.List(c.Request.Context())
 	if err != nil {
-		log.Println("Ошибка получения пользовательей")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения пользовательей"})
-		return
-	}
-	defer rows.Close()
-	var users []User
-	 
-	for rows.Next() {
-		var u User
-		var cart string
-		if err := rows.Scan(&u.Id, &u.Name, &u.Latitude, &u.Longitude, &u.Is_card, &cart); err != nil {
-			log.Printf("Ошибка сканирования пользователья: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Ошибка сканирования пользователья: %v", err)})
-		}
-		u.Cart = parseCart(cart)
-		users = append(users, u)
-	}
-	
-	if err := rows.Err(); err != nil {
-		log.Printf("Ошибка итерации по пользовательям: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка итерации по пользовательям: " + err.Error()})
-		return
-	}
-	
+		requestLog(c).Error("Ошибка получения пользовательей", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
 	c.JSON(http.StatusOK, users)
 }
 
-func getUser(c *gin.Context) {
+func (h *Handlers) getUser(c *gin.Context) {
 	idStr := c.Param("id")
-	id, err := strconv.Atoi(idStr)
+	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil {
-		log.Println("Ошибка преоброзования пармтера")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Ошибка преоброзования пармтера"})
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
 		return
 	}
 
-	row := db.QueryRow("SELECT id,name,latitude,longitude,is_card,cart FROM users WHERE id = ?", id)
-
-	var user User
-	var cart string
-	err = row.Scan(&user.Id, &user.Name, &user.Latitude, &user.Longitude, &user.Is_card, &cart)
-    
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "пользователь не найден"})
+	user, err := h.users.Get(c.Request.Context(), id)
+	if err == errNotFound {
+		respondError(c, CodeUserNotFound)
 		return
 	} else if err != nil {
-		log.Printf("Ошибка при получении пользовательа по ID %d: %v", id, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении пользовательа: " + err.Error()})
+		requestLog(c).Error("Ошибка при получении пользовательа по ID", "user_id", id, "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+
+	if notModified(c, user.Version) {
 		return
 	}
-	
-    user.Cart = parseCart(cart)
-	
 	c.JSON(http.StatusOK, user)
 }
 
-func addUser(c *gin.Context) {
-	var user User
-	if err := c.BindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+func (h *Handlers) addUser(c *gin.Context) {
+	var input UserInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		respondBindingError(c, err)
 		return
 	}
+	user := input.user()
 
-	stmt, err := db.Prepare("INSERT INTO users (name,latitude,longitude,is_card,cart) VALUES (?,?,?,?,?)")
-	
-	if err != nil {
-		log.Println("Ошибка подготовки запроса пользователя в базу данных")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка подготовки запроса пользователя в базу данных"})
+	if err := h.users.Create(c.Request.Context(), &user); err != nil {
+		requestLog(c).Error("Ошибка при добавлении пользователя в базу данных", "error", err)
+		respondError(c, CodeInternal)
 		return
 	}
-	
-	result, err := stmt.Exec(user.Name, user.Latitude, user.Longitude, user.Is_card, strings.Join(convertInt64ToStringSlice(user.Cart),","))
-	
-	if err != nil {
-	    log.Printf("Ошибка при добавлении пользователя в базу данных: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при добавлении пользователя в базу данных"})
-	    return 
-	}
-	
-	id, err := result.LastInsertId()
-	if err != nil {
-	    log.Printf("Ошибка получения ID нового пользователя: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения ID нового пользователя"})
-	    return
-	}
-	
-    user.Id = id
+
+	h.audit(c, AuditActionCreate, AuditEntityUser, user.Id, nil, user)
+	setETag(c, user.Version)
 	c.JSON(http.StatusCreated, gin.H{"message": "Пользователь успешно добавлен", "user": user})
 }
 
-func deleteUser(c *gin.Context) {
-
+// deleteUser переносит пользователя в корзину удаленных.
+func (h *Handlers) deleteUser(c *gin.Context) {
 	idStr := c.Param("id")
 
-	id, err := strconv.Atoi(idStr)
+	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil {
-		log.Println("Ошибка преоброзования пармтера")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Ошибка преоброзования пармтера"})
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
 		return
 	}
 
-	stmt, err := db.Prepare("DELETE FROM users WHERE id = ?")
-	if err != nil {
-		log.Printf("Ошибка подготовки SQL-запроса на удаление: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка подготовки SQL-запроса"})
+	user, err := h.users.Get(c.Request.Context(), id)
+	if err == errNotFound {
+		respondError(c, CodeUserNotFound)
 		return
-	}
-
-	result, err := stmt.Exec(id)
-
-	if err != nil {
-		log.Printf("Ошибка при удалении пользовательа из базы данных: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при удалении пользовательа из базы данных"})
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при получении пользовательа по ID", "user_id", id, "error", err)
+		respondError(c, CodeInternal)
 		return
 	}
-
-	rowsAffectd, err := result.RowsAffected()
-	if err != nil {
-		log.Printf("Ошибка получения количества затронутых строк при удалении: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при удалении пользовательа"})
+	if !checkIfMatch(c, user.Version) {
 		return
 	}
 
-	if rowsAffectd == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "пользователь не был найден"})
+	err = h.users.Delete(c.Request.Context(), id, user.Version)
+	if err == errNotFound {
+		respondError(c, CodeUserNotFound)
+		return
+	} else if err == errVersionConflict {
+		respondVersionConflict(c)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при удалении пользовательа из базы данных", "error", err)
+		respondError(c, CodeInternal)
 		return
 	}
 
+	h.audit(c, AuditActionDelete, AuditEntityUser, id, user, nil)
 	c.JSON(http.StatusOK, gin.H{"message": "Пользовтель успешно удален!"})
 }
 
-func updateUser(c *gin.Context) {
-	idStr := c.Param("id")
-
-	id, err := strconv.Atoi(idStr)
+// restoreUser возвращает пользователя из корзины удаленных.
+func (h *Handlers) restoreUser(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
 	if err != nil {
-		log.Println("Ошибка преоброзования пармтера")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Ошибка преоброзования пармтера"})
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
 		return
 	}
 
-	var user User
-	if err := c.BindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	err = h.users.Restore(c.Request.Context(), id)
+	if err == errNotFound {
+		respondError(c, CodeUserNotFound)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при восстановлении пользователя", "user_id", id, "error", err)
+		respondError(c, CodeInternal)
 		return
 	}
 
-	var currentUser User
-	var currentCart string
-	row := db.QueryRow("SELECT id,name,latitude,longitude,is_card,cart FROM users WHERE id = ?", id)
-	err = row.Scan(&currentUser.Id, &currentUser.Name, &currentUser.Latitude, &currentUser.Longitude, &currentUser.Is_card, &currentCart)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Пользователь не найден"})
-		return
-	} else if err != nil {
-		log.Printf("Ошибка при получении текущих данных пользователя с ID %d: %v", id, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка сервера при получении данных пользователя"})
+	user, err := h.users.Get(c.Request.Context(), id)
+	if err != nil {
+		requestLog(c).Error("Ошибка при получении восстановленного пользователя с ID", "user_id", id, "error", err)
+		respondError(c, CodeInternal)
 		return
 	}
-	currentUser.Cart = parseCart(currentCart)
+	h.audit(c, AuditActionRestore, AuditEntityUser, id, nil, user)
+	setETag(c, user.Version)
+	c.JSON(http.StatusOK, gin.H{"message": "Пользователь восстановлен", "user": user})
+}
 
-	var (
-		updateFields []string
-		updateValues []interface{}
-	)
+// updateUser применяет к пользователю JSON Merge Patch или JSON Patch (см.
+// applyPatch) и возвращает пользователя, заново прочитанного из базы.
+func (h *Handlers) updateUser(c *gin.Context) {
+	idStr := c.Param("id")
 
-	if user.Name != "" && currentUser.Name != user.Name {
-		updateFields = append(updateFields, "name = ?")
-		updateValues = append(updateValues, user.Name)
-	}
-	if user.Latitude != 0 && currentUser.Latitude != user.Latitude {
-		updateFields = append(updateFields, "latitude = ?")
-		updateValues = append(updateValues, user.Latitude)
-	}
-	if user.Longitude != 0 && currentUser.Longitude != currentUser.Longitude {
-		updateFields = append(updateFields, "longitude = ?")
-		updateValues = append(updateValues, user.Longitude)
-	}
-	if currentUser.Is_card != user.Is_card {
-		updateFields = append(updateFields, "is_card = ?")
-		updateValues = append(updateValues, user.Is_card)
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		requestLog(c).Warn("Ошибка преоброзования пармтера")
+		respondError(c, CodeInvalidParameter)
+		return
 	}
-	if len(user.Cart) != 0 {
-		updateFields = append(updateFields, "cart = ?")
-		updateValues = append(updateValues, strings.Join(convertInt64ToStringSlice(user.Cart), ", "))
+
+	currentUser, err := h.users.Get(c.Request.Context(), id)
+	if err == errNotFound {
+		respondError(c, CodeUserNotFound)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при получении текущих данных пользователя с ID", "user_id", id, "error", err)
+		respondError(c, CodeInternal)
+		return
 	}
-	if len(updateFields) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Нету данных для обнвления"})
+	if !checkIfMatch(c, currentUser.Version) {
 		return
 	}
+	document := currentUser
+	if document.Cart == nil {
+		// Пустой массив, а не null, чтобы JSON Patch мог добавлять в
+		// корзину через /cart/-.
+		document.Cart = []int64{}
+	}
 
-	updateQuery := fmt.Sprintf("UPDATE users SET %s WHERE id = ?", strings.Join(updateFields, ", "))
-	updateValues = append(updateValues, id)
-
-	stmt, err := db.Prepare(updateQuery)
-	if err != nil {
-		log.Println("Ошибка подготовки sql запроса")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка подготовки sql запроса"})
+	var input UserInput
+	if !applyPatch(c, document, &input) {
 		return
 	}
-	defer stmt.Close()
+	user := input.user()
+	user.Id = id
+	user.Version = currentUser.Version
 
-	result, err := stmt.Exec(updateValues...)
-	if err != nil {
-		log.Printf("Ошибка при обновлении пользователья в базе данных: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при обновлении пользовательа в базе данных"})
+	cartChanged := formatCart(user.Cart) != formatCart(currentUser.Cart)
+	if user.Name == currentUser.Name && user.Latitude == currentUser.Latitude && user.Longitude == currentUser.Longitude && !cartChanged {
+		respondError(c, CodeNoUpdateData)
 		return
 	}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		log.Printf("Ошибка получения количества затронутых строк при обновлении: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при обновлении пользователья"})
+	err = h.users.Update(c.Request.Context(), user)
+	if err == errNotFound {
+		respondError(c, CodeUserNotFound)
 		return
+	} else if err == errVersionConflict {
+		respondVersionConflict(c)
+		return
+	} else if err != nil {
+		requestLog(c).Error("Ошибка при обновлении пользователья в базе данных", "error", err)
+		respondError(c, CodeInternal)
+		return
+	}
+	if cartChanged {
+		cartUpdatesTotal.Inc()
 	}
 
-	if rowsAffected == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "пользователь не найден, и данные не измнеились"})
+	user, err = h.users.Get(c.Request.Context(), id)
+	if err != nil {
+		requestLog(c).Error("Ошибка при получении обновленного пользователя с ID", "user_id", id, "error", err)
+		respondError(c, CodeInternal)
 		return
 	}
-    user.Id = int64(id)
+	h.audit(c, AuditActionUpdate, AuditEntityUser, id, currentUser, user)
+	setETag(c, user.Version)
 	c.JSON(http.StatusOK, gin.H{"message": "Пользователь успешно обновлен", "user": user})
 }